@@ -16,10 +16,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"text/tabwriter"
@@ -47,6 +50,33 @@ func checkIndex(db letarette.Database) {
 	s.Stop("OK\n")
 }
 
+// verifyIndex reports differences between the space add-ons applied in
+// the index and the add-ons enabled for the configured spaces, and exits
+// with an error status when there are any. The spaces are read from
+// the environment, like for workers.
+func verifyIndex(db letarette.Database) {
+	cfg, err := letarette.LoadConfig()
+	if err != nil {
+		logger.Error.Printf("Config load problems: %v", err)
+		os.Exit(1)
+	}
+
+	drift, err := letarette.CheckSpaceAddons(context.Background(), db, cfg)
+	if err != nil {
+		logger.Error.Printf("Failed to check space add-ons: %v", err)
+		os.Exit(1)
+	}
+	if len(drift) == 0 {
+		fmt.Printf("Space add-ons of %v match the config\n", cfg.Index.Spaces)
+		return
+	}
+	for _, d := range drift {
+		fmt.Println(d)
+	}
+	fmt.Println("Start a worker with the config to apply or remove add-ons")
+	os.Exit(1)
+}
+
 func setIndexPageSize(db letarette.Database, pageSize int) {
 	if pageSize <= 0 {
 		logger.Error.Printf("Invalid page size: %v", pageSize)
@@ -70,6 +100,9 @@ Languages: {{join .Stemmer.Stemmers ","}}
 Token characters: {{printf "%q" .Stemmer.TokenCharacters}}
 Separators: {{printf "%q" .Stemmer.Separators}}
 Remove diacritics: {{if .Stemmer.RemoveDiacritics}}yes{{else}}no{{end}}
+Max token length: {{if .Stemmer.MaxTokenLength}}{{.Stemmer.MaxTokenLength}}, {{if .Stemmer.TruncateLongTokens}}truncating{{else}}dropping{{end}}{{else}}none{{end}}
+Invisible characters: {{printf "%+q" .Stemmer.InvisibleCharacters}}
+Stop words: {{if .Stemmer.StopWords}}{{join .Stemmer.StopWords ","}}{{else}}none{{end}}
 
 Spaces:
 ======
@@ -117,6 +150,63 @@ func printIndexStats(db letarette.Database) {
 	}
 }
 
+// printIndexSchema prints the full text index table definitions as SQL,
+// and the recorded stemmer state as environment settings.
+func printIndexSchema(db letarette.Database) {
+	schema, err := letarette.GetIndexSchema(context.Background(), db)
+	if err != nil {
+		logger.Error.Printf("Failed to get index schema: %v", err)
+		return
+	}
+
+	fmt.Printf("-- Schema version %v\n\n", schema.Version)
+	for _, table := range schema.Tables {
+		fmt.Printf("-- %s: tokenizer %q, prefix %q, content %q\n", table.Name, table.Tokenizer, table.Prefix, table.Content)
+		fmt.Printf("%s;\n\n", table.SQL)
+	}
+
+	stemmer := schema.Stemmer
+	if schema.StemmerUpdated.IsZero() {
+		fmt.Printf("# Stemmer state not recorded, index is empty\n")
+		return
+	}
+	fmt.Printf("# Stemmer state, updated %v\n", schema.StemmerUpdated.Format(time.RFC3339))
+	fmt.Printf("LETARETTE_STEMMER_LANGUAGES=%q\n", strings.Join(stemmer.Stemmers, ","))
+	fmt.Printf("LETARETTE_STEMMER_REMOVE_DIACRITICS=%v\n", stemmer.RemoveDiacritics)
+	fmt.Printf("LETARETTE_STEMMER_TOKENCHARACTERS=%q\n", stemmer.TokenCharacters)
+	fmt.Printf("LETARETTE_STEMMER_SEPARATORS=%q\n", stemmer.Separators)
+	fmt.Printf("LETARETTE_STEMMER_MAX_TOKEN_LENGTH=%v\n", stemmer.MaxTokenLength)
+	fmt.Printf("LETARETTE_STEMMER_TRUNCATE_LONG_TOKENS=%v\n", stemmer.TruncateLongTokens)
+	fmt.Printf("LETARETTE_STEMMER_INVISIBLE_CHARACTERS=%+q\n", stemmer.InvisibleCharacters)
+	fmt.Printf("LETARETTE_STEMMER_STOP_WORDS=%q\n", strings.Join(stemmer.StopWords, ","))
+}
+
+// printStatsHistory lists the stats samples stored by the indexer,
+// oldest first. Samples are only kept for the configured retention.
+func printStatsHistory(db letarette.Database) {
+	samples, err := letarette.GetStatsHistory(context.Background(), db, time.Time{})
+	if err != nil {
+		logger.Error.Printf("Failed to get stats history: %v", err)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(writer, "SAMPLED\tDOCS\tUNIQUE TERMS\tTOTAL TERMS\tBYTES\tSPACES\n")
+	for _, sample := range samples {
+		spaces := make([]string, 0, len(sample.SpaceDocs))
+		for space, docs := range sample.SpaceDocs {
+			spaces = append(spaces, fmt.Sprintf("%s:%d", space, docs))
+		}
+		sort.Strings(spaces)
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			sample.Sampled.Format(time.RFC3339), sample.Docs, sample.UniqueTerms,
+			sample.TotalTerms, sample.Bytes, strings.Join(spaces, " "),
+		)
+	}
+	writer.Flush()
+	fmt.Printf("%v samples\n", len(samples))
+}
+
 func optimizeIndex(db letarette.Database) {
 	s := spinner.New(os.Stdout)
 	s.Start("Optimizing index ")
@@ -149,21 +239,73 @@ func optimizeIndex(db letarette.Database) {
 	s.Stop("OK\n")
 }
 
+// rebuildIndex starts or resumes a rebuild. Interrupting stops the
+// rebuild cleanly, and it can be resumed by running it again.
 func rebuildIndex(db letarette.Database) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	s := spinner.New(os.Stdout)
 	s.Start("Rebuilding index ")
 
-	err := letarette.RebuildIndex(db)
+	err := letarette.RebuildIndex(ctx, db)
 	if err == nil {
 		err = letarette.VacuumIndex(db)
 	}
+	if errors.Is(err, letarette.ErrRebuildCancelled) || errors.Is(err, context.Canceled) {
+		s.Stop("Cancelled\n")
+		printRebuildState(db)
+		return
+	}
 	if err != nil {
 		s.Stop(fmt.Sprintf("Failed to rebuild index: %v\n", err))
+		printRebuildState(db)
 		return
 	}
 	s.Stop("OK\n")
 }
 
+// cancelRebuild stops a rebuild running in another process
+func cancelRebuild(db letarette.Database) {
+	cancelled, err := letarette.CancelRebuild(context.Background(), db)
+	if err != nil {
+		logger.Error.Printf("Failed to cancel rebuild: %v", err)
+		return
+	}
+	if !cancelled {
+		fmt.Printf("No rebuild in progress\n")
+		return
+	}
+	fmt.Printf("Rebuild will stop after the current batch\n")
+}
+
+func printRebuildState(db letarette.Database) {
+	state, err := letarette.GetRebuildState(context.Background(), db)
+	if err != nil {
+		logger.Error.Printf("Failed to get rebuild state: %v", err)
+		return
+	}
+	if state == nil {
+		return
+	}
+	fmt.Printf(
+		"Rebuild started %v is unfinished, %d documents are not searchable.\n"+
+			"Run \"lrcli index rebuild\" again to resume.\n",
+		state.Started.Format(time.RFC3339), state.Remaining,
+	)
+}
+
 func compressIndex(db letarette.Database) {
 	s := spinner.New(os.Stdout)
 	s.Start("Compressing index ")
@@ -180,6 +322,45 @@ func compressIndex(db letarette.Database) {
 	s.Stop("OK\n")
 }
 
+func exportIndex(db letarette.Database, path string, spaces []string) {
+	s := spinner.New(os.Stdout)
+	s.Start("Exporting index ")
+
+	file, err := os.Create(path)
+	if err != nil {
+		s.Stop(fmt.Sprintf("Failed to create export file: %v\n", err))
+		return
+	}
+	err = letarette.ExportIndex(db, file, spaces)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.Stop(fmt.Sprintf("Failed to export index: %v\n", err))
+		return
+	}
+	s.Stop("OK\n")
+}
+
+func importIndex(db letarette.Database, path string) {
+	s := spinner.New(os.Stdout)
+	s.Start("Importing index ")
+
+	file, err := os.Open(path)
+	if err != nil {
+		s.Stop(fmt.Sprintf("Failed to open import file: %v\n", err))
+		return
+	}
+	defer file.Close()
+
+	imported, err := letarette.ImportIndex(db, file)
+	if err != nil {
+		s.Stop(fmt.Sprintf("Failed to import index after %v documents: %v\n", imported, err))
+		return
+	}
+	s.Stop(fmt.Sprintf("Imported %v documents\n", imported))
+}
+
 func forceIndexStemmerState(state snowball.Settings, db letarette.Database) {
 	fmt.Println("Forcing stemmer state change...")
 	err := letarette.ForceIndexStemmerState(state, db)
@@ -190,6 +371,175 @@ func forceIndexStemmerState(state snowball.Settings, db letarette.Database) {
 	fmt.Println("OK")
 }
 
+func touchDocuments(db letarette.Database, space string, docIDs []string) {
+	ids := make([]protocol.DocumentID, len(docIDs))
+	for i, id := range docIDs {
+		ids[i] = protocol.DocumentID(id)
+	}
+	touched, err := letarette.TouchDocuments(db, space, ids, time.Now())
+	if err != nil {
+		logger.Error.Printf("Failed to touch documents: %v", err)
+		return
+	}
+	fmt.Printf("Touched %v of %v documents\n", touched, len(ids))
+}
+
+func deleteDocuments(db letarette.Database, space string, docIDs []string) {
+	ids := make([]protocol.DocumentID, len(docIDs))
+	for i, id := range docIDs {
+		ids[i] = protocol.DocumentID(id)
+	}
+	deleted, err := letarette.DeleteDocuments(db, space, ids)
+	if err != nil {
+		logger.Error.Printf("Failed to delete documents: %v", err)
+		return
+	}
+	fmt.Printf("Deleted %v of %v documents\n", deleted, len(ids))
+}
+
+func printTopTerms(db letarette.Database, space string, limit int) {
+	s := spinner.New(os.Stdout)
+	s.Start("Counting terms ")
+	defer s.Stop()
+
+	terms, err := letarette.TopTerms(context.Background(), db, space, limit)
+	if err != nil {
+		logger.Error.Printf("Failed to get top terms: %v", err)
+		return
+	}
+
+	s.Stop()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	for _, term := range terms {
+		fmt.Fprintf(writer, "%v\t%v\n", term.Term, term.Count)
+	}
+	writer.Flush()
+}
+
+func printDeadLetters(db letarette.Database, space string) {
+	letters, err := letarette.GetDeadLetters(context.Background(), db, space)
+	if err != nil {
+		logger.Error.Printf("Failed to get dead letters: %v", err)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(writer, "SPACE\tID\tATTEMPTS\tFAILED\tUNIT\tERROR\n")
+	for _, letter := range letters {
+		unit := "-"
+		if letter.Unit != 0 {
+			unit = strconv.Itoa(letter.Unit)
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			letter.Space, letter.ID, letter.Attempts, letter.Failed.Format(time.RFC3339), unit, letter.Error,
+		)
+	}
+	writer.Flush()
+	fmt.Printf("%v dead letters\n", len(letters))
+}
+
+func retryDeadLetters(db letarette.Database, space string) {
+	indexed, failed, err := letarette.RetryDeadLetters(context.Background(), db, space)
+	if err != nil {
+		logger.Error.Printf("Failed to retry dead letters: %v", err)
+		return
+	}
+	fmt.Printf("Indexed %v dead letters, %v failed again\n", indexed, failed)
+}
+
+func requestReload(db letarette.Database, space string) {
+	requested, err := letarette.RequestReload(context.Background(), db, space)
+	if err != nil {
+		logger.Error.Printf("Failed to request reload: %v", err)
+		return
+	}
+	if !requested {
+		fmt.Printf("Reload of %q already requested\n", space)
+		return
+	}
+	fmt.Printf("Requested reload of %q, the space keeps a second copy of its documents until done\n", space)
+}
+
+func printReloads(db letarette.Database) {
+	reloads, err := letarette.GetReloads(context.Background(), db)
+	if err != nil {
+		logger.Error.Printf("Failed to get reloads: %v", err)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(writer, "SPACE\tREQUESTED\tSHADOW\tDOCS\n")
+	for _, reload := range reloads {
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n",
+			reload.Space, reload.Requested.Format(time.RFC3339), reload.Shadow, reload.ShadowDocs,
+		)
+	}
+	writer.Flush()
+	fmt.Printf("%v reloads\n", len(reloads))
+}
+
+func setSpaceControl(db letarette.Database, space string, searchDisabled, indexPaused bool) {
+	control := protocol.SpaceControl{
+		Space:          space,
+		SearchDisabled: searchDisabled,
+		IndexPaused:    indexPaused,
+	}
+	err := letarette.SetSpaceControl(context.Background(), db, control)
+	if err != nil {
+		logger.Error.Printf("Failed to set space control: %v", err)
+		return
+	}
+	fmt.Printf("Space %q search disabled: %v, index paused: %v\n", space, searchDisabled, indexPaused)
+}
+
+func printSpaceControls(db letarette.Database) {
+	searchDisabled, indexPaused, err := letarette.GetSpaceControls(context.Background(), db)
+	if err != nil {
+		logger.Error.Printf("Failed to get space controls: %v", err)
+		return
+	}
+	fmt.Printf("Search disabled: %s\n", strings.Join(searchDisabled, ", "))
+	fmt.Printf("Index paused: %s\n", strings.Join(indexPaused, ", "))
+}
+
+func printInterestList(db letarette.Database, space string, stateFilter string) {
+	var filter *letarette.InterestState
+	if stateFilter != "" {
+		state, err := letarette.ParseInterestState(stateFilter)
+		if err != nil {
+			logger.Error.Printf("Invalid state filter: %v", err)
+			return
+		}
+		filter = &state
+	}
+
+	listState, list, err := letarette.GetInterestList(context.Background(), db, space)
+	if err != nil {
+		logger.Error.Printf("Failed to get interest list: %v", err)
+		return
+	}
+
+	fmt.Printf("List created at: %v\n", time.Unix(0, listState.CreatedAt).Format(time.RFC3339Nano))
+	fmt.Printf("Last updated at: %v, document %q\n",
+		time.Unix(0, listState.LastUpdated).Format(time.RFC3339Nano), listState.LastUpdatedDocID)
+
+	counts := map[string]int{}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(writer, "ID\tSTATE\tUPDATED\n")
+	for _, interest := range list {
+		counts[interest.State.String()]++
+		if filter != nil && interest.State != *filter {
+			continue
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\n",
+			interest.DocID, interest.State, time.Unix(0, interest.Updated).Format(time.RFC3339Nano),
+		)
+	}
+	writer.Flush()
+	fmt.Printf("%v pending, %v requested, %v served\n",
+		counts["pending"], counts["requested"], counts["served"])
+}
+
 func doMonitor(cfg letarette.Config) {
 	fmt.Printf("Listening to status broadcasts...\n")
 	listener := func(status protocol.IndexStatus) {
@@ -199,6 +549,7 @@ func doMonitor(cfg letarette.Config) {
 		cfg.Nats.URLS,
 		listener,
 		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
 		client.WithRootCAs(cfg.Nats.RootCAs...),
 	)
 	if err != nil {
@@ -229,11 +580,13 @@ func resetMigration(cfg letarette.Config, version int) {
 
 type sqlOptions struct {
 	databaseOptions
+	Remote    bool     `name:"remote"`
+	Write     bool     `name:"write"`
 	Statement string   `arg:"0"`
 	Args      []string `args:"1"`
 }
 
-func doSQL(cfg letarette.Config, statement string, args []string) {
+func doSQL(cfg letarette.Config, statement string, args []string, write bool) {
 	db, err := letarette.OpenDatabase(cfg)
 	defer db.Close()
 
@@ -250,16 +603,25 @@ func doSQL(cfg letarette.Config, statement string, args []string) {
 		}
 		statement = string(bytes)
 	}
-	sql(db, statement, args)
+	sql(db, statement, args, write)
 }
 
-func sql(db letarette.Database, statement string, stringArgs []string) {
+// sql runs a read-only statement, or any statement if write is set
+func sql(db letarette.Database, statement string, stringArgs []string, write bool) {
 	args := make([]interface{}, len(stringArgs))
 	for i, v := range stringArgs {
 		args[i] = v
 	}
 	start := time.Now()
-	result, err := db.RawQuery(statement, args...)
+	query := db.SafeRawQuery
+	if write {
+		query = db.RawQuery
+	}
+	result, err := query(statement, args...)
+	if errors.Is(err, letarette.ErrNotReadOnly) {
+		logger.Error.Printf("Failed to execute query: %v, use -write to modify the database", err)
+		return
+	}
 	if err != nil {
 		logger.Error.Printf("Failed to execute query: %v", err)
 		return
@@ -271,6 +633,103 @@ func sql(db letarette.Database, statement string, stringArgs []string) {
 	}
 }
 
+// remoteSQL runs a read-only statement on one worker per shard,
+// using LETARETTE_DB_REMOTESQLTOKEN as credentials
+func remoteSQL(cfg letarette.Config, statement string, args []string) {
+	agent, err := client.NewSearchAgent(
+		cfg.Nats.URLS,
+		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
+		client.WithRootCAs(cfg.Nats.RootCAs...),
+		client.WithCredentials(cfg.DB.RemoteSQLToken),
+		client.WithTimeout(10*time.Second),
+	)
+	if err != nil {
+		logger.Error.Printf("Failed to create search agent: %v", err)
+		return
+	}
+	defer agent.Close()
+
+	start := time.Now()
+	responses, err := agent.SQL(statement, args...)
+	if err != nil {
+		logger.Error.Printf("Failed to execute remote query: %v", err)
+		return
+	}
+	duration := float32(time.Since(start)) / float32(time.Second)
+	fmt.Printf("Executed in %vs\n", duration)
+
+	sort.Slice(responses, func(i, j int) bool {
+		return responses[i].Shard < responses[j].Shard
+	})
+	for _, response := range responses {
+		fmt.Printf("Shard %v (worker@%v):\n", response.Shard, response.IndexID)
+		if response.Error != "" {
+			fmt.Printf("Error: %v\n", response.Error)
+			continue
+		}
+		fmt.Println(strings.Join(response.Columns, ", "))
+		for _, row := range response.Rows {
+			values := make([]string, len(row))
+			for i, value := range row {
+				values[i] = fmt.Sprintf("%v", value)
+			}
+			fmt.Println(strings.Join(values, ", "))
+		}
+		if response.Truncated {
+			fmt.Println("(rows truncated)")
+		}
+	}
+}
+
+// stepIndex runs a single indexing update cycle of a space on one
+// worker per shard, and exits with an error status when any step fails.
+// Steps can wait for the next interest list, for up to the
+// interest wait time.
+func stepIndex(cfg letarette.Config, space string) {
+	agent, err := client.NewSearchAgent(
+		cfg.Nats.URLS,
+		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
+		client.WithRootCAs(cfg.Nats.RootCAs...),
+		client.WithTimeout(cfg.Index.Wait.Interest+10*time.Second),
+	)
+	if err != nil {
+		logger.Error.Printf("Failed to create search agent: %v", err)
+		os.Exit(1)
+	}
+	defer agent.Close()
+
+	start := time.Now()
+	results, err := agent.IndexStep(space)
+	if err != nil {
+		logger.Error.Printf("Failed to run index step: %v", err)
+		os.Exit(1)
+	}
+	duration := float32(time.Since(start)) / float32(time.Second)
+	fmt.Printf("Stepped in %vs\n", duration)
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Shard < results[j].Shard
+	})
+	failed := false
+	for _, result := range results {
+		fmt.Printf("Shard %v (worker@%v): ", result.Shard, result.IndexID)
+		if result.Error != "" {
+			fmt.Printf("Error: %v\n", result.Error)
+			failed = true
+			continue
+		}
+		fmt.Printf(
+			"%d listed, %d requested, %d committed\n",
+			result.Listed, result.Requested, result.Committed,
+		)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
 type spellingOptions struct {
 	databaseOptions
 	Command  string `arg:"0"`
@@ -297,3 +756,13 @@ func updateSpelling(cfg letarette.Config, minCount int) {
 	}
 	s.Stop("OK\n")
 }
+
+func backupDatabase(db letarette.Database, path string) {
+	// Progress is logged by the backup, no spinner
+	err := letarette.BackupDatabase(db, path)
+	if err != nil {
+		fmt.Printf("Failed to back up database: %v\n", err)
+		return
+	}
+	fmt.Println("OK")
+}
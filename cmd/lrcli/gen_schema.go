@@ -0,0 +1,138 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build ignore
+// +build ignore
+
+// gen_schema writes the JSON Schema of the protocol.SearchResponse items
+// of the "lrcli search -json" output, derived from the Go types.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+type schema map[string]interface{}
+
+type generator struct {
+	defs schema
+}
+
+func (g *generator) typeSchema(t reflect.Type) schema {
+	if t == reflect.TypeOf(time.Time{}) {
+		return schema{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.typeSchema(t.Elem())
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "contentEncoding": "base64"}
+		}
+		return schema{"type": []string{"array", "null"}, "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		return schema{"type": []string{"object", "null"}, "additionalProperties": g.typeSchema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if name == "" {
+			return g.structSchema(t)
+		}
+		if _, found := g.defs[name]; !found {
+			// Placeholder for recursive types
+			g.defs[name] = schema{}
+			g.defs[name] = g.structSchema(t)
+		}
+		return schema{"$ref": "#/$defs/" + name}
+	default:
+		return schema{}
+	}
+}
+
+func (g *generator) structSchema(t reflect.Type) schema {
+	properties := schema{}
+	var required []string
+	g.addFields(t, properties, &required)
+	s := schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// addFields adds the fields of a struct type as encoded by encoding/json,
+// including the fields of embedded structs
+func (g *generator) addFields(t reflect.Type, properties schema, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.addFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.typeSchema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func main() {
+	output := flag.String("o", "search.schema.json", "output file")
+	flag.Parse()
+
+	g := &generator{defs: schema{}}
+	root := g.typeSchema(reflect.TypeOf(protocol.SearchResponse{}))
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["title"] = "lrcli search -json output"
+	root["description"] = "One search response per line"
+	root["$defs"] = g.defs
+
+	encoded, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode schema: %v\n", err)
+		os.Exit(1)
+	}
+	err = os.WriteFile(*output, append(encoded, '\n'), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write schema: %v\n", err)
+		os.Exit(1)
+	}
+}
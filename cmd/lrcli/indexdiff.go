@@ -0,0 +1,97 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/erkkah/letarette/internal/letarette"
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/erkkah/letarette/pkg/spinner"
+)
+
+func diffIndexes(cfg letarette.Config, db letarette.Database, otherDB string, queryFile string, limit int) {
+	queries, err := loadDiffQueries(db, queryFile)
+	if err != nil {
+		logger.Error.Printf("Failed to load queries: %v", err)
+		return
+	}
+	if limit < 1 || limit > 500 {
+		logger.Error.Printf("Invalid limit: %v", limit)
+		return
+	}
+
+	s := spinner.New(os.Stdout)
+	s.Start("Comparing indexes ")
+	diffs, err := letarette.DiffIndexes(cfg, db, otherDB, queries, uint16(limit))
+	if err != nil {
+		s.Stop(fmt.Sprintf("Failed to compare indexes: %v\n", err))
+		return
+	}
+	s.Stop()
+
+	differing := 0
+	for _, diff := range diffs {
+		if diff.Equal() {
+			continue
+		}
+		differing++
+		fmt.Printf("Query %q: %v vs %v total hits, %v missing, %v added, %v reordered\n",
+			diff.Query, diff.TotalHits, diff.OtherTotal,
+			len(diff.Missing), len(diff.Added), diff.Reordered)
+		for _, id := range diff.Missing {
+			fmt.Printf("  - %v\n", id)
+		}
+		for _, id := range diff.Added {
+			fmt.Printf("  + %v\n", id)
+		}
+	}
+
+	fmt.Printf("\n%v queries compared, %v identical, %v differing\n",
+		len(diffs), len(diffs)-differing, differing)
+}
+
+func loadDiffQueries(db letarette.Database, queryFile string) ([]string, error) {
+	if queryFile == "" {
+		stats, err := letarette.GetIndexStats(db)
+		if err != nil {
+			return nil, err
+		}
+		queries := []string{}
+		for _, term := range stats.CommonTerms {
+			queries = append(queries, term.Term)
+		}
+		return queries, nil
+	}
+
+	file, err := os.Open(queryFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	queries := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		query := strings.TrimSpace(scanner.Text())
+		if query != "" {
+			queries = append(queries, query)
+		}
+	}
+	return queries, scanner.Err()
+}
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/erkkah/letarette/internal/letarette"
 	"github.com/erkkah/letarette/internal/snowball"
@@ -39,19 +40,37 @@ func usage() {
 	usage := `Letarette
 
 Usage:
-    lrcli search [-l <limit>] [-p <page>] [-g <groupsize>] [-i] <space> [<phrase>...]
+    lrcli search [-l <limit>] [-p <page>] [-g <groupsize>] [-i] [-e <mode>] [-r <delimiter>] [-null] [-bench <n>] [-explain] [-json] [<space>] [<phrase>...]
     lrcli monitor
-    lrcli sql [-d <db>] <sql> [<arg>...]
-    lrcli index [-d <db>] stats
+    lrcli status [-g <groupsize>]
+    lrcli ping
+    lrcli sql [-d <db>] [-remote | -write] <sql> [<arg>...]
+    lrcli index [-d <db>] [-history] stats
     lrcli index [-d <db>] check
+    lrcli index [-d <db>] verify
+    lrcli index [-d <db>] schema
     lrcli index [-d <db>] pgsize <size>
     lrcli index [-d <db>] compress
     lrcli index [-d <db>] optimize
-    lrcli index [-d <db>] rebuild
+    lrcli index [-d <db>] [-cancel] rebuild
     lrcli index [-d <db>] forcestemmer
+    lrcli index [-d <db>] diff [-q <queries>] [-l <limit>] <otherdb>
+    lrcli index [-d <db>] touch <space> <docID>...
+    lrcli index [-d <db>] delete <space> <docID>...
+    lrcli index [-d <db>] export <file> [<space>...]
+    lrcli index [-d <db>] import <file>
+    lrcli index [-d <db>] backup <path>
+    lrcli index [-d <db>] topterms [-l <limit>] <space>
+    lrcli index [-d <db>] deadletters [list|retry] [<space>]
+    lrcli index [-d <db>] reload [<space>]
+    lrcli index [-d <db>] [-state <state>] interest <space>
+    lrcli index [-d <db>] [-pause] space [disable|enable <space>]
+    lrcli index probe <space>
+    lrcli index step <space>
     lrcli load [-d <db>] [-m <max>] [-a] <space> <json>
     lrcli synonyms [-d <db>] [<json>]
     lrcli spelling [-d <db>] update <mincount>
+    lrcli stem [-d <db>] [-s <stopwords>] [-y <synonyms>] config-check [<sentence>...]
     lrcli resetmigration [-d <db>] <version>
     lrcli env [-v]
 
@@ -60,10 +79,86 @@ Options:
     -p <page>      Search result page [default: 0]
     -d <db>        Override default or environment DB path
     -i             Interactive search
+    -e <mode>      Snippet control characters, "none", "escape" or "strip" [default: none]
+    -r <delimiter> Search result delimiter, with Go escapes [default: \n]
+    -null          NUL delimited search results, other output to stderr
+    -bench <n>     Run the search n times and report timings instead of hits
+    -explain       List the rank and the matches of each query term of each hit
+    -json          Write the search response as a JSON array, other output to stderr.
+                   Interactive searches write each response as a line of JSON
     -a             Auto-assign document ID on load
     -m <max>       Max documents loaded
+    -q <queries>   File with one query per line, defaults to common terms
     -g <groupsize> Force shard group size, do not discover
+    -s <stopwords> Stopword file, one word per line
+    -y <synonyms>  Synonym file, in the format loaded by "synonyms"
+    -history       Index stats history, see LETARETTE_INDEX_STATSHISTORY_INTERVAL
+    -cancel        Cancel a running rebuild, resume by rebuilding again
+    -state <state> Interest list state filter, "pending", "requested" or "served"
+    -pause         Pause indexing of a search disabled space
+    -remote        Run read-only SQL on one worker per shard, over NATS
     -v             Verbose, lists advanced options
+
+The search <space> defaults to LETARETTE_SEARCH_DEFAULT_SPACE, or to the
+only space in LETARETTE_INDEX_SPACES. With a default, a first <phrase>
+naming an index space is taken as the space.
+
+Index "verify" compares the schema add-ons of the spaces in
+LETARETTE_INDEX_SPACES with the features enabled for them, like
+LETARETTE_INDEX_PHONETIC, and lists spaces that differ. Workers apply
+and remove add-ons of their spaces when started. Exits with an error
+status when any space differs.
+
+Index "reload" requests a reload of <space> by the running indexer, into
+a shadow space that replaces the space when done. Until then, the index
+holds a second copy of the space. Without <space>, lists reloads.
+
+"ping" checks that search workers respond, without searching, and lists
+the responding workers per shard. Exits with an error status when no
+worker responds.
+
+Index "interest" lists the interest list of <space>, the documents
+to be fetched by the indexer, and how far the space is indexed.
+
+Index "space disable" disables search in <space> on running workers,
+searches skip the space and report it as unavailable. Indexing continues,
+unless paused by -pause. "space enable" enables search and resumes
+indexing. Without arguments, lists disabled and paused spaces.
+
+"sql" runs a single read-only statement on the local database, rejecting
+the same statements as "sql -remote". Use -write to run any statement,
+including statements modifying the database.
+
+"sql -remote" runs a single read-only statement on the workers, which
+only serve remote SQL when LETARETTE_DB_REMOTESQLTOKEN is set. The same
+token is sent as credentials. Statements other than SELECT, WITH, VALUES,
+EXPLAIN and reading pragmas are rejected, and at most 1000 rows are
+returned per shard.
+
+Index "probe" measures the time from pushing a document to the cluster
+until it is searchable in <space>, using a probe document that is
+deleted afterwards. Exits with an error status when the probe fails.
+
+Index "delete" removes documents from the local index of <space>,
+keeping them as dead documents, like documents sent with Alive false.
+They are not requested again until the provider lists a later update.
+
+Index "deadletters" lists documents that failed to be indexed, or retries
+them. Documents of a failed multi-space update share a unit, and are
+retried together.
+
+Index "export" writes the documents of all spaces, or of the listed spaces,
+to <file> as JSON Lines, one document per line with its space. Contentless
+spaces are skipped. Index "import" loads an export into existing spaces,
+re-indexing the documents, without requesting them from the providers.
+
+Index "backup" copies the database to a new file at <path>, creating
+missing directories. The database stays available during the backup,
+also to running workers.
+
+Index "step" runs a single indexing update cycle of <space> on one worker
+per shard, without waiting for the cycle timer, and reports the number of
+documents listed, requested and committed by the cycle on each shard.
 `
 	fmt.Println(usage)
 	os.Exit(1)
@@ -110,6 +205,22 @@ func main() {
 			var options indexOptions
 			pennant.MustParse(&options, args)
 			updateFromFromOptions(&options.databaseOptions)
+			if options.Subcommand == "probe" {
+				// Probing goes through the cluster, not the database
+				if options.Arg == "" {
+					usage()
+				}
+				probeIndex(cfg, options.Arg)
+				return
+			}
+			if options.Subcommand == "step" {
+				// Stepping runs on the workers, not the database
+				if options.Arg == "" {
+					usage()
+				}
+				stepIndex(cfg, options.Arg)
+				return
+			}
 			indexSubcommand(cfg, options)
 		}
 	case "load":
@@ -146,6 +257,16 @@ func main() {
 			}
 			updateSpelling(cfg, options.MinCount)
 		}
+	case "stem":
+		{
+			var options stemOptions
+			pennant.MustParse(&options, args)
+			updateFromFromOptions(&options.databaseOptions)
+			if options.Command != "config-check" {
+				usage()
+			}
+			checkStemmerConfig(cfg, options)
+		}
 
 	case "resetmigration":
 		{
@@ -162,10 +283,29 @@ func main() {
 			var options sqlOptions
 			pennant.MustParse(&options, args)
 			updateFromFromOptions(&options.databaseOptions)
-			doSQL(cfg, options.Statement, options.Args)
+			if options.Remote && options.Write {
+				usage()
+			}
+			if options.Remote {
+				remoteSQL(cfg, options.Statement, options.Args)
+			} else {
+				doSQL(cfg, options.Statement, options.Args, options.Write)
+			}
 		}
 	case "monitor":
 		doMonitor(cfg)
+	case "status":
+		{
+			var options statusOptions
+			pennant.MustParse(&options, args)
+			doStatus(cfg, options)
+		}
+	case "ping":
+		{
+			var options globalOptions
+			pennant.MustParse(&options, args)
+			doPing(cfg)
+		}
 	default:
 		usage()
 	}
@@ -173,8 +313,15 @@ func main() {
 
 type indexOptions struct {
 	databaseOptions
-	Subcommand string `arg:"0"`
-	Size       int    `arg:"1"`
+	Subcommand string   `arg:"0"`
+	Arg        string   `arg:"1"`
+	Args       []string `args:"2"`
+	Queries    string   `name:"q"`
+	Limit      int      `name:"l" default:"10"`
+	History    bool     `name:"history"`
+	Cancel     bool     `name:"cancel"`
+	State      string   `name:"state"`
+	Pause      bool     `name:"pause"`
 }
 
 type scopedDatabase struct {
@@ -250,24 +397,118 @@ func indexSubcommand(cfg letarette.Config, options indexOptions) {
 			logger.Warning.Printf("Index and config stemmer settings mismatch. Re-build index or force changes.")
 		}
 		checkIndex(db)
+	case "verify":
+		verifyIndex(db)
+	case "schema":
+		printIndexSchema(db)
 	case "compress":
 		compressIndex(db)
 	case "pgsize":
-		setIndexPageSize(db, options.Size)
+		size, err := strconv.Atoi(options.Arg)
+		if err != nil {
+			usage()
+		}
+		setIndexPageSize(db, size)
 	case "stats":
-		printIndexStats(db)
+		if options.History {
+			printStatsHistory(db)
+		} else {
+			printIndexStats(db)
+		}
 	case "optimize":
 		optimizeIndex(db)
 	case "rebuild":
-		rebuildIndex(db)
+		if options.Cancel {
+			cancelRebuild(db)
+		} else {
+			rebuildIndex(db)
+		}
 	case "forcestemmer":
 		settings := snowball.Settings{
-			Stemmers:         cfg.Stemmer.Languages,
-			RemoveDiacritics: cfg.Stemmer.RemoveDiacritics,
-			Separators:       cfg.Stemmer.Separators,
-			TokenCharacters:  cfg.Stemmer.TokenCharacters,
+			Stemmers:            cfg.Stemmer.Languages,
+			RemoveDiacritics:    cfg.Stemmer.RemoveDiacritics,
+			Separators:          cfg.Stemmer.Separators,
+			TokenCharacters:     cfg.Stemmer.TokenCharacters,
+			MaxTokenLength:      cfg.Stemmer.MaxTokenLength,
+			TruncateLongTokens:  cfg.Stemmer.TruncateLongTokens,
+			InvisibleCharacters: cfg.Stemmer.InvisibleCharacters,
+			StopWords:           cfg.Stemmer.StopWords,
 		}
 		forceIndexStemmerState(settings, db)
+	case "diff":
+		if options.Arg == "" {
+			usage()
+		}
+		diffIndexes(cfg, db, options.Arg, options.Queries, options.Limit)
+	case "touch":
+		if options.Arg == "" || len(options.Args) == 0 {
+			usage()
+		}
+		touchDocuments(db, options.Arg, options.Args)
+	case "delete":
+		if options.Arg == "" || len(options.Args) == 0 {
+			usage()
+		}
+		deleteDocuments(db, options.Arg, options.Args)
+	case "export":
+		if options.Arg == "" {
+			usage()
+		}
+		exportIndex(db, options.Arg, options.Args)
+	case "import":
+		if options.Arg == "" {
+			usage()
+		}
+		importIndex(db, options.Arg)
+	case "backup":
+		if options.Arg == "" {
+			usage()
+		}
+		backupDatabase(db, options.Arg)
+	case "topterms":
+		if options.Arg == "" {
+			usage()
+		}
+		printTopTerms(db, options.Arg, options.Limit)
+	case "deadletters":
+		space := ""
+		if len(options.Args) > 1 {
+			usage()
+		} else if len(options.Args) == 1 {
+			space = options.Args[0]
+		}
+		switch options.Arg {
+		case "", "list":
+			printDeadLetters(db, space)
+		case "retry":
+			retryDeadLetters(db, space)
+		default:
+			usage()
+		}
+	case "reload":
+		if options.Arg == "" {
+			printReloads(db)
+		} else {
+			requestReload(db, options.Arg)
+		}
+	case "interest":
+		if options.Arg == "" {
+			usage()
+		}
+		printInterestList(db, options.Arg, options.State)
+	case "space":
+		switch {
+		case options.Arg == "" && len(options.Args) == 0:
+			printSpaceControls(db)
+		case len(options.Args) != 1:
+			usage()
+		case options.Arg == "disable":
+			setSpaceControl(db, options.Args[0], true, options.Pause)
+		case options.Arg == "enable":
+			setSpaceControl(db, options.Args[0], false, false)
+		default:
+			usage()
+		}
 	default:
 		usage()
 	}
@@ -0,0 +1,132 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/erkkah/letarette/internal/letarette"
+	"github.com/erkkah/letarette/pkg/client"
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// The probe gives up when the probe document is not searchable in time
+const probeTimeout = time.Minute
+const probePollInterval = 50 * time.Millisecond
+
+// probeIndex measures the end-to-end indexing latency of a space, by
+// pushing a probe document to the cluster and searching until it is found.
+// The probe document is deleted afterwards, and the deletion latency is
+// measured the same way.
+//
+// The probe document has a random negative integer ID, valid in both
+// integer and string ID spaces, and a random token as text.
+func probeIndex(cfg letarette.Config, space string) {
+	manager, err := client.StartDocumentManager(
+		cfg.Nats.URLS,
+		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
+		client.WithRootCAs(cfg.Nats.RootCAs...),
+	)
+	if err != nil {
+		logger.Error.Printf("Failed to create document manager: %v", err)
+		os.Exit(1)
+	}
+	defer manager.Close()
+
+	agent, err := client.NewSearchAgent(
+		cfg.Nats.URLS,
+		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
+		client.WithRootCAs(cfg.Nats.RootCAs...),
+		client.WithTimeout(10*time.Second),
+	)
+	if err != nil {
+		logger.Error.Printf("Failed to create search agent: %v", err)
+		os.Exit(1)
+	}
+	defer agent.Close()
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	token := fmt.Sprintf("lrprobe%x", random.Int63())
+	doc := protocol.Document{
+		ID:      protocol.DocumentID(fmt.Sprintf("%d", -random.Int63n(1<<62)-1)),
+		Updated: time.Now(),
+		Title:   "Letarette probe",
+		Text:    token,
+		Alive:   true,
+	}
+
+	publish := func(doc protocol.Document) bool {
+		err := manager.PublishMultiSpaceUpdate(protocol.MultiSpaceDocumentUpdate{
+			Updates: []protocol.DocumentUpdate{{Space: space, Documents: []protocol.Document{doc}}},
+		})
+		if err != nil {
+			logger.Error.Printf("Failed to publish probe document: %v", err)
+		}
+		return err == nil
+	}
+
+	// Polls until the probe document is found, or not found,
+	// returning the time waited
+	waitFor := func(found bool) (time.Duration, bool) {
+		start := time.Now()
+		for time.Since(start) < probeTimeout {
+			// Since-token searches bypass the search cache
+			res, err := agent.Search(token, []string{space}, 1, 0, client.WithNewSinceToken())
+			if err != nil {
+				logger.Warning.Printf("Probe search failed: %v", err)
+			} else if (len(res.Result.Hits) > 0) == found {
+				return time.Since(start), true
+			}
+			time.Sleep(probePollInterval)
+		}
+		return probeTimeout, false
+	}
+
+	fmt.Printf("Probing space %q with document %q\n", space, doc.ID)
+	if !publish(doc) {
+		os.Exit(1)
+	}
+	indexLatency, indexed := waitFor(true)
+
+	doc.Alive = false
+	doc.Updated = time.Now()
+	deleted := publish(doc)
+	var deleteLatency time.Duration
+	if deleted {
+		deleteLatency, deleted = waitFor(false)
+	}
+
+	if indexed {
+		fmt.Printf("Indexing latency: %v\n", indexLatency.Round(time.Millisecond))
+	} else {
+		fmt.Printf("Probe document not searchable after %v\n", probeTimeout)
+	}
+	if deleted {
+		fmt.Printf("Deletion latency: %v\n", deleteLatency.Round(time.Millisecond))
+	} else {
+		fmt.Printf("Failed to delete probe document %q\n", doc.ID)
+	}
+	if !indexed || !deleted {
+		agent.Close()
+		manager.Close()
+		os.Exit(1)
+	}
+}
@@ -14,12 +14,20 @@
 
 package main
 
+//go:generate go run gen_schema.go -o search.schema.json
+
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
+	"unicode"
 
 	"github.com/erkkah/letarette/internal/letarette"
 	"github.com/erkkah/letarette/pkg/client"
@@ -34,17 +42,151 @@ type searchOptions struct {
 	Offset      int      `name:"p" default:"0"`
 	GroupSize   int32    `name:"g"`
 	Interactive bool     `name:"i"`
+	Escape      string   `name:"e" default:"none"`
+	Delimiter   string   `name:"r"`
+	Null        bool     `name:"null"`
+	Bench       int      `name:"bench"`
+	Explain     bool     `name:"explain"`
+	JSON        bool     `name:"json"`
+}
+
+// hitWriter writes search hits as delimited records, with control
+// characters in snippets handled according to the escape mode.
+type hitWriter struct {
+	escape    string
+	delimiter string
+	// Where non-record output goes
+	info io.Writer
+	// Write full responses as JSON, see search.schema.json
+	json bool
+	// Write JSON responses one per line, instead of in an array
+	jsonLines bool
+}
+
+func newHitWriter(options searchOptions) (hitWriter, error) {
+	writer := hitWriter{
+		escape:    options.Escape,
+		delimiter: "\n",
+		info:      os.Stdout,
+	}
+	switch options.Escape {
+	case "none", "escape", "strip":
+	default:
+		return writer, fmt.Errorf("unknown escape mode %q", options.Escape)
+	}
+	if options.Delimiter != "" {
+		delimiter, err := strconv.Unquote(`"` + options.Delimiter + `"`)
+		if err != nil {
+			return writer, fmt.Errorf("invalid delimiter %q", options.Delimiter)
+		}
+		writer.delimiter = delimiter
+	}
+	if options.Null {
+		// Keep stdout clean for piping
+		writer.delimiter = "\x00"
+		writer.info = os.Stderr
+	}
+	if options.JSON {
+		writer.json = true
+		writer.jsonLines = options.Interactive
+		writer.info = os.Stderr
+	}
+	return writer, nil
+}
+
+func (w hitWriter) snippet(snippet string) string {
+	switch w.escape {
+	case "escape":
+		quoted := strconv.Quote(snippet)
+		return quoted[1 : len(quoted)-1]
+	case "strip":
+		snippet = strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return ' '
+			}
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, snippet)
+	}
+	if w.delimiter == "\x00" {
+		snippet = strings.ReplaceAll(snippet, "\x00", "")
+	}
+	return snippet
+}
+
+func (w hitWriter) write(hit protocol.SearchHit) {
+	fmt.Printf("[%v] %s%s", hit.ID, w.snippet(hit.Snippet), w.delimiter)
+}
+
+// writeJSON writes a search response as a JSON array holding the
+// response, or as a single line of JSON in interactive mode
+func (w hitWriter) writeJSON(res protocol.SearchResponse) {
+	encoded, err := json.Marshal(res)
+	if err != nil {
+		logger.Error.Printf("Failed to encode response: %v", err)
+		return
+	}
+	if w.jsonLines {
+		fmt.Printf("%s\n", encoded)
+	} else {
+		fmt.Printf("[%s]\n", encoded)
+	}
+}
+
+// explain writes the rank and term counts of a hit
+func (w hitWriter) explain(hit protocol.SearchHit) {
+	terms := make([]string, 0, len(hit.TermCounts))
+	for term := range hit.TermCounts {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	for i, term := range terms {
+		terms[i] = fmt.Sprintf("%s=%d", term, hit.TermCounts[term])
+	}
+	fmt.Fprintf(w.info, "    rank %v, term matches: %s\n", hit.Rank, strings.Join(terms, " "))
+}
+
+// searchSpace picks the space to search from the first positional
+// argument, when it names an index space or there is no default space.
+// Otherwise all arguments are query phrases, and the default space is used.
+func searchSpace(cfg letarette.Config, options searchOptions) (searchOptions, error) {
+	defaultSpace, defaultErr := cfg.DefaultSearchSpace()
+	if options.Space != "" {
+		if defaultErr != nil {
+			return options, nil
+		}
+		for _, space := range cfg.Index.Spaces {
+			if space == options.Space {
+				return options, nil
+			}
+		}
+		options.Phrases = append([]string{options.Space}, options.Phrases...)
+	}
+	if defaultErr != nil {
+		return options, fmt.Errorf("no <space> given: %w", defaultErr)
+	}
+	options.Space = defaultSpace
+	return options, nil
 }
 
 func doSearch(cfg letarette.Config, options searchOptions) {
-	if len(options.Space) == 0 {
-		fmt.Println("Expected <space> arg")
+	options, err := searchSpace(cfg, options)
+	if err != nil {
+		logger.Error.Printf("%v", err)
+		return
+	}
+	writer, err := newHitWriter(options)
+	if err != nil {
+		logger.Error.Printf("%v", err)
 		return
 	}
-	fmt.Printf("Searching space %q\n", options.Space)
+	fmt.Fprintf(writer.info, "Searching space %q\n", options.Space)
 	a, err := client.NewSearchAgent(
 		cfg.Nats.URLS,
 		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
 		client.WithShardgroupSize(options.GroupSize),
 		client.WithRootCAs(cfg.Nats.RootCAs...),
 		client.WithTimeout(10*time.Second),
@@ -55,39 +197,136 @@ func doSearch(cfg letarette.Config, options searchOptions) {
 	}
 	defer a.Close()
 
+	search := searchPhrase
+	if options.Bench > 0 {
+		search = benchPhrase
+	}
+
 	if options.Interactive {
 		scanner := bufio.NewScanner(os.Stdin)
 		const prompt = "search>"
-		_, _ = os.Stdout.WriteString(prompt)
+		_, _ = io.WriteString(writer.info, prompt)
 		for scanner.Scan() {
-			searchPhrase(scanner.Text(), a, options)
-			_, _ = os.Stdout.WriteString(prompt)
+			search(scanner.Text(), a, options, writer)
+			_, _ = io.WriteString(writer.info, prompt)
 		}
 	} else {
-		searchPhrase(strings.Join(options.Phrases, " "), a, options)
+		search(strings.Join(options.Phrases, " "), a, options, writer)
 	}
 }
 
-func searchPhrase(phrase string, agent client.SearchAgent, options searchOptions) {
+func searchPhrase(phrase string, agent client.SearchAgent, options searchOptions, writer hitWriter) {
+	var requestOptions []client.SearchOption
+	if options.Explain {
+		requestOptions = append(requestOptions, client.WithTermCounts())
+	}
 	res, err := agent.Search(
 		phrase,
 		[]string{options.Space},
 		options.Limit,
 		options.Offset,
+		requestOptions...,
 	)
 	if err != nil {
 		logger.Error.Printf("Failed to perform search: %v", err)
 		return
 	}
 
-	fmt.Printf("Query executed in %v seconds with status %q\n", res.Duration, res.Status.String())
-	fmt.Printf("Returning %v of %v total hits, capped: %v\n",
+	if writer.json {
+		writer.writeJSON(res)
+		return
+	}
+
+	fmt.Fprintf(writer.info, "Query executed in %v seconds with status %q\n", res.Duration, res.Status.String())
+	fmt.Fprintf(writer.info, "Returning %v of %v total hits, capped: %v\n",
 		len(res.Result.Hits), res.Result.TotalHits, res.Result.Capped)
+	if res.Result.Truncated {
+		fmt.Fprintf(writer.info, "Results truncated: %s\n", res.Result.TruncatedReason)
+	}
+	if res.Result.SnippetsOmitted {
+		fmt.Fprintf(writer.info, "Snippets omitted beyond the snippet limit\n")
+	}
+	if len(res.Result.UnavailableSpaces) > 0 {
+		fmt.Fprintf(writer.info, "Search disabled in spaces: %s\n", strings.Join(res.Result.UnavailableSpaces, ", "))
+	}
+	if watermark := res.Result.OldestWatermark(); !watermark.IsZero() {
+		fmt.Fprintf(writer.info, "Index current as of %v\n", watermark.Local().Format(time.RFC1123))
+	}
 	if res.Status == protocol.SearchStatusNoHit && res.Result.Respelt != "" {
-		fmt.Printf("Did you mean %s?\n", res.Result.Respelt)
+		fmt.Fprintf(writer.info, "Did you mean %s?\n", res.Result.Respelt)
 	}
-	fmt.Println()
-	for _, doc := range res.Result.Hits {
-		fmt.Printf("[%v] %s\n", doc.ID, doc.Snippet)
+	fmt.Fprintln(writer.info)
+	for _, hit := range res.Result.Hits {
+		writer.write(hit)
+		if options.Explain {
+			writer.explain(hit)
+		}
+	}
+}
+
+type benchRun struct {
+	roundtrip  time.Duration
+	processing time.Duration
+	status     protocol.SearchStatusCode
+}
+
+// benchPhrase runs the same search options.Bench times on one connection.
+// The first run is reported separately, since the following runs are
+// usually served from the cache.
+func benchPhrase(phrase string, agent client.SearchAgent, options searchOptions, writer hitWriter) {
+	runs := make([]benchRun, 0, options.Bench)
+	for i := 0; i < options.Bench; i++ {
+		start := time.Now()
+		res, err := agent.Search(phrase, []string{options.Space}, options.Limit, options.Offset)
+		if err != nil {
+			logger.Error.Printf("Failed to perform search: %v", err)
+			return
+		}
+		runs = append(runs, benchRun{
+			roundtrip:  time.Since(start),
+			processing: time.Duration(res.Duration * float32(time.Second)),
+			status:     res.Status,
+		})
+	}
+
+	first := runs[0]
+	fmt.Fprintf(writer.info, "First run: %v roundtrip, %v processing, status %q\n",
+		first.roundtrip, first.processing, first.status.String())
+	if len(runs) == 1 {
+		return
+	}
+
+	rest := runs[1:]
+	cacheHits := 0
+	for _, run := range rest {
+		if run.status == protocol.SearchStatusCacheHit {
+			cacheHits++
+		}
+	}
+	fmt.Fprintf(writer.info, "Following %v runs, %v found in cache:\n", len(rest), cacheHits)
+
+	w := tabwriter.NewWriter(writer.info, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "\tMIN\tMEAN\tMEDIAN\tMAX\n")
+	for _, timing := range []struct {
+		name string
+		get  func(benchRun) time.Duration
+	}{
+		{"Roundtrip", func(run benchRun) time.Duration { return run.roundtrip }},
+		{"Processing", func(run benchRun) time.Duration { return run.processing }},
+	} {
+		durations := make([]time.Duration, len(rest))
+		var total time.Duration
+		for i, run := range rest {
+			durations[i] = timing.get(run)
+			total += durations[i]
+		}
+		sort.Slice(durations, func(i, j int) bool {
+			return durations[i] < durations[j]
+		})
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n",
+			timing.name, durations[0], total/time.Duration(len(durations)),
+			durations[len(durations)/2], durations[len(durations)-1],
+		)
 	}
+	w.Flush()
 }
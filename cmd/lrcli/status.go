@@ -0,0 +1,129 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/erkkah/letarette/internal/letarette"
+	"github.com/erkkah/letarette/pkg/client"
+	"github.com/erkkah/letarette/pkg/logger"
+)
+
+type statusOptions struct {
+	GroupSize int32 `name:"g"`
+}
+
+const stemmerStateTemplate = `
+Stemmer state:
+=============
+{{range . -}}
+Shard {{.Shard}} (worker@{{.IndexID}}):
+* Languages:{{"\t"}}{{join .Stemmers ","}}
+* Token characters:{{"\t"}}{{printf "%q" .TokenCharacters}}
+* Separators:{{"\t"}}{{printf "%q" .Separators}}
+* Remove diacritics:{{"\t"}}{{if .RemoveDiacritics}}yes{{else}}no{{end}}
+* Max token length:{{"\t"}}{{if .MaxTokenLength}}{{.MaxTokenLength}}, {{if .TruncateLongTokens}}truncating{{else}}dropping{{end}}{{else}}none{{end}}
+* Invisible characters:{{"\t"}}{{printf "%+q" .InvisibleCharacters}}
+* Stop words:{{"\t"}}{{if .StopWords}}{{join .StopWords ","}}{{else}}none{{end}}
+* Last changed:{{"\t"}}{{.Updated.Format "Mon, 02 Jan 2006 15:04:05 MST"}}
+{{end}}
+`
+
+func doStatus(cfg letarette.Config, options statusOptions) {
+	agent, err := client.NewSearchAgent(
+		cfg.Nats.URLS,
+		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
+		client.WithShardgroupSize(options.GroupSize),
+		client.WithRootCAs(cfg.Nats.RootCAs...),
+		client.WithTimeout(10*time.Second),
+	)
+	if err != nil {
+		logger.Error.Printf("Failed to create search agent: %v", err)
+		return
+	}
+	defer agent.Close()
+
+	states, err := agent.StemmerState()
+	if err != nil {
+		logger.Error.Printf("Failed to get stemmer state: %v", err)
+		return
+	}
+	sort.Slice(states, func(a, b int) bool {
+		return states[a].Shard < states[b].Shard
+	})
+
+	tmpl := template.New("status")
+	tmpl = tmpl.Funcs(template.FuncMap{
+		"join": strings.Join,
+	})
+	tmpl, err = tmpl.Parse(stemmerStateTemplate)
+	if err != nil {
+		logger.Error.Printf("Failed to parse template: %v", err)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	err = tmpl.Execute(writer, states)
+	if err != nil {
+		logger.Error.Printf("Failed to execute template: %v", err)
+	}
+	_ = writer.Flush()
+}
+
+// doPing pings the search workers, exiting with an error status
+// when no worker responds.
+func doPing(cfg letarette.Config) {
+	agent, err := client.NewSearchAgent(
+		cfg.Nats.URLS,
+		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
+		client.WithRootCAs(cfg.Nats.RootCAs...),
+		client.WithTimeout(10*time.Second),
+	)
+	if err != nil {
+		logger.Error.Printf("Failed to create search agent: %v", err)
+		os.Exit(1)
+	}
+	defer agent.Close()
+
+	result, err := agent.Ping()
+	if err != nil {
+		logger.Error.Printf("Ping failed: %v", err)
+		agent.Close()
+		os.Exit(1)
+	}
+
+	shards := make([]string, 0, len(result.Shards))
+	for shard := range result.Shards {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	fmt.Printf("%v workers responded, first in %v\n", result.Workers, result.Latency)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(writer, "SHARD\tWORKERS\n")
+	for _, shard := range shards {
+		fmt.Fprintf(writer, "%v\t%v\n", shard, result.Shards[shard])
+	}
+	_ = writer.Flush()
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/erkkah/letarette/internal/letarette"
+)
+
+type stemOptions struct {
+	databaseOptions
+	Command   string   `arg:"0"`
+	Sentence  []string `args:"1"`
+	Stopwords string   `name:"s"`
+	Synonyms  string   `name:"y"`
+}
+
+// configCheck collects problems found when checking linguistic config.
+// Errors make the check fail, warnings are only reported.
+type configCheck struct {
+	errors   int
+	warnings int
+}
+
+func (c *configCheck) error(format string, args ...interface{}) {
+	c.errors++
+	fmt.Printf("  error: "+format+"\n", args...)
+}
+
+func (c *configCheck) warning(format string, args ...interface{}) {
+	c.warnings++
+	fmt.Printf("  warning: "+format+"\n", args...)
+}
+
+// checkStemmerConfig validates stopword and synonym files, and previews
+// how a sample sentence is transformed. Exits non-zero on errors.
+func checkStemmerConfig(cfg letarette.Config, options stemOptions) {
+	var check configCheck
+
+	var stopwords map[string]bool
+	if options.Stopwords != "" {
+		stopwords = check.stopwords(options.Stopwords)
+	}
+
+	var synonyms map[string][]string
+	if options.Synonyms != "" {
+		synonyms = check.synonyms(options.Synonyms, stopwords)
+	}
+
+	if len(options.Sentence) > 0 {
+		err := previewSentence(cfg, strings.Join(options.Sentence, " "), stopwords, synonyms)
+		if err != nil {
+			check.error("failed to preview sentence: %v", err)
+		}
+	}
+
+	fmt.Printf("\n%d errors, %d warnings\n", check.errors, check.warnings)
+	if check.errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// stopwords reads a stopword file with one word per line.
+// Empty lines and lines starting with "#" are ignored.
+func (c *configCheck) stopwords(path string) map[string]bool {
+	fmt.Printf("Stopwords (%s):\n", path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		c.error("failed to open file: %v", err)
+		return nil
+	}
+	defer file.Close()
+
+	stopwords := map[string]bool{}
+	firstLine := map[string]int{}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if strings.ContainsAny(word, " \t") {
+			c.error("line %d: %q is not a single word", line, word)
+			continue
+		}
+		if first, found := firstLine[word]; found {
+			c.warning("line %d: duplicate of %q on line %d", line, word, first)
+			continue
+		}
+		firstLine[word] = line
+		stopwords[word] = true
+	}
+	if err := scanner.Err(); err != nil {
+		c.error("read error: %v", err)
+	}
+
+	fmt.Printf("  %d stopwords\n", len(stopwords))
+	return stopwords
+}
+
+// synonyms reads a synonym file in the format loaded by "lrcli synonyms",
+// returning the groups each word belongs to.
+func (c *configCheck) synonyms(path string, stopwords map[string]bool) map[string][]string {
+	fmt.Printf("Synonyms (%s):\n", path)
+
+	groups, err := readSynonyms(path)
+	if err != nil {
+		c.error("%v", err)
+		return nil
+	}
+
+	words := 0
+	wordGroups := map[string][]string{}
+	for _, group := range groups {
+		inGroup := map[string]bool{}
+		if len(group.Words) < 2 {
+			c.warning("group %q has less than two words", group.Description)
+		}
+		for _, word := range group.Words {
+			word = strings.ToLower(strings.TrimSpace(word))
+			if inGroup[word] {
+				c.error("group %q lists %q more than once", group.Description, word)
+				continue
+			}
+			inGroup[word] = true
+			words++
+			wordGroups[word] = append(wordGroups[word], group.Description)
+			if stopwords[word] {
+				c.warning("synonym %q in group %q is a stopword", word, group.Description)
+			}
+		}
+	}
+
+	// A word in several groups links them into one chain of synonyms,
+	// which can not be loaded since words must be unique.
+	linking := []string{}
+	for word, groups := range wordGroups {
+		if len(groups) > 1 {
+			linking = append(linking, word)
+		}
+	}
+	sort.Strings(linking)
+	for _, word := range linking {
+		c.error("%q links groups %q", word, wordGroups[word])
+	}
+
+	fmt.Printf("  %d groups, %d words\n", len(groups), words)
+	return wordGroups
+}
+
+func previewSentence(
+	cfg letarette.Config, sentence string, stopwords map[string]bool, synonyms map[string][]string,
+) error {
+	fmt.Printf("Preview:\n")
+	fmt.Printf("  input:     %s\n", sentence)
+
+	scoped, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer scoped.close()
+
+	ctx := context.Background()
+	terms, err := letarette.TokenizeText(ctx, scoped.db, sentence)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  terms:     %s\n", strings.Join(terms, " "))
+
+	// Stopwords are matched against unstemmed query words
+	var kept []string
+	var removed []string
+	for _, word := range strings.Fields(strings.ToLower(sentence)) {
+		word = strings.Trim(word, ".,;:!?\"'()")
+		if stopwords[word] {
+			removed = append(removed, word)
+		} else {
+			kept = append(kept, word)
+		}
+	}
+	fmt.Printf("  stopwords: %s\n", strings.Join(removed, " "))
+	fmt.Printf("  kept:      %s\n", strings.Join(kept, " "))
+
+	for _, word := range kept {
+		if groups, found := synonyms[word]; found {
+			fmt.Printf("  synonyms:  %q in %q\n", word, groups)
+		}
+	}
+	return nil
+}
@@ -34,12 +34,30 @@ func loadSynonyms(db letarette.Database, objFile string) {
 	s.Start("Loading ")
 	defer s.Stop()
 
+	synonyms, err := readSynonyms(objFile)
+	if err != nil {
+		s.Stop(fmt.Sprintf("%v\n", err))
+		return
+	}
+
+	ctx := context.Background()
+	err = letarette.SetSynonyms(ctx, db, synonyms)
+	if err != nil {
+		s.Stop(fmt.Sprintf("Failed to update synonyms: %v\n", err))
+		return
+	}
+
+	s.Stop(strconv.Itoa(len(synonyms)), "synonym groups loaded.\n")
+}
+
+// readSynonyms reads a synonym file, optionally gzipped, containing
+// a stream of JSON arrays like ["description", ["word", "word", ...]].
+func readSynonyms(objFile string) ([]letarette.Synonyms, error) {
 	var fileReader io.Reader
 
 	file, err := os.Open(objFile)
 	if err != nil {
-		s.Stop(fmt.Sprintf("Failed to open file: %v\n", err))
-		return
+		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 	fileReader = file
@@ -47,34 +65,43 @@ func loadSynonyms(db letarette.Database, objFile string) {
 	if strings.HasSuffix(objFile, ".gz") {
 		gzipReader, err := gzip.NewReader(fileReader)
 		if err != nil {
-			s.Stop(fmt.Sprintf("Failed to open gzipped file: %v\n", err))
-			return
+			return nil, fmt.Errorf("failed to open gzipped file: %w", err)
 		}
 		defer gzipReader.Close()
 		fileReader = gzipReader
 	}
 
 	decoder := json.NewDecoder(fileReader)
-	var voidSynonym []interface{}
 	var synonyms []letarette.Synonyms
 
-	count := 0
-
 	for {
+		var voidSynonym []interface{}
 		err := decoder.Decode(&voidSynonym)
 		if err != nil {
 			if !errors.Is(err, io.EOF) {
-				s.Stop(fmt.Sprintf("Read error: %v\n", err))
-				return
+				return nil, fmt.Errorf("read error: %w", err)
 			}
 			break
 		}
-		count++
-		description := voidSynonym[0].(string)
-		voidSynonyms := voidSynonym[1].([]interface{})
+		malformed := fmt.Errorf("malformed synonym group #%d", len(synonyms)+1)
+		if len(voidSynonym) != 2 {
+			return nil, malformed
+		}
+		description, ok := voidSynonym[0].(string)
+		if !ok {
+			return nil, malformed
+		}
+		voidSynonyms, ok := voidSynonym[1].([]interface{})
+		if !ok {
+			return nil, malformed
+		}
 		var synonymWords []string
 		for _, r := range voidSynonyms {
-			synonymWords = append(synonymWords, r.(string))
+			word, ok := r.(string)
+			if !ok {
+				return nil, malformed
+			}
+			synonymWords = append(synonymWords, word)
 		}
 		synonyms = append(synonyms, letarette.Synonyms{
 			Description: description,
@@ -82,14 +109,7 @@ func loadSynonyms(db letarette.Database, objFile string) {
 		})
 	}
 
-	ctx := context.Background()
-	err = letarette.SetSynonyms(ctx, db, synonyms)
-	if err != nil {
-		s.Stop(fmt.Sprintf("Failed to update synonyms: %v\n", err))
-		return
-	}
-
-	s.Stop(strconv.Itoa(count), "synonym groups loaded.\n")
+	return synonyms, nil
 }
 
 func dumpSynonyms(db letarette.Database) {
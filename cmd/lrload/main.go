@@ -37,6 +37,29 @@ type testSet struct {
 	Queries    []string
 	Limit      int
 	Offset     int
+	// Expected result characteristics by query, checked by the agents.
+	// Queries without expectations are not checked.
+	Expect map[string]queryExpectation `json:",omitempty"`
+}
+
+// queryExpectation lists checks applied to the result of a query
+type queryExpectation struct {
+	// Minimum number of total hits
+	MinHits int
+	// Maximum number of total hits, zero for no maximum
+	MaxHits int
+}
+
+// check returns a description of how a result fails the expectation,
+// or an empty string if it does not fail.
+func (e queryExpectation) check(res protocol.SearchResponse) string {
+	if res.Result.TotalHits < e.MinHits {
+		return fmt.Sprintf("%d hits, expected at least %d", res.Result.TotalHits, e.MinHits)
+	}
+	if e.MaxHits > 0 && res.Result.TotalHits > e.MaxHits {
+		return fmt.Sprintf("%d hits, expected at most %d", res.Result.TotalHits, e.MaxHits)
+	}
+	return ""
 }
 
 type testRequest struct {
@@ -45,16 +68,44 @@ type testRequest struct {
 }
 
 type testResult struct {
-	Start    time.Time
-	End      time.Time
-	Duration float32
-	Status   protocol.SearchStatusCode
-	Err      error
+	Start     time.Time
+	End       time.Time
+	Duration  float32
+	Status    protocol.SearchStatusCode
+	Err       error
+	Query     string
+	TotalHits int
+	// Set when the result does not match the expectations of the query
+	Failure string `json:",omitempty"`
 }
 
 // NATSOptions holds common NATS connection params
 type NATSOptions struct {
-	NATSURL string `name:"n" default:"localhost"`
+	NATSURL    string `name:"n" default:"localhost"`
+	CertFile   string `name:"cert"`
+	KeyFile    string `name:"key"`
+	CAFile     string `name:"ca"`
+	SkipVerify bool   `name:"insecure"`
+	// Reconnect settings, defaulting to the client defaults
+	MaxReconnects   int           `name:"reconnects" default:"-1"`
+	ReconnectWait   time.Duration `name:"reconnect-wait" default:"500ms"`
+	ReconnectJitter time.Duration `name:"reconnect-jitter" default:"100ms"`
+}
+
+// clientOptions returns the client options for the TLS and reconnect
+// params, and NATS user info from the NATS_USER and NATS_PASS environment
+func (o NATSOptions) clientOptions() []client.Option {
+	options := []client.Option{
+		client.WithTLS(o.CertFile, o.KeyFile, o.CAFile),
+		client.WithReconnect(o.MaxReconnects, o.ReconnectWait, o.ReconnectJitter),
+	}
+	if o.SkipVerify {
+		options = append(options, client.WithTLSSkipVerify())
+	}
+	if user := os.Getenv("NATS_USER"); user != "" {
+		options = append(options, client.WithUserInfo(user, os.Getenv("NATS_PASS")))
+	}
+	return options
 }
 
 type runOptions struct {
@@ -69,14 +120,36 @@ func main() {
 	usage := `Letarette load generator
 
 Usage:
-    lrload agent [-n <natsURL>]
-    lrload list [-n <natsURL>]
-    lrload run [-n <natsURL>] [-o <file>] [-l <limit>] <testset.json>
+    lrload agent [<nats>]
+    lrload list [<nats>]
+    lrload run [<nats>] [-o <file>] [-l <limit>] <testset.json>
+    lrload replay [<nats>] [-o <file>] [-s <speed>] <querylog.jsonl>
 
-Options:
+NATS options, <nats>:
     -n <natsURL> NATS server URL [default: localhost]
+    -cert <file> Client certificate file, for mutual TLS
+    -key <file>  Client key file, for mutual TLS
+    -ca <file>   Root CA file for server verification
+    -insecure    Skip TLS server verification, for development only
+    -reconnects <n>          Reconnect attempts, -1 for no limit [default: -1]
+    -reconnect-wait <wait>   Wait between reconnect attempts [default: 500ms]
+    -reconnect-jitter <wait> Random extra wait between attempts [default: 100ms]
+
+NATS user authentication is read from the NATS_USER and NATS_PASS
+environment variables, if set.
+
+Options:
     -o <file>    Write raw CSV data to <file>
     -l <limit>   Limit the run to <limit> agents
+    -s <speed>   Replay speed multiplier [default: 1]
+
+Test sets are JSON files, optionally listing expected result
+characteristics by query, checked by the agents:
+    {"Iterations": 100, "Spaces": ["..."], "Queries": ["..."], "Limit": 10,
+     "Expect": {"<query>": {"MinHits": 1, "MaxHits": 0}}}
+
+Query logs are JSON lines files, one query per line:
+    {"Time": "2020-04-01T12:00:00Z", "Query": "...", "Spaces": ["..."], "Limit": 10, "Offset": 0}
 `
 	if len(os.Args) < 2 {
 		fmt.Println(usage)
@@ -91,7 +164,7 @@ Options:
 		{
 			var options NATSOptions
 			pennant.MustParse(&options, args)
-			err := startAgent(options.NATSURL)
+			err := startAgent(options)
 			if err != nil {
 				logger.Error.Printf("Failed to start load agent: %v", err)
 				return
@@ -103,7 +176,7 @@ Options:
 		{
 			var options NATSOptions
 			pennant.MustParse(&options, args)
-			err := listAgents(options.NATSURL)
+			err := listAgents(options)
 			if err != nil {
 				logger.Error.Printf("Failed to list agents: %v", err)
 			}
@@ -118,22 +191,41 @@ Options:
 				return
 			}
 
-			if err = runTestSet(options.NATSURL, testSet, options.Limit, options.Output); err != nil {
+			if err = runTestSet(options.NATSOptions, testSet, options.Limit, options.Output); err != nil {
 				logger.Error.Printf("Failed to run: %v", err)
 			}
 		}
+	case "replay":
+		{
+			var options replayOptions
+			pennant.MustParse(&options, args)
+			entries, err := loadQueryLog(options.QueryLog)
+			if err != nil {
+				logger.Error.Printf("Failed to load query log: %v", err)
+				return
+			}
+
+			if err = replayQueryLog(options.NATSOptions, entries, options.Speed, options.Output); err != nil {
+				logger.Error.Printf("Failed to replay: %v", err)
+			}
+		}
 	}
 
 }
 
 // NATSConnect connects to NATS :)
-func NATSConnect(url string) (*nats.EncodedConn, error) {
-	natsOptions := []nats.Option{
-		nats.MaxReconnects(-1),
-		nats.ReconnectWait(time.Millisecond * 500),
+func NATSConnect(options NATSOptions) (*nats.EncodedConn, error) {
+	natsOptions := client.ReconnectOptions(options.MaxReconnects, options.ReconnectWait, options.ReconnectJitter)
+	var rootCAs []string
+	if options.CAFile != "" {
+		rootCAs = []string{options.CAFile}
+	}
+	natsOptions = append(natsOptions, client.TLSOptions(options.CertFile, options.KeyFile, rootCAs, options.SkipVerify)...)
+	if user := os.Getenv("NATS_USER"); user != "" {
+		natsOptions = append(natsOptions, nats.UserInfo(user, os.Getenv("NATS_PASS")))
 	}
 
-	nc, err := nats.Connect(url, natsOptions...)
+	nc, err := nats.Connect(options.NATSURL, natsOptions...)
 	if err != nil {
 		return nil, err
 	}
@@ -145,8 +237,8 @@ func NATSConnect(url string) (*nats.EncodedConn, error) {
 	return ec, nil
 }
 
-func listAgents(url string) error {
-	ec, err := NATSConnect(url)
+func listAgents(options NATSOptions) error {
+	ec, err := NATSConnect(options)
 	if err != nil {
 		return err
 	}
@@ -161,13 +253,14 @@ func listAgents(url string) error {
 	return nil
 }
 
-func startAgent(url string) error {
-	agent, err := client.NewSearchAgent([]string{url}, client.WithTimeout(time.Second*10))
+func startAgent(options NATSOptions) error {
+	agentOptions := append(options.clientOptions(), client.WithTimeout(time.Second*10))
+	agent, err := client.NewSearchAgent([]string{options.NATSURL}, agentOptions...)
 	if err != nil {
 		return err
 	}
 
-	ec, err := NATSConnect(url)
+	ec, err := NATSConnect(options)
 	if err != nil {
 		return err
 	}
@@ -201,11 +294,16 @@ func startAgent(url string) error {
 			start := time.Now()
 			res, err := agent.Search(q, set.Spaces, set.Limit, set.Offset)
 			results[i] = testResult{
-				Start:    start,
-				End:      time.Now(),
-				Duration: res.Duration,
-				Status:   res.Status,
-				Err:      err,
+				Start:     start,
+				End:       time.Now(),
+				Duration:  res.Duration,
+				Status:    res.Status,
+				Err:       err,
+				Query:     q,
+				TotalHits: res.Result.TotalHits,
+			}
+			if expectation, found := set.Expect[q]; found && err == nil {
+				results[i].Failure = expectation.check(res)
 			}
 		}
 		_ = ec.Publish("leta.load.response", &results)
@@ -235,8 +333,8 @@ func getAgents(ec *nats.EncodedConn) ([]string, error) {
 	return agents, nil
 }
 
-func runTestSet(url string, set testSet, limit int, output string) error {
-	ec, err := NATSConnect(url)
+func runTestSet(options NATSOptions, set testSet, limit int, output string) error {
+	ec, err := NATSConnect(options)
 	if err != nil {
 		return err
 	}
@@ -310,13 +408,16 @@ func report(results []testResult, clients int, total time.Duration, output strin
 				status = fmt.Sprintf("%v", res.Err)
 			}
 			realDuration := res.End.Sub(res.Start)
-			fmt.Fprintf(output, "%v,%v,%q\n", realDuration.Seconds(), res.Duration, status)
+			fmt.Fprintf(output, "%v,%v,%q,%v,%q\n",
+				realDuration.Seconds(), res.Duration, status, res.TotalHits, res.Failure)
 		}
 	}
 
 	var durationMean float32
 	var totalMean float64
 	var successful = 0
+	failures := map[string][]string{}
+	var failed = 0
 
 	for _, res := range results {
 		durationMean += res.Duration
@@ -324,6 +425,10 @@ func report(results []testResult, clients int, total time.Duration, output strin
 		if res.Err == nil {
 			successful++
 		}
+		if res.Failure != "" {
+			failed++
+			failures[res.Query] = append(failures[res.Query], res.Failure)
+		}
 	}
 	durationMean /= float32(len(results))
 	totalMean /= float64(len(results))
@@ -350,6 +455,19 @@ func report(results []testResult, clients int, total time.Duration, output strin
 
 	fmt.Printf("Testset run on %v concurrent agents in %.2fs\n", clients, total.Seconds())
 	fmt.Printf("\nSuccess ratio: %.4f%%\n", 100*float32(successful)/float32(len(results)))
+	if failed > 0 {
+		fmt.Printf("\nValidation failures: %v\n", failed)
+		queries := make([]string, 0, len(failures))
+		for query := range failures {
+			queries = append(queries, query)
+		}
+		sort.Strings(queries)
+		for _, query := range queries {
+			// The last failure is representative
+			list := failures[query]
+			fmt.Printf("%q:\t%v times, last %s\n", query, len(list), list[len(list)-1])
+		}
+	}
 
 	fmt.Printf("\nQuery processing times:\n")
 	fmt.Printf("Mean:\t%v\nMedian:\t%v\n", durationMean, durationMedian)
@@ -0,0 +1,124 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/client"
+	"github.com/erkkah/letarette/pkg/logger"
+)
+
+// queryLogEntry is one line in a JSON lines formatted query log
+type queryLogEntry struct {
+	Time   time.Time
+	Query  string
+	Spaces []string
+	Limit  int
+	Offset int
+}
+
+type replayOptions struct {
+	NATSOptions
+
+	QueryLog string  `arg:"0"`
+	Output   string  `name:"o"`
+	Speed    float64 `name:"s" default:"1"`
+}
+
+func loadQueryLog(path string) ([]queryLogEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []queryLogEntry
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry queryLogEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse query log line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("empty query log")
+	}
+	return entries, nil
+}
+
+// replayQueryLog issues all logged queries, keeping the logged
+// inter-arrival times, scaled by the speed factor.
+func replayQueryLog(options NATSOptions, entries []queryLogEntry, speed float64, output string) error {
+	if speed <= 0 {
+		return fmt.Errorf("invalid replay speed %v", speed)
+	}
+
+	agentOptions := append(options.clientOptions(), client.WithTimeout(time.Second*10))
+	agent, err := client.NewSearchAgent([]string{options.NATSURL}, agentOptions...)
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	results := make([]testResult, len(entries))
+	var wg sync.WaitGroup
+	wg.Add(len(entries))
+
+	first := entries[0].Time
+	start := time.Now()
+	for i, entry := range entries {
+		offset := time.Duration(float64(entry.Time.Sub(first)) / speed)
+		time.Sleep(time.Until(start.Add(offset)))
+
+		go func(i int, entry queryLogEntry) {
+			defer wg.Done()
+			queryStart := time.Now()
+			res, err := agent.Search(entry.Query, entry.Spaces, entry.Limit, entry.Offset)
+			results[i] = testResult{
+				Start:     queryStart,
+				End:       time.Now(),
+				Duration:  res.Duration,
+				Status:    res.Status,
+				Err:       err,
+				Query:     entry.Query,
+				TotalHits: res.Result.TotalHits,
+			}
+		}(i, entry)
+	}
+
+	logger.Debug.Printf("Waiting...")
+	wg.Wait()
+	end := time.Now()
+
+	logger.Debug.Printf("Reporting...")
+	report(results, 1, end.Sub(start), output)
+	return nil
+}
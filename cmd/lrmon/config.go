@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"text/tabwriter"
+	"time"
 
 	"github.com/erkkah/letarette"
 	"github.com/kelseyhightower/envconfig"
@@ -30,6 +31,12 @@ type Config struct {
 		SeedFile string
 		RootCAs  []string
 		Topic    string `default:"leta"`
+		// Lost connections are re-established up to MaxReconnects times,
+		// or forever when negative. Attempts are separated by ReconnectWait
+		// plus a random jitter of up to ReconnectJitter.
+		MaxReconnects   int           `split_words:"true" default:"-1" desc:"advanced"`
+		ReconnectWait   time.Duration `split_words:"true" default:"500ms" desc:"advanced"`
+		ReconnectJitter time.Duration `split_words:"true" default:"100ms" desc:"advanced"`
 	}
 	Host string `default:""`
 	Port uint16 `default:"8080"`
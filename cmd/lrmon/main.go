@@ -45,6 +45,7 @@ func main() {
 		client.WithTopic(cfg.Nats.Topic),
 		client.WithRootCAs(cfg.Nats.RootCAs...),
 		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
 	)
 	if err != nil {
 		logger.Error.Printf("Failed to create monitor: %v", err)
@@ -54,8 +55,9 @@ func main() {
 
 	err = startSearchClient(
 		cfg.Nats.URLS,
-		cfg.Nats.SeedFile,
-		cfg.Nats.RootCAs,
+		client.WithSeedFile(cfg.Nats.SeedFile),
+		client.WithRootCAs(cfg.Nats.RootCAs...),
+		client.WithReconnect(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter),
 	)
 	if err != nil {
 		logger.Error.Printf("Failed to start search client: %v", err)
@@ -35,14 +35,10 @@ type searchResponse struct {
 
 var searchRequests chan searchRequest
 
-func startSearchClient(URLS []string, seedFile string, rootCAs []string) error {
+func startSearchClient(URLS []string, options ...client.Option) error {
 	searchRequests = make(chan searchRequest)
-	agent, err := client.NewSearchAgent(
-		URLS,
-		client.WithSeedFile(seedFile),
-		client.WithRootCAs(rootCAs...),
-		client.WithTimeout(5*time.Second),
-	)
+	options = append(options, client.WithTimeout(5*time.Second))
+	agent, err := client.NewSearchAgent(URLS, options...)
 	if err != nil {
 		return err
 	}
@@ -23,18 +23,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/nats-io/nats.go"
 
 	lr "github.com/erkkah/letarette"
 	"github.com/erkkah/letarette/internal/letarette"
 	"github.com/erkkah/letarette/internal/snowball"
+	"github.com/erkkah/letarette/pkg/client"
 	"github.com/erkkah/letarette/pkg/logger"
 )
 
@@ -63,10 +64,9 @@ func main() {
 
 	logger.Info.Printf("Connecting to nats server at %q\n", cleanURLs(cfg.Nats.URLS))
 
-	options := []nats.Option{
-		nats.MaxReconnects(-1),
-		nats.ReconnectWait(time.Millisecond * 500),
-	}
+	options := client.ReconnectOptions(
+		cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait, cfg.Nats.ReconnectJitter,
+	)
 
 	if cfg.Nats.SeedFile != "" {
 		option, err := nats.NkeyOptionFromSeed(cfg.Nats.SeedFile)
@@ -159,19 +159,41 @@ func main() {
 
 	var searcher letarette.Searcher
 	if !cfg.Search.Disable {
-		searcher, err = letarette.StartSearcher(conn, db, cfg, cache)
+		searcher, err = letarette.StartSearcher(conn, db, cfg, cache, letarette.AllowAllSearches)
 		if err != nil {
 			die("Failed to start searcher: %v", err)
 		}
 	}
 
+	var sqlResponder letarette.SQLResponder
+	if cfg.DB.RemoteSQLToken != "" {
+		sqlResponder, err = letarette.StartSQLResponder(
+			conn, db, cfg, letarette.SQLTokenAuthorizer(cfg.DB.RemoteSQLToken),
+		)
+		if err != nil {
+			die("Failed to start SQL responder: %v", err)
+		}
+	}
+
 	cloner, err := letarette.StartCloner(conn, db, cfg)
 	if err != nil {
 		die("Failed to start cloner: %v", err)
 	}
 
+	var health io.Closer
+	if cfg.Health.ListenAddr != "" {
+		health, err = letarette.StartHealthServer(db, cfg)
+		if err != nil {
+			die("Failed to start health server: %v", err)
+		}
+	}
+
 	<-mainContext.Done()
 
+	if health != nil {
+		_ = health.Close()
+	}
+
 	if metrics != nil {
 		metrics.Close()
 	}
@@ -181,6 +203,9 @@ func main() {
 	if searcher != nil {
 		searcher.Close()
 	}
+	if sqlResponder != nil {
+		sqlResponder.Close()
+	}
 	if indexer != nil {
 		indexer.Close()
 	}
@@ -34,6 +34,18 @@ struct MatchData {
     int offset;
 };
 
+// Returns the column (0), token offset (1) or token count (2) of a match
+static int matchProperty(const Fts5ExtensionApi *pApi, Fts5Context *pFts, struct MatchData* match, int property) {
+    switch (property) {
+    case 0:
+        return match->column;
+    case 1:
+        return match->offset;
+    default:
+        return pApi->xPhraseSize(pFts, match->phrase);
+    }
+}
+
 static void firstMatch(
     const Fts5ExtensionApi *pApi,   // API offered by current FTS version
     Fts5Context *pFts,              // First arg to pass to pApi functions
@@ -45,13 +57,13 @@ static void firstMatch(
         sqlite3_result_error_code(pCtx, SQLITE_ERROR);
         return;
     }
-    int columnOrOffset = sqlite3_value_int(apVal[0]);
+    int property = sqlite3_value_int(apVal[0]);
 
     sqlite3_int64 rowid = pApi->xRowid(pFts);
 
     struct MatchData* cached = pApi->xGetAuxdata(pFts, 0);
     if (cached != 0 && cached->rowid == rowid) {
-        sqlite3_result_int(pCtx, columnOrOffset ? cached->offset : cached->column);
+        sqlite3_result_int(pCtx, matchProperty(pApi, pFts, cached, property));
         return;
     }
 
@@ -77,7 +89,7 @@ static void firstMatch(
     cached->column = column;
     cached->offset = offset;
 
-    sqlite3_result_int(pCtx, columnOrOffset ? offset : column);
+    sqlite3_result_int(pCtx, matchProperty(pApi, pFts, cached, property));
 }
 
 struct TokenRangeContext {
@@ -86,6 +98,9 @@ struct TokenRangeContext {
     int currentToken;
     int textRangeStart;
     int textRangeEnd;
+    // Text offsets of the tokens in range, when highlighting
+    int* starts;
+    int* ends;
 };
 
 static int tokenRangeCallback(
@@ -104,6 +119,10 @@ static int tokenRangeCallback(
 
     if (ctx->currentToken >= ctx->tokenStart) {
         ctx->textRangeEnd = iEnd;
+        if (ctx->starts) {
+            ctx->starts[ctx->currentToken - ctx->tokenStart] = iStart;
+            ctx->ends[ctx->currentToken - ctx->tokenStart] = iEnd;
+        }
     }
 
     ctx->currentToken++;
@@ -122,7 +141,7 @@ static void getTokens(
     int nVal,                       // Number of values in apVal[] array
     sqlite3_value **apVal           // Array of trailing arguments
 ) {
-    if (nVal != 3) {
+    if (nVal != 3 && nVal != 7) {
         sqlite3_result_error_code(pCtx, SQLITE_ERROR);
         return;
     }
@@ -136,20 +155,106 @@ static void getTokens(
         return;
     }
 
+    const char* open = "";
+    const char* close = "";
+    int matchOffset = 0;
+    int matchLength = 0;
+    if (nVal == 7) {
+        open = (const char*) sqlite3_value_text(apVal[3]);
+        close = (const char*) sqlite3_value_text(apVal[4]);
+        open = open ? open : "";
+        close = close ? close : "";
+        matchOffset = sqlite3_value_int(apVal[5]);
+        matchLength = sqlite3_value_int(apVal[6]);
+    }
+    int highlight = count > 0 && (*open != 0 || *close != 0);
+
     struct TokenRangeContext ctx = {
-        offset,offset + count,0,0,0
+        offset,offset + count,0,0,0,0,0
     };
+    char* matched = 0;
+    if (highlight) {
+        ctx.starts = sqlite3_malloc(count * sizeof(int));
+        ctx.ends = sqlite3_malloc(count * sizeof(int));
+        matched = sqlite3_malloc(count);
+        if (!ctx.starts || !ctx.ends || !matched) {
+            sqlite3_free(ctx.starts);
+            sqlite3_free(ctx.ends);
+            sqlite3_free(matched);
+            sqlite3_result_error_nomem(pCtx);
+            return;
+        }
+        memset(matched, 0, count);
+    }
 
     int result = pApi->xTokenize(pFts, entry, length, &ctx, tokenRangeCallback);
-    if (result != SQLITE_OK && result != SQLITE_DONE) {
+    if (result == SQLITE_DONE) {
+        result = SQLITE_OK;
+    }
+    if (result == SQLITE_OK && highlight) {
+        // Mark the tokens of the match in range
+        for (int token = matchOffset; token < matchOffset + matchLength; token++) {
+            if (token >= offset && token < offset + count) {
+                matched[token - offset] = 1;
+            }
+        }
+    }
+    if (result != SQLITE_OK) {
+        sqlite3_free(ctx.starts);
+        sqlite3_free(ctx.ends);
+        sqlite3_free(matched);
         sqlite3_result_error_code(pCtx, result);
         return;
     }
 
-    const char* snippetStart = entry + ctx.textRangeStart;
-    int snippetLength = strnlen(snippetStart, ctx.textRangeEnd - ctx.textRangeStart);
-    const char* snippet = strndup(snippetStart, snippetLength);
-    sqlite3_result_text(pCtx, snippet, snippetLength, free);
+    if (!highlight) {
+        const char* snippetStart = entry + ctx.textRangeStart;
+        int snippetLength = strnlen(snippetStart, ctx.textRangeEnd - ctx.textRangeStart);
+        const char* snippet = strndup(snippetStart, snippetLength);
+        sqlite3_result_text(pCtx, snippet, snippetLength, free);
+        return;
+    }
+
+    // Wrap runs of matched tokens in the highlight markers
+    int tokens = ctx.currentToken - offset;
+    if (tokens > count) {
+        tokens = count;
+    }
+    sqlite3_str* snippet = sqlite3_str_new(0);
+    int textPos = ctx.textRangeStart;
+    for (int i = 0; i < tokens; i++) {
+        int startsRun = matched[i] && (i == 0 || !matched[i-1]);
+        int endsRun = matched[i] && (i == tokens - 1 || !matched[i+1]);
+        if (startsRun) {
+            sqlite3_str_append(snippet, entry + textPos, ctx.starts[i] - textPos);
+            sqlite3_str_appendall(snippet, open);
+            textPos = ctx.starts[i];
+        }
+        if (endsRun) {
+            sqlite3_str_append(snippet, entry + textPos, ctx.ends[i] - textPos);
+            sqlite3_str_appendall(snippet, close);
+            textPos = ctx.ends[i];
+        }
+    }
+    if (ctx.textRangeEnd > textPos) {
+        sqlite3_str_append(snippet, entry + textPos, ctx.textRangeEnd - textPos);
+    }
+
+    sqlite3_free(ctx.starts);
+    sqlite3_free(ctx.ends);
+    sqlite3_free(matched);
+
+    int snippetLength = sqlite3_str_length(snippet);
+    char* highlighted = sqlite3_str_finish(snippet);
+    if (!highlighted) {
+        if (snippetLength == 0) {
+            sqlite3_result_text(pCtx, "", 0, SQLITE_STATIC);
+        } else {
+            sqlite3_result_error_nomem(pCtx);
+        }
+        return;
+    }
+    sqlite3_result_text(pCtx, highlighted, snippetLength, sqlite3_free);
 }
 
 static void tokenCount(
@@ -173,6 +278,26 @@ static void tokenCount(
     sqlite3_result_int(pCtx, tokens);
 }
 
+static void matchCount(
+    const Fts5ExtensionApi *pApi,   // API offered by current FTS version
+    Fts5Context *pFts,              // First arg to pass to pApi functions
+    sqlite3_context *pCtx,          // Context for returning result/error
+    int nVal,                       // Number of values in apVal[] array
+    sqlite3_value **apVal           // Array of trailing arguments
+) {
+    if (nVal != 0) {
+        sqlite3_result_error_code(pCtx, SQLITE_ERROR);
+        return;
+    }
+    int instances = 0;
+    int result = pApi->xInstCount(pFts, &instances);
+    if (result != SQLITE_OK) {
+        sqlite3_result_error_code(pCtx, result);
+        return;
+    }
+    sqlite3_result_int(pCtx, instances);
+}
+
 static fts5_api *fts5APIFromDB(sqlite3 *db){
     fts5_api *pRet = 0;
     sqlite3_stmt *pStmt = 0;
@@ -201,7 +326,7 @@ int initAuxiliaryFunctions(sqlite3* db) {
     }
 
     result = fts->xCreateFunction(
-        // gettokens(fts, text, starttoken, count)
+        // gettokens(fts, text, starttoken, count [, open, close, matchoffset, matchlength])
         fts, "gettokens", (void*) 0, getTokens, (void*) 0
     );
 
@@ -214,5 +339,14 @@ int initAuxiliaryFunctions(sqlite3* db) {
         fts, "tokens", (void*) 0, tokenCount, (void*) 0
     );
 
+    if (result != SQLITE_OK) {
+        return result;
+    }
+
+    result = fts->xCreateFunction(
+        // matchcount(fts)
+        fts, "matchcount", (void*) 0, matchCount, (void*) 0
+    );
+
     return result;
 }
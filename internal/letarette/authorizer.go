@@ -0,0 +1,58 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+)
+
+// SearchAuthorizer decides which spaces a search request may search.
+//
+// The credentials are the value of the protocol.CredentialsHeader NATS
+// message header of the request, empty when not set. Their format is up
+// to the authorizer, typically a bearer token or signed claims.
+//
+// The authorizer returns the spaces to search, which may be a subset of
+// the requested spaces. Spaces left out are skipped silently. Returning
+// an error, or no spaces at all, rejects the request with
+// protocol.SearchStatusUnauthorized.
+type SearchAuthorizer func(ctx context.Context, credentials string, spaces []string) ([]string, error)
+
+// ErrUnauthorized can be returned by a SearchAuthorizer to reject a request
+var ErrUnauthorized = errors.New("unauthorized")
+
+// AllowAllSearches is the default SearchAuthorizer,
+// allowing all requests to search all requested spaces.
+func AllowAllSearches(ctx context.Context, credentials string, spaces []string) ([]string, error) {
+	return spaces, nil
+}
+
+// SQLAuthorizer decides if a remote SQL request may run,
+// see StartSQLResponder. The credentials are passed like for
+// SearchAuthorizer. Returning an error rejects the request.
+type SQLAuthorizer func(ctx context.Context, credentials string, statement string) error
+
+// SQLTokenAuthorizer returns a SQLAuthorizer allowing requests
+// with credentials equal to the given token.
+func SQLTokenAuthorizer(token string) SQLAuthorizer {
+	return func(ctx context.Context, credentials string, statement string) error {
+		if token == "" || subtle.ConstantTimeCompare([]byte(credentials), []byte(token)) != 1 {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/erkkah/letarette/pkg/logger"
+)
+
+// Number of pages copied by each backup step
+const backupStepPages = 1024
+
+// Wait before retrying a backup step that made no progress,
+// when the source database is locked
+var backupBusyWait = 100 * time.Millisecond
+
+// Number of retries of a backup step making no progress
+// before the backup fails
+const maxBackupBusyRetries = 300
+
+// Number of times a backup may restart before the rest of it
+// is copied in a single step
+const maxBackupRestarts = 3
+
+// BackupDatabase makes a consistent copy of a database to a new file at
+// destPath, using the SQLite online backup API. The database stays
+// available, and the indexer can keep running during the backup.
+//
+// The backup is copied in steps, logging progress. Steps blocked by a
+// locked database are retried, for at most maxBackupBusyRetries times in
+// a row. Since a backup restarts when another connection writes to the
+// database, a backup restarting repeatedly copies the rest in a single
+// step, holding a read transaction on the database until done.
+//
+// The directory of destPath is created if missing. An existing file at
+// destPath is not overwritten. When the backup fails, the partial copy
+// is removed.
+func BackupDatabase(dbo Database, destPath string) error {
+	db := dbo.(*database)
+
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup destination %q already exists", destPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(destPath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	err = backupTo(db, destPath)
+	if err != nil {
+		for _, file := range []string{destPath, destPath + "-journal"} {
+			if removeErr := os.Remove(file); removeErr != nil && !os.IsNotExist(removeErr) {
+				logger.Error.Printf("Failed to remove partial backup %q: %v", file, removeErr)
+			}
+		}
+	}
+	return err
+}
+
+func backupTo(db *database, destPath string) error {
+	ctx := context.Background()
+
+	dest, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	srcConn, err := db.rdb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		destSQLite, ok := destDriverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection type %T", destDriverConn)
+		}
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			srcSQLite, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected driver connection type %T", srcDriverConn)
+			}
+			backup, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return fmt.Errorf("failed to start backup: %w", err)
+			}
+			err = stepBackup(backup)
+			if finishErr := backup.Finish(); err == nil {
+				err = finishErr
+			}
+			return err
+		})
+	})
+}
+
+// backupSteps is the part of sqlite3.SQLiteBackup used when stepping
+type backupSteps interface {
+	Step(pages int) (bool, error)
+	Remaining() int
+	PageCount() int
+}
+
+func stepBackup(backup backupSteps) error {
+	start := time.Now()
+	logger.Info.Printf("Starting backup")
+
+	restarts := 0
+	retries := 0
+	pages := backupStepPages
+	lastRemaining := -1
+	for {
+		done, err := backup.Step(pages)
+		if err != nil {
+			return fmt.Errorf("backup step failed: %w", err)
+		}
+		if done {
+			break
+		}
+
+		remaining := backup.Remaining()
+		total := backup.PageCount()
+		if remaining != lastRemaining {
+			retries = 0
+		}
+		switch {
+		case remaining == lastRemaining:
+			// Locked, retry
+			retries++
+			if retries > maxBackupBusyRetries {
+				return fmt.Errorf("backup made no progress after %d retries", maxBackupBusyRetries)
+			}
+			time.Sleep(backupBusyWait)
+		case lastRemaining >= 0 && remaining > lastRemaining:
+			restarts++
+			logger.Info.Printf("Backup restarted by database changes")
+			if restarts > maxBackupRestarts {
+				pages = -1
+			}
+		default:
+			if total > 0 {
+				logger.Info.Printf("Backup %d%% done", 100*(total-remaining)/total)
+			}
+		}
+		lastRemaining = remaining
+	}
+
+	logger.Info.Printf("Backup done in %v seconds", time.Since(start).Seconds())
+	return nil
+}
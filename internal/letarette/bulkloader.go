@@ -16,8 +16,6 @@ package letarette
 
 import (
 	"context"
-	"database/sql"
-	"fmt"
 
 	"github.com/erkkah/letarette/pkg/protocol"
 	"github.com/jmoiron/sqlx"
@@ -27,9 +25,8 @@ import (
 // database and space.
 func StartBulkLoad(dbo Database, space string) (*BulkLoader, error) {
 	db := dbo.(*database)
-	sql := db.getRawDB()
 	ctx := context.Background()
-	tx, err := sql.BeginTxx(ctx, nil)
+	tx, err := db.getRawDB().BeginTxx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -38,12 +35,18 @@ func StartBulkLoad(dbo Database, space string) (*BulkLoader, error) {
 		_ = tx.Rollback()
 		return nil, err
 	}
+	mode, err := getSpaceModeTx(ctx, tx, spaceID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
 	statement := tx.StmtxContext(ctx, db.addDocumentStatement)
 	return &BulkLoader{
 		spaceID,
+		mode,
 		tx,
 		statement,
-		sql,
+		db,
 		0,
 	}, nil
 }
@@ -51,41 +54,20 @@ func StartBulkLoad(dbo Database, space string) (*BulkLoader, error) {
 // BulkLoader performs transactional loading of documents into the index
 type BulkLoader struct {
 	spaceID     int
+	mode        spaceMode
 	tx          *sqlx.Tx
 	statement   *sqlx.Stmt
-	db          *sqlx.DB
+	db          *database
 	loadedBytes uint32
 }
 
 // Load loads one document into the current loading transaction
 func (bl *BulkLoader) Load(doc protocol.Document) error {
-	txt := ""
-	title := ""
 	if doc.Alive {
-		txt = doc.Text
-		title = doc.Title
-	}
-
-	bl.loadedBytes += uint32(len(title) + len(txt))
-
-	res, err := bl.statement.Exec(
-		sql.Named("spaceID", bl.spaceID),
-		sql.Named("docID", doc.ID),
-		sql.Named("updated", doc.Updated.UnixNano()),
-		sql.Named("title", title),
-		sql.Named("txt", txt),
-		sql.Named("alive", doc.Alive),
-	)
-
-	if err != nil {
-		return err
+		bl.loadedBytes += uint32(len(doc.Title) + len(doc.Text))
 	}
 
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected != 1 {
-		return fmt.Errorf("unexpected number of rows changed")
-	}
-	return nil
+	return bl.db.addDocumentTx(context.Background(), bl.tx, bl.statement, bl.spaceID, bl.mode, doc)
 }
 
 // Commit - commits the bulk load transaction and performs
@@ -98,7 +80,7 @@ func (bl *BulkLoader) Commit() error {
 		return err
 	}
 
-	_, err = bl.db.Exec(`vacuum`)
+	_, err = bl.db.getRawDB().Exec(`vacuum`)
 	if err != nil {
 		return err
 	}
@@ -61,7 +61,12 @@ func StartShardClone(ctx context.Context, db *database, shardGroup string, dest
 		return nil, err
 	}
 
-	rowQ := "select docs.id as rowid, docID as id, space from docs join spaces using (spaceID)"
+	// Documents in contentless spaces have no content to clone,
+	// they are fetched by the receiving worker instead.
+	rowQ := `
+	select docs.id as rowid, docID as id, space
+	from docs join spaces using (spaceID)
+	where not spaces.contentless`
 
 	rows, err := db.rdb.QueryxContext(ctx, rowQ)
 	if err != nil {
@@ -73,7 +78,7 @@ func StartShardClone(ctx context.Context, db *database, shardGroup string, dest
 	}
 
 	statement, err := db.rdb.PreparexContext(
-		ctx, `select updatedNanos, title, txt as "text", alive from docs where id = ?`,
+		ctx, `select updatedNanos, title, txt as "text", alive, source, language, version, boost from docs where id = ?`,
 	)
 
 	if err != nil {
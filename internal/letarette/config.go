@@ -17,10 +17,14 @@ package letarette
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 	"text/tabwriter"
 	"time"
+	"unicode"
 
 	"github.com/erkkah/letarette"
+	"github.com/erkkah/letarette/pkg/protocol"
 
 	"github.com/kelseyhightower/envconfig"
 )
@@ -32,12 +36,54 @@ type Config struct {
 		SeedFile string
 		RootCAs  []string
 		Topic    string `default:"leta"`
+		// Lost connections are re-established up to MaxReconnects times,
+		// or forever when negative. Attempts are separated by ReconnectWait
+		// plus a random jitter of up to ReconnectJitter.
+		MaxReconnects   int           `split_words:"true" default:"-1" desc:"advanced"`
+		ReconnectWait   time.Duration `split_words:"true" default:"500ms" desc:"advanced"`
+		ReconnectJitter time.Duration `split_words:"true" default:"100ms" desc:"advanced"`
+		// Document updates are received from durable JetStream consumers
+		// when UseJetStream is set, instead of as core NATS messages,
+		// so updates published while the worker is down are not lost.
+		// Consumers are named after the index ID, and updates are
+		// acknowledged once stored. The UpdateStream stream, holding
+		// the document update subjects, is set up outside of Letarette.
+		UseJetStream bool   `split_words:"true" default:"false" desc:"advanced"`
+		UpdateStream string `split_words:"true" default:"letarette" desc:"advanced"`
 	}
 	DB struct {
 		Path           string `default:"letarette.db"`
 		CacheSizeMB    uint32 `default:"1024" desc:"advanced"` // default 1G DB cache
 		MMapSizeMB     uint32 `default:"0" desc:"internal"`    // no DB mmap by default
 		ToolConnection bool   `ignored:"true"`
+		// The database is journaled in WAL mode, letting searches run
+		// while documents are written. WAL needs shared memory between
+		// processes, which some network filesystems do not support.
+		// When WAL can not be enabled, the database is opened using the
+		// JournalFallback mode if set, or not at all.
+		// "DELETE", "TRUNCATE" and "PERSIST" are rollback journal modes,
+		// where writes block searches and searches block writes. They
+		// differ only in how the journal file is reset after each commit:
+		// by deleting it, truncating it or overwriting its header.
+		// TRUNCATE is usually fastest, DELETE is the most compatible.
+		JournalFallback string `split_words:"true" default:"" desc:"advanced"`
+		// Credentials required to run read-only SQL statements remotely,
+		// see StartSQLResponder. Empty disables remote SQL.
+		RemoteSQLToken string `split_words:"true" default:"" desc:"advanced"`
+		// Workers sharing a database wait up to MigrationWait for a
+		// migration started by another worker to finish, before failing
+		// on the unfinished migration.
+		MigrationWait time.Duration `split_words:"true" default:"30s" desc:"advanced"`
+		// The WAL is checkpointed every CheckpointInterval, without
+		// waiting for searches or writes, keeping the WAL from growing
+		// while searches keep it busy. Every VacuumInterval, up to
+		// VacuumPages unused pages are freed, or all if zero.
+		// The first vacuum of a database created without incremental
+		// vacuuming is a full vacuum, blocking indexing while it runs.
+		// Zero intervals disable checkpointing and vacuuming.
+		CheckpointInterval time.Duration `split_words:"true" default:"1m" desc:"advanced"`
+		VacuumInterval     time.Duration `split_words:"true" default:"0" desc:"advanced"`
+		VacuumPages        int           `split_words:"true" default:"1000" desc:"advanced"`
 	}
 	Index struct {
 		Spaces         []string `required:"true" default:"docs"`
@@ -50,9 +96,142 @@ type Config struct {
 			Interest   time.Duration `default:"5s" desc:"advanced"`
 			Document   time.Duration `default:"30s" desc:"advanced"`
 			Refetch    time.Duration `default:"3s" desc:"advanced"`
+			// Per-space overrides of Cycle and EmptyCycle, as "space:duration" lists.
+			// Each space is scheduled on its own: a space with pending documents is
+			// cycled after its Cycle wait, an idle space after its EmptyCycle wait.
+			// Document updates trigger an immediate cycle of all non-idle spaces.
+			// Housekeeping runs when all spaces are idle, at most once per the
+			// global EmptyCycle wait.
+			SpaceCycle      map[string]time.Duration `split_words:"true" desc:"advanced"`
+			SpaceEmptyCycle map[string]time.Duration `split_words:"true" desc:"advanced"`
 		}
-		Disable  bool `default:"false" desc:"advanced"`
-		Compress bool `default:"false"`
+		// The watchdog recovers spaces that make no progress for the
+		// Timeout duration while having outstanding documents, by resetting
+		// requested documents to be requested again.
+		// With Refetch set, the interest list of a stuck space is also
+		// dropped, and fetched again from the last committed position.
+		// A zero Timeout disables the watchdog.
+		Watchdog struct {
+			Timeout time.Duration `default:"5m" desc:"advanced"`
+			Refetch bool          `default:"false" desc:"advanced"`
+		}
+		// Per-space max document counts, as "space:count" lists.
+		// Spaces with more documents after committing an interest list
+		// have their least recently updated documents evicted, for rolling
+		// window indexes. Eviction is best-effort: spaces can exceed their
+		// max count between commits, and evicted documents are indexed
+		// again if updated, or fetched again by ClockSkew lookbacks.
+		MaxDocs map[string]int `split_words:"true" desc:"advanced"`
+		// Per-space indexing priorities, as "space:priority" lists.
+		// The cycle waits of a space, see Wait, are divided by its
+		// priority, so a space with priority 4 is cycled four times as
+		// often as a space with the default priority 1, keeping
+		// frequently changing spaces fresh.
+		Priority map[string]int `desc:"advanced"`
+		// Documents of an interest list updated within PriorityBoostWindow
+		// are requested before the other documents of the list, making
+		// recent updates searchable sooner while a long list is fetched.
+		// Interest lists are still fetched in update order, so documents
+		// in later lists wait for earlier lists to be indexed.
+		// A zero window requests documents in update order.
+		PriorityBoostWindow time.Duration `split_words:"true" default:"0" desc:"advanced"`
+		// Per-space overrides of ReqSize, as "space:size" lists.
+		SpaceReqSize map[string]uint16 `split_words:"true" desc:"advanced"`
+		// Document managers with clocks going backwards by up to ClockSkew
+		// are tolerated by fetching index updates again from ClockSkew before
+		// the index position each time the space has caught up.
+		// Documents already indexed are not fetched again, but the index
+		// updates of the ClockSkew window are re-read every empty cycle.
+		// A zero ClockSkew disables the lookback.
+		ClockSkew time.Duration `split_words:"true" default:"0" desc:"advanced"`
+		// Key index statistics are sampled every Interval and kept for
+		// the Retention duration, see "lrcli index -history stats".
+		// A zero Interval disables sampling.
+		StatsHistory struct {
+			Interval  time.Duration `default:"0" desc:"advanced"`
+			Retention time.Duration `default:"720h" desc:"advanced"`
+		}
+		// Document updates received are queued for storing in a queue of
+		// UpdateQueueSize updates. A full queue blocks receiving updates.
+		UpdateQueueSize int  `split_words:"true" default:"50" desc:"advanced"`
+		Disable         bool `default:"false" desc:"advanced"`
+		Compress        bool `default:"false"`
+		// Documents failing to be indexed are stored as dead letters, see
+		// "lrcli index deadletters". Documents that have failed
+		// DeadLetterAttempts times are given up on, and not waited for
+		// in the interest list. Until then, they are requested again.
+		DeadLetterAttempts int `split_words:"true" default:"3" desc:"advanced"`
+		// Received document updates are stored together in one commit
+		// once MinDocs documents are waiting, or when the first waiting
+		// update has waited for MaxLatency. Larger batches mean fewer,
+		// larger database writes and checkpoints, at the cost of
+		// documents becoming searchable up to MaxLatency later.
+		// Index cycles also wait for batched documents.
+		// A MinDocs of zero or one stores each update as received.
+		CommitBatch struct {
+			MinDocs    int           `split_words:"true" default:"0" desc:"advanced"`
+			MaxLatency time.Duration `split_words:"true" default:"1s" desc:"advanced"`
+		}
+		// Document fields stored for filtering and ranking.
+		// Fields not listed here are ignored when indexing.
+		StoredFields []string `split_words:"true" desc:"advanced"`
+		// Stored fields parsed into typed values for range filtering,
+		// see FieldParsing.
+		NumericFields []string `split_words:"true" desc:"advanced"`
+		DateFields    []string `split_words:"true" desc:"advanced"`
+		// Numbers are parsed using the given decimal separator,
+		// ignoring any group (thousands) separators, "1 234,5" with
+		// decimal separator "," and group separator " ".
+		// Dates are parsed by trying each of the date formats in order,
+		// formats are Go time layouts like "2006-01-02" or "02.01.2006".
+		// Dates without time zone are parsed as UTC.
+		FieldParsing struct {
+			DecimalSeparator string   `split_words:"true" default:"." desc:"advanced"`
+			GroupSeparator   string   `split_words:"true" default:"" desc:"advanced"`
+			DateFormats      []string `split_words:"true" default:"2006-01-02T15:04:05Z07:00,2006-01-02" desc:"advanced"`
+		}
+		// Spaces indexed without storing document title and text.
+		// Search results from these spaces have no snippets and no
+		// content, see protocol.SearchRequest.IncludeContent. There is no
+		// stored text to build "more like this" queries from either, such
+		// queries need the text from the document manager.
+		// The mode of a space can not be changed once it has documents.
+		Contentless []string `desc:"advanced"`
+		// Spaces using integer document IDs, stored and ordered as integers.
+		// Documents with IDs that are not decimal 64-bit integers are rejected,
+		// and the ID type of a space can not be changed once it has documents.
+		IntegerIDs []string `split_words:"true" desc:"advanced"`
+		// Document IDs are normalized before indexing, so that IDs
+		// differing only in formatting, like "Doc/1/" and "doc/1", refer
+		// to the same document. Matches of Pattern are replaced by
+		// Replacement, then Trim characters are trimmed from both ends,
+		// then the ID is lowercased if Lowercase is set.
+		// Normalization applies to documents, interest lists, touches
+		// and dead letters. Documents are requested from the document
+		// manager by normalized ID, and search hits have normalized IDs.
+		// Changing the normalization leaves documents indexed under
+		// their old IDs, reload or rebuild the affected spaces after
+		// changing it.
+		IDNormalization struct {
+			Lowercase   bool   `default:"false" desc:"advanced"`
+			Trim        string `default:"" desc:"advanced"`
+			Pattern     string `default:"" desc:"advanced"`
+			Replacement string `default:"" desc:"advanced"`
+		}
+		// Spaces indexing phonetic (Soundex) codes of the words in
+		// document titles and texts, for phonetic searches.
+		// The codes are stored and indexed in addition to the text,
+		// growing the index by roughly as much as a contentless copy of
+		// the space. Best suited for spaces of names and short texts.
+		// Documents indexed before enabling have no codes until reloaded.
+		Phonetic []string `desc:"advanced"`
+		// Spaces indexing the exact case of the words in document
+		// titles and texts, for case sensitive searches telling "IT"
+		// from "it". Like phonetic codes, the words are stored and
+		// indexed in addition to the text, growing the index by roughly
+		// as much as a contentless copy of the space.
+		// Documents indexed before enabling are not found until reloaded.
+		ExactCase []string `split_words:"true" desc:"advanced"`
 	}
 	Spelling struct {
 		MinFrequency int `split_words:"true" default:"5" desc:"advanced"`
@@ -64,6 +243,21 @@ type Config struct {
 		TokenCharacters  string   `desc:"advanced"`
 		Separators       string   `desc:"advanced"`
 		StopwordCutoff   float32  `split_words:"true" default:"1" desc:"advanced"`
+		// Tokens longer than MaxTokenLength bytes, like base64 blobs or
+		// long URLs, are dropped, or truncated if TruncateLongTokens is set.
+		// Applied both when indexing and searching. Zero disables the limit.
+		MaxTokenLength     int  `split_words:"true" default:"0" desc:"advanced"`
+		TruncateLongTokens bool `split_words:"true" default:"false" desc:"advanced"`
+		// Invisible characters, like byte order marks and zero-width
+		// spaces and joiners, are removed from document titles and texts
+		// before tokenization, and from queries before parsing.
+		// Defaults to BOM, ZWSP, ZWNJ, ZWJ, word joiner and soft hyphen.
+		InvisibleCharacters string `split_words:"true" default:"\ufeff\u200b\u200c\u200d\u2060\u00ad" desc:"advanced"`
+		// Words never indexed or searched for, matched case insensitively
+		// after stemming. Unlike the stop words found by StopwordCutoff,
+		// they are removed from phrases too. Documents indexed before
+		// changing the list are not updated until reloaded.
+		StopWords []string `split_words:"true" desc:"advanced"`
 	}
 	Search struct {
 		Timeout        time.Duration `default:"4s"`
@@ -72,13 +266,100 @@ type Config struct {
 		CacheMaxsizeMB uint64        `split_words:"true" default:"250"`
 		Disable        bool          `default:"false" desc:"advanced"`
 		Strategy       int           `default:"1" desc:"internal"`
+		// Totals estimated on request count matches up to EstimateCap,
+		// see protocol.SearchRequest.EstimateTotal.
+		EstimateCap int `split_words:"true" default:"1000000" desc:"advanced"`
+		// Order of hits with equal rank, "docid" to order by space and
+		// document ID for stable paging, or "none" to leave it to the index.
+		// Clients merging the hits of several shards always order equal
+		// rank hits by space and document ID.
+		Tiebreaker string `default:"docid" desc:"advanced"`
+		// Handling of queries where all words are stop words, "empty" to
+		// return no hits, or "raw" to match the words anyway. Either way,
+		// the result is flagged, see protocol.SearchResult.StopwordsOnly.
+		StopwordQueries string `split_words:"true" default:"empty" desc:"advanced"`
+		// Document text returned with hits on request is cut after
+		// MaxContentSize bytes, zero disables returning document text.
+		// See protocol.SearchRequest.IncludeContent.
+		MaxContentSize int `split_words:"true" default:"65536" desc:"advanced"`
+		// Snippets are generated for at most MaxSnippets hits of each
+		// search, the following hits have empty snippets. Zero disables
+		// the limit. Document text returned by IncludeContent is not limited.
+		MaxSnippets int `split_words:"true" default:"100" desc:"advanced"`
+		// Snippets hold SnippetWindow tokens before and after the first
+		// match of each hit, with the words of that match wrapped in the
+		// highlight markers, like "<b>" and "</b>". Empty markers disable
+		// highlighting. The default window, zero, holds one token before
+		// and eight after the first match.
+		// Searches can override these, see protocol.SearchRequest.SnippetWindow.
+		SnippetWindow         int    `split_words:"true" default:"0" desc:"advanced"`
+		SnippetHighlightOpen  string `split_words:"true" default:"" desc:"advanced"`
+		SnippetHighlightClose string `split_words:"true" default:"" desc:"advanced"`
+		// Searches in more than MaxSpaces spaces are rejected with
+		// status protocol.SearchStatusQueryError, since each space
+		// adds to the cost of the search. Zero disables the limit.
+		MaxSpaces int `split_words:"true" default:"64" desc:"advanced"`
+		// Responses to clients accepting compression are gzipped when
+		// larger than CompressThreshold bytes, zero disables compression.
+		// See protocol.AcceptEncodingHeader.
+		CompressThreshold int `split_words:"true" default:"16384" desc:"advanced"`
+		// Queries running longer than this are logged, zero disables logging
+		SlowQueryThreshold time.Duration `split_words:"true" default:"0" desc:"advanced"`
+		// Fraction of queries logged, from 0 to 1, for example 0.01 to
+		// log one query in a hundred. Slow queries, see SlowQueryThreshold,
+		// and failed queries are always logged, and are not counted as
+		// sampled. Sampled queries are logged at info level.
+		QueryLogSampling float64 `split_words:"true" default:"0" desc:"advanced"`
+		// Redact query phrases in logs
+		RedactQueries bool `split_words:"true" default:"false" desc:"advanced"`
+		// Pinned search snapshots are released after being unused for
+		// SnapshotTimeout. At most MaxSnapshots are kept open at once.
+		SnapshotTimeout time.Duration `split_words:"true" default:"1m" desc:"advanced"`
+		MaxSnapshots    int           `split_words:"true" default:"16" desc:"advanced"`
+		// At most MaxConcurrent searches run at once, with up to QueueSize
+		// searches waiting. Searches arriving to a full queue get a "busy"
+		// response, searches waiting longer than QueueTimeout time out.
+		// Zero MaxConcurrent and QueueSize use defaults of 4 * GOMAXPROCS
+		// and 2 * MaxConcurrent. Zero QueueTimeout disables the timeout.
+		MaxConcurrent int           `split_words:"true" default:"0" desc:"advanced"`
+		QueueSize     int           `split_words:"true" default:"0" desc:"advanced"`
+		QueueTimeout  time.Duration `split_words:"true" default:"1s" desc:"advanced"`
+		// Space searched by "lrcli search" when no space is given.
+		// Defaults to the only index space, when there is just one.
+		DefaultSpace string `split_words:"true"`
+		// Hits are boosted by their first match position, multiplying
+		// the rank by 1 + Weight * (1 - offset / Cutoff), where offset
+		// is the token offset of the first match in the matching column.
+		// Matches at Cutoff tokens or later are not boosted, zero Weight
+		// disables boosting. Boosting reads the first match position of
+		// every match up to the search cap. Search strategies producing
+		// text snippets read it anyway, other strategies and contentless
+		// and phonetic spaces get one extra index lookup per match.
+		PositionBoost struct {
+			Weight float64 `default:"0" desc:"advanced"`
+			Cutoff int     `default:"100" desc:"advanced"`
+		}
+		// Punctuation trimmed from the start and end of query words
+		// before parsing, see NormalizeQuery. Empty disables query
+		// normalization. Must not contain the query operators.
+		QueryTrim string `split_words:"true" default:".,;:!?()[]{}<>" desc:"advanced"`
+		// Spaces not searched, in addition to spaces with search disabled
+		// at runtime by protocol.SpaceControl. These can not be enabled
+		// at runtime. Indexing of the spaces continues.
+		DisabledSpaces []string `split_words:"true" desc:"advanced"`
 	}
 	Shard          string `default:"1/1"`
 	ShardgroupSize uint16 `ignored:"true"`
 	ShardIndex     uint16 `ignored:"true"`
 	CloningPort    uint16 `default:"8192"`
 	CloningHost    string
-	Profile        struct {
+	// The worker serves health checks and metrics over HTTP on
+	// ListenAddr, like ":8080", see StartHealthServer.
+	// Empty disables the health server.
+	Health struct {
+		ListenAddr string `split_words:"true" default:"" desc:"advanced"`
+	}
+	Profile struct {
 		HTTP  int    `desc:"internal"`
 		CPU   string `desc:"internal"`
 		Mem   string `desc:"internal"`
@@ -102,6 +383,27 @@ func LoadConfig() (cfg Config, err error) {
 		return
 	}
 
+	cfg.DB.JournalFallback = strings.ToUpper(cfg.DB.JournalFallback)
+	switch cfg.DB.JournalFallback {
+	case "", "DELETE", "TRUNCATE", "PERSIST":
+	default:
+		return Config{}, fmt.Errorf("unsupported journal fallback mode %q", cfg.DB.JournalFallback)
+	}
+
+	cfg.Search.Tiebreaker = strings.ToLower(cfg.Search.Tiebreaker)
+	switch cfg.Search.Tiebreaker {
+	case "docid", "none":
+	default:
+		return Config{}, fmt.Errorf("unsupported search tiebreaker %q", cfg.Search.Tiebreaker)
+	}
+
+	cfg.Search.StopwordQueries = strings.ToLower(cfg.Search.StopwordQueries)
+	switch cfg.Search.StopwordQueries {
+	case "empty", "raw":
+	default:
+		return Config{}, fmt.Errorf("unsupported stopword query handling %q", cfg.Search.StopwordQueries)
+	}
+
 	if len(cfg.Index.Spaces) < 1 {
 		return Config{}, fmt.Errorf("no spaces defined")
 	}
@@ -114,10 +416,118 @@ func LoadConfig() (cfg Config, err error) {
 		return Config{}, fmt.Errorf("space names must be unique")
 	}
 
+	for _, space := range cfg.Index.Contentless {
+		if _, found := unique[space]; !found {
+			return Config{}, fmt.Errorf("contentless space %q is not an index space", space)
+		}
+	}
+
+	for _, space := range cfg.Index.IntegerIDs {
+		if _, found := unique[space]; !found {
+			return Config{}, fmt.Errorf("integer ID space %q is not an index space", space)
+		}
+	}
+
+	for _, space := range cfg.Index.Phonetic {
+		if _, found := unique[space]; !found {
+			return Config{}, fmt.Errorf("phonetic space %q is not an index space", space)
+		}
+	}
+
+	for _, space := range cfg.Index.ExactCase {
+		if _, found := unique[space]; !found {
+			return Config{}, fmt.Errorf("exact case space %q is not an index space", space)
+		}
+	}
+
+	for space, maxDocs := range cfg.Index.MaxDocs {
+		if _, found := unique[space]; !found {
+			return Config{}, fmt.Errorf("max docs space %q is not an index space", space)
+		}
+		if maxDocs < 1 {
+			return Config{}, fmt.Errorf("max docs of space %q must be positive", space)
+		}
+	}
+
+	for space, priority := range cfg.Index.Priority {
+		if _, found := unique[space]; !found {
+			return Config{}, fmt.Errorf("priority space %q is not an index space", space)
+		}
+		if priority < 1 {
+			return Config{}, fmt.Errorf("priority of space %q must be positive", space)
+		}
+	}
+
+	for space, reqSize := range cfg.Index.SpaceReqSize {
+		if _, found := unique[space]; !found {
+			return Config{}, fmt.Errorf("request size space %q is not an index space", space)
+		}
+		if reqSize < 1 {
+			return Config{}, fmt.Errorf("request size of space %q must be positive", space)
+		}
+	}
+
+	if cfg.Index.CommitBatch.MinDocs > 1 && cfg.Index.CommitBatch.MaxLatency <= 0 {
+		return Config{}, fmt.Errorf("commit batch max latency must be positive")
+	}
+
+	if _, err := regexp.Compile(cfg.Index.IDNormalization.Pattern); err != nil {
+		return Config{}, fmt.Errorf("invalid ID normalization pattern: %w", err)
+	}
+
+	if cfg.Index.UpdateQueueSize < 1 {
+		return Config{}, fmt.Errorf("update queue size must be positive")
+	}
+
+	if cfg.Search.DefaultSpace != "" {
+		if _, found := unique[cfg.Search.DefaultSpace]; !found {
+			return Config{}, fmt.Errorf("default search space %q is not an index space", cfg.Search.DefaultSpace)
+		}
+	}
+
+	if cfg.Stemmer.MaxTokenLength < 0 || cfg.Stemmer.MaxTokenLength == 1 {
+		return Config{}, fmt.Errorf("max token length must be zero or at least 2")
+	}
+
+	if cfg.Search.EstimateCap < cfg.Search.Cap {
+		return Config{}, fmt.Errorf("search estimate cap must not be lower than the search cap")
+	}
+
+	if cfg.Search.SnippetWindow < 0 || cfg.Search.SnippetWindow > protocol.MaxSnippetWindow {
+		return Config{}, fmt.Errorf("snippet window must be between 0 and %d", protocol.MaxSnippetWindow)
+	}
+
+	if cfg.Search.QueryLogSampling < 0 || cfg.Search.QueryLogSampling > 1 {
+		return Config{}, fmt.Errorf("query log sampling must be between 0 and 1")
+	}
+
+	if cfg.Search.PositionBoost.Weight < 0 || cfg.Search.PositionBoost.Cutoff < 1 {
+		return Config{}, fmt.Errorf("position boost weight must not be negative, and cutoff must be positive")
+	}
+
+	if strings.ContainsAny(cfg.Search.QueryTrim, `-*"`) || strings.IndexFunc(cfg.Search.QueryTrim, unicode.IsSpace) >= 0 {
+		return Config{}, fmt.Errorf("query trim characters must not include operators, quotes or spaces")
+	}
+
+	for _, space := range cfg.Search.DisabledSpaces {
+		if _, found := unique[space]; !found {
+			return Config{}, fmt.Errorf("disabled search space %q is not an index space", space)
+		}
+	}
+
+	err = validateFieldParsing(cfg)
+	if err != nil {
+		return Config{}, err
+	}
+
 	if !validateIndexDurations(cfg) {
 		return Config{}, fmt.Errorf("invalid index timing settings")
 	}
 
+	if cfg.Search.SnapshotTimeout <= cfg.Search.Timeout {
+		return Config{}, fmt.Errorf("search snapshot timeout must be longer than search timeout")
+	}
+
 	group, size, err := parseShardString(cfg.Shard)
 	if err != nil {
 		return
@@ -129,10 +539,28 @@ func LoadConfig() (cfg Config, err error) {
 }
 
 func validateIndexDurations(cfg Config) bool {
-	return (cfg.Index.Wait.Interest > time.Millisecond*20 &&
-		cfg.Index.Wait.Cycle < cfg.Index.Wait.EmptyCycle &&
-		cfg.Index.Wait.Refetch > time.Millisecond*20 &&
-		cfg.Index.Wait.Refetch < cfg.Index.Wait.Document)
+	wait := cfg.Index.Wait
+	spaces := map[string]bool{}
+	for _, space := range cfg.Index.Spaces {
+		spaces[space] = true
+		if cfg.cycleWait(space) >= cfg.emptyCycleWait(space) {
+			return false
+		}
+	}
+	for space := range wait.SpaceCycle {
+		if !spaces[space] {
+			return false
+		}
+	}
+	for space := range wait.SpaceEmptyCycle {
+		if !spaces[space] {
+			return false
+		}
+	}
+	return (wait.Interest > time.Millisecond*20 &&
+		wait.Cycle < wait.EmptyCycle &&
+		wait.Refetch > time.Millisecond*20 &&
+		wait.Refetch < wait.Document)
 }
 
 var usageFormat = fmt.Sprintf(
@@ -167,3 +595,49 @@ func Usage(advanced bool) {
 	}
 	_ = envconfig.Usagef(prefix, &cfg, tabs, format)
 }
+
+// DefaultSearchSpace returns the configured default search space,
+// or the only index space when there is just one.
+func (cfg Config) DefaultSearchSpace() (string, error) {
+	if cfg.Search.DefaultSpace != "" {
+		return cfg.Search.DefaultSpace, nil
+	}
+	if len(cfg.Index.Spaces) == 1 {
+		return cfg.Index.Spaces[0], nil
+	}
+	return "", fmt.Errorf("no default search space configured for %d index spaces", len(cfg.Index.Spaces))
+}
+
+// cycleWait returns the cycle wait time for a space
+func (cfg Config) cycleWait(space string) time.Duration {
+	wait, found := cfg.Index.Wait.SpaceCycle[space]
+	if !found {
+		wait = cfg.Index.Wait.Cycle
+	}
+	return wait / time.Duration(cfg.priority(space))
+}
+
+// emptyCycleWait returns the empty cycle wait time for a space
+func (cfg Config) emptyCycleWait(space string) time.Duration {
+	wait, found := cfg.Index.Wait.SpaceEmptyCycle[space]
+	if !found {
+		wait = cfg.Index.Wait.EmptyCycle
+	}
+	return wait / time.Duration(cfg.priority(space))
+}
+
+// priority returns the indexing priority of a space
+func (cfg Config) priority(space string) int {
+	if priority, found := cfg.Index.Priority[space]; found && priority > 0 {
+		return priority
+	}
+	return 1
+}
+
+// reqSize returns the number of documents requested at a time for a space
+func (cfg Config) reqSize(space string) uint16 {
+	if size, found := cfg.Index.SpaceReqSize[space]; found && size > 0 {
+		return size
+	}
+	return cfg.Index.ReqSize
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"testing"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/xt"
+)
+
+func TestSpaceCycleWaits(t *testing.T) {
+	xt := xt.X(t)
+
+	t.Setenv("LETARETTE_INDEX_SPACES", "news,archive,blog")
+	t.Setenv("LETARETTE_INDEX_WAIT_SPACE_CYCLE", "archive:1s")
+	t.Setenv("LETARETTE_INDEX_WAIT_SPACE_EMPTY_CYCLE", "archive:20s")
+	t.Setenv("LETARETTE_INDEX_PRIORITY", "news:4,archive:2")
+	cfg, err := LoadConfig()
+	xt.Nilf(err, "Failed to load config: %v", err)
+
+	// Waits are divided by the priority of the space
+	xt.Equal(25*time.Millisecond, cfg.cycleWait("news"))
+	xt.Equal(1250*time.Millisecond, cfg.emptyCycleWait("news"))
+	xt.Equal(500*time.Millisecond, cfg.cycleWait("archive"))
+	xt.Equal(10*time.Second, cfg.emptyCycleWait("archive"))
+	xt.Equal(100*time.Millisecond, cfg.cycleWait("blog"))
+	xt.Equal(5*time.Second, cfg.emptyCycleWait("blog"))
+}
+
+func TestSpaceReqSize(t *testing.T) {
+	xt := xt.X(t)
+
+	t.Setenv("LETARETTE_INDEX_SPACES", "news,archive")
+	t.Setenv("LETARETTE_INDEX_REQSIZE", "20")
+	t.Setenv("LETARETTE_INDEX_SPACE_REQ_SIZE", "archive:200")
+	cfg, err := LoadConfig()
+	xt.Nilf(err, "Failed to load config: %v", err)
+
+	xt.Equal(uint16(20), cfg.reqSize("news"))
+	xt.Equal(uint16(200), cfg.reqSize("archive"))
+}
+
+func TestSpaceSchedulingConfig_Invalid(t *testing.T) {
+	for name, env := range map[string][2]string{
+		"unknown priority space":      {"LETARETTE_INDEX_PRIORITY", "other:2"},
+		"zero priority":               {"LETARETTE_INDEX_PRIORITY", "news:0"},
+		"negative priority":           {"LETARETTE_INDEX_PRIORITY", "news:-1"},
+		"unknown request size space":  {"LETARETTE_INDEX_SPACE_REQ_SIZE", "other:10"},
+		"zero request size":           {"LETARETTE_INDEX_SPACE_REQ_SIZE", "news:0"},
+		"unknown cycle space":         {"LETARETTE_INDEX_WAIT_SPACE_CYCLE", "other:1s"},
+		"unknown empty cycle space":   {"LETARETTE_INDEX_WAIT_SPACE_EMPTY_CYCLE", "other:1s"},
+		"cycle not below empty cycle": {"LETARETTE_INDEX_WAIT_SPACE_CYCLE", "news:10s"},
+		"empty cycle not above cycle": {"LETARETTE_INDEX_WAIT_SPACE_EMPTY_CYCLE", "news:50ms"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			xt := xt.X(t)
+			t.Setenv("LETARETTE_INDEX_SPACES", "news,archive")
+			t.Setenv(env[0], env[1])
+			_, err := LoadConfig()
+			xt.NotNilf(err, "Expected %s to be rejected", name)
+		})
+	}
+}
@@ -15,6 +15,7 @@
 package letarette
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	drv "database/sql/driver"
@@ -22,11 +23,14 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -56,6 +60,26 @@ const (
 	served
 )
 
+var interestStateNames = []string{"pending", "requested", "served"}
+
+func (state InterestState) String() string {
+	if int(state) < len(interestStateNames) {
+		return interestStateNames[state]
+	}
+	return fmt.Sprintf("InterestState(%d)", int(state))
+}
+
+// ParseInterestState parses the name of an interest state,
+// "pending", "requested" or "served".
+func ParseInterestState(name string) (InterestState, error) {
+	for state, stateName := range interestStateNames {
+		if name == stateName {
+			return InterestState(state), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown interest state %q", name)
+}
+
 // Interest represents one row in the interest list
 type Interest struct {
 	DocID   protocol.DocumentID `db:"docID"`
@@ -83,6 +107,7 @@ func (state InterestListState) createdAtTime() time.Time {
 type Database interface {
 	Close() error
 	RawQuery(q string, args ...interface{}) ([]string, error)
+	SafeRawQuery(q string, args ...interface{}) ([]string, error)
 	RawExec(q string, args ...interface{}) error
 }
 
@@ -90,26 +115,92 @@ type database struct {
 	rdb            *sqlx.DB
 	wdb            *sqlx.DB
 	resultCap      int
+	estimateCap    int
+	maxContentSize int
+	maxSnippets    int
+	snippetWindow  int
+	snippetOpen    string
+	snippetClose   string
+	positionWeight float64
+	positionCutoff int
 	searchStrategy int
-
-	addDocumentStatement    *sqlx.Stmt
-	updateInterestStatement *sqlx.Stmt
+	tiebreak       bool
+	rawStopwords   bool
+	invisible      *strings.Replacer
+	storedFields   map[string]bool
+	fieldParser    fieldParser
+	idNormalizer   idNormalizer
+	contentless    map[string]bool
+	// Spaces with search disabled by config, see Config.Search.DisabledSpaces
+	searchDisabled map[string]bool
+	// Spaces with integer document IDs, by spaceID.
+	// Reloads add spaces while indexing, see setIntegerIDs.
+	integerIDs     map[int]bool
+	integerIDsLock sync.RWMutex
+	// Set once all migrations are applied, see checkSchemaReady
+	schemaReady     int32
+	latestMigration uint
+	// WAL frames and checkpointed frames of the latest checkpoint,
+	// see checkpointWAL
+	walFrames       int64
+	walCheckpointed int64
+	stopMaintenance context.CancelFunc
+	maintenance     sync.WaitGroup
+	// Interest list entries updated within the window are requested first
+	priorityBoostWindow time.Duration
+	// Failed attempts before giving up on a document, see addDeadLetters
+	deadLetterAttempts int
+
+	addDocumentStatement     *sqlx.Stmt
+	updateInterestStatement  *sqlx.Stmt
+	clearDeadLetterStatement *sqlx.Stmt
 }
 
 // OpenDatabase connects to a new or existing database and
 // migrates the database up to the latest version.
 func OpenDatabase(cfg Config) (Database, error) {
 	registerCustomDriver(cfg)
-	rdb, wdb, err := openDatabase(cfg.DB.Path, cfg.Index.Spaces)
+	rdb, wdb, err := openDatabase(cfg.DB.Path, cfg.Index.Spaces, cfg.DB.JournalFallback, cfg.DB.MigrationWait)
 	if err != nil {
 		return nil, err
 	}
 
+	latestMigration, err := latestMigrationVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	contentless := map[string]bool{}
+	for _, space := range cfg.Index.Contentless {
+		contentless[space] = true
+	}
+
 	if !cfg.DB.ToolConnection {
+		err = setSpaceContentModes(wdb, cfg.Index.Spaces, contentless)
+		if err != nil {
+			return nil, err
+		}
+
+		err = applySpaceAddons(context.Background(), wdb, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		err = setSpaceIDTypes(wdb, cfg.Index.Spaces, cfg.Index.IntegerIDs)
+		if err != nil {
+			return nil, err
+		}
+
 		err = preloadDB(cfg.DB.Path)
 		if err != nil {
 			return nil, err
 		}
+	} else {
+		// Tool connections do not configure spaces
+		contentless, err = loadContentlessSpaces(rdb)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	var addDocumentSQL string
@@ -134,24 +225,85 @@ func OpenDatabase(cfg Config) (Database, error) {
 		return nil, fmt.Errorf("failed to prepare interest update statement: %w", err)
 	}
 
-	newDB := &database{
-		rdb:                     rdb,
-		wdb:                     wdb,
-		resultCap:               cfg.Search.Cap,
-		searchStrategy:          cfg.Search.Strategy,
-		addDocumentStatement:    addDocumentStatement,
-		updateInterestStatement: updateInterestStatement,
+	clearDeadLetterStatement, err := wdb.Preparex(clearDeadLetterSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare dead letter statement: %w", err)
+	}
+
+	newDB, err := newDatabase(cfg, rdb, wdb, contentless)
+	if err != nil {
+		return nil, err
+	}
+	newDB.addDocumentStatement = addDocumentStatement
+	newDB.updateInterestStatement = updateInterestStatement
+	newDB.clearDeadLetterStatement = clearDeadLetterStatement
+	newDB.latestMigration = latestMigration
+
+	if !cfg.DB.ToolConnection {
+		newDB.startMaintenance(cfg.DB.CheckpointInterval, cfg.DB.VacuumInterval, cfg.DB.VacuumPages)
 	}
 	return newDB, nil
 }
 
+// newDatabase creates a database using the settings of cfg,
+// without preparing statements or starting maintenance.
+func newDatabase(cfg Config, rdb, wdb *sqlx.DB, contentless map[string]bool) (*database, error) {
+	storedFields := map[string]bool{}
+	for _, field := range cfg.Index.StoredFields {
+		storedFields[field] = true
+	}
+
+	// Loaded from the database, since tool connections do
+	// not configure spaces.
+	var integerIDSpaces []int
+	err := rdb.Select(&integerIDSpaces, "select spaceID from spaces where integerIDs")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get space ID types: %w", err)
+	}
+	integerIDs := map[int]bool{}
+	for _, spaceID := range integerIDSpaces {
+		integerIDs[spaceID] = true
+	}
+
+	searchDisabled := map[string]bool{}
+	for _, space := range cfg.Search.DisabledSpaces {
+		searchDisabled[space] = true
+	}
+
+	return &database{
+		rdb:                 rdb,
+		wdb:                 wdb,
+		resultCap:           cfg.Search.Cap,
+		estimateCap:         cfg.Search.EstimateCap,
+		maxContentSize:      cfg.Search.MaxContentSize,
+		maxSnippets:         cfg.Search.MaxSnippets,
+		snippetWindow:       cfg.Search.SnippetWindow,
+		snippetOpen:         cfg.Search.SnippetHighlightOpen,
+		snippetClose:        cfg.Search.SnippetHighlightClose,
+		positionWeight:      cfg.Search.PositionBoost.Weight,
+		positionCutoff:      cfg.Search.PositionBoost.Cutoff,
+		searchStrategy:      cfg.Search.Strategy,
+		tiebreak:            cfg.Search.Tiebreaker != "none",
+		rawStopwords:        cfg.Search.StopwordQueries == "raw",
+		priorityBoostWindow: cfg.Index.PriorityBoostWindow,
+		deadLetterAttempts:  cfg.Index.DeadLetterAttempts,
+		storedFields:        storedFields,
+		fieldParser:         newFieldParser(cfg),
+		idNormalizer:        newIDNormalizer(cfg),
+		invisible:           newInvisibleStripper(cfg.Stemmer.InvisibleCharacters),
+		contentless:         contentless,
+		searchDisabled:      searchDisabled,
+		integerIDs:          integerIDs,
+	}, nil
+}
+
 // ResetMigration forces the migration version of a db.
 // It is typically used to back out of a failed migration.
 // Note: no migration steps are actually performed, it only
 // sets the version and resets the dirty flag.
 func ResetMigration(cfg Config, version int) error {
 	registerCustomDriver(cfg)
-	db, err := openMigrationConnection(cfg.DB.Path)
+	db, err := openMigrationConnection(cfg.DB.Path, cfg.DB.JournalFallback)
 	if err != nil {
 		return err
 	}
@@ -182,12 +334,24 @@ func multiError(message string, errorList []error) error {
 func (db *database) Close() error {
 	var errs []error
 
-	if err := db.addDocumentStatement.Close(); err != nil {
-		errs = append(errs, err)
+	if db.stopMaintenance != nil {
+		db.stopMaintenance()
+		db.maintenance.Wait()
 	}
 
-	if err := db.updateInterestStatement.Close(); err != nil {
-		errs = append(errs, err)
+	// Read-only databases have no writer, see openReadOnlyDatabase
+	if db.wdb != nil {
+		if err := db.addDocumentStatement.Close(); err != nil {
+			errs = append(errs, err)
+		}
+
+		if err := db.updateInterestStatement.Close(); err != nil {
+			errs = append(errs, err)
+		}
+
+		if err := db.clearDeadLetterStatement.Close(); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
 	logger.Debug.Printf("Closing database")
@@ -195,12 +359,14 @@ func (db *database) Close() error {
 		errs = append(errs, err)
 	}
 
-	if _, err := db.wdb.Exec("pragma wal_checkpoint(TRUNCATE);"); err != nil {
-		errs = append(errs, err)
-	}
+	if db.wdb != nil {
+		if _, err := db.wdb.Exec("pragma wal_checkpoint(TRUNCATE);"); err != nil {
+			errs = append(errs, err)
+		}
 
-	if err := db.wdb.Close(); err != nil {
-		errs = append(errs, err)
+		if err := db.wdb.Close(); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
 	if errs != nil {
@@ -217,14 +383,47 @@ func (db *database) RawExec(statement string, args ...interface{}) error {
 	return nil
 }
 
+// RawQuery runs any statement on the write connection, returning
+// the rows formatted as comma separated strings.
 func (db *database) RawQuery(statement string, args ...interface{}) ([]string, error) {
 	res, err := db.getRawDB().Queryx(statement, args...)
 	if err != nil {
 		return nil, err
 	}
+	return formatRawRows(res)
+}
+
+// SafeRawQuery is RawQuery for single read-only statements, run on the
+// read connection. Other statements, like ATTACH and pragma assignments,
+// are rejected with ErrNotReadOnly, see checkReadOnlySQL.
+func (db *database) SafeRawQuery(statement string, args ...interface{}) ([]string, error) {
+	err := checkReadOnlySQL(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	conn, err := db.rdb.Connx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = checkPreparedReadOnly(conn, statement)
+	if err != nil {
+		return nil, err
+	}
+	res, err := conn.QueryxContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	return formatRawRows(res)
+}
+
+func formatRawRows(res *sqlx.Rows) ([]string, error) {
 	defer res.Close()
 
-	err = res.Err()
+	err := res.Err()
 	if err != nil {
 		return nil, err
 	}
@@ -257,6 +456,12 @@ func (db *database) RawQuery(statement string, args ...interface{}) ([]string, e
 	return result, nil
 }
 
+// isStoredField returns true for fields usable by demotions and facets,
+// the configured stored fields and the document source and language.
+func (db *database) isStoredField(field string) bool {
+	return db.storedFields[field] || field == protocol.SourceField || field == protocol.LanguageField
+}
+
 func (db *database) getRawDB() *sqlx.DB {
 	return db.wdb
 }
@@ -267,10 +472,145 @@ func (db *database) getIndexID() (string, error) {
 	return indexID, err
 }
 
+// setSpaceContentModes stores the contentless setting for each space.
+// Changing the mode of a space that has documents is not allowed, since
+// the documents are indexed in different full text tables.
+func setSpaceContentModes(db *sqlx.DB, spaces []string, contentless map[string]bool) error {
+	for _, space := range spaces {
+		var state struct {
+			Contentless bool
+			Docs        int
+		}
+		err := db.Get(&state, `
+		select contentless, (select count(*) from docs where docs.spaceID = spaces.spaceID) as docs
+		from spaces where space = ?`, space)
+		if err != nil {
+			return fmt.Errorf("failed to get space content mode: %w", err)
+		}
+		if state.Contentless == contentless[space] {
+			continue
+		}
+		if state.Docs > 0 {
+			return fmt.Errorf("cannot change content mode of non-empty space %q", space)
+		}
+		_, err = db.Exec("update spaces set contentless = ? where space = ?", contentless[space], space)
+		if err != nil {
+			return fmt.Errorf("failed to set space content mode: %w", err)
+		}
+	}
+	return nil
+}
+
+// setSpaceIDTypes stores the document ID type of each space.
+// Changing the ID type of a space that has documents is not allowed,
+// since stored IDs are not converted.
+func setSpaceIDTypes(db *sqlx.DB, spaces []string, integerIDSpaces []string) error {
+	integerIDs := map[string]bool{}
+	for _, space := range integerIDSpaces {
+		integerIDs[space] = true
+	}
+	for _, space := range spaces {
+		var state struct {
+			IntegerIDs bool `db:"integerIDs"`
+			Docs       int
+		}
+		err := db.Get(&state, `
+		select integerIDs, (select count(*) from docs where docs.spaceID = spaces.spaceID) as docs
+		from spaces where space = ?`, space)
+		if err != nil {
+			return fmt.Errorf("failed to get space ID type: %w", err)
+		}
+		if state.IntegerIDs == integerIDs[space] {
+			continue
+		}
+		if state.Docs > 0 {
+			return fmt.Errorf("cannot change ID type of non-empty space %q", space)
+		}
+		_, err = db.Exec("update spaces set integerIDs = ? where space = ?", integerIDs[space], space)
+		if err != nil {
+			return fmt.Errorf("failed to set space ID type: %w", err)
+		}
+	}
+	return nil
+}
+
+// docIDValue returns the value used to store a document ID in a space,
+// an integer for integer ID spaces and the ID string otherwise.
+func (db *database) docIDValue(spaceID int, id protocol.DocumentID) (interface{}, error) {
+	db.integerIDsLock.RLock()
+	integerIDs := db.integerIDs[spaceID]
+	db.integerIDsLock.RUnlock()
+	if !integerIDs {
+		return id, nil
+	}
+	return id.Integer()
+}
+
+// setIntegerIDs marks a space created after opening the database
+// as using integer document IDs.
+func (db *database) setIntegerIDs(spaceID int) {
+	db.integerIDsLock.Lock()
+	defer db.integerIDsLock.Unlock()
+	db.integerIDs[spaceID] = true
+}
+
 //go:embed migrations
 var migrations embed.FS
 
-func initDB(db *sqlx.DB, spaces []string) error {
+// Poll interval when waiting for a migration by another worker
+const migrationPollInterval = 100 * time.Millisecond
+
+// latestMigrationVersion finds the version of the last embedded migration
+func latestMigrationVersion() (uint, error) {
+	sourceDriver, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		return 0, err
+	}
+	defer sourceDriver.Close()
+
+	version, err := sourceDriver.First()
+	for err == nil {
+		var next uint
+		next, err = sourceDriver.Next(version)
+		if err == nil {
+			version = next
+		}
+	}
+	// The source driver returns ErrNotExist after the last migration
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	return version, nil
+}
+
+// checkSchemaReady reports whether all migrations are applied and the
+// full text index exists. Databases shared by workers can be opened by
+// one worker while another is migrating. Once ready, the schema is not
+// checked again.
+func (db *database) checkSchemaReady(ctx context.Context) bool {
+	if atomic.LoadInt32(&db.schemaReady) == 1 {
+		return true
+	}
+
+	var state struct {
+		Version uint
+		Dirty   bool
+	}
+	err := db.rdb.GetContext(ctx, &state, `select version, dirty from schema_migrations`)
+	if err != nil || state.Dirty || state.Version < db.latestMigration {
+		return false
+	}
+	var tables int
+	err = db.rdb.GetContext(ctx, &tables, `select count(*) from sqlite_master where type = 'table' and name = 'fts'`)
+	if err != nil || tables == 0 {
+		return false
+	}
+
+	atomic.StoreInt32(&db.schemaReady, 1)
+	return true
+}
+
+func initDB(db *sqlx.DB, spaces []string, migrationWait time.Duration) error {
 	sourceDriver, err := iofs.New(migrations, "migrations")
 	if err != nil {
 		return err
@@ -291,6 +631,20 @@ func initDB(db *sqlx.DB, spaces []string) error {
 		return err
 	}
 
+	// A dirty migration is either running in another worker,
+	// or has failed
+	deadline := time.Now().Add(migrationWait)
+	if dirty && migrationWait > 0 {
+		logger.Info.Printf("Waiting for migration at level %v to finish", version)
+	}
+	for dirty && time.Now().Before(deadline) {
+		time.Sleep(migrationPollInterval)
+		version, dirty, err = m.Version()
+		if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+			return err
+		}
+	}
+
 	if dirty {
 		return fmt.Errorf("database has a dirty migration at level %v", version)
 	}
@@ -368,18 +722,21 @@ const driver = "sqlite3_letarette"
 
 func registerCustomDriver(cfg Config) {
 	drivers := sql.Drivers()
-	if sort.Search(len(drivers), func(i int) bool { return drivers[i] == driver }) == len(drivers) {
+	if i := sort.SearchStrings(drivers, driver); i == len(drivers) || drivers[i] != driver {
 		logger.Debug.Printf("Registering %q driver", driver)
 		sql.Register(driver,
 			&sqlite3.SQLiteDriver{
 				ConnectHook: func(conn *sqlite3.SQLiteConn) error {
 					logger.Debug.Printf("Initializing snowball stemmer")
 					err := snowball.Init(conn, snowball.Settings{
-						Stemmers:         cfg.Stemmer.Languages,
-						RemoveDiacritics: cfg.Stemmer.RemoveDiacritics,
-						TokenCharacters:  cfg.Stemmer.TokenCharacters,
-						Separators:       cfg.Stemmer.Separators,
-						MinTokenLength:   2,
+						Stemmers:           cfg.Stemmer.Languages,
+						RemoveDiacritics:   cfg.Stemmer.RemoveDiacritics,
+						TokenCharacters:    cfg.Stemmer.TokenCharacters,
+						Separators:         cfg.Stemmer.Separators,
+						MinTokenLength:     2,
+						MaxTokenLength:     cfg.Stemmer.MaxTokenLength,
+						TruncateLongTokens: cfg.Stemmer.TruncateLongTokens,
+						StopWords:          cfg.Stemmer.StopWords,
 					})
 					if err != nil {
 						return err
@@ -403,6 +760,12 @@ func registerCustomDriver(cfg Config) {
 						return err
 					}
 
+					logger.Debug.Printf("Initializing ranking functions")
+					err = registerRankingFunctions(conn)
+					if err != nil {
+						return err
+					}
+
 					logger.Debug.Printf("Setting up pragmas")
 					pragmas := []string{
 						"pragma threads=4",
@@ -430,7 +793,10 @@ const (
 	readWrite connectionMode = false
 )
 
-func getDatabaseURL(dbPath string, mode connectionMode) (string, error) {
+// WAL journaling is used unless not supported, see Config.DB.JournalFallback
+const walJournal = "WAL"
+
+func getDatabaseURL(dbPath string, mode connectionMode, journal string) (string, error) {
 	abspath, err := filepath.Abs(dbPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to get absolute path to DB: %w", err)
@@ -438,7 +804,7 @@ func getDatabaseURL(dbPath string, mode connectionMode) (string, error) {
 	escapedPath := strings.Replace(abspath, " ", "%20", -1)
 
 	args := []string{
-		"_journal=WAL",
+		"_journal=" + journal,
 		"_foreign_keys=true",
 		"_timeout=500",
 		"cache=private",
@@ -459,30 +825,60 @@ func getDatabaseURL(dbPath string, mode connectionMode) (string, error) {
 	return fmt.Sprintf("file:%s?%s", escapedPath, strings.Join(args, "&")), nil
 }
 
-func openMigrationConnection(dbPath string) (db *sqlx.DB, err error) {
-	url, err := getDatabaseURL(dbPath, readWrite)
+func openMigrationConnection(dbPath string, journalFallback string) (db *sqlx.DB, err error) {
+	db, _, err = connectWriter(dbPath, journalFallback)
+	return
+}
+
+// connectWriter opens a read-write connection using WAL journaling,
+// or using the fallback journal mode, if given, when WAL can not be
+// enabled. Returns the journal mode used.
+func connectWriter(dbPath string, journalFallback string) (*sqlx.DB, string, error) {
+	url, err := getDatabaseURL(dbPath, readWrite, walJournal)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	db, err := sqlx.Connect(driver, url)
+	if err == nil {
+		// Setting the journal mode fails silently on some filesystems
+		var journal string
+		err = db.Get(&journal, "pragma journal_mode")
+		if err == nil && !strings.EqualFold(journal, walJournal) {
+			err = fmt.Errorf("journal mode is %q", journal)
+		}
+		if err != nil {
+			_ = db.Close()
+		}
+	}
+	if err == nil {
+		return db, walJournal, nil
+	}
+	if journalFallback == "" {
+		return nil, "", fmt.Errorf("failed to enable WAL journaling, see LETARETTE_DB_JOURNAL_FALLBACK: %w", err)
+	}
+
+	logger.Warning.Printf("Failed to enable WAL journaling, using %s journaling: %v", journalFallback, err)
+	url, err = getDatabaseURL(dbPath, readWrite, journalFallback)
+	if err != nil {
+		return nil, "", err
 	}
 	db, err = sqlx.Connect(driver, url)
-	return
+	return db, journalFallback, err
 }
 
-func openDatabase(dbPath string, spaces []string) (rdb *sqlx.DB, wdb *sqlx.DB, err error) {
+func openDatabase(
+	dbPath string, spaces []string, journalFallback string, migrationWait time.Duration,
+) (rdb *sqlx.DB, wdb *sqlx.DB, err error) {
 
 	// Only one writer
-	writeSqliteURL, err := getDatabaseURL(dbPath, readWrite)
-	if err != nil {
-		return nil, nil, err
-	}
-	wdb, err = sqlx.Connect(driver, writeSqliteURL)
+	wdb, journal, err := connectWriter(dbPath, journalFallback)
 	if err != nil {
 		return
 	}
 	wdb.SetMaxOpenConns(1)
 
 	// Multiple readers
-	readSqliteURL, err := getDatabaseURL(dbPath, readOnly)
+	readSqliteURL, err := getDatabaseURL(dbPath, readOnly, journal)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -493,7 +889,7 @@ func openDatabase(dbPath string, spaces []string) (rdb *sqlx.DB, wdb *sqlx.DB, e
 	rdb.SetMaxOpenConns(0)
 	rdb.SetMaxIdleConns(8)
 
-	err = initDB(wdb, spaces)
+	err = initDB(wdb, spaces, migrationWait)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,295 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// DeadLetter is a document that failed to be indexed.
+// Dead letters of the same non-zero Unit are the documents of
+// a multi-space update, retried together.
+type DeadLetter struct {
+	Space    string
+	ID       protocol.DocumentID
+	Error    string
+	Attempts int
+	Failed   time.Time
+	Unit     int
+	Document protocol.Document
+}
+
+const addDeadLetterSQL = `
+insert into deadletters (spaceID, docID, document, error, failed, unit)
+values (:spaceID, :docID, :document, :error, :failed, :unit)
+on conflict (spaceID, docID) do update set
+    document = excluded.document,
+    error = excluded.error,
+    failed = excluded.failed,
+    unit = excluded.unit,
+    attempts = attempts + 1
+`
+
+// Documents indexed successfully are no longer dead
+const clearDeadLetterSQL = `
+delete from deadletters where spaceID = :spaceID and docID = :docID
+`
+
+// addDeadLetters stores the documents of a failed update as dead letters,
+// counting the attempts for documents failing repeatedly. The documents
+// of an update spanning several spaces are stored as one unit.
+//
+// Documents that have failed deadLetterAttempts times are given up on,
+// and marked as served in the interest list, to not hold up the update
+// cycle waiting for them. Until then, they are requested again like
+// other documents not served. Returns the number of documents given up on.
+func (db *database) addDeadLetters(ctx context.Context, updates []protocol.DocumentUpdate, cause error) (int, error) {
+	maxAttempts := db.deadLetterAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	tx, err := db.wdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	unit := 0
+	if updateSpaces(updates) > 1 {
+		err = tx.GetContext(ctx, &unit, `select ifnull(max(unit), 0) + 1 from deadletters`)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	givenUp := 0
+	for _, update := range updates {
+		if len(update.Documents) == 0 {
+			continue
+		}
+		spaceID, err := db.getSpaceID(ctx, update.Space)
+		if err != nil {
+			return 0, err
+		}
+		for _, doc := range update.Documents {
+			doc.ID = db.idNormalizer.normalize(doc.ID)
+			document, err := json.Marshal(doc)
+			if err != nil {
+				return 0, fmt.Errorf("failed to encode dead letter: %w", err)
+			}
+
+			_, err = tx.ExecContext(ctx, addDeadLetterSQL,
+				sql.Named("spaceID", spaceID),
+				sql.Named("docID", doc.ID),
+				sql.Named("document", string(document)),
+				sql.Named("error", cause.Error()),
+				sql.Named("failed", time.Now().UnixNano()),
+				sql.Named("unit", unit),
+			)
+			if err != nil {
+				return 0, fmt.Errorf("failed to store dead letter: %w", err)
+			}
+
+			var attempts int
+			err = tx.GetContext(ctx, &attempts,
+				`select attempts from deadletters where spaceID = ? and docID = ?`, spaceID, doc.ID)
+			if err != nil {
+				return 0, err
+			}
+			if attempts < maxAttempts {
+				continue
+			}
+			if attempts == maxAttempts {
+				givenUp++
+			}
+
+			// Documents with invalid IDs are not in the interest list
+			if docID, err := db.docIDValue(spaceID, doc.ID); err == nil {
+				_, err = tx.StmtxContext(ctx, db.updateInterestStatement).ExecContext(
+					ctx,
+					sql.Named("state", served),
+					sql.Named("spaceID", spaceID),
+					sql.Named("docID", docID),
+				)
+				if err != nil {
+					return 0, fmt.Errorf("failed to update interest list: %w", err)
+				}
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	tx = nil
+	metrics.DeadLetters.Add(int64(givenUp))
+	return givenUp, nil
+}
+
+// updateSpaces counts the spaces with documents in an update
+func updateSpaces(updates []protocol.DocumentUpdate) int {
+	spaces := map[string]bool{}
+	for _, update := range updates {
+		if len(update.Documents) > 0 {
+			spaces[update.Space] = true
+		}
+	}
+	return len(spaces)
+}
+
+// getDeadLetters lists dead letters in a space, or in all spaces
+// when space is empty, oldest failures first.
+func (db *database) getDeadLetters(ctx context.Context, space string) ([]DeadLetter, error) {
+	var rows []struct {
+		Space    string
+		DocID    string `db:"docID"`
+		Document string
+		Error    string
+		Attempts int
+		Failed   int64
+		Unit     int
+	}
+	err := db.rdb.SelectContext(ctx, &rows, `
+		select space, docID, document, error, attempts, failed, unit
+		from deadletters join spaces using(spaceID)
+		where ? = '' or space = ?
+		order by failed
+		`, space, space)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, len(rows))
+	for i, row := range rows {
+		letters[i] = DeadLetter{
+			Space:    row.Space,
+			ID:       protocol.DocumentID(row.DocID),
+			Error:    row.Error,
+			Attempts: row.Attempts,
+			Failed:   time.Unix(0, row.Failed),
+			Unit:     row.Unit,
+		}
+		err = json.Unmarshal([]byte(row.Document), &letters[i].Document)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode dead letter %q: %w", row.DocID, err)
+		}
+	}
+	return letters, nil
+}
+
+// addFailedUpdate handles an update that failed to be indexed as a whole,
+// returning the number of documents failing. Documents of single space
+// updates are indexed again one by one, storing those failing as dead
+// letters. Updates spanning several spaces are stored as dead letters
+// as a whole, since indexing part of them would break their atomicity,
+// see addMultiSpaceDocumentUpdates.
+func (db *database) addFailedUpdate(ctx context.Context, updates []protocol.DocumentUpdate, cause error) int {
+	if updateSpaces(updates) <= 1 {
+		return db.addDocumentsSeparately(ctx, updates)
+	}
+	logger.Warning.Printf("Failed to index multi-space update: %v", cause)
+	_, err := db.addDeadLetters(ctx, updates, cause)
+	if err != nil {
+		logger.Error.Printf("Failed to store dead letters: %v", err)
+	}
+	failed := 0
+	for _, update := range updates {
+		failed += len(update.Documents)
+	}
+	return failed
+}
+
+// addDocumentsSeparately indexes documents one by one, storing
+// those failing as dead letters. Used when a batch of documents
+// fails to be indexed as a whole, to find the failing documents.
+func (db *database) addDocumentsSeparately(ctx context.Context, updates []protocol.DocumentUpdate) (failed int) {
+	for _, update := range updates {
+		for _, doc := range update.Documents {
+			err := db.addDocumentUpdates(ctx, update.Space, []protocol.Document{doc})
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			failed++
+			logger.Warning.Printf("Failed to index document %q in space %q: %v", doc.ID, update.Space, err)
+			_, err = db.addDeadLetters(ctx, []protocol.DocumentUpdate{
+				{Space: update.Space, Documents: []protocol.Document{doc}},
+			}, err)
+			if err != nil {
+				logger.Error.Printf("Failed to store dead letter: %v", err)
+			}
+		}
+	}
+	return failed
+}
+
+// retryDeadLetters tries to index dead letters in a space, or in all
+// spaces when space is empty. Documents indexed successfully are removed
+// from the dead letters, the others have their attempts counted.
+// Dead letters of a multi-space update are retried as one update.
+func (db *database) retryDeadLetters(ctx context.Context, space string) (indexed int, failed int, err error) {
+	letters, err := db.getDeadLetters(ctx, space)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var units []int
+	unitUpdates := map[int][]protocol.DocumentUpdate{}
+	for _, letter := range letters {
+		unit := letter.Unit
+		if unit == 0 {
+			// Failed on its own, retried on its own
+			unit = -len(units) - 1
+		}
+		if _, found := unitUpdates[unit]; !found {
+			units = append(units, unit)
+		}
+		unitUpdates[unit] = append(unitUpdates[unit], protocol.DocumentUpdate{
+			Space: letter.Space, Documents: []protocol.Document{letter.Document},
+		})
+	}
+
+	for _, unit := range units {
+		update := unitUpdates[unit]
+		unitFailed := 0
+		if unit < 0 {
+			unitFailed = db.addDocumentsSeparately(ctx, update)
+		} else if err := db.addMultiSpaceDocumentUpdates(ctx, update); err != nil && ctx.Err() == nil {
+			unitFailed = len(update)
+			_, err = db.addDeadLetters(ctx, update, err)
+			if err != nil {
+				return indexed, failed, err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return indexed, failed, err
+		}
+		failed += unitFailed
+		indexed += len(update) - unitFailed
+	}
+	return indexed, failed, nil
+}
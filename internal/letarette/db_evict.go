@@ -0,0 +1,101 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// evictDocuments deletes the least recently updated documents of a space
+// beyond the max document count, in batches. The IDs of evicted documents
+// are passed to the evicted callback, for cache invalidation.
+// Returns the number of evicted documents.
+func (db *database) evictDocuments(
+	ctx context.Context, space string, maxDocs int, evicted func([]protocol.DocumentID),
+) (int, error) {
+	spaceID, err := db.getSpaceID(ctx, space)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = db.rdb.GetContext(ctx, &count, `select count(*) from docs where spaceID = ?`, spaceID)
+	if err != nil || count <= maxDocs {
+		return 0, err
+	}
+
+	total := 0
+	for total < count-maxDocs {
+		docs, err := db.evictBatch(ctx, spaceID, maxDocs)
+		if err != nil {
+			return total, fmt.Errorf("failed to evict documents: %w", err)
+		}
+		if len(docs) == 0 {
+			break
+		}
+		total += len(docs)
+		evicted(docs)
+	}
+	return total, nil
+}
+
+func (db *database) evictBatch(ctx context.Context, spaceID int, maxDocs int) ([]protocol.DocumentID, error) {
+	tx, err := db.wdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var docs []struct {
+		ID    int64
+		DocID protocol.DocumentID `db:"docID"`
+	}
+	err = tx.SelectContext(ctx, &docs, `
+		select id, docID from docs
+		where spaceID = ?
+		order by updatedNanos desc, id desc
+		limit ? offset ?
+		`, spaceID, purgeBatchSize, maxDocs)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+
+	ids := make([]protocol.DocumentID, len(docs))
+	for i, doc := range docs {
+		_, err = tx.ExecContext(ctx, `delete from docs where id = ?`, doc.ID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, `delete from docfields where spaceID = ? and docID = ?`, spaceID, doc.DocID)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = doc.DocID
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	tx = nil
+	return ids, nil
+}
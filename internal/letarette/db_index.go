@@ -22,7 +22,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+
 	"github.com/erkkah/letarette/internal/snowball"
+	"github.com/erkkah/letarette/pkg/logger"
 	"github.com/erkkah/letarette/pkg/protocol"
 )
 
@@ -39,26 +42,44 @@ func (db *database) getDocumentCount(ctx context.Context) (uint64, error) {
 	return count, err
 }
 
-var addCompressedDocumentSQL = `
-replace into docs (spaceID, docID, updatedNanos, title, txt, alive)
-values (:spaceID, :docID, :updated, :title, compress(:txt), :alive);
+// Documents are only replaced by updates with the same or higher version,
+// stale updates affect no rows.
+const staleVersionCondition = `
+where not exists (select 1 from docs where spaceID = :spaceID and docID = :docID and version > :version)
 `
 
+var addCompressedDocumentSQL = `
+replace into docs (spaceID, docID, updatedNanos, title, txt, alive, source, language, version, boost)
+select :spaceID, :docID, :updated, :title, compress(:txt), :alive, :source, :language, :version, :boost
+` + staleVersionCondition
+
 var addUncompressedDocumentSQL = `
-replace into docs (spaceID, docID, updatedNanos, title, txt, alive)
-values (:spaceID, :docID, :updated, :title, :txt, :alive);
-`
+replace into docs (spaceID, docID, updatedNanos, title, txt, alive, source, language, version, boost)
+select :spaceID, :docID, :updated, :title, :txt, :alive, :source, :language, :version, :boost
+` + staleVersionCondition
+
+// Contentless documents get ids above all ids used in the contentless
+// index, since index entries of replaced documents are never removed.
+var addContentlessDocumentSQL = `
+replace into docs (id, spaceID, docID, updatedNanos, title, txt, alive, source, language, version, boost)
+select
+	max(ifnull((select max(id) from docs), 0), ifnull((select max(rowid) from ftsc), 0)) + 1,
+	:spaceID, :docID, :updated, '', '', :alive, :source, :language, :version, :boost
+` + staleVersionCondition
 
 var updateInterestSQL = `
 update interest set state=:state where spaceID=:spaceID and docID=:docID
 `
 
 func (db *database) addDocumentUpdates(ctx context.Context, space string, docs []protocol.Document) error {
-	spaceID, err := db.getSpaceID(ctx, space)
-	if err != nil {
-		return err
-	}
+	return db.addMultiSpaceDocumentUpdates(ctx, []protocol.DocumentUpdate{
+		{Space: space, Documents: docs},
+	})
+}
 
+// addMultiSpaceDocumentUpdates applies updates for any number of spaces
+// in one transaction, making all of them visible to searches at once.
+func (db *database) addMultiSpaceDocumentUpdates(ctx context.Context, updates []protocol.DocumentUpdate) error {
 	tx, err := db.wdb.BeginTxx(ctx, nil)
 	if err != nil {
 		return err
@@ -70,53 +91,231 @@ func (db *database) addDocumentUpdates(ctx context.Context, space string, docs [
 		}
 	}()
 
+	for _, update := range updates {
+		spaceID, err := db.getSpaceID(ctx, update.Space)
+		if err != nil {
+			return err
+		}
+		err = db.addDocumentsTx(ctx, tx, spaceID, update.Documents)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		tx = nil
+	}
+
+	return err
+}
+
+func (db *database) addDocumentsTx(ctx context.Context, tx *sqlx.Tx, spaceID int, docs []protocol.Document) error {
+	mode, err := getSpaceModeTx(ctx, tx, spaceID)
+	if err != nil {
+		return err
+	}
+
 	docsStatement := tx.StmtxContext(ctx, db.addDocumentStatement)
 	interestStatement := tx.StmtxContext(ctx, db.updateInterestStatement)
+	deadLetterStatement := tx.StmtxContext(ctx, db.clearDeadLetterStatement)
 
 	for _, doc := range docs {
-		txt := ""
-		title := ""
-		if doc.Alive {
-			txt = doc.Text
-			title = doc.Title
+		doc.ID = db.idNormalizer.normalize(doc.ID)
+		err = db.addDocumentTx(ctx, tx, docsStatement, spaceID, mode, doc)
+		if err != nil {
+			return err
 		}
 
-		res, err := docsStatement.ExecContext(
+		docID, err := db.docIDValue(spaceID, doc.ID)
+		if err != nil {
+			return err
+		}
+		_, err = interestStatement.ExecContext(
 			ctx,
+			sql.Named("state", served),
 			sql.Named("spaceID", spaceID),
-			sql.Named("docID", doc.ID),
-			sql.Named("updated", doc.Updated.UnixNano()),
-			sql.Named("title", title),
-			sql.Named("txt", txt),
-			sql.Named("alive", doc.Alive),
+			sql.Named("docID", docID),
 		)
 
 		if err != nil {
-			return fmt.Errorf("failed to update doc: %w", err)
-		}
-
-		updatedRows, _ := res.RowsAffected()
-		if updatedRows != 1 {
-			return fmt.Errorf("failed to update index, no rows affected")
+			return fmt.Errorf("failed to update interest list: %w", err)
 		}
 
-		_, err = interestStatement.ExecContext(
+		_, err = deadLetterStatement.ExecContext(
 			ctx,
-			sql.Named("state", served),
 			sql.Named("spaceID", spaceID),
 			sql.Named("docID", doc.ID),
 		)
+		if err != nil {
+			return fmt.Errorf("failed to clear dead letter: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// spaceMode holds the space settings affecting how documents are indexed
+type spaceMode struct {
+	Contentless bool
+	Phonetic    bool
+	ExactCase   bool `db:"exactCase"`
+}
 
+// documentBoost returns the stored boost of a document,
+// clamping boosts to the valid range.
+func documentBoost(boost float32) float64 {
+	switch {
+	case boost <= 0:
+		return 1
+	case boost < protocol.MinBoost:
+		return protocol.MinBoost
+	case boost > protocol.MaxBoost:
+		return protocol.MaxBoost
+	}
+	return float64(boost)
+}
+
+func getSpaceModeTx(ctx context.Context, tx *sqlx.Tx, spaceID int) (spaceMode, error) {
+	var mode spaceMode
+	err := tx.GetContext(ctx, &mode, "select contentless, phonetic, exactCase from spaces where spaceID = ?", spaceID)
+	if err != nil {
+		return mode, fmt.Errorf("failed to get space content mode: %w", err)
+	}
+	return mode, nil
+}
+
+// addDocumentTx stores a single document and its fields, using the
+// provided document statement for spaces that store content.
+func (db *database) addDocumentTx(
+	ctx context.Context, tx *sqlx.Tx, docsStatement *sqlx.Stmt,
+	spaceID int, mode spaceMode, doc protocol.Document,
+) error {
+	txt := ""
+	title := ""
+	source := ""
+	language := ""
+	if doc.Alive {
+		txt = db.invisible.Replace(doc.Text)
+		title = db.invisible.Replace(doc.Title)
+		source = doc.Source
+		language = doc.Language
+	}
+
+	docID, err := db.docIDValue(spaceID, doc.ID)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{
+		sql.Named("spaceID", spaceID),
+		sql.Named("docID", docID),
+		sql.Named("updated", doc.Updated.UnixNano()),
+		sql.Named("title", title),
+		sql.Named("txt", txt),
+		sql.Named("alive", doc.Alive),
+		sql.Named("source", source),
+		sql.Named("language", language),
+		sql.Named("version", int64(doc.Version)),
+		sql.Named("boost", documentBoost(doc.Boost)),
+	}
+
+	var res sql.Result
+	if mode.Contentless {
+		// Title and text are not stored
+		contentlessArgs := append(args[:3:3], args[5:]...)
+		res, err = tx.ExecContext(ctx, addContentlessDocumentSQL, contentlessArgs...)
+	} else {
+		res, err = docsStatement.ExecContext(ctx, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to update doc: %w", err)
+	}
+
+	updatedRows, _ := res.RowsAffected()
+	if updatedRows == 0 {
+		// A newer version is already stored
+		metrics.StaleUpdates.Add(1)
+		logger.Debug.Printf("Ignoring stale update of document %q, version %d", doc.ID, doc.Version)
+		return nil
+	}
+	if updatedRows != 1 {
+		return fmt.Errorf("failed to update index, %d rows affected", updatedRows)
+	}
+
+	if mode.Contentless && doc.Alive {
+		rowID, err := res.LastInsertId()
 		if err != nil {
-			return fmt.Errorf("failed to update interest list: %w", err)
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "insert into ftsc(rowid, title, txt) values (?, ?, ?)", rowID, title, txt)
+		if err != nil {
+			return fmt.Errorf("failed to index contentless doc: %w", err)
 		}
 	}
-	err = tx.Commit()
-	if err == nil {
-		tx = nil
+
+	if mode.Phonetic && doc.Alive {
+		codes := phoneticCodes(title + " " + txt)
+		if codes != "" {
+			rowID, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "insert into ftsp(rowid, codes) values (?, ?)", rowID, codes)
+			if err != nil {
+				return fmt.Errorf("failed to index phonetic codes: %w", err)
+			}
+		}
 	}
 
-	return err
+	if mode.ExactCase && doc.Alive {
+		words := exactCaseWords(title + " " + txt)
+		if words != "" {
+			rowID, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "insert into ftse(rowid, words) values (?, ?)", rowID, words)
+			if err != nil {
+				return fmt.Errorf("failed to index exact case words: %w", err)
+			}
+		}
+	}
+
+	return db.storeDocumentFieldsTx(ctx, tx, spaceID, doc)
+}
+
+func (db *database) storeDocumentFieldsTx(ctx context.Context, tx *sqlx.Tx, spaceID int, doc protocol.Document) error {
+	_, err := tx.ExecContext(ctx, "delete from docfields where spaceID = ? and docID = ?", spaceID, doc.ID)
+	if err != nil {
+		return fmt.Errorf("failed to clear doc fields: %w", err)
+	}
+	if !doc.Alive {
+		return nil
+	}
+
+	for field, value := range doc.Fields {
+		if !db.storedFields[field] {
+			continue
+		}
+		// Unparseable values are stored without a typed value,
+		// and are left out of range filtering.
+		typed, err := db.fieldParser.parse(field, value)
+		if err != nil {
+			metrics.FieldParseErrors.Add(1)
+			logger.Warning.Printf("Failed to parse field %q of document %q: %v", field, doc.ID, err)
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			"insert into docfields (spaceID, docID, field, value, num) values (?, ?, ?, ?, ?)",
+			spaceID, doc.ID, field, value, typed,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to store doc field: %w", err)
+		}
+	}
+	return nil
 }
 
 func (db *database) commitInterestList(ctx context.Context, space string) error {
@@ -136,17 +335,19 @@ func (db *database) commitInterestList(ctx context.Context, space string) error
 		DocID   protocol.DocumentID `db:"docID"`
 	}
 
+	// The position is the last served entry of the interest list, in
+	// document manager order, using the update time of the list entry.
+	// Documents sharing update times are only ordered by the document
+	// manager, and stored documents may have been updated since listed.
+	// The position never moves back in time, which it would when the
+	// list was fetched from before the position to handle clock skew.
 	err = tx.GetContext(ctx, &indexPosition, `
-		with listState as (
-			select listCreatedAtNanos from spaces where space = ?
-		)
-		select docs.updatedNanos, docs.docID
-		from
-		interest
-		left join docs using(docID)
-		cross join listState
-		where interest.state = ? and docs.updatedNanos <= listState.listCreatedAtNanos
-		order by docs.updatedNanos desc, docs.docID desc
+		select interest.updatedNanos, interest.docID
+		from interest join spaces using(spaceID)
+		where spaces.space = ? and interest.state = ?
+		and interest.updatedNanos <= spaces.listCreatedAtNanos
+		and interest.updatedNanos >= spaces.lastUpdatedAtNanos
+		order by interest.rowid desc
 		limit 1;`, space, served)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -200,8 +401,9 @@ func (db *database) getInterestList(ctx context.Context, space string) (result [
 	}
 	rows, err := db.rdb.QueryxContext(ctx,
 		`
-		select docID, state from interest
+		select docID, state, updatedNanos from interest
 		where spaceID = ?
+		order by priority desc, rowid
 		`, spaceID)
 	if err != nil {
 		return
@@ -252,17 +454,111 @@ func (db *database) fakeServeRequested(ctx context.Context, space string) error
 	return err
 }
 
+// deleteDocuments replaces existing live documents by dead documents,
+// removing them from the index. Returns the number of documents deleted.
+//
+// Dead documents keep their row, updated at the time of deletion, so they
+// are not requested again until listed with a later update time.
+// The stored version is kept, letting later provider updates through.
+func (db *database) deleteDocuments(ctx context.Context, space string, ids []protocol.DocumentID) (int, error) {
+	spaceID, err := db.getSpaceID(ctx, space)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var dead []protocol.Document
+	for _, id := range ids {
+		id = db.idNormalizer.normalize(id)
+		docID, err := db.docIDValue(spaceID, id)
+		if err != nil {
+			return 0, err
+		}
+		var versions []int64
+		err = db.rdb.SelectContext(
+			ctx, &versions,
+			"select version from docs where spaceID = ? and docID = ? and alive", spaceID, docID,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up doc: %w", err)
+		}
+		for _, version := range versions {
+			dead = append(dead, protocol.Document{ID: id, Updated: now, Version: uint64(version)})
+		}
+	}
+
+	if len(dead) == 0 {
+		return 0, nil
+	}
+	err = db.addDocumentUpdates(ctx, space, dead)
+	if err != nil {
+		return 0, err
+	}
+	return len(dead), nil
+}
+
+// touchDocuments sets the update time of existing documents,
+// returning the number of documents touched.
+func (db *database) touchDocuments(
+	ctx context.Context, space string, ids []protocol.DocumentID, updated time.Time,
+) (int, error) {
+	spaceID, err := db.getSpaceID(ctx, space)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.wdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	touched := 0
+	for _, id := range ids {
+		docID, err := db.docIDValue(spaceID, db.idNormalizer.normalize(id))
+		if err != nil {
+			return 0, err
+		}
+		res, err := tx.ExecContext(
+			ctx,
+			"update docs set updatedNanos = ? where spaceID = ? and docID = ?",
+			updated.UnixNano(), spaceID, docID,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to touch doc: %w", err)
+		}
+		rows, _ := res.RowsAffected()
+		touched += int(rows)
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		tx = nil
+	}
+
+	return touched, err
+}
+
 func (db *database) hasDocument(ctx context.Context, space string, doc Interest) (bool, error) {
 	spaceID, err := db.getSpaceID(ctx, space)
 	if err != nil {
 		return false, err
 	}
+	docID, err := db.docIDValue(spaceID, doc.DocID)
+	if err != nil {
+		return false, err
+	}
 	var exists bool
 	err = db.rdb.GetContext(
 		ctx, &exists,
 		`select count(*) == 1 from docs where docs.spaceID = ? and docs.docID = ? and docs.updatedNanos = ?`,
 		spaceID,
-		doc.DocID,
+		docID,
 		doc.Updated,
 	)
 	return exists, err
@@ -303,14 +599,34 @@ func (db *database) setInterestList(ctx context.Context, indexUpdate protocol.In
 	if err != nil {
 		return err
 	}
-	st, err := tx.PreparexContext(ctx, `insert into interest (spaceID, docID, state, updatedNanos) values(?, ?, ?, ?)`)
+	// IDs normalized to the same ID are listed once, at the first position
+	st, err := tx.PreparexContext(ctx, `
+		insert into interest (spaceID, docID, state, updatedNanos, priority) values(?, ?, ?, ?, ?)
+		on conflict(spaceID, docID) do update set
+		updatedNanos = max(updatedNanos, excluded.updatedNanos),
+		priority = max(priority, excluded.priority)
+	`)
 	if err != nil {
 		return err
 	}
 	defer st.Close()
 
+	// Recently updated documents are requested first
+	var boostedAfter time.Time
+	if db.priorityBoostWindow > 0 {
+		boostedAfter = time.Now().Add(-db.priorityBoostWindow)
+	}
+
 	for _, update := range indexUpdate.Updates {
-		_, err := st.ExecContext(ctx, spaceID, update.ID, pending, update.Updated.UnixNano())
+		docID, err := db.docIDValue(spaceID, db.idNormalizer.normalize(update.ID))
+		if err != nil {
+			return fmt.Errorf("invalid interest list for space %q: %w", indexUpdate.Space, err)
+		}
+		priority := 0
+		if !boostedAfter.IsZero() && update.Updated.After(boostedAfter) {
+			priority = 1
+		}
+		_, err = st.ExecContext(ctx, spaceID, docID, pending, update.Updated.UnixNano(), priority)
 		if err != nil {
 			return err
 		}
@@ -346,7 +662,12 @@ func (db *database) setInterestState(
 		return err
 	}
 
-	_, err = db.wdb.ExecContext(ctx, "update interest set state = ? where spaceID=? and docID=?", state, spaceID, docID)
+	idValue, err := db.docIDValue(spaceID, docID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.wdb.ExecContext(ctx, "update interest set state = ? where spaceID=? and docID=?", state, spaceID, idValue)
 	return err
 }
 
@@ -357,12 +678,17 @@ func (db *database) getStemmerState() (snowball.Settings, time.Time, error) {
 	removeDiacritics as removediacritics,
 	tokenCharacters as tokencharacters,
 	separators,
+	maxTokenLength as maxtokenlength,
+	truncateLongTokens as truncatelongtokens,
+	invisibleCharacters as invisiblecharacters,
+	stopWords as stopwordlist,
 	updated
 	from stemmerstate
 	`
 	var state struct {
-		Languages string
-		Updated   time.Time
+		Languages    string
+		StopWordList string
+		Updated      time.Time
 		snowball.Settings
 	}
 	err := db.rdb.Get(&state, query)
@@ -371,6 +697,9 @@ func (db *database) getStemmerState() (snowball.Settings, time.Time, error) {
 	} else {
 		state.Stemmers = strings.Split(state.Languages, ",")
 	}
+	if len(state.StopWordList) > 0 {
+		state.StopWords = strings.Split(state.StopWordList, ",")
+	}
 	return state.Settings, state.Updated, err
 }
 
@@ -392,7 +721,8 @@ func (db *database) setStemmerState(state snowball.Settings) error {
 	}
 	query := `
 	update stemmerstate
-	set languages = ?, removeDiacritics = ?, tokenCharacters = ?, separators = ?
+	set languages = ?, removeDiacritics = ?, tokenCharacters = ?, separators = ?,
+	maxTokenLength = ?, truncateLongTokens = ?, invisibleCharacters = ?, stopWords = ?
 	`
 
 	languages := strings.Join(state.Stemmers, ",")
@@ -401,6 +731,10 @@ func (db *database) setStemmerState(state snowball.Settings) error {
 		state.RemoveDiacritics,
 		state.TokenCharacters,
 		state.Separators,
+		state.MaxTokenLength,
+		state.TruncateLongTokens,
+		state.InvisibleCharacters,
+		strings.Join(state.StopWords, ","),
 	)
 	return err
 }
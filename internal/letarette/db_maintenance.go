@@ -0,0 +1,144 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/logger"
+)
+
+// SQLite auto_vacuum mode allowing incremental vacuuming
+const incrementalAutoVacuum = 2
+
+// startMaintenance starts checkpointing the WAL every checkpointInterval,
+// and vacuuming up to vacuumPages free pages every vacuumInterval.
+// Zero intervals disable each task. Stopped by stopMaintenance.
+func (db *database) startMaintenance(checkpointInterval, vacuumInterval time.Duration, vacuumPages int) {
+	if checkpointInterval <= 0 && vacuumInterval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	db.stopMaintenance = cancel
+	db.maintenance.Add(1)
+
+	go func() {
+		defer db.maintenance.Done()
+
+		var checkpoints, vacuums <-chan time.Time
+		if checkpointInterval > 0 {
+			ticker := time.NewTicker(checkpointInterval)
+			defer ticker.Stop()
+			checkpoints = ticker.C
+		}
+		if vacuumInterval > 0 {
+			ticker := time.NewTicker(vacuumInterval)
+			defer ticker.Stop()
+			vacuums = ticker.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-checkpoints:
+				err := db.checkpointWAL(ctx)
+				if err != nil && ctx.Err() == nil {
+					logger.Error.Printf("Failed to checkpoint WAL: %v", err)
+				}
+			case <-vacuums:
+				err := db.incrementalVacuum(ctx, vacuumPages)
+				if err != nil && ctx.Err() == nil {
+					logger.Error.Printf("Failed to vacuum database: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// checkpointWAL runs a passive checkpoint, copying as much of the WAL
+// as possible to the database without waiting for readers or writers.
+// The WAL size and checkpointed frames are kept for status broadcasts,
+// see getCheckpointStats.
+func (db *database) checkpointWAL(ctx context.Context) error {
+	var result struct {
+		Busy         int
+		Log          int64
+		Checkpointed int64
+	}
+	err := db.wdb.QueryRowxContext(ctx, "pragma wal_checkpoint(PASSIVE)").Scan(
+		&result.Busy, &result.Log, &result.Checkpointed,
+	)
+	if err != nil {
+		return err
+	}
+	// Not in WAL mode, see Config.DB.JournalFallback
+	if result.Log < 0 {
+		return nil
+	}
+	atomic.StoreInt64(&db.walFrames, result.Log)
+	atomic.StoreInt64(&db.walCheckpointed, result.Checkpointed)
+	logger.Debug.Printf("Checkpointed %d of %d WAL frames", result.Checkpointed, result.Log)
+	return nil
+}
+
+// getCheckpointStats returns the number of frames in the WAL, and the
+// number of those that were checkpointed, as of the latest checkpoint.
+func (db *database) getCheckpointStats() (frames int64, checkpointed int64) {
+	return atomic.LoadInt64(&db.walFrames), atomic.LoadInt64(&db.walCheckpointed)
+}
+
+// incrementalVacuum frees up to maxPages unused database pages.
+// Databases not created for incremental vacuuming are converted by
+// a full vacuum the first time.
+func (db *database) incrementalVacuum(ctx context.Context, maxPages int) error {
+	conn, err := db.wdb.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var mode int
+	err = conn.GetContext(ctx, &mode, "pragma auto_vacuum")
+	if err != nil {
+		return err
+	}
+	if mode != incrementalAutoVacuum {
+		logger.Info.Printf("Enabling incremental vacuum, running full vacuum")
+		_, err = conn.ExecContext(ctx, "pragma auto_vacuum = incremental")
+		if err != nil {
+			return err
+		}
+		_, err = conn.ExecContext(ctx, "vacuum")
+		if err != nil {
+			return fmt.Errorf("failed to enable incremental vacuum: %w", err)
+		}
+		return nil
+	}
+
+	// One row is returned for each freed page
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("pragma incremental_vacuum(%d)", maxPages))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
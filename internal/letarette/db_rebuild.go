@@ -0,0 +1,221 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/logger"
+)
+
+// ErrRebuildCancelled is returned by RebuildIndex when a rebuild is
+// cancelled by CancelRebuild.
+var ErrRebuildCancelled = errors.New("rebuild cancelled")
+
+// RebuildState is the state of a rebuild in progress
+type RebuildState struct {
+	Started time.Time
+	// Documents up to this position are indexed
+	Position  int64
+	Remaining int
+}
+
+// Number of documents indexed in each rebuild transaction
+const rebuildBatchSize = 1000
+
+// getRebuildState returns the state of an unfinished rebuild,
+// or nil if no rebuild is in progress.
+func (db *database) getRebuildState(ctx context.Context) (*RebuildState, error) {
+	var state struct {
+		Started  int64
+		Position int64
+	}
+	err := db.rdb.GetContext(ctx, &state, `select started, position from rebuild`)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining int
+	err = db.rdb.GetContext(ctx, &remaining, `
+		select count(*) from docs join spaces using(spaceID)
+		where id > ? and not contentless
+		`, state.Position)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RebuildState{
+		Started:   time.Unix(0, state.Started),
+		Position:  state.Position,
+		Remaining: remaining,
+	}, nil
+}
+
+// rebuild clears the full text index and indexes all documents again,
+// in batches committed separately. Progress is stored in the rebuild
+// table, and an interrupted rebuild is resumed from the last batch.
+func (db *database) rebuild(ctx context.Context) error {
+	started, err := db.startRebuild(ctx)
+	if err != nil {
+		return err
+	}
+	if !started {
+		logger.Info.Printf("Resuming unfinished rebuild")
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		done, err := db.rebuildBatch(ctx)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// startRebuild clears the index and stores the rebuild state, unless
+// a rebuild is already in progress. Returns true for new rebuilds.
+func (db *database) startRebuild(ctx context.Context) (bool, error) {
+	tx, err := db.wdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	result, err := tx.ExecContext(
+		ctx, `insert or ignore into rebuild (id, started, position) values (1, ?, 0)`, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to store rebuild state: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if inserted > 0 {
+		_, err = tx.ExecContext(ctx, `insert into fts(fts) values('delete-all')`)
+		if err != nil {
+			return false, fmt.Errorf("failed to clear index: %w", err)
+		}
+	} else {
+		// Resuming clears any cancel request left behind
+		_, err = tx.ExecContext(ctx, `update rebuild set cancel = false`)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		tx = nil
+	}
+	return inserted > 0, err
+}
+
+// rebuildBatch indexes the next batch of documents after the rebuild
+// position. Returns true when all documents are indexed, and the
+// rebuild is done.
+func (db *database) rebuildBatch(ctx context.Context) (bool, error) {
+	tx, err := db.wdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var state struct {
+		Position int64
+		Cancel   bool
+	}
+	err = tx.GetContext(ctx, &state, `select position, cancel from rebuild`)
+	if err != nil {
+		return false, fmt.Errorf("failed to get rebuild state: %w", err)
+	}
+
+	if state.Cancel {
+		_, err = tx.ExecContext(ctx, `update rebuild set cancel = false`)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err == nil {
+			tx = nil
+			err = ErrRebuildCancelled
+		}
+		return false, err
+	}
+
+	var last sql.NullInt64
+	err = tx.GetContext(ctx, &last, `
+		select max(id) from (
+			select id from docs join spaces using(spaceID)
+			where id > ? and not contentless
+			order by id limit ?
+		)
+		`, state.Position, rebuildBatchSize)
+	if err != nil {
+		return false, err
+	}
+
+	done := !last.Valid
+	if done {
+		_, err = tx.ExecContext(ctx, `delete from rebuild`)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			insert into fts(rowid, title, txt)
+			select id, title, uncompress(txt) from docs join spaces using(spaceID)
+			where id > ? and id <= ? and not contentless
+			`, state.Position, last.Int64)
+		if err != nil {
+			return false, fmt.Errorf("failed to index documents: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `update rebuild set position = ?`, last.Int64)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		tx = nil
+	}
+	return done, err
+}
+
+// cancelRebuild requests a running rebuild to stop after its current
+// batch. Returns false if no rebuild is in progress.
+func (db *database) cancelRebuild(ctx context.Context) (bool, error) {
+	result, err := db.wdb.ExecContext(ctx, `update rebuild set cancel = true`)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
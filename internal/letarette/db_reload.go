@@ -0,0 +1,298 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// Reload is a requested or running space reload
+type Reload struct {
+	Space     string
+	Requested time.Time
+	// Shadow space being filled, empty until the reload is started
+	Shadow string
+	// Documents in the shadow space so far
+	ShadowDocs int
+}
+
+// shadowSpaceName is the name of the space filled by a reload
+func shadowSpaceName(space string) string {
+	return space + "#reload"
+}
+
+// Number of documents deleted in each retired space purge transaction
+const purgeBatchSize = 1000
+
+// requestReload stores a reload request for a space, to be started by
+// the indexer. Returns false if a reload of the space is already requested.
+func (db *database) requestReload(ctx context.Context, space string) (bool, error) {
+	var retired bool
+	err := db.rdb.GetContext(ctx, &retired, `select retired from spaces where space = ?`, space)
+	if errors.Is(err, sql.ErrNoRows) || retired {
+		return false, fmt.Errorf("no space %q in index", space)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.wdb.ExecContext(
+		ctx, `insert or ignore into reloads (space, requested) values (?, ?)`, space, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted > 0, err
+}
+
+// getReloads lists requested and running reloads
+func (db *database) getReloads(ctx context.Context) ([]Reload, error) {
+	var rows []struct {
+		Space      string
+		Requested  int64
+		Shadow     sql.NullString
+		ShadowDocs int `db:"shadowDocs"`
+	}
+	err := db.rdb.SelectContext(ctx, &rows, `
+		select
+			reloads.space, requested, spaces.space as shadow,
+			(select count(*) from docs where docs.spaceID = reloads.shadowID) as shadowDocs
+		from reloads left join spaces on spaces.spaceID = reloads.shadowID
+		order by requested
+		`)
+	if err != nil {
+		return nil, err
+	}
+
+	reloads := make([]Reload, len(rows))
+	for i, row := range rows {
+		reloads[i] = Reload{
+			Space:      row.Space,
+			Requested:  time.Unix(0, row.Requested),
+			Shadow:     row.Shadow.String,
+			ShadowDocs: row.ShadowDocs,
+		}
+	}
+	return reloads, nil
+}
+
+// startReload creates the shadow space of a requested reload, with the
+// content mode and ID type of the reloaded space, and an index position
+// at the beginning of time. Returns the name of the shadow space.
+// Reloads already started keep their shadow space and position.
+func (db *database) startReload(ctx context.Context, space string) (string, error) {
+	shadow := shadowSpaceName(space)
+
+	tx, err := db.wdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var shadowID sql.NullInt64
+	err = tx.GetContext(ctx, &shadowID, `select shadowID from reloads where space = ?`, space)
+	if err != nil {
+		return "", fmt.Errorf("failed to get reload: %w", err)
+	}
+
+	if !shadowID.Valid {
+		result, err := tx.ExecContext(ctx, `
+			insert into spaces (space, lastUpdatedAtNanos, contentless, integerIDs, phonetic, exactCase)
+			select ?, 0, contentless, integerIDs, phonetic, exactCase from spaces where space = ?
+			`, shadow, space)
+		if err != nil {
+			return "", fmt.Errorf("failed to create shadow space: %w", err)
+		}
+		shadowID.Int64, err = result.LastInsertId()
+		if err != nil {
+			return "", err
+		}
+		_, err = tx.ExecContext(ctx, `update reloads set shadowID = ? where space = ?`, shadowID.Int64, space)
+		if err != nil {
+			return "", err
+		}
+		var spaceID int
+		err = tx.GetContext(ctx, &spaceID, `select spaceID from spaces where space = ?`, space)
+		if err != nil {
+			return "", err
+		}
+		err = copySpaceAddons(ctx, tx, spaceID, int(shadowID.Int64))
+		if err != nil {
+			return "", fmt.Errorf("failed to add space add-ons to shadow space: %w", err)
+		}
+	}
+
+	var integerIDs bool
+	err = tx.GetContext(ctx, &integerIDs, `select integerIDs from spaces where spaceID = ?`, shadowID.Int64)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+	tx = nil
+
+	if integerIDs {
+		db.setIntegerIDs(int(shadowID.Int64))
+	}
+	return shadow, nil
+}
+
+// swapReload replaces a space with its completed shadow space.
+// The replaced space is renamed and marked as retired, leaving its
+// documents to be deleted by purgeRetiredSpaces. The shadow space
+// takes over the search and indexing settings of the space.
+func (db *database) swapReload(ctx context.Context, space string) error {
+	tx, err := db.wdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var spaceID int
+	err = tx.GetContext(ctx, &spaceID, `select spaceID from spaces where space = ?`, space)
+	if err != nil {
+		return fmt.Errorf("failed to get space ID: %w", err)
+	}
+
+	retired := fmt.Sprintf("%s#retired-%d", space, spaceID)
+	statements := []struct {
+		sql  string
+		args []interface{}
+	}{
+		{`update spaces set space = ?, retired = true where spaceID = ?`, []interface{}{retired, spaceID}},
+		{`update spaces set space = ? where space = ?`, []interface{}{space, shadowSpaceName(space)}},
+		{`update spaces set (searchDisabled, indexPaused) =
+			(select searchDisabled, indexPaused from spaces where spaceID = ?)
+			where space = ?`, []interface{}{spaceID, space}},
+		{`delete from reloads where space = ?`, []interface{}{space}},
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement.sql, statement.args...)
+		if err != nil {
+			return fmt.Errorf("failed to swap in reloaded space: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		tx = nil
+	}
+	return err
+}
+
+// purgeRetiredSpaces deletes the documents of spaces replaced by reloads
+// in batches, and then the spaces themselves. The IDs of deleted documents
+// are passed to the deleted callback, for cache invalidation.
+func (db *database) purgeRetiredSpaces(ctx context.Context, deleted func([]protocol.DocumentID)) error {
+	var retired []int
+	err := db.rdb.SelectContext(ctx, &retired, `select spaceID from spaces where retired`)
+	if err != nil {
+		return err
+	}
+
+	for _, spaceID := range retired {
+		for {
+			docs, err := db.purgeBatch(ctx, spaceID)
+			if err != nil {
+				return fmt.Errorf("failed to purge retired space: %w", err)
+			}
+			if len(docs) == 0 {
+				break
+			}
+			deleted(docs)
+		}
+
+		tx, err := db.wdb.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		err = removeSpaceAddons(ctx, tx, spaceID)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to purge retired space: %w", err)
+		}
+		for _, table := range []string{"docfields", "interest", "deadletters", "spaces"} {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf(`delete from %s where spaceID = ?`, table), spaceID)
+			if err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("failed to purge retired space: %w", err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *database) purgeBatch(ctx context.Context, spaceID int) ([]protocol.DocumentID, error) {
+	tx, err := db.wdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var docs []struct {
+		ID    int64
+		DocID protocol.DocumentID `db:"docID"`
+	}
+	err = tx.SelectContext(
+		ctx, &docs, `select id, docID from docs where spaceID = ? order by id limit ?`, spaceID, purgeBatchSize,
+	)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+
+	last := docs[len(docs)-1].ID
+	_, err = tx.ExecContext(ctx, `delete from docs where spaceID = ? and id <= ?`, spaceID, last)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	tx = nil
+
+	ids := make([]protocol.DocumentID, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.DocID
+	}
+	return ids, nil
+}
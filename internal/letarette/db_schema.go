@@ -0,0 +1,88 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/erkkah/letarette/internal/snowball"
+)
+
+// FTSTable describes a full text index table
+type FTSTable struct {
+	Name string
+	// Create statement, as stored in sqlite_master
+	SQL string
+	// Table options, empty when not set
+	Tokenizer string
+	Prefix    string
+	Content   string
+}
+
+// IndexSchema describes how the full text index was built
+type IndexSchema struct {
+	// Schema migration version
+	Version int
+	Tables  []FTSTable
+	// Recorded stemmer state, used when indexing
+	Stemmer        snowball.Settings
+	StemmerUpdated time.Time
+}
+
+// Matches fts5 options like "tokenize='snowball'", or double quoted
+// like "tokenize = \"unicode61 tokenchars '^'\""
+var ftsOptionPattern = regexp.MustCompile(`(?i)(\w+)\s*=\s*(?:'([^']*)'|"([^"]*)")`)
+
+func (db *database) getIndexSchema(ctx context.Context) (IndexSchema, error) {
+	var schema IndexSchema
+
+	err := db.rdb.GetContext(ctx, &schema.Version, `select version from schema_migrations`)
+	if err != nil {
+		return schema, err
+	}
+
+	err = db.rdb.SelectContext(ctx, &schema.Tables, `
+		select name, sql from sqlite_master
+		where type = 'table' and sql like 'create virtual table%using fts5%'
+		order by name
+		`)
+	if err != nil {
+		return schema, err
+	}
+	for i, table := range schema.Tables {
+		for _, option := range ftsOptionPattern.FindAllStringSubmatch(table.SQL, -1) {
+			value := option[2] + option[3]
+			switch option[1] {
+			case "tokenize":
+				schema.Tables[i].Tokenizer = value
+			case "prefix":
+				schema.Tables[i].Prefix = value
+			case "content":
+				schema.Tables[i].Content = value
+			}
+		}
+	}
+
+	// Stemmer state is recorded when first indexing
+	schema.Stemmer, schema.StemmerUpdated, err = db.getStemmerState()
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return schema, err
+}
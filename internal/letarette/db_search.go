@@ -16,38 +16,159 @@ package letarette
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/jmoiron/sqlx"
 
 	"github.com/erkkah/letarette/pkg/protocol"
 )
 
-func phrasesToMatchString(phrases []Phrase) string {
+// searchColumns are the full text index columns
+// that phrases can be limited to.
+var searchColumns = []string{"title", "txt"}
+
+// columnAliases are alternative query names of search columns
+var columnAliases = map[string]string{"body": "txt"}
+
+// validatePhraseColumns checks that all column limited
+// phrases refer to existing columns.
+func validatePhraseColumns(phrases []Phrase) error {
+	for _, phrase := range phrases {
+		if phrase.Column == "" {
+			continue
+		}
+		if !isSearchColumn(phrase.Column) {
+			return fmt.Errorf(
+				"%w: unknown column %q, expected one of %v", errInvalidQuery, phrase.Column, searchColumns,
+			)
+		}
+	}
+	return nil
+}
+
+func isSearchColumn(column string) bool {
+	for _, searchColumn := range searchColumns {
+		if column == searchColumn {
+			return true
+		}
+	}
+	return false
+}
+
+// searchColumn resolves a query column name, or alias, to its search
+// column. Returns false for names of no search column.
+func searchColumn(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if column, found := columnAliases[name]; found {
+		return column, true
+	}
+	return name, isSearchColumn(name)
+}
+
+// phraseToMatchExpression builds the match expression of a single
+// phrase, ignoring exclusion. A phrase with a synonym group matches
+// any of the synonyms.
+func phraseToMatchExpression(phrase Phrase, group []string) string {
+	if phrase.Group {
+		return groupToMatchExpression(phrase.Text)
+	}
+	phraseExpr := phrase.Text
+	if !strings.HasPrefix(phrase.Text, `"`) {
+		phraseExpr = fmt.Sprintf("%q", phrase.Text)
+	}
+	if phrase.Wildcard {
+		phraseExpr += "*"
+	}
+	if len(group) > 0 {
+		alternatives := make([]string, len(group))
+		for j, synonym := range group {
+			alternatives[j] = fmt.Sprintf("%q", strings.Join(synonymWords(synonym), " "))
+		}
+		phraseExpr = fmt.Sprintf("(%s)", strings.Join(alternatives, " OR "))
+	}
+	if phrase.Column != "" {
+		phraseExpr = fmt.Sprintf("%s : %s", phrase.Column, phraseExpr)
+	}
+	return phraseExpr
+}
+
+// groupToMatchExpression builds the match expression of an OR group,
+// where all including phrases of an alternative are required.
+func groupToMatchExpression(group string) string {
+	var alternatives []string
+	for _, phrases := range parseGroup(group, false) {
+		var includes []string
+		var excludes []string
+		for _, phrase := range phrases {
+			if phrase.Exclude {
+				excludes = append(excludes, phraseToMatchExpression(phrase, nil))
+			} else {
+				includes = append(includes, phraseToMatchExpression(phrase, nil))
+			}
+		}
+		alternative := strings.Join(includes, " AND ")
+		if len(excludes) > 0 {
+			alternative += fmt.Sprintf(" NOT (%s)", strings.Join(excludes, " OR "))
+		}
+		alternatives = append(alternatives, fmt.Sprintf("(%s)", alternative))
+	}
+	return fmt.Sprintf("(%s)", strings.Join(alternatives, " OR "))
+}
+
+// phrasesToMatchString builds an FTS5 match expression of query phrases.
+// Phrases with synonyms, see phraseSynonyms.expand, match any of the
+// synonyms in the group of the phrase.
+func phrasesToMatchString(phrases []Phrase, synonyms [][]string) string {
 	var includes []string
+	var required []string
+	var columnGroup []string
 	var excludes []string
 
-	for _, v := range phrases {
-		phraseExpr := v.Text
-		if !strings.HasPrefix(v.Text, `"`) {
-			phraseExpr = fmt.Sprintf("%q", v.Text)
-		}
-		if v.Wildcard {
-			phraseExpr += "*"
+	// Adjacent column phrases match in any of their columns
+	endColumnGroup := func() {
+		switch len(columnGroup) {
+		case 0:
+			return
+		case 1:
+			required = append(required, columnGroup[0])
+		default:
+			required = append(required, fmt.Sprintf("(%s)", strings.Join(columnGroup, " OR ")))
 		}
-		if v.Exclude {
+		columnGroup = nil
+	}
+
+	for i, v := range phrases {
+		group := synonyms[i]
+		phraseExpr := phraseToMatchExpression(v, group)
+		switch {
+		case v.Exclude:
 			excludes = append(excludes, phraseExpr)
-		} else {
+		case v.Column != "":
+			// Column filters and OR groups can not be used within NEAR groups
+			columnGroup = append(columnGroup, phraseExpr)
+		case len(group) > 0 || v.Group:
+			endColumnGroup()
+			required = append(required, phraseExpr)
+		default:
+			endColumnGroup()
 			includes = append(includes, phraseExpr)
 		}
 	}
+	endColumnGroup()
 
 	const nearRange = 15
-	matchString := ""
+	var all []string
 	if len(includes) > 0 {
-		matchString += fmt.Sprintf("NEAR(%s, %d)", strings.Join(includes, " "), nearRange)
+		all = append(all, fmt.Sprintf("NEAR(%s, %d)", strings.Join(includes, " "), nearRange))
 	}
+	all = append(all, required...)
+	matchString := strings.Join(all, " AND ")
 	if len(excludes) > 0 {
 		matchString += fmt.Sprintf(" NOT (%s)", strings.Join(excludes, " OR "))
 	}
@@ -56,7 +177,30 @@ func phrasesToMatchString(phrases []Phrase) string {
 }
 
 func (db *database) search(
-	ctx context.Context, phrases []Phrase, spaces []string, pageLimit uint16, pageOffset uint16,
+	ctx context.Context, phrases []Phrase, query protocol.SearchRequest,
+) (
+	protocol.SearchResult, error,
+) {
+	return db.searchIn(ctx, db.rdb, phrases, query)
+}
+
+// searchIn searches using the provided queryer, which is either
+// the read connection pool or a pinned snapshot transaction.
+func (db *database) searchIn(
+	ctx context.Context, q sqlx.QueryerContext, phrases []Phrase, query protocol.SearchRequest,
+) (
+	protocol.SearchResult, error,
+) {
+	return db.searchSince(ctx, q, phrases, query, noSince)
+}
+
+// noSince searches all documents, ranked by relevance
+const noSince = -1
+
+// searchSince searches documents indexed after a position in the index,
+// most recently updated first. See protocol.SearchRequest.Since.
+func (db *database) searchSince(
+	ctx context.Context, q sqlx.QueryerContext, phrases []Phrase, query protocol.SearchRequest, since int64,
 ) (
 	protocol.SearchResult, error,
 ) {
@@ -65,46 +209,825 @@ func (db *database) search(
 		return protocol.SearchResult{}, fmt.Errorf("empty search phrase list")
 	}
 
-	matchString := phrasesToMatchString(phrases)
+	var matchString string
+	var synonymGroups [][]string
+	stopwordsOnly := false
+	if query.Phonetic {
+		var err error
+		matchString, err = phrasesToPhoneticMatchString(phrases)
+		if err != nil {
+			return protocol.SearchResult{}, err
+		}
+	} else if query.ExactCase {
+		var err error
+		matchString, err = phrasesToExactCaseMatchString(phrases)
+		if err != nil {
+			return protocol.SearchResult{}, err
+		}
+	} else {
+		var err error
+		stopwordsOnly, err = db.isStopwordQuery(ctx, q, phrases)
+		if err != nil {
+			return protocol.SearchResult{}, err
+		}
+		if stopwordsOnly {
+			if !db.rawStopwords {
+				return protocol.SearchResult{StopwordsOnly: true}, nil
+			}
+			phrases = keepStopwords(phrases)
+		}
+		synonymGroups = make([][]string, len(phrases))
+		if expandable(phrases) {
+			synonyms, err := db.getPhraseSynonyms(ctx, q)
+			if err != nil {
+				return protocol.SearchResult{}, err
+			}
+			phrases, synonymGroups = synonyms.expand(phrases)
+		}
+		if query.Fuzzy > 0 {
+			synonymGroups, err = fuzzyGroups(ctx, q, phrases, synonymGroups, query.Fuzzy)
+			if err != nil {
+				return protocol.SearchResult{}, err
+			}
+		}
+		matchString = phrasesToMatchString(phrases, synonymGroups)
+	}
+
+	result, err := db.searchMatch(ctx, q, matchString, query, since)
+	if err != nil {
+		return result, err
+	}
+	result.StopwordsOnly = stopwordsOnly
+	db.omitSnippets(&result)
 
-	query, err := loadSearchQuery(db.searchStrategy)
+	result.SpaceCounts, result.Facets, result.NumericStats, err = db.aggregate(ctx, q, matchString, query, since)
+	if err != nil {
+		return result, err
+	}
+
+	if query.EstimateTotal {
+		result.EstimatedTotal, result.EstimateIsLowerBound = result.TotalHits, false
+		if result.Capped {
+			result.EstimatedTotal, result.EstimateIsLowerBound, err = db.estimateTotal(ctx, q, matchString, query, since)
+		}
+	}
+	if err == nil && query.TermCounts {
+		err = db.addTermCounts(ctx, q, &result, phrases, synonymGroups, query)
+	}
+	if err != nil || !query.IncludeContent {
+		return result, err
+	}
+
+	err = db.addHitContent(ctx, q, &result)
+	return result, err
+}
+
+// addHitContent sets the content of each hit to the stored document text,
+// cut at the max content size.
+func (db *database) addHitContent(ctx context.Context, q sqlx.QueryerContext, result *protocol.SearchResult) error {
+	if db.maxContentSize <= 0 {
+		return nil
+	}
+	spaceIDs := map[string]int{}
+	for i, hit := range result.Hits {
+		if db.contentless[hit.Space] {
+			continue
+		}
+		spaceID, found := spaceIDs[hit.Space]
+		if !found {
+			err := sqlx.GetContext(ctx, q, &spaceID, "select spaceID from spaces where space = ?", hit.Space)
+			if err != nil {
+				return fmt.Errorf("failed to get space ID: %w", err)
+			}
+			spaceIDs[hit.Space] = spaceID
+		}
+		docID, err := db.docIDValue(spaceID, hit.ID)
+		if err != nil {
+			return err
+		}
+
+		var content string
+		err = sqlx.GetContext(
+			ctx, q, &content, "select uncompress(txt) from docs where spaceID = ? and docID = ?", spaceID, docID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to get hit content: %w", err)
+		}
+		if len(content) > db.maxContentSize {
+			cut := db.maxContentSize
+			for cut > 0 && !utf8.RuneStart(content[cut]) {
+				cut--
+			}
+			content = content[:cut]
+			result.Truncate(fmt.Sprintf("content cut at %d bytes", db.maxContentSize))
+		}
+		result.Hits[i].Content = content
+	}
+	return nil
+}
+
+// addTermCounts sets the term counts of each hit, the number of matches
+// of each included phrase in the document. Each phrase is matched on its
+// own against the hits, in one query per index table.
+func (db *database) addTermCounts(
+	ctx context.Context, q sqlx.QueryerContext, result *protocol.SearchResult,
+	phrases []Phrase, synonyms [][]string, query protocol.SearchRequest,
+) error {
+	var labels []string
+	for _, phrase := range phrases {
+		if !phrase.Exclude {
+			labels = append(labels, termLabel(phrase))
+		}
+	}
+
+	spaceIDs := map[string]int{}
+	rowIDs := map[string][]int64{}
+	hitByRowID := map[int64]int{}
+	for i, hit := range result.Hits {
+		spaceID, found := spaceIDs[hit.Space]
+		if !found {
+			err := sqlx.GetContext(ctx, q, &spaceID, "select spaceID from spaces where space = ?", hit.Space)
+			if err != nil {
+				return fmt.Errorf("failed to get space ID: %w", err)
+			}
+			spaceIDs[hit.Space] = spaceID
+		}
+		docID, err := db.docIDValue(spaceID, hit.ID)
+		if err != nil {
+			return err
+		}
+		var rowID int64
+		err = sqlx.GetContext(ctx, q, &rowID, "select id from docs where spaceID = ? and docID = ?", spaceID, docID)
+		if err != nil {
+			return fmt.Errorf("failed to get hit row: %w", err)
+		}
+
+		var table string
+		switch {
+		case query.Phonetic:
+			table = "ftsp"
+		case query.ExactCase:
+			table = "ftse"
+		case db.contentless[hit.Space]:
+			table = "ftsc"
+		default:
+			table = "fts"
+		}
+		rowIDs[table] = append(rowIDs[table], rowID)
+		hitByRowID[rowID] = i
+
+		counts := make(map[string]int, len(labels))
+		for _, label := range labels {
+			counts[label] = 0
+		}
+		result.Hits[i].TermCounts = counts
+	}
+
+	for i, phrase := range phrases {
+		if phrase.Exclude {
+			continue
+		}
+		var matchString string
+		var err error
+		switch {
+		case query.Phonetic:
+			matchString, err = phrasesToPhoneticMatchString([]Phrase{phrase})
+		case query.ExactCase:
+			matchString, err = phrasesToExactCaseMatchString([]Phrase{phrase})
+		default:
+			matchString = phraseToMatchExpression(phrase, synonyms[i])
+		}
+		if err != nil {
+			// Phrases without codes or words match nothing
+			continue
+		}
+		label := termLabel(phrase)
+
+		for table, ids := range rowIDs {
+			jsonIDs, err := json.Marshal(ids)
+			if err != nil {
+				return err
+			}
+			countQuery := fmt.Sprintf(`
+				select rowid, matchcount(%[1]s) as matchcount from %[1]s
+				where %[1]s match ? and rowid in (select value from json_each(?))
+				`, table)
+			var counts []struct {
+				RowID int64 `db:"rowid"`
+				Count int   `db:"matchcount"`
+			}
+			err = sqlx.SelectContext(ctx, q, &counts, countQuery, matchString, string(jsonIDs))
+			if err != nil {
+				return fmt.Errorf("failed to count term matches: %w", err)
+			}
+			for _, count := range counts {
+				result.Hits[hitByRowID[count.RowID]].TermCounts[label] += count.Count
+			}
+		}
+	}
+	return nil
+}
+
+// termLabel names a phrase in term counts, as written in the query
+func termLabel(phrase Phrase) string {
+	// Phrases quoted to keep stop words, see keepStopwords
+	phrase.Text = strings.TrimSpace(unquote(phrase.Text))
+	return phrase.String()
+}
+
+// snippetLimit returns the number of hits to generate snippets for,
+// starting at a page offset, when searching for the given query.
+func (db *database) snippetLimit(query protocol.SearchRequest, offset int) int {
+	if db.maxSnippets <= 0 {
+		return int(query.PageLimit) + offset
+	}
+	return min(db.maxSnippets, int(query.PageLimit)) + offset
+}
+
+// snippetOptions returns the first token and number of tokens of
+// snippets, relative to the first match, and the highlight markers
+// of a search, from the request or the config
+func (db *database) snippetOptions(query protocol.SearchRequest) (before int, length int, open string, close string) {
+	window := db.snippetWindow
+	if query.SnippetWindow > 0 {
+		window = query.SnippetWindow
+	}
+	if window > 0 {
+		before, length = window, 2*window+1
+	} else {
+		// One token before and eight after the first match
+		before, length = 1, 10
+	}
+	open, close = db.snippetOpen, db.snippetClose
+	if query.SnippetOpen != "" || query.SnippetClose != "" {
+		open, close = query.SnippetOpen, query.SnippetClose
+	}
+	return
+}
+
+// omitSnippets clears the snippets of hits beyond the max number
+// of snippets, marking the result.
+func (db *database) omitSnippets(result *protocol.SearchResult) {
+	if db.maxSnippets <= 0 || len(result.Hits) <= db.maxSnippets {
+		return
+	}
+	for i := db.maxSnippets; i < len(result.Hits); i++ {
+		result.Hits[i].Snippet = ""
+	}
+	result.SnippetsOmitted = true
+}
+
+// lastDocumentPosition returns the position of the last indexed document.
+// Documents are given increasing positions as they are indexed.
+func (db *database) lastDocumentPosition(ctx context.Context, q sqlx.QueryerContext) (int64, error) {
+	var position int64
+	err := sqlx.GetContext(ctx, q, &position, "select ifnull(max(id), 0) from docs")
+	return position, err
+}
+
+func (db *database) searchMatch(
+	ctx context.Context, q sqlx.QueryerContext, matchString string, query protocol.SearchRequest, since int64,
+) (
+	protocol.SearchResult, error,
+) {
+	if query.Phonetic {
+		// All spaces share the phonetic index
+		phoneticQuery, err := SQL("search_phonetic.sql")
+		if err != nil {
+			return protocol.SearchResult{}, err
+		}
+		return db.searchSpaces(ctx, q, phoneticQuery, matchString, query, since, 0)
+	}
+	if query.ExactCase {
+		// All spaces share the exact case index
+		exactCaseQuery, err := SQL("search_exactcase.sql")
+		if err != nil {
+			return protocol.SearchResult{}, err
+		}
+		return db.searchSpaces(ctx, q, exactCaseQuery, matchString, query, since, 0)
+	}
+
+	searchQuery, err := loadSearchQuery(db.searchStrategy)
 	if err != nil {
 		return protocol.SearchResult{}, fmt.Errorf("search strategy %d not found", db.searchStrategy)
 	}
+	contentlessFile := "search_contentless.sql"
+	if since != noSince {
+		searchQuery, err = SQL("search_since.sql")
+		if err != nil {
+			return protocol.SearchResult{}, err
+		}
+		contentlessFile = "search_since_contentless.sql"
+	} else if query.CollapseField != "" {
+		searchQuery, err = SQL("search_collapse.sql")
+		if err != nil {
+			return protocol.SearchResult{}, err
+		}
+		contentlessFile = "search_collapse_contentless.sql"
+	}
 
+	var contentSpaces []string
+	var contentlessSpaces []string
+	for _, space := range query.Spaces {
+		if db.contentless[space] {
+			contentlessSpaces = append(contentlessSpaces, space)
+		} else {
+			contentSpaces = append(contentSpaces, space)
+		}
+	}
+
+	if len(contentlessSpaces) == 0 {
+		return db.searchSpaces(ctx, q, searchQuery, matchString, query, since, db.snippetLimit(query, 0))
+	}
+
+	contentlessQuery, err := SQL(contentlessFile)
+	if err != nil {
+		return protocol.SearchResult{}, err
+	}
+
+	if len(contentSpaces) == 0 {
+		return db.searchSpaces(ctx, q, contentlessQuery, matchString, query, since, 0)
+	}
+
+	// Contentless spaces are searched in a separate index.
+	// Fetch all hits up to the end of the requested page from
+	// both indexes, and merge.
+	pageStart := int(query.PageOffset) * int(query.PageLimit)
+	pageEnd := pageStart + int(query.PageLimit)
+	if pageEnd > math.MaxUint16 {
+		pageEnd = math.MaxUint16
+	}
+
+	var merged protocol.SearchResult
+	var hitLists [][]protocol.SearchHit
+	parts := []struct {
+		sql    string
+		spaces []string
+	}{
+		{searchQuery, contentSpaces},
+		{contentlessQuery, contentlessSpaces},
+	}
+	for _, part := range parts {
+		partQuery := query
+		partQuery.Spaces = part.spaces
+		partQuery.PageLimit = uint16(pageEnd)
+		partQuery.PageOffset = 0
+
+		// Hits can move up to pageStart positions when merged
+		result, err := db.searchSpaces(
+			ctx, q, part.sql, matchString, partQuery, since, db.snippetLimit(query, pageStart),
+		)
+		if err != nil {
+			return result, err
+		}
+		merged.TotalHits += result.TotalHits
+		merged.Capped = merged.Capped || result.Capped
+		hitLists = append(hitLists, result.Hits)
+	}
+	if merged.TotalHits > db.resultCap {
+		merged.TotalHits = db.resultCap
+		merged.Capped = true
+	}
+
+	if db.tiebreak {
+		merged.Hits = protocol.MergeHits(pageEnd, hitLists...)
+	} else {
+		merged.Hits = protocol.MergeHitsUntied(pageEnd, hitLists...)
+	}
+	if query.CollapseField != "" {
+		// Groups can span both indexes
+		merged.Hits = protocol.CollapseHits(merged.Hits)
+	}
+	if pageStart > len(merged.Hits) {
+		pageStart = len(merged.Hits)
+	}
+	merged.Hits = merged.Hits[pageStart:]
+
+	return merged, nil
+}
+
+// splitSpaces splits the given spaces into those present in the
+// index and searchable, those that are not present, and those
+// with search disabled.
+func (db *database) splitSpaces(ctx context.Context, spaces []string) (found, missing, unavailable []string, err error) {
+	if len(spaces) == 0 {
+		return nil, nil, nil, nil
+	}
+	query, args, err := sqlx.In(`select space, searchDisabled from spaces where space in (?)`, spaces)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var present []struct {
+		Space          string
+		SearchDisabled bool `db:"searchDisabled"`
+	}
+	err = db.rdb.SelectContext(ctx, &present, query, args...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	exists := map[string]bool{}
+	disabled := map[string]bool{}
+	for _, space := range present {
+		exists[space.Space] = true
+		disabled[space.Space] = space.SearchDisabled || db.searchDisabled[space.Space]
+	}
+	for _, space := range spaces {
+		switch {
+		case !exists[space]:
+			missing = append(missing, space)
+		case disabled[space]:
+			unavailable = append(unavailable, space)
+		default:
+			found = append(found, space)
+		}
+	}
+	return found, missing, unavailable, nil
+}
+
+// getSpaceWatermarks reads the update time of the last indexed document
+// of each space, see InterestListState.LastUpdated.
+// Spaces without indexed documents are left out.
+func (db *database) getSpaceWatermarks(
+	ctx context.Context, q sqlx.QueryerContext, spaces []string,
+) (map[string]time.Time, error) {
+	if len(spaces) == 0 {
+		return nil, nil
+	}
+	query, args, err := sqlx.In(`select space, lastUpdatedAtNanos from spaces where space in (?)`, spaces)
+	if err != nil {
+		return nil, err
+	}
+	var states []struct {
+		Space       string
+		LastUpdated int64 `db:"lastUpdatedAtNanos"`
+	}
+	err = sqlx.SelectContext(ctx, q, &states, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var watermarks map[string]time.Time
+	for _, state := range states {
+		if state.LastUpdated == 0 {
+			continue
+		}
+		if watermarks == nil {
+			watermarks = map[string]time.Time{}
+		}
+		watermarks[state.Space] = time.Unix(0, state.LastUpdated).UTC()
+	}
+	return watermarks, nil
+}
+
+// Matches are counted in one pass, without ranking, scanning one match
+// beyond the estimate cap to tell if the cap was reached.
+const estimateSQL = `
+with
+matches as (
+    select rowid from %[1]s where %[1]s match :match and rowid > :since limit :estimateCap
+)
+select
+    count(*) as scanned,
+    count(spaces.spaceID) as total
+from
+    matches
+    left join docs on
+        docs.id = matches.rowid
+        and docs.alive
+        and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+    left join spaces on
+        spaces.spaceID = docs.spaceID
+        and spaces.space in (:spaces)
+`
+
+// estimateTotal counts the hits of a query up to the estimate cap,
+// reporting if the count is a lower bound.
+func (db *database) estimateTotal(
+	ctx context.Context, q sqlx.QueryerContext, matchString string, query protocol.SearchRequest, since int64,
+) (int, bool, error) {
+	languages, err := jsonLanguages(query)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var contentSpaces []string
+	var contentlessSpaces []string
+	for _, space := range query.Spaces {
+		if db.contentless[space] {
+			contentlessSpaces = append(contentlessSpaces, space)
+		} else {
+			contentSpaces = append(contentSpaces, space)
+		}
+	}
+	parts := []struct {
+		table  string
+		spaces []string
+	}{
+		{"fts", contentSpaces},
+		{"ftsc", contentlessSpaces},
+	}
+	if query.Phonetic {
+		parts = parts[:1]
+		parts[0].table = "ftsp"
+		parts[0].spaces = query.Spaces
+	}
+	if query.ExactCase {
+		parts = parts[:1]
+		parts[0].table = "ftse"
+		parts[0].spaces = query.Spaces
+	}
+
+	var total int
+	var lowerBound bool
+	for _, part := range parts {
+		if len(part.spaces) == 0 {
+			continue
+		}
+		namedQuery, namedArgs, err := sqlx.Named(fmt.Sprintf(estimateSQL, part.table), map[string]interface{}{
+			"match":       matchString,
+			"estimateCap": db.estimateCap + 1,
+			"spaces":      part.spaces,
+			"since":       since,
+			"languages":   languages,
+		})
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to expand named binds: %w", err)
+		}
+		spacedQuery, args, err := sqlx.In(namedQuery, namedArgs...)
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to expand 'in' values: %w", err)
+		}
+
+		var count struct {
+			Total   int
+			Scanned int
+		}
+		err = sqlx.GetContext(ctx, q, &count, spacedQuery, args...)
+		if err != nil {
+			return 0, false, err
+		}
+		total += min(count.Total, db.estimateCap)
+		lowerBound = lowerBound || count.Scanned > db.estimateCap
+	}
+	return total, lowerBound, nil
+}
+
+// Space counts, facets and numeric stats are aggregated from one pass
+// over the matches, materialized once and shared by all.
+// The cap is applied to matches in all spaces, like for search totals.
+const aggregateSQL = `
+with
+matches as (
+    select rowid from %[1]s where %[1]s match :match and rowid > :since limit :cap
+),
+hits as materialized (
+    select docs.spaceID, docs.docID, spaces.space
+    from
+        matches
+        join docs on docs.id = matches.rowid
+        join spaces using(spaceID)
+    where
+        space in (:spaces)
+        and docs.alive
+        and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+)
+%[2]s
+`
+
+const spaceCountsSQL = `
+select 'space' as kind, '' as field, space as value, count(*) as count, null as min, null as max, null as sum
+from hits
+group by space
+`
+
+const facetsSQL = `
+select 'facet' as kind, docvalues.field, docvalues.value, count(*) as count, null as min, null as max, null as sum
+from
+    hits
+    join docvalues using(spaceID, docID)
+where
+    docvalues.field in (:facets)
+group by docvalues.field, docvalues.value
+`
+
+const numericStatsSQL = `
+select
+    'stats' as kind, docfields.field, '' as value, count(*) as count,
+    min(docfields.num) as min, max(docfields.num) as max, sum(docfields.num) as sum
+from
+    hits
+    join docfields using(spaceID, docID)
+where
+    docfields.field in (:numericStats)
+    and docfields.num is not null
+group by docfields.field
+`
+
+// aggregate counts the hits in each space and for each facet value,
+// and computes numeric field stats, up to the result cap, as requested
+// by the query.
+func (db *database) aggregate(
+	ctx context.Context, q sqlx.QueryerContext, matchString string, query protocol.SearchRequest, since int64,
+) (
+	map[string]int, map[string][]protocol.FacetBucket, map[string]protocol.NumericStats, error,
+) {
+	var contentSpaces []string
+	var contentlessSpaces []string
+	for _, space := range query.Spaces {
+		if db.contentless[space] {
+			contentlessSpaces = append(contentlessSpaces, space)
+		} else {
+			contentSpaces = append(contentSpaces, space)
+		}
+	}
+
+	var selects []string
+	if query.CountSpaces {
+		selects = append(selects, spaceCountsSQL)
+	}
+	if len(query.Facets) > 0 {
+		selects = append(selects, facetsSQL)
+	}
+	if len(query.NumericStats) > 0 {
+		selects = append(selects, numericStatsSQL)
+	}
+	if len(selects) == 0 {
+		return nil, nil, nil, nil
+	}
+	aggregates := strings.Join(selects, "union all")
+
+	languages, err := jsonLanguages(query)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var counts map[string]int
+	if query.CountSpaces {
+		counts = map[string]int{}
+	}
+	var facetLists []map[string][]protocol.FacetBucket
+	var statsLists []map[string]protocol.NumericStats
+	parts := []struct {
+		table  string
+		spaces []string
+	}{
+		{"fts", contentSpaces},
+		{"ftsc", contentlessSpaces},
+	}
+	if query.Phonetic {
+		parts = parts[:1]
+		parts[0].table = "ftsp"
+		parts[0].spaces = query.Spaces
+	}
+	if query.ExactCase {
+		parts = parts[:1]
+		parts[0].table = "ftse"
+		parts[0].spaces = query.Spaces
+	}
+	for _, part := range parts {
+		if len(part.spaces) == 0 {
+			continue
+		}
+		namedQuery, namedArgs, err := sqlx.Named(fmt.Sprintf(aggregateSQL, part.table, aggregates), map[string]interface{}{
+			"match":        matchString,
+			"cap":          db.resultCap,
+			"spaces":       part.spaces,
+			"facets":       query.Facets,
+			"numericStats": query.NumericStats,
+			"since":        since,
+			"languages":    languages,
+		})
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to expand named binds: %w", err)
+		}
+		spacedQuery, args, err := sqlx.In(namedQuery, namedArgs...)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to expand 'in' values: %w", err)
+		}
+
+		var rows []struct {
+			Kind  string
+			Field string
+			Value string
+			Count int
+			Min   sql.NullFloat64
+			Max   sql.NullFloat64
+			Sum   sql.NullFloat64
+		}
+		err = sqlx.SelectContext(ctx, q, &rows, spacedQuery, args...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		facets := map[string][]protocol.FacetBucket{}
+		stats := map[string]protocol.NumericStats{}
+		for _, row := range rows {
+			switch row.Kind {
+			case "space":
+				counts[row.Value] = row.Count
+			case "facet":
+				facets[row.Field] = append(facets[row.Field], protocol.FacetBucket{
+					Value: row.Value, Count: row.Count,
+				})
+			case "stats":
+				stats[row.Field] = protocol.NumericStats{
+					Count: row.Count,
+					Min:   row.Min.Float64,
+					Max:   row.Max.Float64,
+					Sum:   row.Sum.Float64,
+					Avg:   row.Sum.Float64 / float64(row.Count),
+				}
+			}
+		}
+		facetLists = append(facetLists, facets)
+		statsLists = append(statsLists, stats)
+	}
+
+	var facets map[string][]protocol.FacetBucket
+	if len(query.Facets) > 0 {
+		limit := int(query.FacetLimit)
+		if limit == 0 {
+			limit = protocol.DefaultFacetLimit
+		}
+		facets = protocol.MergeFacets(limit, facetLists...)
+	}
+	return counts, facets, protocol.MergeNumericStats(statsLists...), nil
+}
+
+// jsonLanguages encodes the language filter of a query as a JSON
+// array, bound as ":languages" in search queries.
+func jsonLanguages(query protocol.SearchRequest) (string, error) {
+	if len(query.Languages) == 0 {
+		return "[]", nil
+	}
+	languages, err := json.Marshal(query.Languages)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode languages: %w", err)
+	}
+	return string(languages), nil
+}
+
+func (db *database) searchSpaces(
+	ctx context.Context, q sqlx.QueryerContext, searchQuery string, matchString string,
+	query protocol.SearchRequest, since int64, snippets int,
+) (
+	protocol.SearchResult, error,
+) {
 	type hit struct {
 		protocol.SearchHit
 		Total int
+		// Number of matches, when Total counts collapsed groups
+		Matches int
 	}
 	var hits []hit
 
 	var result protocol.SearchResult
 
-	spaceArgs := make([]interface{}, len(spaces))
-	for i, v := range spaces {
-		spaceArgs[i] = v
+	demotions, err := json.Marshal(query.Demotions)
+	if err != nil {
+		return result, fmt.Errorf("failed to encode demotions: %w", err)
 	}
-	spacedQuery, spacedArgs, err := sqlx.In(query, spaceArgs...)
+	if query.Demotions == nil {
+		demotions = []byte("[]")
+	}
+	languages, err := jsonLanguages(query)
 	if err != nil {
-		return result, fmt.Errorf("failed to expand 'in' values: %w", err)
+		return result, err
 	}
 
-	namedQuery, namedArgs, err := sqlx.Named(spacedQuery, map[string]interface{}{
-		"match":  matchString,
-		"cap":    db.resultCap + 1,
-		"limit":  pageLimit,
-		"offset": pageOffset * pageLimit,
+	snippetBefore, snippetLength, snippetOpen, snippetClose := db.snippetOptions(query)
+
+	namedQuery, namedArgs, err := sqlx.Named(searchQuery, map[string]interface{}{
+		"match":          matchString,
+		"cap":            db.resultCap + 1,
+		"spaces":         query.Spaces,
+		"demotions":      string(demotions),
+		"decayHalfLife":  query.DecayHalfLifeHours,
+		"positionWeight": db.positionWeight,
+		"positionCutoff": db.positionCutoff,
+		"now":            time.Now().UnixNano(),
+		"limit":          query.PageLimit,
+		"offset":         query.PageOffset * query.PageLimit,
+		"since":          since,
+		"languages":      languages,
+		"collapseField":  query.CollapseField,
+		"snippets":       snippets,
+		"snippetBefore":  snippetBefore,
+		"snippetLength":  snippetLength,
+		"snippetOpen":    snippetOpen,
+		"snippetClose":   snippetClose,
+		"tiebreak":       db.tiebreak,
+		"boost":          !query.IgnoreBoost,
 	})
 	if err != nil {
 		return result, fmt.Errorf("failed to expand named binds: %w", err)
 	}
 
-	args := append(namedArgs[:0:0], namedArgs[:2]...)
-	args = append(args, spacedArgs...)
-	args = append(args, namedArgs[2:]...)
+	spacedQuery, args, err := sqlx.In(namedQuery, namedArgs...)
+	if err != nil {
+		return result, fmt.Errorf("failed to expand 'in' values: %w", err)
+	}
 
-	//logger.Debug.Printf("Search query: [%s], args: %v", namedQuery, args)
-	err = db.rdb.SelectContext(ctx, &hits, namedQuery, args...)
+	//logger.Debug.Printf("Search query: [%s], args: %v", spacedQuery, args)
+	err = sqlx.SelectContext(ctx, q, &hits, spacedQuery, args...)
 	if err != nil {
 		return result, err
 	}
@@ -112,6 +1035,9 @@ func (db *database) search(
 	if len(hits) > 0 {
 		result.TotalHits = hits[0].Total
 	}
+	if len(hits) > 0 && hits[0].Matches > db.resultCap {
+		result.Capped = true
+	}
 	if result.TotalHits > db.resultCap {
 		result.TotalHits = db.resultCap
 		result.Capped = true
@@ -0,0 +1,78 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// setSpaceControl stores the search and indexing settings of a space
+func (db *database) setSpaceControl(ctx context.Context, control protocol.SpaceControl) error {
+	result, err := db.wdb.ExecContext(ctx,
+		`update spaces set searchDisabled = ?, indexPaused = ? where space = ? and not retired`,
+		control.SearchDisabled, control.IndexPaused, control.Space,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("no space %q in index", control.Space)
+	}
+	return nil
+}
+
+// getSpaceControls lists the spaces with search disabled, by config or
+// at runtime, and the spaces with indexing paused, in name order.
+func (db *database) getSpaceControls(ctx context.Context) (searchDisabled, indexPaused []string, err error) {
+	var rows []struct {
+		Space          string
+		SearchDisabled bool `db:"searchDisabled"`
+		IndexPaused    bool `db:"indexPaused"`
+	}
+	err = db.rdb.SelectContext(ctx, &rows, `
+		select space, searchDisabled, indexPaused from spaces
+		where not retired and (searchDisabled or indexPaused)
+		`)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	disabled := map[string]bool{}
+	for space := range db.searchDisabled {
+		disabled[space] = true
+	}
+	for _, row := range rows {
+		if row.SearchDisabled {
+			disabled[row.Space] = true
+		}
+		if row.IndexPaused {
+			indexPaused = append(indexPaused, row.Space)
+		}
+	}
+	for space := range disabled {
+		searchDisabled = append(searchDisabled, space)
+	}
+	sort.Strings(searchDisabled)
+	sort.Strings(indexPaused)
+	return searchDisabled, indexPaused, nil
+}
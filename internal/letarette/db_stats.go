@@ -0,0 +1,170 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// StatsSample is a sample of key index statistics at one point in time
+type StatsSample struct {
+	Sampled time.Time
+	// Number of alive documents, in total and by space
+	Docs      int
+	SpaceDocs map[string]int
+	// Number of distinct terms, and of term occurrences
+	UniqueTerms int
+	TotalTerms  int
+	// Size of the database file
+	Bytes int64
+}
+
+// sampleStats collects key statistics of the index.
+// Term counts are read from the fts5vocab "row" table, visiting each
+// distinct term once.
+func (db *database) sampleStats(ctx context.Context) (StatsSample, error) {
+	sample := StatsSample{
+		Sampled:   time.Now(),
+		SpaceDocs: map[string]int{},
+	}
+
+	conn, err := db.wdb.Connx(ctx)
+	if err != nil {
+		return sample, err
+	}
+	defer conn.Close()
+
+	var spaces []struct {
+		Space string
+		Docs  int
+	}
+	err = conn.SelectContext(ctx, &spaces, `
+		select space, count(docs.id) as docs
+		from spaces left join docs on docs.spaceID = spaces.spaceID and docs.alive
+		group by space
+		`)
+	if err != nil {
+		return sample, fmt.Errorf("failed to count documents: %w", err)
+	}
+	for _, space := range spaces {
+		sample.SpaceDocs[space.Space] = space.Docs
+		sample.Docs += space.Docs
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`create virtual table if not exists temp.samplestats using fts5vocab(main, 'fts', 'row')`,
+	)
+	if err != nil {
+		return sample, err
+	}
+	err = conn.QueryRowxContext(
+		ctx, `select count(*), ifnull(sum(cnt), 0) from temp.samplestats`,
+	).Scan(&sample.UniqueTerms, &sample.TotalTerms)
+	if err != nil {
+		return sample, fmt.Errorf("failed to count terms: %w", err)
+	}
+
+	err = conn.QueryRowxContext(
+		ctx, `select page_count * page_size from pragma_page_count(), pragma_page_size()`,
+	).Scan(&sample.Bytes)
+	if err != nil {
+		return sample, fmt.Errorf("failed to get database size: %w", err)
+	}
+
+	return sample, nil
+}
+
+// addStatsSample stores a sample, and drops samples older than the retention
+func (db *database) addStatsSample(ctx context.Context, sample StatsSample, retention time.Duration) error {
+	spaceDocs, err := json.Marshal(sample.SpaceDocs)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.wdb.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `
+		replace into statshistory (sampled, docs, uniqueTerms, totalTerms, bytes, spaceDocs)
+		values (?, ?, ?, ?, ?, ?)
+		`,
+		sample.Sampled.UnixNano(), sample.Docs, sample.UniqueTerms, sample.TotalTerms,
+		sample.Bytes, string(spaceDocs),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store stats sample: %w", err)
+	}
+
+	_, err = tx.ExecContext(
+		ctx, `delete from statshistory where sampled < ?`, sample.Sampled.Add(-retention).UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to drop old stats samples: %w", err)
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		tx = nil
+	}
+	return err
+}
+
+// getStatsHistory lists stored samples taken after a point in time, oldest first
+func (db *database) getStatsHistory(ctx context.Context, after time.Time) ([]StatsSample, error) {
+	var rows []struct {
+		Sampled     int64
+		Docs        int
+		UniqueTerms int `db:"uniqueTerms"`
+		TotalTerms  int `db:"totalTerms"`
+		Bytes       int64
+		SpaceDocs   string `db:"spaceDocs"`
+	}
+	err := db.rdb.SelectContext(ctx, &rows, `
+		select sampled, docs, uniqueTerms, totalTerms, bytes, spaceDocs
+		from statshistory
+		where sampled > ?
+		order by sampled
+		`, after.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]StatsSample, len(rows))
+	for i, row := range rows {
+		samples[i] = StatsSample{
+			Sampled:     time.Unix(0, row.Sampled),
+			Docs:        row.Docs,
+			UniqueTerms: row.UniqueTerms,
+			TotalTerms:  row.TotalTerms,
+			Bytes:       row.Bytes,
+		}
+		err = json.Unmarshal([]byte(row.SpaceDocs), &samples[i].SpaceDocs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode space counts: %w", err)
+		}
+	}
+	return samples, nil
+}
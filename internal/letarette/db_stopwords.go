@@ -16,8 +16,11 @@ package letarette
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
+
+	"github.com/jmoiron/sqlx"
 )
 
 /*
@@ -54,6 +57,56 @@ func (db *database) stopwordFilterPhrases(ctx context.Context, unfiltered []Phra
 	return filtered, nil
 }
 
+// isStopwordQuery reports if all included words of a query are stop
+// words, which the query tokenizer removes, leaving nothing to match.
+// Like in the tokenizer, phrases of several words and wildcard phrases
+// keep their stop words.
+func (db *database) isStopwordQuery(ctx context.Context, q sqlx.QueryerContext, phrases []Phrase) (bool, error) {
+	words := map[string]bool{}
+	for _, phrase := range phrases {
+		if phrase.Exclude {
+			continue
+		}
+		word := strings.ToLower(unquote(phrase.Text))
+		if phrase.Wildcard || strings.Contains(word, " ") {
+			return false, nil
+		}
+		words[word] = true
+	}
+	if len(words) == 0 {
+		return false, nil
+	}
+
+	wordList := make([]string, 0, len(words))
+	for word := range words {
+		wordList = append(wordList, word)
+	}
+	jsonWords, err := json.Marshal(wordList)
+	if err != nil {
+		return false, err
+	}
+	var stopwords int
+	err = sqlx.GetContext(
+		ctx, q, &stopwords,
+		`select count(distinct word) from stopwords where word in (select value from json_each(?))`,
+		string(jsonWords),
+	)
+	return stopwords == len(words), err
+}
+
+// keepStopwords quotes single word phrases with a trailing space,
+// which turns off stop word removal in the query tokenizer.
+func keepStopwords(phrases []Phrase) []Phrase {
+	kept := make([]Phrase, len(phrases))
+	for i, phrase := range phrases {
+		if !phrase.Wildcard && !phrase.Group {
+			phrase.Text = fmt.Sprintf(`"%s "`, unquote(phrase.Text))
+		}
+		kept[i] = phrase
+	}
+	return kept
+}
+
 func (db *database) updateStopwords(ctx context.Context, stopwordPercentageCutoff float32) error {
 	sql := db.getRawDB()
 
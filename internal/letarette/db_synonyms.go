@@ -17,6 +17,10 @@ package letarette
 import (
 	"context"
 	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
 )
 
 // Synonyms is a named list of words that are considered synonyms
@@ -75,3 +79,132 @@ func SetSynonyms(ctx context.Context, dbo Database, synonyms []Synonyms) error {
 	tx = nil
 	return nil
 }
+
+// phraseSynonyms holds the synonym groups containing multi-word synonyms,
+// by the lower case words of each synonym. Groups of single words only are
+// handled by the stemmer, which adds synonyms of query tokens at the same
+// position. Multi-word synonyms span several positions, and are expanded
+// before searching instead, see expand.
+type phraseSynonyms struct {
+	groups map[string][]string
+	// Max number of words in a synonym
+	maxWords int
+}
+
+// getPhraseSynonyms reads the synonym groups containing multi-word synonyms
+func (db *database) getPhraseSynonyms(ctx context.Context, q sqlx.QueryerContext) (phraseSynonyms, error) {
+	var words []struct {
+		SynonymID int `db:"synonymID"`
+		Word      string
+	}
+	err := sqlx.SelectContext(ctx, q, &words, `
+		select synonymID, word from synonym_words
+		where synonymID in (
+			select synonymID from synonym_words where trim(word) like '% %'
+		)
+		order by synonymID, rowid
+	`)
+	if err != nil {
+		return phraseSynonyms{}, fmt.Errorf("failed to read synonyms: %w", err)
+	}
+
+	result := phraseSynonyms{groups: map[string][]string{}}
+	var group []string
+	for i, word := range words {
+		group = append(group, word.Word)
+		if i+1 < len(words) && words[i+1].SynonymID == word.SynonymID {
+			continue
+		}
+		for _, synonym := range group {
+			words := synonymWords(synonym)
+			result.groups[strings.Join(words, " ")] = group
+			result.maxWords = max(result.maxWords, len(words))
+		}
+		group = nil
+	}
+	return result, nil
+}
+
+// synonymWords splits a synonym or a phrase into lower case words
+// like the indexer does, dropping quotes and other punctuation.
+func synonymWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// expandable reports whether any of the phrases can match a synonym,
+// see expand. OR groups and phrases without words have no synonyms.
+func expandable(phrases []Phrase) bool {
+	for _, phrase := range phrases {
+		if !phrase.Group && len(synonymWords(phrase.Text)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// expand replaces query phrases matching a synonym by the synonym,
+// returning the resulting phrases and the synonym group of each phrase,
+// or nil for phrases without synonyms.
+//
+// Included phrases are matched together with the included phrases
+// following them, with the same column, so that both a single word and
+// a sequence of words can match a multi-word synonym. Excluded and
+// wildcard phrases only match on their own, and OR groups have no synonyms.
+//
+// Synonyms can overlap, like "new york" and "new york city", or
+// "new york" and "york city". The longest synonym starting at the first
+// phrase wins, and phrases are then matched from the end of that synonym.
+// With the synonyms "new york" and "york city", the query "new york city"
+// matches "new york", followed by "city". With "new york city" added,
+// it matches "new york city".
+func (s phraseSynonyms) expand(phrases []Phrase) ([]Phrase, [][]string) {
+	if len(s.groups) == 0 {
+		return phrases, make([][]string, len(phrases))
+	}
+
+	var expanded []Phrase
+	var groups [][]string
+	for i := 0; i < len(phrases); {
+		first := phrases[i]
+		end := i + 1
+		if !first.Exclude && !first.Wildcard && !first.Group {
+			for end < len(phrases) && end-i < s.maxWords {
+				next := phrases[end]
+				if next.Exclude || next.Wildcard || next.Group || next.Column != first.Column {
+					break
+				}
+				end++
+			}
+		}
+
+		var group []string
+		for ; end > i; end-- {
+			var words []string
+			for _, phrase := range phrases[i:end] {
+				words = append(words, synonymWords(phrase.Text)...)
+			}
+			if found, ok := s.groups[strings.Join(words, " ")]; ok {
+				group = found
+				break
+			}
+		}
+		if group == nil {
+			expanded = append(expanded, first)
+			groups = append(groups, nil)
+			i++
+			continue
+		}
+
+		var texts []string
+		for _, phrase := range phrases[i:end] {
+			texts = append(texts, phrase.Text)
+		}
+		first.Text = strings.Join(texts, " ")
+		expanded = append(expanded, first)
+		groups = append(groups, group)
+		i = end
+	}
+	return expanded, groups
+}
@@ -15,17 +15,28 @@
 package letarette
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/nats-io/nats.go"
+
 	"github.com/erkkah/letarette/internal/snowball"
+	"github.com/erkkah/letarette/pkg/client"
 	"github.com/erkkah/letarette/pkg/protocol"
 
 	xt "github.com/erkkah/letarette/pkg/xt"
@@ -61,6 +72,8 @@ func getTestSetup(t *testing.T, compress ...bool) *testSetup {
 	}
 
 	setup.config.Stemmer.Languages = []string{"english"}
+	setup.config.Search.Strategy = 1
+	setup.config.Search.Cap = 1000
 
 	db, err := OpenDatabase(setup.config)
 	if err != nil {
@@ -80,60 +93,2482 @@ func TestOpen(t *testing.T) {
 	xt.Assertf(setup.db != nil, "Database is nil!")
 }
 
-func TestAddDocument_EmptySpace(t *testing.T) {
+func TestCheckSchemaReady(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	latest, err := latestMigrationVersion()
+	xt.Nil(err)
+	xt.Equal(latest, setup.db.latestMigration)
+	xt.True(setup.db.checkSchemaReady(ctx))
+
+	// Simulate another worker migrating
+	setup.db.schemaReady = 0
+	_, err = setup.db.wdb.Exec(`update schema_migrations set dirty = true`)
+	xt.Nil(err)
+	xt.False(setup.db.checkSchemaReady(ctx))
+
+	go func() {
+		time.Sleep(migrationPollInterval * 3)
+		_, _ = setup.db.wdb.Exec(`update schema_migrations set dirty = false`)
+	}()
+	err = initDB(setup.db.wdb, setup.config.Index.Spaces, 5*time.Second)
+	xt.Nilf(err, "Expected migration to be waited for, got %v", err)
+	xt.True(setup.db.checkSchemaReady(ctx))
+
+	_, err = setup.db.wdb.Exec(`update schema_migrations set dirty = true`)
+	xt.Nil(err)
+	err = initDB(setup.db.wdb, setup.config.Index.Spaces, migrationPollInterval)
+	xt.NotNil(err)
+	// Checked only until ready
+	xt.True(setup.db.checkSchemaReady(ctx))
+}
+
+func TestAddDocument_EmptySpace(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	docs := []protocol.Document{
+		{},
+	}
+	err := setup.db.addDocumentUpdates(ctx, "", docs)
+	xt.Containsf(err, "no such space", "Adding document with empty space should fail")
+}
+
+func TestAddDocument_NewDocument(t *testing.T) {
+	setup := getTestSetup(t, false)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	// "Cortex " below (note the space) is a "valid"
+	// compressed header in the original sqlite3 compress extension.
+	docs := []protocol.Document{
+		{
+			ID:      "myID",
+			Updated: time.Now(),
+			Text:    "Cortex and such",
+			Alive:   true,
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+
+	xt.Nilf(err, "Failed to add new document")
+}
+
+func TestAddDocument_NewDocument_Compressed(t *testing.T) {
+	setup := getTestSetup(t, true)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{
+			ID:      "myID",
+			Updated: time.Now(),
+			Text:    "tjo och hej",
+			Alive:   true,
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+
+	xt.Nilf(err, "Failed to add new document")
+}
+
+func TestAddMultiSpaceDocumentUpdates(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	err := setup.db.RawExec(`insert into spaces (space, lastUpdatedAtNanos) values("other", 0)`)
+	xt.Nilf(err, "Failed to create space: %v", err)
+
+	countDocs := func() int {
+		var count int
+		err := setup.db.rdb.Get(&count, "select count(*) from docs")
+		xt.Nilf(err, "Failed to count docs: %v", err)
+		return count
+	}
+
+	doc := func(id string) []protocol.Document {
+		return []protocol.Document{
+			{
+				ID:      protocol.DocumentID(id),
+				Updated: time.Now(),
+				Text:    "tjo och hej",
+				Alive:   true,
+			},
+		}
+	}
+
+	ctx := context.Background()
+	err = setup.db.addMultiSpaceDocumentUpdates(ctx, []protocol.DocumentUpdate{
+		{Space: "test", Documents: doc("first")},
+		{Space: "kawonka", Documents: doc("second")},
+	})
+	xt.Containsf(err, "no such space", "Update with unknown space should fail")
+	xt.Equalf(0, countDocs(), "Partially applied update should not be visible")
+
+	err = setup.db.addMultiSpaceDocumentUpdates(ctx, []protocol.DocumentUpdate{
+		{Space: "test", Documents: doc("first")},
+		{Space: "other", Documents: doc("second")},
+	})
+	xt.Nilf(err, "Failed to add multi space update: %v", err)
+	xt.Equalf(2, countDocs(), "Expected documents in both spaces")
+}
+
+func TestSearch_Demotions(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+	setup.db.storedFields = map[string]bool{"state": true}
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{
+			ID:      "archived",
+			Updated: time.Now(),
+			Text:    "banana banana banana",
+			Alive:   true,
+			Fields:  map[string]string{"state": "archived"},
+		},
+		{
+			ID:      "current",
+			Updated: time.Now(),
+			Text:    "banana split with a lot of other things in it",
+			Alive:   true,
+			Fields:  map[string]string{"state": "current"},
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	phrases := ParseQuery("banana")
+
+	result, err := setup.db.search(ctx, phrases, query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(2, len(result.Hits), "Expected all documents")
+	xt.Equalf(protocol.DocumentID("archived"), result.Hits[0].ID, "Expected best match first")
+
+	query.Demotions = []protocol.Demotion{
+		{Field: "state", Value: "archived", Factor: 0.1},
+	}
+	result, err = setup.db.search(ctx, phrases, query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(2, len(result.Hits), "Expected demoted documents to be kept")
+	xt.Equalf(protocol.DocumentID("current"), result.Hits[0].ID, "Expected demoted document last")
+}
+
+func TestSearch_Boost(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	strong := protocol.Document{
+		ID:      "strong",
+		Updated: time.Now(),
+		Text:    "banana banana banana",
+		Alive:   true,
+	}
+	weak := protocol.Document{
+		ID:      "weak",
+		Updated: time.Now(),
+		Text:    "banana split with a lot of other things in it",
+		Alive:   true,
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{strong, weak})
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	phrases := ParseQuery("banana")
+
+	result, err := setup.db.search(ctx, phrases, query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(2, len(result.Hits), "Expected all documents")
+	xt.Equalf(protocol.DocumentID("strong"), result.Hits[0].ID, "Expected best match first")
+
+	// Ranks are negative bm25 scores, the ratio is the boost
+	// needed for the weaker match to catch up.
+	threshold := result.Hits[0].Rank / result.Hits[1].Rank
+	xt.Truef(threshold > 1, "Expected different ranks")
+
+	weak.Boost = threshold * 0.9
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{weak})
+	xt.Nilf(err, "Failed to add documents: %v", err)
+	result, err = setup.db.search(ctx, phrases, query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(protocol.DocumentID("strong"), result.Hits[0].ID, "Expected boost below threshold to keep order")
+
+	weak.Boost = threshold * 1.1
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{weak})
+	xt.Nilf(err, "Failed to add documents: %v", err)
+	result, err = setup.db.search(ctx, phrases, query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(protocol.DocumentID("weak"), result.Hits[0].ID, "Expected boosted document first")
+
+	query.IgnoreBoost = true
+	result, err = setup.db.search(ctx, phrases, query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(protocol.DocumentID("strong"), result.Hits[0].ID, "Expected boost to be ignored")
+}
+
+func TestDocumentBoost(t *testing.T) {
+	xt := xt.X(t)
+
+	xt.Equal(1.0, documentBoost(0))
+	xt.Equal(1.0, documentBoost(-2))
+	xt.Equal(2.0, documentBoost(2))
+	xt.Equal(protocol.MinBoost, documentBoost(0.0001))
+	xt.Equal(float64(protocol.MaxBoost), documentBoost(1000))
+}
+
+func TestSearch_Fuzzy(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{
+			ID:      "receive",
+			Updated: time.Now(),
+			Text:    "please receive this message",
+			Alive:   true,
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+	err = UpdateSpellfix(ctx, setup.db, 1)
+	xt.Nilf(err, "Failed to update spelling index: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	search := func(phrase string, fuzzy int) int {
+		query.Fuzzy = fuzzy
+		result, err := setup.db.search(ctx, ParseQuery(phrase), query)
+		xt.Nilf(err, "Search failed: %v", err)
+		return len(result.Hits)
+	}
+
+	xt.Equalf(1, search("receive", 0), "Expected exact match")
+	xt.Equalf(0, search("receve", 0), "Expected no match without fuzzy")
+	xt.Equalf(1, search("receve", 1), "Expected one edit to match")
+	xt.Equalf(0, search("recieve", 1), "Expected two edits not to match at distance one")
+	xt.Equalf(1, search("recieve", 2), "Expected two edits to match")
+	xt.Equalf(1, search("receive", 2), "Expected exact match with fuzzy")
+
+	searcher := &searcher{db: setup.db}
+	query.Fuzzy = protocol.MaxFuzzy + 1
+	err = searcher.validateRequest(query, ParseQuery("recieve"))
+	xt.Truef(errors.Is(err, errInvalidQuery), "Expected distance above cap to be rejected")
+}
+
+func TestEditDistance(t *testing.T) {
+	xt := xt.X(t)
+
+	xt.Equal(0, editDistance("receive", "receive"))
+	xt.Equal(1, editDistance("receve", "receive"))
+	xt.Equal(2, editDistance("recieve", "receive"))
+	xt.Equal(3, editDistance("", "åäö"))
+}
+
+func TestSearch_ColumnFilters(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{
+			ID:      "title",
+			Updated: time.Now(),
+			Title:   "banana",
+			Text:    "split",
+			Alive:   true,
+		},
+		{
+			ID:      "text",
+			Updated: time.Now(),
+			Title:   "split",
+			Text:    "banana",
+			Alive:   true,
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+
+	result, err := setup.db.search(ctx, ParseQuery("title:banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected title match only")
+	xt.Equalf(protocol.DocumentID("title"), result.Hits[0].ID, "Expected title match")
+
+	result, err = setup.db.search(ctx, ParseQuery(`split txt:"banana"`), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected text match only")
+	xt.Equalf(protocol.DocumentID("text"), result.Hits[0].ID, "Expected text match")
+
+	result, err = setup.db.search(ctx, ParseQuery("banana -title:banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected title match excluded")
+	xt.Equalf(protocol.DocumentID("text"), result.Hits[0].ID, "Expected text match")
+
+	result, err = setup.db.search(ctx, ParseQuery("body:banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected body alias to match text")
+	xt.Equalf(protocol.DocumentID("text"), result.Hits[0].ID, "Expected text match")
+
+	// Adjacent column phrases match in any of their columns
+	result, err = setup.db.search(ctx, ParseQuery("title:banana body:cherry"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected match of either column phrase")
+	xt.Equalf(protocol.DocumentID("title"), result.Hits[0].ID, "Expected title match")
+
+	result, err = setup.db.search(ctx, ParseQuery("title:banana body:banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(2, len(result.Hits), "Expected matches of both column phrases")
+
+	result, err = setup.db.search(ctx, ParseQuery("title:banana split body:cherry"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(0, len(result.Hits), "Expected separated column phrases to all be required")
+
+	phrases := ParseQuery("http://example.com re:banana")
+	xt.Nil(validatePhraseColumns(phrases))
+	_, err = setup.db.search(ctx, phrases, query)
+	xt.Nilf(err, "Expected prefixes naming no column to be searchable: %v", err)
+
+	err = validatePhraseColumns([]Phrase{{Text: "banana", Column: "nope"}})
+	xt.Assertf(errors.Is(err, errInvalidQuery), "Expected unknown column to be rejected")
+}
+
+func TestSearch_BuiltQuery(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{
+			ID:      "horse",
+			Updated: time.Now(),
+			Title:   "grazing",
+			Text:    "a brown horse in the meadow",
+			Alive:   true,
+		},
+		{
+			ID:      "pony",
+			Updated: time.Now(),
+			Title:   "grazing",
+			Text:    "a brown horse in the meadow next to a pony",
+			Alive:   true,
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+
+	built := client.NewQuery().And("meadow").Phrase("brown", "horse")
+	result, err := setup.db.search(ctx, ParseQuery(built.String()), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(2, len(result.Hits), "Expected both documents to match")
+
+	built = built.Not("pony")
+	result, err = setup.db.search(ctx, ParseQuery(built.String()), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected excluded document to be removed")
+	xt.Equalf(protocol.DocumentID("horse"), result.Hits[0].ID, "Expected document without excluded term")
+}
+
+func TestSearch_OrGroups(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	texts := map[protocol.DocumentID]string{
+		"saddle": "a horse with a leather saddle",
+		"pony":   "a horse and a pony with a saddle",
+		"bridle": "a horse wearing a bridle",
+		"cart":   "a horse pulling a cart",
+	}
+	var docs []protocol.Document
+	for id, text := range texts {
+		docs = append(docs, protocol.Document{
+			ID:      id,
+			Updated: time.Now(),
+			Title:   "stable",
+			Text:    text,
+			Alive:   true,
+		})
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	matching := func(q string) []protocol.DocumentID {
+		result, err := setup.db.search(ctx, ReducePhraseList(ParseQuery(q)), query)
+		xt.Nilf(err, "Search for %q failed: %v", q, err)
+		var ids []protocol.DocumentID
+		for _, hit := range result.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+
+	saddle := client.NewQuery().And("saddle").Not("pony")
+	tack := client.NewQuery().Or("bridle", "reins")
+	built := client.NewQuery().And("horse").OrQueries(saddle, tack)
+	xt.DeepEqual([]protocol.DocumentID{"bridle", "saddle"}, matching(built.String()))
+
+	built = client.NewQuery().OrQueries(client.NewQuery().And("pony", "saddle"), client.NewQuery().Prefix("car"))
+	xt.DeepEqual([]protocol.DocumentID{"cart", "pony"}, matching(built.String()))
+
+	xt.DeepEqual([]protocol.DocumentID{"bridle", "saddle"}, matching("horse -(cart OR pony)"))
+	xt.DeepEqual([]protocol.DocumentID{"bridle", "cart"}, matching("horse -(saddle OR (leather OR pony))"))
+	xt.Equal(0, len(matching("horse (saddle OR bridle) cart")))
+}
+
+func TestSearch_TimeDecay(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{
+			ID:      "old",
+			Updated: time.Now().Add(-time.Hour * 24 * 10),
+			Text:    "banana banana banana",
+			Alive:   true,
+		},
+		{
+			ID:      "new",
+			Updated: time.Now(),
+			Text:    "banana split with a lot of other things in it",
+			Alive:   true,
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	phrases := ParseQuery("banana")
+
+	result, err := setup.db.search(ctx, phrases, query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(protocol.DocumentID("old"), result.Hits[0].ID, "Expected best match first")
+
+	query.DecayHalfLifeHours = 24
+	result, err = setup.db.search(ctx, phrases, query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(protocol.DocumentID("new"), result.Hits[0].ID, "Expected recent document first")
+}
+
+func TestSearch_PositionBoost(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	filler := strings.Repeat("apple ", 20)
+	docs := []protocol.Document{
+		{ID: "late", Updated: time.Now(), Text: filler + "banana", Alive: true},
+		{ID: "early", Updated: time.Now(), Text: "banana " + filler, Alive: true},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	phrases := ParseQuery("banana")
+
+	// Leave equal ranks in index order, see Config.Search.Tiebreaker
+	setup.db.tiebreak = false
+
+	for _, strategy := range []int{1, 2, 3} {
+		setup.db.searchStrategy = strategy
+		setup.db.positionWeight = 0
+		result, err := setup.db.search(ctx, phrases, query)
+		xt.Nilf(err, "Search failed: %v", err)
+		xt.Equalf(protocol.DocumentID("late"), result.Hits[0].ID, "Expected equal ranks in index order")
+
+		setup.db.positionWeight = 1
+		setup.db.positionCutoff = 10
+		result, err = setup.db.search(ctx, phrases, query)
+		xt.Nilf(err, "Search failed: %v", err)
+		xt.Equalf(protocol.DocumentID("early"), result.Hits[0].ID, "Expected early match first, strategy %d", strategy)
+	}
+}
+
+func TestSearch_SpaceCounts(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	var docs []protocol.Document
+	for _, id := range []protocol.DocumentID{"a", "b", "c"} {
+		docs = append(docs, protocol.Document{ID: id, Updated: time.Now(), Text: "banana", Alive: true})
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:      []string{"test"},
+		PageLimit:   1,
+		CountSpaces: true,
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected one page of hits")
+	xt.DeepEqualf(map[string]int{"test": 3}, result.SpaceCounts, "Expected counts across all pages")
+}
+
+func TestSearch_Facets(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+	setup.db.storedFields = map[string]bool{"color": true}
+
+	xt := xt.X(t)
+
+	var docs []protocol.Document
+	for i, color := range []string{"red", "blue", "red", "green"} {
+		docs = append(docs, protocol.Document{
+			ID:      protocol.DocumentID(fmt.Sprintf("doc%d", i)),
+			Updated: time.Now(),
+			Text:    "banana",
+			Alive:   true,
+			Fields:  map[string]string{"color": color},
+		})
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:      []string{"test"},
+		PageLimit:   1,
+		CountSpaces: true,
+		Facets:      []string{"color"},
+		FacetLimit:  2,
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected one page of hits")
+	xt.Equalf(4, result.TotalHits, "Expected total across all pages")
+	xt.DeepEqualf(map[string]int{"test": 4}, result.SpaceCounts, "Expected counts across all pages")
+	xt.DeepEqualf(map[string][]protocol.FacetBucket{
+		"color": {{Value: "red", Count: 2}, {Value: "blue", Count: 1}},
+	}, result.Facets, "Expected top facet buckets")
+}
+
+func TestSearch_NumericStats(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+	setup.db.storedFields = map[string]bool{"price": true}
+	setup.db.fieldParser.numeric = map[string]bool{"price": true}
+	setup.db.fieldParser.decimalSeparator = "."
+
+	xt := xt.X(t)
+
+	var docs []protocol.Document
+	for i, price := range []string{"10", "2.5", "n/a", "30"} {
+		docs = append(docs, protocol.Document{
+			ID:      protocol.DocumentID(fmt.Sprintf("doc%d", i)),
+			Updated: time.Now(),
+			Text:    "banana",
+			Alive:   true,
+			Fields:  map[string]string{"price": price},
+		})
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:       []string{"test"},
+		PageLimit:    1,
+		NumericStats: []string{"price"},
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected one page of hits")
+	xt.DeepEqualf(map[string]protocol.NumericStats{
+		"price": {Count: 3, Min: 2.5, Max: 30, Sum: 42.5, Avg: 42.5 / 3},
+	}, result.NumericStats, "Expected stats across all pages")
+}
+
+func TestSearch_EstimateTotal(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+	setup.db.resultCap = 2
+	setup.db.estimateCap = 4
+
+	xt := xt.X(t)
+
+	var docs []protocol.Document
+	for i := 0; i < 5; i++ {
+		docs = append(docs, protocol.Document{
+			ID:      protocol.DocumentID(fmt.Sprintf("doc%d", i)),
+			Updated: time.Now(),
+			Text:    "banana",
+			Alive:   i != 0,
+		})
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:        []string{"test"},
+		PageLimit:     1,
+		EstimateTotal: true,
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Assertf(result.Capped, "Expected capped result")
+	xt.Equal(2, result.TotalHits)
+	xt.Equal(4, result.EstimatedTotal)
+	xt.False(result.EstimateIsLowerBound)
+
+	setup.db.estimateCap = 3
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal(3, result.EstimatedTotal)
+	xt.True(result.EstimateIsLowerBound)
+
+	setup.db.resultCap = 10
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(result.TotalHits, result.EstimatedTotal, "Expected exact total when not capped")
+	xt.False(result.EstimateIsLowerBound)
+}
+
+func TestSearch_Tiebreaker(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	// Identical documents get equal rank
+	ids := []string{"doc3", "doc0", "doc5", "doc1", "doc4", "doc2"}
+	var docs []protocol.Document
+	for _, id := range ids {
+		docs = append(docs, protocol.Document{
+			ID:      protocol.DocumentID(id),
+			Updated: time.Now(),
+			Text:    "banana",
+			Alive:   true,
+		})
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	expected := append([]string{}, ids...)
+	sort.Strings(expected)
+
+	for strategy := 1; strategy <= 3; strategy++ {
+		setup.db.searchStrategy = strategy
+		for round := 0; round < 3; round++ {
+			var paged []string
+			for page := uint16(0); page < 3; page++ {
+				query := protocol.SearchRequest{
+					Spaces:     []string{"test"},
+					PageLimit:  2,
+					PageOffset: page,
+				}
+				result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+				xt.Nilf(err, "Search failed: %v", err)
+				for _, hit := range result.Hits {
+					paged = append(paged, string(hit.ID))
+				}
+			}
+			xt.DeepEqualf(expected, paged, "Unexpected order with strategy %d", strategy)
+		}
+	}
+}
+
+func TestSearch_MultiWordSynonyms(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	err := SetSynonyms(ctx, setup.db, []Synonyms{
+		{Description: "new york", Words: []string{"ny", "new york"}},
+		{Description: "new york city", Words: []string{"nyc", "new york city"}},
+		{Description: "big apple", Words: []string{"gotham", `"Big Apple"`}},
+	})
+	xt.Nilf(err, "Failed to set synonyms: %v", err)
+
+	docs := []protocol.Document{
+		{ID: "short", Text: "greetings from ny"},
+		{ID: "long", Text: "greetings from new york"},
+		{ID: "reversed", Text: "york is new"},
+		{ID: "city", Text: "greetings from nyc"},
+		{ID: "other", Text: "greetings from boston"},
+		{ID: "apple", Text: "greetings from the big apple"},
+	}
+	for i := range docs {
+		docs[i].Updated = time.Now()
+		docs[i].Alive = true
+	}
+	err = setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	search := func(q string) []string {
+		query := protocol.SearchRequest{
+			Spaces:    []string{"test"},
+			PageLimit: 10,
+		}
+		result, err := setup.db.search(ctx, ParseQuery(q), query)
+		xt.Nilf(err, "Search failed: %v", err)
+		var ids []string
+		for _, hit := range result.Hits {
+			ids = append(ids, string(hit.ID))
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	// A single word matches the multi-word synonym as a phrase
+	xt.DeepEqual([]string{"long", "short"}, search("ny"))
+	// Multiple words, quoted or not, collapse to the synonym
+	xt.DeepEqual([]string{"long", "short"}, search("new york"))
+	xt.DeepEqual([]string{"long", "short"}, search(`"new york"`))
+	xt.DeepEqual([]string{"long", "short"}, search("greetings ny"))
+	xt.DeepEqual([]string{"reversed"}, search("york -ny"))
+	// The longest overlapping synonym wins
+	xt.DeepEqual([]string{"city"}, search("new york city"))
+	xt.DeepEqual([]string{"city"}, search("txt:nyc"))
+	// Quotes and punctuation are dropped like when indexing
+	xt.DeepEqual([]string{"long", "short"}, search(`"New York,"`))
+	xt.DeepEqual([]string{"long", "short"}, search(`new-york`))
+	xt.DeepEqual([]string{"apple"}, search("gotham"))
+	xt.DeepEqual([]string{"apple"}, search(`"big apple"`))
+	// OR groups have no synonyms
+	xt.DeepEqual([]string{"long", "other", "reversed"}, search("(new york OR boston)"))
+}
+
+func TestIndex_InvisibleCharacters(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	setup.db.invisible = newInvisibleStripper("\ufeff\u200b\u200d")
+
+	ctx := context.Background()
+	docs := []protocol.Document{
+		{ID: "bom", Title: "\ufeffReport", Text: "\ufeffquarterly numbers"},
+		{ID: "joined", Text: "the key\u200bboard is broken"},
+		{ID: "plain", Text: "the mouse is fine"},
+	}
+	for i := range docs {
+		docs[i].Updated = time.Now()
+		docs[i].Alive = true
+	}
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	search := func(q string) []string {
+		query := protocol.SearchRequest{
+			Spaces:    []string{"test"},
+			PageLimit: 10,
+		}
+		// Like the searcher, strip the query before parsing
+		q = setup.db.invisible.Replace(q)
+		result, err := setup.db.search(ctx, ParseQuery(q), query)
+		xt.Nilf(err, "Search failed: %v", err)
+		var ids []string
+		for _, hit := range result.Hits {
+			ids = append(ids, string(hit.ID))
+		}
+		return ids
+	}
+
+	xt.DeepEqual([]string{"bom"}, search("quarterly"))
+	xt.DeepEqual([]string{"bom"}, search("title:report"))
+	xt.DeepEqual([]string{"joined"}, search("keyboard"))
+	xt.DeepEqual([]string{"joined"}, search("key\u200dboard"))
+	xt.DeepEqual([]string{"plain"}, search("\ufeffmouse"))
+	xt.DeepEqual([]string(nil), search("key"))
+}
+
+func TestSpaceAddons(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	phoneticCfg := setup.config
+	phoneticCfg.Index.Phonetic = []string{"test"}
+
+	drift, err := CheckSpaceAddons(ctx, setup.db, phoneticCfg)
+	xt.Nil(err)
+	xt.DeepEqual([]SpaceAddonDrift{{Space: "test", Addon: "phonetic", Required: 1}}, drift)
+
+	err = applySpaceAddons(ctx, setup.db.wdb, phoneticCfg)
+	xt.Nilf(err, "Failed to apply add-ons: %v", err)
+	drift, err = CheckSpaceAddons(ctx, setup.db, phoneticCfg)
+	xt.Nil(err)
+	xt.Equal(0, len(drift))
+
+	docs := []protocol.Document{{ID: "smith", Title: "John Smith", Updated: time.Now(), Alive: true}}
+	err = setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+	var codes int
+	err = setup.db.rdb.Get(&codes, "select count(*) from ftsp")
+	xt.Nil(err)
+	xt.Equalf(1, codes, "Expected phonetic codes")
+
+	// Disabling the feature removes the add-on
+	drift, err = CheckSpaceAddons(ctx, setup.db, setup.config)
+	xt.Nil(err)
+	xt.DeepEqual([]SpaceAddonDrift{{Space: "test", Addon: "phonetic", Applied: 1}}, drift)
+	err = applySpaceAddons(ctx, setup.db.wdb, setup.config)
+	xt.Nilf(err, "Failed to remove add-ons: %v", err)
+	err = setup.db.rdb.Get(&codes, "select count(*) from ftsp")
+	xt.Nil(err)
+	xt.Equalf(0, codes, "Expected phonetic codes to be removed")
+	var phonetic bool
+	err = setup.db.rdb.Get(&phonetic, "select phonetic from spaces where space = 'test'")
+	xt.Nil(err)
+	xt.False(phonetic)
+
+	// Unknown add-ons, like those of later versions, fail the upgrade
+	err = setup.db.RawExec(`
+		insert into spaceaddons (spaceID, addon, version, appliedNanos)
+		select spaceID, 'future', 2, 0 from spaces where space = 'test'`)
+	xt.Nil(err)
+	err = applySpaceAddons(ctx, setup.db.wdb, setup.config)
+	xt.NotNil(err)
+	drift, err = CheckSpaceAddons(ctx, setup.db, setup.config)
+	xt.Nil(err)
+	xt.DeepEqual([]SpaceAddonDrift{{Space: "test", Addon: "future", Applied: 2, Unknown: true}}, drift)
+}
+
+func TestSearch_Collapse(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+	setup.db.storedFields = map[string]bool{"family": true}
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{ID: "a1", Text: "banana split", Fields: map[string]string{"family": "a"}},
+		{ID: "a2", Text: "banana banana banana", Fields: map[string]string{"family": "a"}},
+		{ID: "a3", Text: "banana bread", Fields: map[string]string{"family": "a"}},
+		{ID: "b1", Text: "banana boat", Fields: map[string]string{"family": "b"}},
+		{ID: "none", Text: "banana peel"},
+	}
+	for i := range docs {
+		docs[i].Updated = time.Now()
+		docs[i].Alive = true
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:        []string{"test"},
+		PageLimit:     10,
+		CollapseField: "family",
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(3, result.TotalHits, "Expected total to count groups")
+	xt.Equal(3, len(result.Hits))
+	groups := map[protocol.DocumentID]int{}
+	for _, hit := range result.Hits {
+		groups[hit.ID] = hit.CollapseCount
+	}
+	xt.DeepEqualf(map[protocol.DocumentID]int{"a2": 3, "b1": 1, "none": 1}, groups,
+		"Expected best ranked hit of each group")
+	xt.Equal("a2", string(result.Hits[0].ID))
+
+	query.PageLimit = 1
+	query.PageOffset = 1
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected paging over groups")
+	xt.NotEqual("a2", string(result.Hits[0].ID))
+}
+
+func TestSearch_Phonetic(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	err := setup.db.RawExec("update spaces set phonetic = true where space = 'test'")
+	xt.Nil(err)
+
+	docs := []protocol.Document{
+		{ID: "smith", Title: "John Smith", Text: "carpenter"},
+		{ID: "smyth", Title: "Jane Smyth", Text: "baker"},
+		{ID: "jones", Title: "Bob Jones", Text: "carpenter"},
+	}
+	for i := range docs {
+		docs[i].Updated = time.Now()
+		docs[i].Alive = true
+	}
+	err = setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{Spaces: []string{"test"}, PageLimit: 10}
+	result, err := setup.db.search(ctx, ParseQuery("smyth"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal(1, len(result.Hits))
+
+	query.Phonetic = true
+	result, err = setup.db.search(ctx, ParseQuery("smyth"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(2, len(result.Hits), "Expected phonetic matches")
+	xt.Equal(2, result.TotalHits)
+
+	result, err = setup.db.search(ctx, ParseQuery("smyth -baker"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal(1, len(result.Hits))
+	xt.Equal("smith", string(result.Hits[0].ID))
+
+	docs[0].Alive = false
+	err = setup.db.addDocumentUpdates(ctx, "test", docs[:1])
+	xt.Nilf(err, "Failed to delete document: %v", err)
+	var codes int
+	err = setup.db.rdb.Get(&codes, "select count(*) from ftsp")
+	xt.Nil(err)
+	xt.Equalf(2, codes, "Expected codes of deleted document to be removed")
+
+	_, err = setup.db.search(ctx, ParseQuery("123"), query)
+	xt.Truef(errors.Is(err, errInvalidQuery), "Expected query without codes to be rejected")
+}
+
+func TestSearch_ExactCase(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	exactCaseCfg := setup.config
+	exactCaseCfg.Index.ExactCase = []string{"test"}
+	err := applySpaceAddons(ctx, setup.db.wdb, exactCaseCfg)
+	xt.Nilf(err, "Failed to apply add-ons: %v", err)
+
+	docs := []protocol.Document{
+		{ID: "acronym", Title: "IT department", Text: "Call IT support"},
+		{ID: "word", Title: "Lunch", Text: "it is time for lunch"},
+		{ID: "nasa", Text: "NASA launches rockets"},
+		{ID: "nasal", Text: "a nasal spray"},
+	}
+	for i := range docs {
+		docs[i].Updated = time.Now()
+		docs[i].Alive = true
+	}
+	err = setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	search := func(q string, exactCase bool) []string {
+		query := protocol.SearchRequest{Spaces: []string{"test"}, PageLimit: 10, ExactCase: exactCase}
+		result, err := setup.db.search(ctx, ParseQuery(q), query)
+		xt.Nilf(err, "Search failed: %v", err)
+		var ids []string
+		for _, hit := range result.Hits {
+			ids = append(ids, string(hit.ID))
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	xt.DeepEqual([]string{"acronym", "word"}, search("it", false))
+	xt.DeepEqual([]string{"acronym"}, search("IT", true))
+	xt.DeepEqual([]string{"word"}, search("it", true))
+	xt.DeepEqual([]string{"acronym"}, search(`"IT support"`, true))
+	xt.DeepEqual([]string(nil), search(`"it support"`, true))
+	xt.DeepEqual([]string{"nasa"}, search("NASA", true))
+	xt.DeepEqual([]string{"nasa"}, search("NAS*", true))
+	xt.DeepEqual([]string{"nasal"}, search("nas*", true))
+	xt.DeepEqual([]string{"word"}, search("it -IT", true))
+
+	docs[0].Alive = false
+	err = setup.db.addDocumentUpdates(ctx, "test", docs[:1])
+	xt.Nilf(err, "Failed to delete document: %v", err)
+	xt.DeepEqual([]string(nil), search("IT", true))
+
+	_, err = setup.db.search(ctx, ParseQuery("--"), protocol.SearchRequest{
+		Spaces: []string{"test"}, PageLimit: 10, ExactCase: true,
+	})
+	xt.NotNil(err)
+}
+
+func TestSearch_StopwordsOnly(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	docs := []protocol.Document{
+		{ID: "cat", Text: "the cat and the hat"},
+		{ID: "dog", Text: "a dog of the house"},
+	}
+	for i := range docs {
+		docs[i].Updated = time.Now()
+		docs[i].Alive = true
+	}
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+	err = setup.db.RawExec("insert into stopwords (word) values ('the'), ('and'), ('of')")
+	xt.Nil(err)
+
+	search := func(q string) ([]string, bool) {
+		query := protocol.SearchRequest{Spaces: []string{"test"}, PageLimit: 10}
+		result, err := setup.db.search(ctx, ParseQuery(q), query)
+		xt.Nilf(err, "Search failed: %v", err)
+		var ids []string
+		for _, hit := range result.Hits {
+			ids = append(ids, string(hit.ID))
+		}
+		sort.Strings(ids)
+		return ids, result.StopwordsOnly
+	}
+
+	for _, raw := range []bool{false, true} {
+		setup.db.rawStopwords = raw
+
+		// Mixed queries drop their stop words
+		ids, stopwordsOnly := search("the cat")
+		xt.DeepEqual([]string{"cat"}, ids)
+		xt.False(stopwordsOnly)
+		ids, stopwordsOnly = search(`"of the house"`)
+		xt.DeepEqual([]string{"dog"}, ids)
+		xt.False(stopwordsOnly)
+
+		ids, stopwordsOnly = search("The and")
+		xt.True(stopwordsOnly)
+		if raw {
+			xt.DeepEqual([]string{"cat"}, ids)
+		} else {
+			xt.DeepEqual([]string(nil), ids)
+		}
+
+		ids, stopwordsOnly = search("of")
+		xt.True(stopwordsOnly)
+		if raw {
+			xt.DeepEqual([]string{"dog"}, ids)
+		} else {
+			xt.DeepEqual([]string(nil), ids)
+		}
+	}
+}
+
+func TestSearch_TermCounts(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	docs := []protocol.Document{
+		{ID: "many", Title: "Horse", Text: "horse gallops past a horse, and one horse gallops near a donkey"},
+		{ID: "few", Title: "Donkey", Text: "a donkey and a horse"},
+		{ID: "none", Text: "a bird"},
+	}
+	for i := range docs {
+		docs[i].Updated = time.Now()
+		docs[i].Alive = true
+	}
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{Spaces: []string{"test"}, PageLimit: 10}
+	result, err := setup.db.search(ctx, ParseQuery("horse donkey -bird"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal(2, len(result.Hits))
+	for _, hit := range result.Hits {
+		xt.Equal(0, len(hit.TermCounts))
+	}
+
+	query.TermCounts = true
+	termCounts := func(q string) map[string]map[string]int {
+		result, err := setup.db.search(ctx, ParseQuery(q), query)
+		xt.Nilf(err, "Search failed: %v", err)
+		counts := map[string]map[string]int{}
+		for _, hit := range result.Hits {
+			counts[string(hit.ID)] = hit.TermCounts
+		}
+		return counts
+	}
+	xt.DeepEqual(map[string]map[string]int{
+		"many": {"horse": 4, "donkey": 1},
+		"few":  {"horse": 1, "donkey": 2},
+	}, termCounts("horse donkey -bird"))
+	xt.DeepEqual(map[string]map[string]int{
+		"few": {"horse": 1, "title:donkey": 1},
+	}, termCounts("horse title:donkey"))
+	xt.DeepEqual(map[string]map[string]int{
+		"many": {"horse": 4, "gal*": 2},
+	}, termCounts("gal* horse"))
+}
+
+func TestSearch_Source(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	var docs []protocol.Document
+	for i, source := range []string{"feed", "crawler", "feed", ""} {
+		docs = append(docs, protocol.Document{
+			ID:      protocol.DocumentID(fmt.Sprintf("doc%d", i)),
+			Updated: time.Now(),
+			Text:    "banana",
+			Alive:   true,
+			Source:  source,
+		})
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+		Facets:    []string{protocol.SourceField},
+		Demotions: []protocol.Demotion{
+			{Field: protocol.SourceField, Value: "feed", Factor: 0.1},
+		},
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal(4, len(result.Hits))
+	sources := map[protocol.DocumentID]string{}
+	for _, hit := range result.Hits {
+		sources[hit.ID] = hit.Source
+	}
+	xt.Equal("crawler", sources["doc1"])
+	xt.Equal("", sources["doc3"])
+	xt.Equalf("feed", result.Hits[3].Source, "Expected demoted source last")
+	xt.DeepEqualf(map[string][]protocol.FacetBucket{
+		protocol.SourceField: {{Value: "feed", Count: 2}, {Value: "crawler", Count: 1}},
+	}, result.Facets, "Expected source facet without empty sources")
+}
+
+func TestSearch_Languages(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	var docs []protocol.Document
+	for i, language := range []string{"en", "sv", "en", ""} {
+		docs = append(docs, protocol.Document{
+			ID:       protocol.DocumentID(fmt.Sprintf("doc%d", i)),
+			Updated:  time.Now(),
+			Text:     "banana",
+			Alive:    true,
+			Language: language,
+		})
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:      []string{"test"},
+		PageLimit:   10,
+		CountSpaces: true,
+		Languages:   []string{"sv", ""},
+		Facets:      []string{protocol.LanguageField},
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(2, len(result.Hits), "Expected documents in filtered languages")
+	for _, hit := range result.Hits {
+		xt.Assertf(hit.Language != "en", "Expected no english documents")
+	}
+	xt.DeepEqual(map[string]int{"test": 2}, result.SpaceCounts)
+	xt.DeepEqual(map[string][]protocol.FacetBucket{
+		protocol.LanguageField: {{Value: "sv", Count: 1}},
+	}, result.Facets)
+
+	query.Languages = nil
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(4, len(result.Hits), "Expected all documents without filter")
+}
+
+func TestEvictDocuments(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	start := time.Now()
+	var docs []protocol.Document
+	for i := 0; i < 5; i++ {
+		docs = append(docs, protocol.Document{
+			ID:      protocol.DocumentID(fmt.Sprintf("doc%d", i)),
+			Updated: start.Add(time.Duration(i) * time.Second),
+			Text:    "banana",
+			Alive:   true,
+		})
+	}
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	var evictedIDs []protocol.DocumentID
+	evicted, err := setup.db.evictDocuments(ctx, "test", 3, func(ids []protocol.DocumentID) {
+		evictedIDs = append(evictedIDs, ids...)
+	})
+	xt.Nilf(err, "Eviction failed: %v", err)
+	xt.Equal(2, evicted)
+	xt.DeepEqualf([]protocol.DocumentID{"doc1", "doc0"}, evictedIDs, "Expected oldest documents evicted")
+
+	query := protocol.SearchRequest{Spaces: []string{"test"}, PageLimit: 10}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal(3, result.TotalHits)
+
+	evicted, err = setup.db.evictDocuments(ctx, "test", 3, func([]protocol.DocumentID) {})
+	xt.Nil(err)
+	xt.Equal(0, evicted)
+}
+
+func TestSearch_IncludeContent(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	docs := []protocol.Document{
+		{ID: "short", Updated: time.Now(), Text: "banana split", Alive: true},
+		{ID: "long", Updated: time.Now(), Text: "banana åäö", Alive: true},
+	}
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	setup.db.maxContentSize = 12
+	query := protocol.SearchRequest{Spaces: []string{"test"}, PageLimit: 10}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	for _, hit := range result.Hits {
+		xt.Equalf("", hit.Content, "Expected no content unless requested")
+	}
+
+	query.IncludeContent = true
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	content := map[protocol.DocumentID]string{}
+	for _, hit := range result.Hits {
+		content[hit.ID] = hit.Content
+	}
+	xt.Equal("banana split", content["short"])
+	xt.Equalf("banana åä", content["long"], "Expected content cut at character boundary")
+	xt.True(result.Truncated)
+}
+
+func TestSearch_MaxSnippets(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	var docs []protocol.Document
+	for i := 0; i < 5; i++ {
+		docs = append(docs, protocol.Document{
+			ID:      protocol.DocumentID(fmt.Sprintf("doc%d", i)),
+			Updated: time.Now(),
+			Title:   "banana",
+			Text:    "banana split",
+			Alive:   true,
+		})
+	}
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	for strategy := 1; strategy <= 3; strategy++ {
+		setup.db.searchStrategy = strategy
+		setup.db.maxSnippets = 2
+		query := protocol.SearchRequest{Spaces: []string{"test"}, PageLimit: 10}
+		result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+		xt.Nilf(err, "Search failed: %v", err)
+		xt.Equal(5, len(result.Hits))
+		for i, hit := range result.Hits {
+			xt.Equalf(i < 2, hit.Snippet != "", "Expected snippets for the first hits only, strategy %d", strategy)
+		}
+		xt.True(result.SnippetsOmitted)
+
+		setup.db.maxSnippets = 0
+		result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+		xt.Nilf(err, "Search failed: %v", err)
+		for _, hit := range result.Hits {
+			xt.NotEqual("", hit.Snippet)
+		}
+		xt.False(result.SnippetsOmitted)
+	}
+}
+
+func TestSearch_SnippetOptions(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	docs := []protocol.Document{
+		{
+			ID:      "snippet",
+			Updated: time.Now(),
+			Title:   "fruit",
+			Text:    "alpha bravo charlie delta banana echo foxtrot golf hotel",
+			Alive:   true,
+		},
+	}
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	// The default window keeps one token before and eight after
+	query := protocol.SearchRequest{Spaces: []string{"test"}, PageLimit: 10}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal(1, len(result.Hits))
+	xt.Equal("…delta banana echo foxtrot golf hotel", result.Hits[0].Snippet)
+
+	setup.db.snippetWindow = 1
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal("…delta banana echo…", result.Hits[0].Snippet)
+
+	setup.db.snippetOpen, setup.db.snippetClose = "[", "]"
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal("…delta [banana] echo…", result.Hits[0].Snippet)
+
+	query.SnippetWindow = 4
+	query.SnippetOpen, query.SnippetClose = "<b>", "</b>"
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal("alpha bravo charlie delta <b>banana</b> echo foxtrot golf hotel", result.Hits[0].Snippet)
+}
+
+func TestDocumentVersions(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	update := func(text string, version uint64) {
+		err := setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{{
+			ID:      "doc",
+			Updated: time.Now(),
+			Text:    text,
+			Alive:   true,
+			Version: version,
+		}})
+		xt.Nilf(err, "Failed to add document: %v", err)
+	}
+	stored := func() string {
+		var text string
+		err := setup.db.rdb.Get(&text, "select txt from docs where docID = 'doc'")
+		xt.Nil(err)
+		return text
+	}
+
+	stale := metrics.StaleUpdates.Value()
+	update("second", 2)
+	update("first", 1)
+	xt.Equalf("second", stored(), "Expected stale update to be ignored")
+	update("unversioned", 0)
+	xt.Equal("second", stored())
+	xt.Equal(stale+2, metrics.StaleUpdates.Value())
+
+	update("second again", 2)
+	xt.Equalf("second again", stored(), "Expected same version to replace")
+	update("third", 3)
+	xt.Equal("third", stored())
+}
+
+func TestIndexSchema(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	schema, err := setup.db.getIndexSchema(context.Background())
+	xt.Nilf(err, "Failed to get schema: %v", err)
+	xt.Assert(schema.Version > 0)
+	xt.Equal(4, len(schema.Tables))
+	for _, table := range schema.Tables[:2] {
+		xt.Equal("snowball", table.Tokenizer)
+		xt.Equal("2 3 4", table.Prefix)
+	}
+	xt.Equal("fts", schema.Tables[0].Name)
+	xt.Equal("cdocs", schema.Tables[0].Content)
+	xt.Equal("ftsc", schema.Tables[1].Name)
+	xt.Equal("ftse", schema.Tables[2].Name)
+	xt.Equal("unicode61 remove_diacritics 0 tokenchars '^'", schema.Tables[2].Tokenizer)
+	xt.Equal("ftsp", schema.Tables[3].Name)
+}
+
+func TestReload(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	addDocs := func(space string, text string, ids ...string) {
+		var docs []protocol.Document
+		for _, id := range ids {
+			docs = append(docs, protocol.Document{
+				ID:      protocol.DocumentID(id),
+				Updated: time.Now(),
+				Text:    text,
+				Alive:   true,
+			})
+		}
+		err := setup.db.addDocumentUpdates(ctx, space, docs)
+		xt.Nilf(err, "Failed to add documents: %v", err)
+	}
+	search := func(phrase string) []protocol.SearchHit {
+		query := protocol.SearchRequest{Spaces: []string{"test"}, PageLimit: 10}
+		result, err := setup.db.search(ctx, ParseQuery(phrase), query)
+		xt.Nilf(err, "Search failed: %v", err)
+		return result.Hits
+	}
+
+	addDocs("test", "banana", "old1", "old2")
+
+	requested, err := setup.db.requestReload(ctx, "test")
+	xt.Nil(err)
+	xt.True(requested)
+	requested, err = setup.db.requestReload(ctx, "test")
+	xt.Nil(err)
+	xt.Falsef(requested, "Expected repeated request to be ignored")
+	_, err = setup.db.requestReload(ctx, "missing")
+	xt.NotNil(err)
+
+	shadow, err := setup.db.startReload(ctx, "test")
+	xt.Nil(err)
+	xt.Equal(shadowSpaceName("test"), shadow)
+	addDocs(shadow, "mango", "new1")
+
+	reloads, err := setup.db.getReloads(ctx)
+	xt.Nil(err)
+	xt.Equal(1, len(reloads))
+	xt.Equal(shadow, reloads[0].Shadow)
+	xt.Equal(1, reloads[0].ShadowDocs)
+	xt.Equalf(2, len(search("banana")), "Expected reloaded space to be searchable")
+
+	err = setup.db.swapReload(ctx, "test")
+	xt.Nil(err)
+	xt.Equal(0, len(search("banana")))
+	xt.Equal(1, len(search("mango")))
+
+	var purged []protocol.DocumentID
+	err = setup.db.purgeRetiredSpaces(ctx, func(ids []protocol.DocumentID) {
+		purged = append(purged, ids...)
+	})
+	xt.Nil(err)
+	xt.Equal(2, len(purged))
+
+	var spaces int
+	err = setup.db.rdb.Get(&spaces, "select count(*) from spaces")
+	xt.Nil(err)
+	xt.Equal(1, spaces)
+	reloads, err = setup.db.getReloads(ctx)
+	xt.Nil(err)
+	xt.Equal(0, len(reloads))
+}
+
+func TestSearch_Since(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	doc := func(id string) protocol.Document {
+		return protocol.Document{
+			ID: protocol.DocumentID(id), Updated: time.Now(), Text: "banana", Alive: true,
+		}
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{doc("old"), doc("updated")})
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	since, err := setup.db.lastDocumentPosition(ctx, setup.db.rdb)
+	xt.Nilf(err, "Failed to get position: %v", err)
+
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{doc("new"), doc("updated")})
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	result, err := setup.db.searchSince(ctx, setup.db.rdb, ParseQuery("banana"), query, since)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(2, result.TotalHits, "Expected new and updated documents")
+	xt.Equalf(protocol.DocumentID("updated"), result.Hits[0].ID, "Expected most recent first")
+	xt.Equalf(protocol.DocumentID("new"), result.Hits[1].ID, "Expected most recent first")
+
+	// Replacing the last document moves it further
+	since, err = setup.db.lastDocumentPosition(ctx, setup.db.rdb)
+	xt.Nilf(err, "Failed to get position: %v", err)
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{doc("updated")})
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	result, err = setup.db.searchSince(ctx, setup.db.rdb, ParseQuery("banana"), query, since)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected updated document")
+	xt.Equalf(protocol.DocumentID("updated"), result.Hits[0].ID, "Expected updated document")
+}
+
+func TestSearch_Contentless(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	err := setSpaceContentModes(setup.db.wdb, []string{"test"}, map[string]bool{"test": true})
+	xt.Nilf(err, "Failed to set space content mode: %v", err)
+	setup.db.contentless = map[string]bool{"test": true}
+
+	doc := protocol.Document{
+		ID:      "secret",
+		Updated: time.Now(),
+		Title:   "Top secret",
+		Text:    "banana",
+		Alive:   true,
+	}
+	ctx := context.Background()
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{doc})
+	xt.Nilf(err, "Failed to add document: %v", err)
+
+	var stored string
+	err = setup.db.rdb.Get(&stored, "select title || txt from docs")
+	xt.Nilf(err, "Failed to get document: %v", err)
+	xt.Equalf("", stored, "Expected no stored content")
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected contentless document hit")
+
+	doc.Text = "apple"
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{doc})
+	xt.Nilf(err, "Failed to update document: %v", err)
+
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(0, len(result.Hits), "Expected no hits on replaced content")
+
+	result, err = setup.db.search(ctx, ParseQuery("apple"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected hit on updated content")
+
+	err = setSpaceContentModes(setup.db.wdb, []string{"test"}, map[string]bool{})
+	xt.Containsf(err, "non-empty space", "Expected mode change of non-empty space to fail")
+}
+
+func TestSearch_ContentlessUpdated(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	err := setSpaceContentModes(setup.db.wdb, []string{"test"}, map[string]bool{"test": true})
+	xt.Nilf(err, "Failed to set space content mode: %v", err)
+	setup.db.contentless = map[string]bool{"test": true}
+	setup.db.resultCap = 3
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		doc := protocol.Document{
+			ID:      "updated",
+			Updated: time.Now(),
+			Text:    fmt.Sprintf("banana %d", i),
+			Alive:   true,
+		}
+		err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{doc})
+		xt.Nilf(err, "Failed to add document: %v", err)
+	}
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{
+		{ID: "other", Updated: time.Now(), Text: "banana", Alive: true},
+	})
+	xt.Nilf(err, "Failed to add document: %v", err)
+
+	// Rows of replaced documents take no cap slots and are not counted
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal(2, len(result.Hits))
+	xt.Equal(2, result.TotalHits)
+
+	result, err = setup.db.search(ctx, ParseQuery("banana 4"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equal(1, len(result.Hits))
+	xt.Equal(1, result.TotalHits)
+}
+
+func TestDeadLetters(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	spaceID, err := setup.db.getSpaceID(ctx, "test")
+	xt.Nilf(err, "Failed to get space ID: %v", err)
+	setup.db.integerIDs = map[int]bool{spaceID: true}
+
+	update := []protocol.DocumentUpdate{{
+		Space: "test",
+		Documents: []protocol.Document{
+			{ID: "1", Updated: time.Now(), Text: "banana", Alive: true},
+			{ID: "bad", Updated: time.Now(), Text: "banana", Alive: true},
+		},
+	}}
+	err = setup.db.addMultiSpaceDocumentUpdates(ctx, update)
+	xt.Assertf(err != nil, "Expected invalid document ID to fail the update")
+
+	failed := setup.db.addDocumentsSeparately(ctx, update)
+	xt.Equalf(1, failed, "Expected one failing document")
+	failed = setup.db.addDocumentsSeparately(ctx, update)
+	xt.Equalf(1, failed, "Expected one failing document")
+
+	letters, err := setup.db.getDeadLetters(ctx, "")
+	xt.Nilf(err, "Failed to get dead letters: %v", err)
+	xt.Equalf(1, len(letters), "Expected one dead letter")
+	xt.Equalf(protocol.DocumentID("bad"), letters[0].ID, "Expected failing document")
+	xt.Equalf(2, letters[0].Attempts, "Expected attempts to be counted")
+	xt.Equalf("banana", letters[0].Document.Text, "Expected document to be kept")
+
+	setup.db.integerIDs = map[int]bool{}
+	indexed, failed, err := setup.db.retryDeadLetters(ctx, "test")
+	xt.Nilf(err, "Failed to retry dead letters: %v", err)
+	xt.Equalf(1, indexed, "Expected dead letter to be indexed")
+	xt.Equalf(0, failed, "Expected no failures")
+
+	letters, err = setup.db.getDeadLetters(ctx, "test")
+	xt.Nilf(err, "Failed to get dead letters: %v", err)
+	xt.Equalf(0, len(letters), "Expected indexed dead letter to be removed")
+}
+
+func TestDeadLetters_MultiSpace(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	err := setup.db.RawExec(`insert into spaces (space, lastUpdatedAtNanos) values("other", 0)`)
+	xt.Nilf(err, "Failed to create space: %v", err)
+	ctx := context.Background()
+	spaceID, err := setup.db.getSpaceID(ctx, "other")
+	xt.Nilf(err, "Failed to get space ID: %v", err)
+	setup.db.integerIDs = map[int]bool{spaceID: true}
+
+	countDocs := func() int {
+		var count int
+		err := setup.db.rdb.Get(&count, "select count(*) from docs")
+		xt.Nilf(err, "Failed to count docs: %v", err)
+		return count
+	}
+
+	update := []protocol.DocumentUpdate{
+		{Space: "test", Documents: []protocol.Document{
+			{ID: "a", Updated: time.Now(), Text: "banana", Alive: true},
+		}},
+		{Space: "other", Documents: []protocol.Document{
+			{ID: "1", Updated: time.Now(), Text: "banana", Alive: true},
+			{ID: "bad", Updated: time.Now(), Text: "banana", Alive: true},
+		}},
+	}
+	err = setup.db.addMultiSpaceDocumentUpdates(ctx, update)
+	xt.Assertf(err != nil, "Expected invalid document ID to fail the update")
+
+	// No part of a failed multi-space update is indexed
+	failed := setup.db.addFailedUpdate(ctx, update, err)
+	xt.Equal(3, failed)
+	xt.Equalf(0, countDocs(), "Partially applied update should not be visible")
+
+	letters, err := setup.db.getDeadLetters(ctx, "")
+	xt.Nilf(err, "Failed to get dead letters: %v", err)
+	xt.Equal(3, len(letters))
+	for _, letter := range letters {
+		xt.Assertf(letter.Unit != 0, "Expected dead letter unit")
+		xt.Equal(letters[0].Unit, letter.Unit)
+	}
+
+	setup.db.integerIDs = map[int]bool{}
+	indexed, failed, err := setup.db.retryDeadLetters(ctx, "")
+	xt.Nilf(err, "Failed to retry dead letters: %v", err)
+	xt.Equal(3, indexed)
+	xt.Equal(0, failed)
+	xt.Equal(3, countDocs())
+}
+
+func TestDeadLetters_Attempts(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	setup.db.deadLetterAttempts = 2
+	ctx := context.Background()
+	err := setup.db.setInterestList(ctx, protocol.IndexUpdate{
+		Space:   "test",
+		Updates: []protocol.DocumentReference{{ID: "failing", Updated: time.Now()}},
+	})
+	xt.Nilf(err, "Setting interest list failed: %v", err)
+	err = setup.db.setInterestState(ctx, "test", "failing", requested)
+	xt.Nil(err)
+
+	state := func() InterestState {
+		interests, err := setup.db.getInterestList(ctx, "test")
+		xt.Nilf(err, "Getting interest list failed: %v", err)
+		xt.Equal(1, len(interests))
+		return interests[0].State
+	}
+
+	update := []protocol.DocumentUpdate{{
+		Space:     "test",
+		Documents: []protocol.Document{{ID: "failing", Updated: time.Now(), Alive: true}},
+	}}
+	givenUp, err := setup.db.addDeadLetters(ctx, update, errors.New("failing"))
+	xt.Nilf(err, "Failed to add dead letter: %v", err)
+	xt.Equal(0, givenUp)
+	xt.Equalf(requested, state(), "Expected document to be requested again")
+
+	givenUp, err = setup.db.addDeadLetters(ctx, update, errors.New("failing"))
+	xt.Nilf(err, "Failed to add dead letter: %v", err)
+	xt.Equal(1, givenUp)
+	xt.Equalf(served, state(), "Expected document to be given up on")
+}
+
+func TestIntegerIDs(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	err := setSpaceIDTypes(setup.db.wdb, []string{"test"}, []string{"test"})
+	xt.Nilf(err, "Failed to set space ID type: %v", err)
+	ctx := context.Background()
+	spaceID, err := setup.db.getSpaceID(ctx, "test")
+	xt.Nilf(err, "Failed to get space ID: %v", err)
+	setup.db.integerIDs = map[int]bool{spaceID: true}
+
+	docTime := time.Now()
+	list := protocol.IndexUpdate{
+		Space: "test",
+		Updates: []protocol.DocumentReference{
+			{ID: protocol.IntegerDocumentID(9), Updated: docTime},
+			{ID: protocol.IntegerDocumentID(10), Updated: docTime},
+		},
+	}
+	err = setup.db.setInterestList(ctx, list)
+	xt.Nilf(err, "Setting interest list failed: %v", err)
+
+	var docs []protocol.Document
+	for _, ref := range list.Updates {
+		docs = append(docs, protocol.Document{ID: ref.ID, Updated: docTime, Text: "banana", Alive: true})
+	}
+	err = setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	var idType string
+	err = setup.db.rdb.Get(&idType, "select distinct typeof(docID) from docs")
+	xt.Nilf(err, "Failed to get ID type: %v", err)
+	xt.Equalf("integer", idType, "Expected IDs to be stored as integers")
+
+	err = setup.db.commitInterestList(ctx, "test")
+	xt.Nilf(err, "Failed to commit list: %v", err)
+	state, err := setup.db.getInterestListState(ctx, "test")
+	xt.Nilf(err, "Failed to get list state: %v", err)
+	xt.Equalf(protocol.DocumentID("10"), state.LastUpdatedDocID, "Expected IDs to be ordered as integers")
+
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{{ID: "koko", Updated: docTime, Alive: true}})
+	xt.Containsf(err, "not an integer", "Expected non-integer ID to be rejected")
+
+	err = setSpaceIDTypes(setup.db.wdb, []string{"test"}, nil)
+	xt.Containsf(err, "non-empty space", "Expected ID type change of non-empty space to fail")
+}
+
+func TestSearchSnapshot(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	snapshots := newSearchSnapshots(setup.db, "index", time.Minute, 1)
+	defer snapshots.close()
+
+	ctx := context.Background()
+	token, tx, err := snapshots.pin(ctx)
+	xt.Nilf(err, "Failed to pin snapshot: %v", err)
+	xt.Equalf("index:1", token, "Unexpected snapshot token")
+
+	docs := []protocol.Document{
+		{
+			ID:      "late",
+			Updated: time.Now(),
+			Text:    "banana",
+			Alive:   true,
+		},
+	}
+	err = setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add document: %v", err)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	_, snapshot, found := snapshots.get("other:1," + token)
+	xt.Assertf(found, "Expected snapshot to be found")
+	xt.Assertf(snapshot == tx, "Expected pinned snapshot")
+	result, err := setup.db.searchIn(ctx, snapshot, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(0, len(result.Hits), "Expected no hits in snapshot")
+
+	result, err = setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected hit in live index")
+
+	token, _, err = snapshots.pin(ctx)
+	xt.Nilf(err, "Failed to pin snapshot: %v", err)
+	xt.Equalf("", token, "Expected snapshot cap to be enforced")
+
+	snapshots.release("other:1,index:1")
+	_, _, found = snapshots.get("index:1")
+	xt.Assertf(!found, "Expected released snapshot to be gone")
+	token, _, err = snapshots.pin(ctx)
+	xt.Nilf(err, "Failed to pin snapshot: %v", err)
+	xt.Equalf("index:2", token, "Expected released snapshot to free its slot")
+}
+
+func TestTouchDocuments(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{
+			ID:      "touched",
+			Updated: time.Now().Add(-time.Hour),
+			Text:    "banana",
+			Alive:   true,
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add document: %v", err)
+
+	touchTime := time.Now()
+	touched, err := setup.db.touchDocuments(ctx, "test", []protocol.DocumentID{"touched", "missing"}, touchTime)
+	xt.Nilf(err, "Failed to touch documents: %v", err)
+	xt.Equalf(1, touched, "Expected only existing documents to be touched")
+
+	var updated int64
+	err = setup.db.rdb.Get(&updated, "select updatedNanos from docs where docID = 'touched'")
+	xt.Nilf(err, "Failed to get document: %v", err)
+	xt.Equalf(touchTime.UnixNano(), updated, "Expected updated timestamp")
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected touched document to stay indexed")
+}
+
+func TestDeleteDocuments(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{
+			ID:      "deleted",
+			Updated: time.Now().Add(-time.Hour),
+			Text:    "banana",
+			Alive:   true,
+			Version: 3,
+		},
+		{
+			ID:      "kept",
+			Updated: time.Now().Add(-time.Hour),
+			Text:    "banana",
+			Alive:   true,
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	deleted, err := setup.db.deleteDocuments(ctx, "test", []protocol.DocumentID{"deleted", "missing"})
+	xt.Nilf(err, "Failed to delete documents: %v", err)
+	xt.Equalf(1, deleted, "Expected only existing documents to be deleted")
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	result, err := setup.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected deleted document to be removed")
+	xt.Equal(protocol.DocumentID("kept"), result.Hits[0].ID)
+
+	var alive bool
+	err = setup.db.rdb.Get(&alive, "select alive from docs where docID = 'deleted'")
+	xt.Nilf(err, "Expected deleted document to be kept as dead: %v", err)
+	xt.Truef(!alive, "Expected deleted document to be dead")
+
+	deleted, err = setup.db.deleteDocuments(ctx, "test", []protocol.DocumentID{"deleted"})
+	xt.Nilf(err, "Failed to delete documents: %v", err)
+	xt.Equalf(0, deleted, "Expected dead documents not to be deleted again")
+}
+
+func TestBackupDatabase(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	docs := []protocol.Document{
+		{
+			ID:      "backedup",
+			Updated: time.Now(),
+			Text:    "banana",
+			Alive:   true,
+		},
+	}
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	backupPath := path.Join(setup.tmpDir, "backups", "leta.db")
+	err = BackupDatabase(setup.db, backupPath)
+	xt.Nilf(err, "Backup failed: %v", err)
+
+	err = BackupDatabase(setup.db, backupPath)
+	xt.NotNilf(err, "Expected existing backup not to be overwritten")
+
+	backup, err := sqlx.Open("sqlite3", backupPath)
+	xt.Nil(err)
+	defer backup.Close()
+	var count int
+	err = backup.Get(&count, "select count(*) from docs where docID = 'backedup'")
+	xt.Nilf(err, "Failed to read backup: %v", err)
+	xt.Equalf(1, count, "Expected document in backup")
+}
+
+func TestBackupDatabase_Failed(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	// Closing the source fails the backup after creating the destination
+	err := setup.db.rdb.Close()
+	xt.Nil(err)
+	backupPath := path.Join(setup.tmpDir, "backups", "leta.db")
+	err = BackupDatabase(setup.db, backupPath)
+	xt.NotNilf(err, "Expected backup of closed database to fail")
+	_, err = os.Stat(backupPath)
+	xt.Truef(os.IsNotExist(err), "Expected partial backup to be removed, got: %v", err)
+}
+
+// stalledBackup is a backup that never makes progress
+type stalledBackup struct {
+	steps int
+}
+
+func (b *stalledBackup) Step(pages int) (bool, error) {
+	b.steps++
+	return false, nil
+}
+
+func (b *stalledBackup) Remaining() int {
+	return 10
+}
+
+func (b *stalledBackup) PageCount() int {
+	return 20
+}
+
+func TestStepBackup_Stalled(t *testing.T) {
+	xt := xt.X(t)
+
+	defer func(wait time.Duration) { backupBusyWait = wait }(backupBusyWait)
+	backupBusyWait = time.Millisecond
+
+	backup := &stalledBackup{}
+	err := stepBackup(backup)
+	xt.NotNilf(err, "Expected stalled backup to fail")
+	xt.Equal(maxBackupBusyRetries+2, backup.steps)
+}
+
+func TestBatchUpdates(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	const numDocs = 1000
+	updates := make(chan queuedUpdate, numDocs)
+	acks := 0
+	for i := 0; i < numDocs; i++ {
+		updates <- queuedUpdate{
+			updates: []protocol.DocumentUpdate{{
+				Space: "test",
+				Documents: []protocol.Document{{
+					ID:      protocol.DocumentID(fmt.Sprintf("doc%d", i)),
+					Updated: time.Now(),
+					Text:    "burst",
+					Alive:   true,
+				}},
+			}},
+			ack: func() { acks++ },
+		}
+	}
+	close(updates)
+
+	// Each store is one write transaction
+	transactions := 0
+	store := func(batch []protocol.DocumentUpdate) {
+		transactions++
+		err := setup.db.addMultiSpaceDocumentUpdates(ctx, batch)
+		xt.Nil(err)
+	}
+	batchUpdates(ctx, updates, 200, 200*time.Millisecond, func() {}, store)
+
+	xt.Assertf(transactions < 10, "Expected fewer than 10 transactions, got %d", transactions)
+	xt.Equal(numDocs, acks)
+
+	var stored int
+	err := setup.db.rdb.Get(&stored, "select count(*) from docs")
+	xt.Nil(err)
+	xt.Equal(numDocs, stored)
+}
+
+func TestBatchUpdates_Acks(t *testing.T) {
+	xt := xt.X(t)
+
+	var events []string
+	queue := func(ctx context.Context, numUpdates int) {
+		updates := make(chan queuedUpdate, numUpdates)
+		for i := 0; i < numUpdates; i++ {
+			id := protocol.DocumentID(fmt.Sprintf("doc%d", i))
+			updates <- queuedUpdate{
+				updates: []protocol.DocumentUpdate{{
+					Space:     "test",
+					Documents: []protocol.Document{{ID: id}},
+				}},
+				ack: func() { events = append(events, "ack "+string(id)) },
+			}
+		}
+		close(updates)
+		store := func(batch []protocol.DocumentUpdate) {
+			events = append(events, fmt.Sprintf("store %d", len(batch)))
+		}
+		batchUpdates(ctx, updates, 2, time.Hour, func() {}, store)
+	}
+
+	// Updates are acknowledged once their batch is stored
+	queue(context.Background(), 3)
+	xt.DeepEqual([]string{
+		"store 2", "ack doc0", "ack doc1",
+		"store 1", "ack doc2",
+	}, events)
+
+	// Updates stored while shutting down are not acknowledged,
+	// and are redelivered on restart
+	events = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queue(ctx, 3)
+	xt.DeepEqual([]string{"store 2", "store 1"}, events)
+}
+
+func TestCheckpointAndVacuum(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	var docs []protocol.Document
+	for i := 0; i < 100; i++ {
+		docs = append(docs, protocol.Document{
+			ID:      protocol.DocumentID(fmt.Sprintf("doc%d", i)),
+			Updated: time.Now(),
+			Text:    strings.Repeat("filler ", 100),
+			Alive:   true,
+		})
+	}
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nil(err)
+
+	err = setup.db.checkpointWAL(ctx)
+	xt.Nil(err)
+	frames, checkpointed := setup.db.getCheckpointStats()
+	xt.Assertf(frames > 0, "Expected WAL frames")
+	xt.Assertf(checkpointed <= frames, "Checkpointed %d of %d frames", checkpointed, frames)
+
+	// The first vacuum enables incremental vacuuming
+	err = setup.db.incrementalVacuum(ctx, 10)
+	xt.Nil(err)
+	var mode int
+	err = setup.db.wdb.Get(&mode, "pragma auto_vacuum")
+	xt.Nil(err)
+	xt.Equal(incrementalAutoVacuum, mode)
+
+	_, err = setup.db.wdb.Exec("delete from docs")
+	xt.Nil(err)
+	var freeBefore, freeAfter int
+	err = setup.db.wdb.Get(&freeBefore, "pragma freelist_count")
+	xt.Nil(err)
+	err = setup.db.incrementalVacuum(ctx, 10)
+	xt.Nil(err)
+	err = setup.db.wdb.Get(&freeAfter, "pragma freelist_count")
+	xt.Nil(err)
+	xt.Assertf(freeBefore > 10, "Expected free pages, got %d", freeBefore)
+	xt.Equal(freeBefore-10, freeAfter)
+}
+
+func TestHealthServer(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	health := &healthServer{db: setup.db}
+	recorder := httptest.NewRecorder()
+	health.serveHealth(recorder, httptest.NewRequest("GET", "/health", nil))
+	xt.Equal(http.StatusOK, recorder.Code)
+	var status HealthStatus
+	err := json.Unmarshal(recorder.Body.Bytes(), &status)
+	xt.Nilf(err, "Failed to decode health status: %v", err)
+	xt.Equal("ok", status.Status)
+	xt.DeepEqual([]string{"test"}, status.Spaces)
+
+	metrics.DocRequests.Add(3)
+	recorder = httptest.NewRecorder()
+	serveMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	xt.Equal(http.StatusOK, recorder.Code)
+	xt.Contains(recorder.Body.String(), "letarette_docrequests ")
+
+	setup.db.Close()
+	setup.db = nil
+	recorder = httptest.NewRecorder()
+	health.serveHealth(recorder, httptest.NewRequest("GET", "/health", nil))
+	xt.Equal(http.StatusServiceUnavailable, recorder.Code)
+}
+
+func TestExportImportIndex(t *testing.T) {
+	source := getTestSetup(t, true)
+	defer source.cleanup()
+	target := getTestSetup(t)
+	defer target.cleanup()
+	source.db.storedFields = map[string]bool{"state": true}
+	target.db.storedFields = source.db.storedFields
+
+	xt := xt.X(t)
+
+	updated := time.Unix(0, time.Now().UnixNano())
+	docs := []protocol.Document{
+		{
+			ID:      "alive",
+			Updated: updated,
+			Title:   "Exported",
+			Text:    "banana split with a lot of other things in it",
+			Alive:   true,
+			Fields:  map[string]string{"state": "current"},
+			Version: 2,
+		},
+		{
+			ID:      "dead",
+			Updated: updated,
+		},
+	}
+	ctx := context.Background()
+	err := source.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	var exported bytes.Buffer
+	err = ExportIndex(source.db, &exported, nil)
+	xt.Nilf(err, "Failed to export index: %v", err)
+	xt.Equalf(2, strings.Count(exported.String(), "\n"), "Expected one line per document")
+
+	imported, err := ImportIndex(target.db, &exported)
+	xt.Nilf(err, "Failed to import index: %v", err)
+	xt.Equal(2, imported)
+
+	query := protocol.SearchRequest{
+		Spaces:    []string{"test"},
+		PageLimit: 10,
+	}
+	result, err := target.db.search(ctx, ParseQuery("banana"), query)
+	xt.Nilf(err, "Search failed: %v", err)
+	xt.Equalf(1, len(result.Hits), "Expected imported document to be searchable")
+
+	var text string
+	err = target.db.rdb.Get(&text, "select uncompress(txt) from docs where docID = 'alive'")
+	xt.Nilf(err, "Failed to get document: %v", err)
+	xt.Equalf(docs[0].Text, text, "Expected uncompressed text to be exported")
+
+	var state string
+	err = target.db.rdb.Get(&state, "select value from docfields where docID = 'alive' and field = 'state'")
+	xt.Nilf(err, "Expected imported stored field: %v", err)
+	xt.Equal("current", state)
+
+	var alive bool
+	err = target.db.rdb.Get(&alive, "select alive from docs where docID = 'dead'")
+	xt.Nilf(err, "Expected imported dead document: %v", err)
+	xt.Truef(!alive, "Expected dead document to stay dead")
+
+	var only bytes.Buffer
+	err = ExportIndex(source.db, &only, []string{"other"})
+	xt.Nilf(err, "Failed to export index: %v", err)
+	xt.Equalf(0, only.Len(), "Expected no documents in unknown space")
+}
+
+func TestCommitInterestList_EqualTimestamps(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	// Listed in document manager order, not in ID order
+	listTime := time.Now()
+	list := protocol.IndexUpdate{
+		Space: "test",
+		Updates: []protocol.DocumentReference{
+			{ID: "koko", Updated: listTime},
+			{ID: "bello", Updated: listTime},
+		},
+	}
+	err := setup.db.setInterestList(ctx, list)
+	xt.Nilf(err, "Setting interest list failed: %v", err)
+	for _, ref := range list.Updates {
+		err = setup.db.setInterestState(ctx, "test", ref.ID, served)
+		xt.Nil(err)
+	}
+
+	err = setup.db.commitInterestList(ctx, "test")
+	xt.Nilf(err, "Failed to commit list: %v", err)
+	state, err := setup.db.getInterestListState(ctx, "test")
+	xt.Nil(err)
+	xt.Equal(listTime.UnixNano(), state.LastUpdated)
+	xt.Equalf(protocol.DocumentID("bello"), state.LastUpdatedDocID, "Expected last listed document")
+}
+
+func TestCommitInterestList_RegressingClock(t *testing.T) {
 	setup := getTestSetup(t)
 	defer setup.cleanup()
 
 	xt := xt.X(t)
-
 	ctx := context.Background()
-	docs := []protocol.Document{
-		{},
+
+	commit := func(id protocol.DocumentID, updated time.Time) InterestListState {
+		err := setup.db.setInterestList(ctx, protocol.IndexUpdate{
+			Space:   "test",
+			Updates: []protocol.DocumentReference{{ID: id, Updated: updated}},
+		})
+		xt.Nilf(err, "Setting interest list failed: %v", err)
+		err = setup.db.setInterestState(ctx, "test", id, served)
+		xt.Nil(err)
+		err = setup.db.commitInterestList(ctx, "test")
+		xt.Nilf(err, "Failed to commit list: %v", err)
+		state, err := setup.db.getInterestListState(ctx, "test")
+		xt.Nil(err)
+		return state
 	}
-	err := setup.db.addDocumentUpdates(ctx, "", docs)
-	xt.Containsf(err, "no such space", "Adding document with empty space should fail")
-}
 
-func TestAddDocument_NewDocument(t *testing.T) {
-	setup := getTestSetup(t, false)
-	defer setup.cleanup()
+	now := time.Now()
+	state := commit("later", now)
+	xt.Equal(protocol.DocumentID("later"), state.LastUpdatedDocID)
 
-	xt := xt.X(t)
+	// Found by looking back from the position
+	state = commit("earlier", now.Add(-time.Minute))
+	xt.Equalf(now.UnixNano(), state.LastUpdated, "Expected position to stay")
+	xt.Equal(protocol.DocumentID("later"), state.LastUpdatedDocID)
+}
 
-	// "Cortex " below (note the space) is a "valid"
-	// compressed header in the original sqlite3 compress extension.
-	docs := []protocol.Document{
-		{
-			ID:      "myID",
-			Updated: time.Now(),
-			Text:    "Cortex and such",
-			Alive:   true,
-		},
-	}
-	ctx := context.Background()
-	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+func TestFetchPosition(t *testing.T) {
+	xt := xt.X(t)
 
-	xt.Nilf(err, "Failed to add new document")
+	start := time.Now()
+	position := newFetchPosition(start, "a")
+	horizon := start.Add(time.Hour)
+
+	// Equal timestamps are broken by the last document
+	position.advance([]protocol.DocumentReference{
+		{ID: "c", Updated: start},
+		{ID: "b", Updated: start},
+	}, horizon)
+	xt.Equal(protocol.DocumentID("b"), position.ID)
+	xt.Assert(position.Updated.Equal(start))
+
+	// Regressing clock, the position follows the references
+	// while remembering the furthest reference
+	position.advance([]protocol.DocumentReference{
+		{ID: "d", Updated: start.Add(-time.Minute)},
+	}, horizon)
+	xt.Equal(protocol.DocumentID("d"), position.ID)
+	position.rewind(time.Second)
+	xt.Equal(protocol.DocumentID(""), position.ID)
+	xt.Assertf(position.Updated.Equal(start.Add(-time.Second)), "Expected rewind from furthest reference")
+
+	// Stops before references past the horizon
+	position.advance([]protocol.DocumentReference{
+		{ID: "e", Updated: start.Add(time.Second)},
+		{ID: "f", Updated: horizon.Add(time.Second)},
+	}, horizon)
+	xt.Equal(protocol.DocumentID("e"), position.ID)
 }
 
-func TestAddDocument_NewDocument_Compressed(t *testing.T) {
-	setup := getTestSetup(t, true)
+func TestAddMultiSpaceDocumentUpdates_ConcurrentReader(t *testing.T) {
+	setup := getTestSetup(t)
 	defer setup.cleanup()
 
 	xt := xt.X(t)
 
-	docs := []protocol.Document{
-		{
-			ID:      "myID",
+	ctx := context.Background()
+	err := setup.db.RawExec(`insert into spaces (space, lastUpdatedAtNanos) values("other", 0)`)
+	xt.Nilf(err, "Failed to create space: %v", err)
+	testID, err := setup.db.getSpaceID(ctx, "test")
+	xt.Nil(err)
+	otherID, err := setup.db.getSpaceID(ctx, "other")
+	xt.Nil(err)
+
+	// Reads while writing should never see an update applied
+	// to only one of the spaces
+	done := make(chan struct{})
+	type readResult struct {
+		reads   int
+		partial int
+		err     error
+	}
+	result := make(chan readResult)
+	go func() {
+		var res readResult
+		for {
+			select {
+			case <-done:
+				result <- res
+				return
+			default:
+			}
+			var counts struct {
+				Test  int
+				Other int
+			}
+			err := setup.db.rdb.Get(&counts, `
+				select coalesce(sum(spaceID = ?), 0) as test, coalesce(sum(spaceID = ?), 0) as other
+				from docs`, testID, otherID)
+			if err != nil {
+				res.err = err
+				continue
+			}
+			res.reads++
+			if counts.Test != counts.Other {
+				res.partial++
+			}
+		}
+	}()
+
+	const numUpdates = 50
+	for i := 0; i < numUpdates; i++ {
+		doc := protocol.Document{
+			ID:      protocol.DocumentID(fmt.Sprintf("doc%d", i)),
 			Updated: time.Now(),
 			Text:    "tjo och hej",
 			Alive:   true,
-		},
+		}
+		err = setup.db.addMultiSpaceDocumentUpdates(ctx, []protocol.DocumentUpdate{
+			{Space: "test", Documents: []protocol.Document{doc}},
+			{Space: "other", Documents: []protocol.Document{doc}},
+		})
+		xt.Nilf(err, "Failed to add multi space update: %v", err)
 	}
-	ctx := context.Background()
-	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	close(done)
+	res := <-result
 
-	xt.Nilf(err, "Failed to add new document")
+	xt.Nilf(res.err, "Read failed: %v", res.err)
+	xt.Assertf(res.reads > 0, "Expected reads while writing")
+	xt.Equalf(0, res.partial, "Expected no partially visible updates in %d reads", res.reads)
+
+	var count int
+	err = setup.db.rdb.Get(&count, "select count(*) from docs")
+	xt.Nil(err)
+	xt.Equal(2*numUpdates, count)
 }
 
 func TestCommitInterestList_Empty(t *testing.T) {
@@ -188,19 +2623,21 @@ func TestCommitInterestList_NonEmptyWithUpdates(t *testing.T) {
 
 	xt := xt.X(t)
 
+	listTime := time.Now()
 	list := protocol.IndexUpdate{
 		Space: "test",
 		Updates: []protocol.DocumentReference{
 			{
-				ID: "bello", Updated: time.Now(),
+				ID: "bello", Updated: listTime.Add(-time.Second),
 			},
 			{
-				ID: "koko", Updated: time.Now(),
+				ID: "koko", Updated: listTime,
 			},
 		},
 	}
 
-	docTime := time.Now()
+	// Updated again since listed
+	docTime := listTime.Add(time.Second)
 	docID := protocol.DocumentID("koko")
 	docs := []protocol.Document{
 		{
@@ -224,7 +2661,7 @@ func TestCommitInterestList_NonEmptyWithUpdates(t *testing.T) {
 	afterState, err := setup.db.getInterestListState(ctx, "test")
 	xt.Nilf(err, "Failed to get list state: %v", err)
 
-	xt.Equalf(docTime.UnixNano(), afterState.LastUpdated, "Expected last updated to be %v, was %v", docTime.UnixNano(), afterState.LastUpdated)
+	xt.Equalf(listTime.UnixNano(), afterState.LastUpdated, "Expected last updated to be %v, was %v", listTime.UnixNano(), afterState.LastUpdated)
 
 	xt.Equalf(docID, afterState.LastUpdatedDocID, "Expected last updated ID to be %v, was %v", docID, afterState.LastUpdatedDocID)
 }
@@ -253,6 +2690,364 @@ func TestGetLastUpdateTime_NonExistingSpace(t *testing.T) {
 	xt.Containsf(err, "sql: no rows", "Fetching last update time for unknown space should fail!")
 }
 
+func TestSplitSpaces(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	found, missing, unavailable, err := setup.db.splitSpaces(ctx, []string{"kawonka", "test"})
+	xt.Nilf(err, "Failed to split spaces: %v", err)
+	xt.DeepEqualf([]string{"test"}, found, "Expected existing space to be found")
+	xt.DeepEqualf([]string{"kawonka"}, missing, "Expected nonexisting space to be missing")
+	xt.Equalf(0, len(unavailable), "Expected no unavailable spaces")
+}
+
+func TestAddDocument_NormalizedIDs(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+	setup.db.idNormalizer = idNormalizer{lowercase: true, trim: "/"}
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	err := setup.db.setInterestList(ctx, protocol.IndexUpdate{
+		Space: "test",
+		Updates: []protocol.DocumentReference{
+			{ID: "Doc/1/", Updated: time.Unix(0, 1)},
+			{ID: "doc/1", Updated: time.Unix(0, 2)},
+		},
+	})
+	xt.Nilf(err, "Failed to set interest list: %v", err)
+
+	list, err := setup.db.getInterestList(ctx, "test")
+	xt.Nilf(err, "Failed to get interest list: %v", err)
+	xt.Equalf(1, len(list), "Expected duplicate IDs to be listed once")
+	xt.Equal(protocol.DocumentID("doc/1"), list[0].DocID)
+	xt.Equal(int64(2), list[0].Updated)
+
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{
+		{ID: "DOC/1", Updated: time.Now(), Text: "banana", Alive: true},
+		{ID: "/doc/1/", Updated: time.Now(), Text: "banana split", Alive: true},
+	})
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	count, err := setup.db.getDocumentCount(ctx)
+	xt.Nil(err)
+	xt.Equalf(uint64(1), count, "Expected one document")
+
+	list, err = setup.db.getInterestList(ctx, "test")
+	xt.Nil(err)
+	xt.Equalf(served, list[0].State, "Expected normalized interest to be served")
+}
+
+func TestIndexer_ShardNormalizedIDs(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+	setup.db.idNormalizer = idNormalizer{lowercase: true, trim: "/"}
+
+	xt := xt.X(t)
+
+	update := protocol.DocumentUpdate{
+		Space: "test",
+		Documents: []protocol.Document{
+			{ID: "doc/1"}, {ID: "Doc/1/"}, {ID: "/DOC/1"},
+		},
+	}
+	ids := []protocol.DocumentID{"doc/1", "Doc/1/", "/DOC/1"}
+
+	home := ShardIndexFromDocumentID("doc/1", 2)
+	xt.NotEqualf(
+		home, ShardIndexFromDocumentID("Doc/1/", 2),
+		"Expected raw and normalized IDs to hash to different shards",
+	)
+
+	for shard := 0; shard < 2; shard++ {
+		idx := &indexer{cfg: setup.config, db: setup.db}
+		idx.cfg.ShardgroupSize = 2
+		idx.cfg.ShardIndex = uint16(shard)
+
+		filtered := idx.shardFilter(update)
+		touched := idx.shardIDs(ids)
+		if shard != home {
+			xt.Equalf(0, len(filtered.Documents), "Expected no documents in shard %d", shard)
+			xt.Equalf(0, len(touched), "Expected no touched IDs in shard %d", shard)
+			continue
+		}
+		xt.Equalf(3, len(filtered.Documents), "Expected all documents in shard %d", shard)
+		for _, doc := range filtered.Documents {
+			xt.Equal(protocol.DocumentID("doc/1"), doc.ID)
+		}
+		xt.DeepEqual([]protocol.DocumentID{"doc/1", "doc/1", "doc/1"}, touched)
+	}
+}
+
+func TestIndexer_InvalidateNormalizedIDs(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+	setup.db.idNormalizer = idNormalizer{lowercase: true, trim: "/"}
+
+	xt := xt.X(t)
+
+	cache := NewCache(time.Minute, 1000)
+	idx := &indexer{
+		context: context.Background(),
+		cfg:     setup.config,
+		db:      setup.db,
+		cache:   cache,
+	}
+	idx.cfg.ShardgroupSize = 1
+
+	cached := func() bool {
+		_, found := cache.Get("banana", []string{"test"}, 10, 0)
+		return found
+	}
+	waitFor := func(expected bool) bool {
+		deadline := time.Now().Add(time.Second * 5)
+		for cached() != expected {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return true
+	}
+
+	cache.Put("banana", []string{"test"}, 10, 0, protocol.SearchResult{
+		Hits: []protocol.SearchHit{{Space: "test", ID: "doc/1"}},
+	})
+	xt.Truef(waitFor(true), "Expected result to be cached")
+
+	idx.storeUpdate([]protocol.DocumentUpdate{idx.shardFilter(protocol.DocumentUpdate{
+		Space: "test",
+		Documents: []protocol.Document{
+			{ID: "Doc/1/", Updated: time.Now(), Text: "banana", Alive: true},
+		},
+	})})
+	xt.Truef(waitFor(false), "Expected update of unnormalized ID to invalidate cached result")
+
+	count, err := setup.db.getDocumentCount(context.Background())
+	xt.Nil(err)
+	xt.Equalf(uint64(1), count, "Expected update to be stored")
+}
+
+func TestIndexer_RunStep(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+	ctx := context.Background()
+
+	// Document requests are buffered while connecting, no server needed
+	nc, err := nats.Connect("nats://127.0.0.1:1", nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+	xt.Nilf(err, "Failed to create connection: %v", err)
+	defer nc.Close()
+	ec, err := nats.NewEncodedConn(nc, nats.JSON_ENCODER)
+	xt.Nil(err)
+
+	idx := &indexer{
+		context:             ctx,
+		cfg:                 setup.config,
+		conn:                ec,
+		db:                  setup.db,
+		cache:               NewCache(time.Minute, 1000),
+		lastDocumentRequest: map[string]time.Time{},
+		progress:            map[string]spaceProgress{},
+		indexUpdates:        map[string]chan protocol.IndexUpdate{},
+		updateReceived:      make(chan struct{}, 1),
+		paused:              map[string]bool{},
+	}
+	idx.cfg.Index.ReqSize = 2
+	idx.cfg.Index.MaxOutstanding = 4
+	idx.cfg.Index.Wait.Interest = time.Millisecond * 10
+	idx.cfg.Index.Wait.Document = time.Hour
+	idx.cfg.Index.Wait.Refetch = time.Hour
+
+	list := protocol.IndexUpdate{
+		Space: "test",
+		Updates: []protocol.DocumentReference{
+			{ID: "1", Updated: time.Now()},
+			{ID: "2", Updated: time.Now()},
+			{ID: "3", Updated: time.Now()},
+		},
+	}
+	err = setup.db.setInterestList(ctx, list)
+	xt.Nilf(err, "Setting interest list failed: %v", err)
+
+	// Documents are requested in chunks of ReqSize
+	result := idx.runStep("test")
+	xt.Nilf(result.err, "Step failed: %v", result.err)
+	xt.Equal(3, result.listed)
+	xt.Equal(2, result.requested)
+	xt.Equal(0, result.committed)
+
+	result = idx.runStep("test")
+	xt.Nilf(result.err, "Step failed: %v", result.err)
+	xt.Equal(3, result.listed)
+	xt.Equal(1, result.requested)
+	xt.Equal(0, result.committed)
+
+	var docs []protocol.Document
+	for _, ref := range list.Updates {
+		docs = append(docs, protocol.Document{ID: ref.ID, Updated: ref.Updated, Text: "banana", Alive: true})
+	}
+	err = setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+	for _, ref := range list.Updates {
+		err = setup.db.setInterestState(ctx, "test", ref.ID, served)
+		xt.Nil(err)
+	}
+
+	// A fully served list is committed
+	result = idx.runStep("test")
+	xt.Nilf(result.err, "Step failed: %v", result.err)
+	xt.Equal(3, result.listed)
+	xt.Equal(0, result.requested)
+	xt.Equal(3, result.committed)
+
+	result = idx.runStep("test")
+	xt.Nilf(result.err, "Step failed: %v", result.err)
+	xt.Equalf(0, result.listed, "Expected committed list to be cleared")
+
+	result = idx.runStep("other")
+	xt.NotNilf(result.err, "Expected step of unindexed space to fail")
+	idx.paused["test"] = true
+	result = idx.runStep("test")
+	xt.NotNilf(result.err, "Expected step of paused space to fail")
+}
+
+func TestDiffIndexes(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+	otherSetup := getTestSetup(t)
+	defer otherSetup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	docs := []protocol.Document{
+		{ID: "1", Updated: time.Now(), Text: "banana split", Alive: true},
+		{ID: "2", Updated: time.Now(), Text: "banana bread", Alive: true},
+	}
+	err := setup.db.addDocumentUpdates(ctx, "test", docs)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+	err = otherSetup.db.addDocumentUpdates(ctx, "test", append(docs, protocol.Document{
+		ID: "3", Updated: time.Now(), Text: "banana boat", Alive: true,
+	}))
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	otherPath := otherSetup.config.DB.Path
+	err = otherSetup.db.Close()
+	xt.Nil(err)
+	otherSetup.db = nil
+
+	schemaVersion := func() uint {
+		url, err := getDatabaseURL(otherPath, readOnly, "")
+		xt.Nil(err)
+		db, err := sqlx.Connect(driver, url)
+		xt.Nilf(err, "Failed to open other index: %v", err)
+		defer db.Close()
+		var version uint
+		err = db.Get(&version, "select version from schema_migrations")
+		xt.Nil(err)
+		return version
+	}
+	before, err := os.Stat(otherPath)
+	xt.Nil(err)
+	versionBefore := schemaVersion()
+
+	diffs, err := DiffIndexes(setup.config, setup.db, otherPath, []string{"banana", "split"}, 10)
+	xt.Nilf(err, "Failed to diff indexes: %v", err)
+	xt.Equal(2, len(diffs))
+
+	xt.Falsef(diffs[0].Equal(), "Expected indexes to differ")
+	xt.Equal(2, diffs[0].TotalHits)
+	xt.Equal(3, diffs[0].OtherTotal)
+	xt.DeepEqual([]protocol.DocumentID{"3"}, diffs[0].Added)
+	xt.Equal(0, len(diffs[0].Missing))
+
+	xt.Truef(diffs[1].Equal(), "Expected equal results for %q", diffs[1].Query)
+
+	after, err := os.Stat(otherPath)
+	xt.Nil(err)
+	xt.Equalf(before.ModTime(), after.ModTime(), "Expected other index to be left unmodified")
+	xt.Equalf(before.Size(), after.Size(), "Expected other index to be left unmodified")
+	xt.Equal(versionBefore, schemaVersion())
+
+	// Older indexes are not migrated
+	writer, err := sqlx.Connect(driver, "file:"+otherPath)
+	xt.Nil(err)
+	_, err = writer.Exec("update schema_migrations set version = version - 1")
+	xt.Nil(err)
+	xt.Nil(writer.Close())
+	_, err = DiffIndexes(setup.config, setup.db, otherPath, []string{"banana"}, 10)
+	xt.NotNilf(err, "Expected schema version mismatch to fail")
+	xt.Equalf(versionBefore-1, schemaVersion(), "Expected other index not to be migrated")
+
+	_, err = DiffIndexes(setup.config, setup.db, path.Join(setup.tmpDir, "missing.db"), []string{"banana"}, 10)
+	xt.NotNilf(err, "Expected missing index to fail")
+}
+
+func TestGetSpaceWatermarks(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	watermarks, err := setup.db.getSpaceWatermarks(ctx, setup.db.rdb, []string{"test", "kawonka"})
+	xt.Nilf(err, "Failed to get watermarks: %v", err)
+	xt.Equalf(0, len(watermarks), "Expected no watermark before indexing")
+
+	updated := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	_, err = setup.db.wdb.Exec(
+		`update spaces set listCreatedAtNanos = ?, lastUpdatedAtNanos = ? where space = "test"`,
+		updated.UnixNano(), updated.UnixNano(),
+	)
+	xt.Nil(err)
+
+	watermarks, err = setup.db.getSpaceWatermarks(ctx, setup.db.rdb, []string{"test", "kawonka"})
+	xt.Nilf(err, "Failed to get watermarks: %v", err)
+	xt.DeepEqual(map[string]time.Time{"test": updated}, watermarks)
+
+	result := protocol.SearchResult{Watermarks: map[string]time.Time{
+		"test":  updated,
+		"other": updated.Add(-time.Hour),
+	}}
+	xt.Equal(updated.Add(-time.Hour), result.OldestWatermark())
+}
+
+func TestSpaceControl(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	err := setup.db.setSpaceControl(ctx, protocol.SpaceControl{Space: "test", SearchDisabled: true, IndexPaused: true})
+	xt.Nilf(err, "Failed to set space control: %v", err)
+
+	found, _, unavailable, err := setup.db.splitSpaces(ctx, []string{"test"})
+	xt.Nilf(err, "Failed to split spaces: %v", err)
+	xt.Equalf(0, len(found), "Expected disabled space not to be found")
+	xt.DeepEqualf([]string{"test"}, unavailable, "Expected disabled space to be unavailable")
+
+	disabled, paused, err := setup.db.getSpaceControls(ctx)
+	xt.Nilf(err, "Failed to get space controls: %v", err)
+	xt.DeepEqualf([]string{"test"}, disabled, "Expected search disabled space")
+	xt.DeepEqualf([]string{"test"}, paused, "Expected index paused space")
+
+	err = setup.db.setSpaceControl(ctx, protocol.SpaceControl{Space: "test"})
+	xt.Nilf(err, "Failed to set space control: %v", err)
+	found, _, _, err = setup.db.splitSpaces(ctx, []string{"test"})
+	xt.Nilf(err, "Failed to split spaces: %v", err)
+	xt.DeepEqualf([]string{"test"}, found, "Expected enabled space to be found")
+
+	err = setup.db.setSpaceControl(ctx, protocol.SpaceControl{Space: "kawonka"})
+	xt.NotNilf(err, "Expected setting control of missing space to fail")
+}
+
 func TestGetInterestList_Empty(t *testing.T) {
 	setup := getTestSetup(t)
 	defer setup.cleanup()
@@ -331,6 +3126,59 @@ func TestSetGetInterestList_CurrentListEmpty(t *testing.T) {
 	}
 }
 
+func TestSetInterestList_PriorityBoost(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	setup.db.priorityBoostWindow = time.Hour
+	now := time.Now()
+	list := protocol.IndexUpdate{
+		Space: "test",
+		Updates: []protocol.DocumentReference{
+			{ID: "old", Updated: now.Add(-3 * time.Hour)},
+			{ID: "older", Updated: now.Add(-2 * time.Hour)},
+			{ID: "recent", Updated: now.Add(-time.Minute)},
+		},
+	}
+
+	ctx := context.Background()
+	err := setup.db.setInterestList(ctx, list)
+	xt.Nilf(err, "Setting interest list failed: %v", err)
+
+	interests, err := setup.db.getInterestList(ctx, "test")
+	xt.Nilf(err, "Getting interest list failed: %v", err)
+	var ids []protocol.DocumentID
+	for _, interest := range interests {
+		ids = append(ids, interest.DocID)
+	}
+	xt.DeepEqual([]protocol.DocumentID{"recent", "old", "older"}, ids)
+
+	// The index position follows the document manager order
+	for _, interest := range interests {
+		err = setup.db.setInterestState(ctx, "test", interest.DocID, served)
+		xt.Nil(err)
+	}
+	err = setup.db.commitInterestList(ctx, "test")
+	xt.Nilf(err, "Committing interest list failed: %v", err)
+	state, err := setup.db.getInterestListState(ctx, "test")
+	xt.Nil(err)
+	xt.Equal(protocol.DocumentID("recent"), state.LastUpdatedDocID)
+}
+
+func TestParseInterestState(t *testing.T) {
+	xt := xt.X(t)
+
+	for _, state := range []InterestState{pending, requested, served} {
+		parsed, err := ParseInterestState(state.String())
+		xt.Nil(err)
+		xt.Equal(state, parsed)
+	}
+	_, err := ParseInterestState("lost")
+	xt.NotNil(err)
+}
+
 func TestSetInterestList_CurrentListNonEmpty(t *testing.T) {
 	setup := getTestSetup(t)
 	defer setup.cleanup()
@@ -397,9 +3245,12 @@ func TestSetStemmerState_Existing(t *testing.T) {
 		Stemmers: []string{
 			"german", "dutch",
 		},
-		RemoveDiacritics: true,
-		TokenCharacters:  "asd",
-		Separators:       "zxc",
+		RemoveDiacritics:   true,
+		TokenCharacters:    "asd",
+		Separators:         "zxc",
+		MaxTokenLength:     64,
+		TruncateLongTokens: true,
+		StopWords:          []string{"the", "and"},
 	}
 	err = setup.db.setStemmerState(state)
 	xt.Assert(err == nil)
@@ -412,3 +3263,313 @@ func TestSetStemmerState_Existing(t *testing.T) {
 
 	xt.DeepEqual(fetched, state)
 }
+
+func TestCheckStemmerSettings_MaxTokenLength(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	err := CheckStemmerSettings(setup.db, setup.config)
+	xt.Nil(err)
+
+	cfg := setup.config
+	cfg.Stemmer.MaxTokenLength = 32
+	err = CheckStemmerSettings(setup.db, cfg)
+	xt.Assert(errors.Is(err, ErrStemmerSettingsMismatch))
+
+	cfg = setup.config
+	cfg.Stemmer.TruncateLongTokens = true
+	err = CheckStemmerSettings(setup.db, cfg)
+	xt.Assert(errors.Is(err, ErrStemmerSettingsMismatch))
+}
+
+func TestCheckStemmerSettings_StopWords(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	err := CheckStemmerSettings(setup.db, setup.config)
+	xt.Nil(err)
+
+	cfg := setup.config
+	cfg.Stemmer.StopWords = []string{"the"}
+	err = CheckStemmerSettings(setup.db, cfg)
+	xt.Assert(errors.Is(err, ErrStemmerSettingsMismatch))
+}
+
+// The test setup driver is registered without a max token length,
+// so the stemmer is tested using separate drivers.
+func openMaxTokenLengthDB(t *testing.T, name string, truncate bool) *sqlx.DB {
+	sql.Register(name, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return snowball.Init(conn, snowball.Settings{
+				Stemmers:           []string{"english"},
+				MinTokenLength:     2,
+				MaxTokenLength:     8,
+				TruncateLongTokens: truncate,
+			})
+		},
+	})
+	db, err := sqlx.Open(name, ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`
+	create table stopwords (word text);
+	create table synonym_words (word text, synonymID integer);
+	create virtual table fts using fts5(txt, tokenize='snowball');
+	create virtual table vocab using fts5vocab(fts, row);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create tables: %v", err)
+	}
+	return db
+}
+
+func TestMaxTokenLength(t *testing.T) {
+	xt := xt.X(t)
+
+	for _, truncate := range []bool{false, true} {
+		db := openMaxTokenLengthDB(t, fmt.Sprintf("sqlite3_maxtoken_%v", truncate), truncate)
+		defer db.Close()
+
+		before := snowball.OversizedTokens()
+		_, err := db.Exec(
+			`insert into fts(txt) values ('short aGVsbG8gd29ybGQ= ääääää')`,
+		)
+		xt.Nil(err)
+		xt.Equal(before+2, snowball.OversizedTokens())
+
+		var terms []string
+		err = db.Select(&terms, "select term from vocab order by term")
+		xt.Nil(err)
+		if truncate {
+			// "ääääää" is 12 bytes, cut at a character boundary
+			xt.DeepEqual([]string{"agvsbg8g", "short", "ääää"}, terms)
+		} else {
+			xt.DeepEqual([]string{"short"}, terms)
+		}
+
+		// Queries are cut the same way, oversized tokens matching
+		// truncated tokens, or nothing when dropped
+		var matches int
+		err = db.Get(&matches, `select count(*) from fts where fts match '"aGVsbG8gd29ybGQ="'`)
+		xt.Nil(err)
+		if truncate {
+			xt.Equal(1, matches)
+		} else {
+			xt.Equal(0, matches)
+		}
+		xt.Equal(before+2, snowball.OversizedTokens())
+	}
+}
+
+func TestConfiguredStopWords(t *testing.T) {
+	xt := xt.X(t)
+
+	sql.Register("sqlite3_stopwords", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return snowball.Init(conn, snowball.Settings{
+				Stemmers:       []string{"english"},
+				MinTokenLength: 2,
+				StopWords:      []string{"The", "sat", "don't", "jumping"},
+			})
+		},
+	})
+	db, err := sqlx.Open("sqlite3_stopwords", ":memory:")
+	xt.Nil(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`
+	create table stopwords (word text);
+	create table synonym_words (word text, synonymID integer);
+	create virtual table fts using fts5(txt, tokenize='snowball');
+	create virtual table vocab using fts5vocab(fts, row);
+	insert into fts(txt) values ('THE black cat sat over the dont jumps');
+	`)
+	xt.Nil(err)
+
+	// Stop words are matched case insensitively, after stemming,
+	// stop words of several tokens are ignored
+	var terms []string
+	err = db.Select(&terms, "select term from vocab order by term")
+	xt.Nil(err)
+	xt.DeepEqual([]string{"black", "cat", "dont", "over"}, terms)
+
+	// Stop words are removed from phrases too
+	var matches int
+	err = db.Get(&matches, `select count(*) from fts where fts match '"cat the over"'`)
+	xt.Nil(err)
+	xt.Equal(1, matches)
+
+	// Words with the stem of a stop word are removed
+	err = db.Get(&matches, `select count(*) from fts where fts match '"cat jumps over"'`)
+	xt.Nil(err)
+	xt.Equal(1, matches)
+}
+
+func TestStatsHistory(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	update := []protocol.DocumentUpdate{{
+		Space: "test",
+		Documents: []protocol.Document{
+			{ID: "1", Updated: time.Now(), Text: "banana split", Alive: true},
+			{ID: "2", Updated: time.Now(), Text: "banana", Alive: true},
+		},
+	}}
+	err := setup.db.addMultiSpaceDocumentUpdates(ctx, update)
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	sample, err := setup.db.sampleStats(ctx)
+	xt.Nilf(err, "Failed to sample stats: %v", err)
+	xt.Equal(2, sample.Docs)
+	xt.Equal(2, sample.SpaceDocs["test"])
+	xt.Equal(2, sample.UniqueTerms)
+	xt.Equal(3, sample.TotalTerms)
+	xt.Assert(sample.Bytes > 0)
+
+	old := sample
+	old.Sampled = sample.Sampled.Add(-2 * time.Hour)
+	err = setup.db.addStatsSample(ctx, old, 24*time.Hour)
+	xt.Nilf(err, "Failed to add sample: %v", err)
+	err = setup.db.addStatsSample(ctx, sample, time.Hour)
+	xt.Nilf(err, "Failed to add sample: %v", err)
+
+	samples, err := setup.db.getStatsHistory(ctx, time.Time{})
+	xt.Nilf(err, "Failed to get stats history: %v", err)
+	xt.Equalf(1, len(samples), "Expected samples older than retention to be dropped")
+	xt.Equal(sample.Sampled.UnixNano(), samples[0].Sampled.UnixNano())
+	xt.Equal(2, samples[0].SpaceDocs["test"])
+}
+
+func TestRebuild_CancelAndResume(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	doc := func(id string) protocol.Document {
+		return protocol.Document{
+			ID: protocol.DocumentID(id), Updated: time.Now(), Text: "banana", Alive: true,
+		}
+	}
+	indexed := func() int {
+		var count int
+		err := setup.db.rdb.Get(&count, `select count(*) from fts where fts match 'banana'`)
+		xt.Nilf(err, "Failed to count indexed documents: %v", err)
+		return count
+	}
+
+	ctx := context.Background()
+	err := setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{doc("a"), doc("b")})
+	xt.Nilf(err, "Failed to add documents: %v", err)
+
+	started, err := setup.db.startRebuild(ctx)
+	xt.Nilf(err, "Failed to start rebuild: %v", err)
+	xt.Assertf(started, "Expected new rebuild")
+	xt.Equalf(0, indexed(), "Expected cleared index")
+
+	// Documents changed while rebuilding are left to the rebuild
+	err = setup.db.addDocumentUpdates(ctx, "test", []protocol.Document{doc("b"), doc("c")})
+	xt.Nilf(err, "Failed to add documents: %v", err)
+	xt.Equal(0, indexed())
+
+	cancelled, err := setup.db.cancelRebuild(ctx)
+	xt.Nilf(err, "Failed to cancel rebuild: %v", err)
+	xt.Assert(cancelled)
+	_, err = setup.db.rebuildBatch(ctx)
+	xt.Assertf(errors.Is(err, ErrRebuildCancelled), "Expected cancelled rebuild, got %v", err)
+
+	state, err := setup.db.getRebuildState(ctx)
+	xt.Nilf(err, "Failed to get rebuild state: %v", err)
+	xt.Assertf(state != nil, "Expected unfinished rebuild")
+	xt.Equal(3, state.Remaining)
+
+	err = setup.db.rebuild(ctx)
+	xt.Nilf(err, "Failed to resume rebuild: %v", err)
+	xt.Equal(3, indexed())
+
+	state, err = setup.db.getRebuildState(ctx)
+	xt.Nilf(err, "Failed to get rebuild state: %v", err)
+	xt.Assertf(state == nil, "Expected finished rebuild")
+
+	_, err = setup.db.wdb.Exec(`insert into fts(fts, rank) values('integrity-check', 1)`)
+	xt.Nilf(err, "Index integrity check failed: %v", err)
+}
+
+func TestCheckReadOnlySQL(t *testing.T) {
+	xt := xt.X(t)
+
+	for _, statement := range []string{
+		"select count(*) from docs",
+		"  SELECT 1;  ",
+		"with x as (select 1) select * from x",
+		"explain query plan select * from docs",
+		"pragma page_count",
+		"PRAGMA table_info(docs)",
+	} {
+		xt.Nilf(checkReadOnlySQL(statement), "Expected %q to be allowed", statement)
+	}
+	for _, statement := range []string{
+		"",
+		"delete from docs",
+		"select 1; delete from docs",
+		"/* select */ delete from docs",
+		"pragma journal_mode = delete",
+		"pragma journal_mode(delete)",
+		"pragma writable_schema",
+		"attach database 'x' as x",
+	} {
+		xt.Assertf(errors.Is(checkReadOnlySQL(statement), ErrNotReadOnly), "Expected %q to be rejected", statement)
+	}
+}
+
+func TestRunReadOnlySQL(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	ctx := context.Background()
+	columns, rows, truncated, err := setup.db.runReadOnlySQL(ctx, "select space, 1 as one from spaces where space = ?", []string{"test"})
+	xt.Nilf(err, "Failed to run statement: %v", err)
+	xt.DeepEqual([]string{"space", "one"}, columns)
+	xt.DeepEqual([][]interface{}{{"test", int64(1)}}, rows)
+	xt.False(truncated)
+
+	_, _, _, err = setup.db.runReadOnlySQL(ctx, "with x as (select 1) delete from docs", nil)
+	xt.Assertf(errors.Is(err, ErrNotReadOnly), "Expected write through CTE to be rejected, got %v", err)
+}
+
+func TestSafeRawQuery(t *testing.T) {
+	setup := getTestSetup(t)
+	defer setup.cleanup()
+
+	xt := xt.X(t)
+
+	rows, err := setup.db.SafeRawQuery("select space, 1 from spaces where space = ?", "test")
+	xt.Nilf(err, "Failed to run statement: %v", err)
+	xt.DeepEqual([]string{"test, 1"}, rows)
+
+	for _, statement := range []string{
+		"delete from spaces",
+		"attach database ':memory:' as x",
+		"pragma key = 'secret'",
+		"with x as (select 1) delete from spaces",
+	} {
+		_, err = setup.db.SafeRawQuery(statement)
+		xt.Assertf(errors.Is(err, ErrNotReadOnly), "Expected %q to be rejected, got %v", statement, err)
+	}
+
+	rows, err = setup.db.RawQuery("select count(*) from spaces")
+	xt.Nil(err)
+	xt.DeepEqual([]string{"1"}, rows)
+}
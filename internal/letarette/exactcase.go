@@ -0,0 +1,87 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// exactCaseMarker marks upper case letters in exact case words.
+// It is a token character of the exact case index, see migration 23.
+const exactCaseMarker = '^'
+
+// exactCaseWord encodes the case of a word in lower case, since the
+// index tokenizer folds case. Upper case letters are lowered and
+// marked, turning "IT" into "^i^t" and "It" into "^it".
+func exactCaseWord(word string) string {
+	var encoded strings.Builder
+	for _, r := range word {
+		if unicode.IsUpper(r) || unicode.IsTitle(r) {
+			encoded.WriteRune(exactCaseMarker)
+			r = unicode.ToLower(r)
+		}
+		encoded.WriteRune(r)
+	}
+	return encoded.String()
+}
+
+// exactCaseWords returns the space separated case encoded
+// words of a text, in text order.
+func exactCaseWords(text string) string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		words[i] = exactCaseWord(word)
+	}
+	return strings.Join(words, " ")
+}
+
+// phrasesToExactCaseMatchString builds a match expression for the
+// exact case index, matching the case encoded words of each phrase
+// in order. Column filters do not apply to the exact case index,
+// and are ignored. OR groups are not supported.
+func phrasesToExactCaseMatchString(phrases []Phrase) (string, error) {
+	var includes []string
+	var excludes []string
+	for _, phrase := range phrases {
+		if phrase.Group {
+			return "", fmt.Errorf("%w: OR group in exact case query", errInvalidQuery)
+		}
+		words := exactCaseWords(phrase.Text)
+		if words == "" {
+			continue
+		}
+		expr := fmt.Sprintf("%q", words)
+		if phrase.Wildcard {
+			expr += " *"
+		}
+		if phrase.Exclude {
+			excludes = append(excludes, expr)
+		} else {
+			includes = append(includes, expr)
+		}
+	}
+	if len(includes) == 0 {
+		return "", fmt.Errorf("%w: no words in exact case query", errInvalidQuery)
+	}
+	matchString := strings.Join(includes, " AND ")
+	if len(excludes) > 0 {
+		matchString += fmt.Sprintf(" NOT (%s)", strings.Join(excludes, " OR "))
+	}
+	return matchString, nil
+}
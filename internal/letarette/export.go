@@ -0,0 +1,188 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// ExportedDocument is a line of the JSON Lines index export format,
+// holding a document and its space. See ExportIndex.
+type ExportedDocument struct {
+	Space string
+	protocol.Document
+}
+
+// ExportIndex writes the documents of the given spaces, or of all spaces
+// when none are given, to w as JSON Lines, one ExportedDocument per line.
+//
+// Documents are exported with their text, stored fields and metadata.
+// Index terms are not exported, since importing re-indexes the text
+// using the stemmer settings of the importing index. Dead documents are
+// exported too, keeping them from being requested again after import.
+// Contentless spaces have no text to export, and are skipped.
+func ExportIndex(dbo Database, w io.Writer, spaces []string) error {
+	db := dbo.(*database)
+	ctx := context.Background()
+
+	var contentless []string
+	err := db.rdb.SelectContext(ctx, &contentless, "select space from spaces where contentless")
+	if err != nil {
+		return err
+	}
+	for _, space := range contentless {
+		logger.Warning.Printf("Skipping export of contentless space %q", space)
+	}
+
+	query := `
+	select docs.id as rowid, spaceID, space, docID as id, updatedNanos, title,
+	uncompress(txt) as "text", alive, source, language, version, boost
+	from docs join spaces using (spaceID)
+	where not spaces.contentless
+	and (? or space in (?))
+	order by spaceID, docs.id`
+	allSpaces := len(spaces) == 0
+	if allSpaces {
+		spaces = []string{""}
+	}
+	query, args, err := sqlx.In(query, allSpaces, spaces)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.rdb.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fields, err := db.rdb.PreparexContext(ctx, "select field, value from docfields where spaceID = ? and docID = ?")
+	if err != nil {
+		return err
+	}
+	defer fields.Close()
+
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	for rows.Next() {
+		var doc struct {
+			ExportedDocument
+			RowID        int64 `db:"rowid"`
+			SpaceID      int   `db:"spaceID"`
+			UpdatedNanos int64 `db:"updatedNanos"`
+		}
+		err = rows.StructScan(&doc)
+		if err != nil {
+			return err
+		}
+		doc.Updated = time.Unix(0, doc.UpdatedNanos)
+
+		var values []struct {
+			Field string
+			Value string
+		}
+		err = fields.SelectContext(ctx, &values, doc.SpaceID, doc.ID)
+		if err != nil {
+			return fmt.Errorf("failed to read doc fields: %w", err)
+		}
+		for _, value := range values {
+			if doc.Fields == nil {
+				doc.Fields = map[string]string{}
+			}
+			doc.Fields[value.Field] = value.Value
+		}
+
+		err = encoder.Encode(doc.ExportedDocument)
+		if err != nil {
+			return err
+		}
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	return writer.Flush()
+}
+
+// ImportIndex loads documents exported by ExportIndex, read from r,
+// directly into the index, bypassing the interest list cycle.
+// Consecutive documents of a space are loaded in a single transaction,
+// and all spaces must exist in the index.
+// Returns the number of imported documents.
+func ImportIndex(dbo Database, r io.Reader) (int, error) {
+	var loader *BulkLoader
+	defer func() {
+		if loader != nil {
+			_ = loader.Rollback()
+		}
+	}()
+
+	decoder := json.NewDecoder(r)
+	space := ""
+	imported := 0
+	for {
+		var doc ExportedDocument
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("failed to read document: %w", err)
+		}
+		if doc.Space == "" {
+			return imported, fmt.Errorf("document %q has no space", doc.ID)
+		}
+
+		if loader == nil || doc.Space != space {
+			if loader != nil {
+				err = loader.Commit()
+				loader = nil
+				if err != nil {
+					return imported, err
+				}
+			}
+			loader, err = StartBulkLoad(dbo, doc.Space)
+			if err != nil {
+				return imported, fmt.Errorf("failed to start bulk load: %w", err)
+			}
+			space = doc.Space
+		}
+
+		err = loader.Load(doc.Document)
+		if err != nil {
+			return imported, err
+		}
+		imported++
+	}
+
+	if loader != nil {
+		err := loader.Commit()
+		loader = nil
+		if err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// fieldParser parses stored field values of numeric and date
+// fields into typed values, according to the field parsing config.
+type fieldParser struct {
+	numeric          map[string]bool
+	dates            map[string]bool
+	decimalSeparator string
+	groupSeparator   string
+	dateFormats      []string
+}
+
+func newFieldParser(cfg Config) fieldParser {
+	parser := fieldParser{
+		numeric:          map[string]bool{},
+		dates:            map[string]bool{},
+		decimalSeparator: cfg.Index.FieldParsing.DecimalSeparator,
+		groupSeparator:   cfg.Index.FieldParsing.GroupSeparator,
+		dateFormats:      cfg.Index.FieldParsing.DateFormats,
+	}
+	for _, field := range cfg.Index.NumericFields {
+		parser.numeric[field] = true
+	}
+	for _, field := range cfg.Index.DateFields {
+		parser.dates[field] = true
+	}
+	return parser
+}
+
+// parse returns the typed value of a field, a float64 for numeric fields
+// and Unix nanoseconds for date fields. Other fields, and values failing
+// to parse, have no typed value and nil is returned.
+func (p fieldParser) parse(field, value string) (interface{}, error) {
+	var typed interface{}
+	var err error
+	value = strings.TrimSpace(value)
+	switch {
+	case p.numeric[field]:
+		typed, err = p.parseNumber(value)
+	case p.dates[field]:
+		typed, err = p.parseDate(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return typed, nil
+}
+
+func (p fieldParser) parseNumber(value string) (float64, error) {
+	normalized := value
+	if p.groupSeparator != "" {
+		normalized = strings.ReplaceAll(normalized, p.groupSeparator, "")
+	}
+	if p.decimalSeparator != "." {
+		if strings.Contains(normalized, ".") {
+			return 0, fmt.Errorf("invalid number %q", value)
+		}
+		normalized = strings.Replace(normalized, p.decimalSeparator, ".", 1)
+	}
+	number, err := strconv.ParseFloat(normalized, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	return number, nil
+}
+
+func (p fieldParser) parseDate(value string) (int64, error) {
+	for _, format := range p.dateFormats {
+		date, err := time.Parse(format, value)
+		if err == nil {
+			return date.UnixNano(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid date %q, expected one of %v", value, p.dateFormats)
+}
+
+func validateFieldParsing(cfg Config) error {
+	stored := map[string]bool{}
+	for _, field := range cfg.Index.StoredFields {
+		stored[field] = true
+	}
+	for _, fields := range [][]string{cfg.Index.NumericFields, cfg.Index.DateFields} {
+		for _, field := range fields {
+			if !stored[field] {
+				return fmt.Errorf("typed field %q is not a stored field", field)
+			}
+		}
+	}
+
+	parsing := cfg.Index.FieldParsing
+	if utf8.RuneCountInString(parsing.DecimalSeparator) != 1 {
+		return fmt.Errorf("decimal separator must be a single character")
+	}
+	if parsing.DecimalSeparator == parsing.GroupSeparator {
+		return fmt.Errorf("decimal and group separators must differ")
+	}
+	if len(cfg.Index.DateFields) > 0 && len(parsing.DateFormats) == 0 {
+		return fmt.Errorf("date fields require at least one date format")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"testing"
+	"time"
+
+	xt "github.com/erkkah/letarette/pkg/xt"
+)
+
+func TestFieldParser(t *testing.T) {
+	xt := xt.X(t)
+
+	var cfg Config
+	cfg.Index.NumericFields = []string{"price"}
+	cfg.Index.DateFields = []string{"published"}
+	cfg.Index.FieldParsing.DecimalSeparator = ","
+	cfg.Index.FieldParsing.GroupSeparator = " "
+	cfg.Index.FieldParsing.DateFormats = []string{"2006-01-02", "02.01.2006"}
+	parser := newFieldParser(cfg)
+
+	typed, err := parser.parse("price", " 1 234,5 ")
+	xt.Nilf(err, "Failed to parse number: %v", err)
+	xt.Equal(1234.5, typed)
+
+	_, err = parser.parse("price", "1.5")
+	xt.Containsf(err, "invalid number", "Expected wrong decimal separator to fail")
+
+	typed, err = parser.parse("published", "24.12.2019")
+	xt.Nilf(err, "Failed to parse date: %v", err)
+	xt.Equal(time.Date(2019, 12, 24, 0, 0, 0, 0, time.UTC).UnixNano(), typed)
+
+	_, err = parser.parse("published", "yesterday")
+	xt.Containsf(err, "invalid date", "Expected unknown date format to fail")
+
+	typed, err = parser.parse("title", "anything")
+	xt.Nil(err)
+	xt.Nil(typed)
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Number of spelling index candidates checked for each fuzzy term
+const fuzzyCandidates = 20
+
+// fuzzyGroups adds near-matches of single word phrases to the synonym
+// groups of a phrase list, see protocol.SearchRequest.Fuzzy.
+// Near-matches are words in the spelling index within the given edit
+// distance of the phrase. Phrases already having synonyms are kept.
+func fuzzyGroups(
+	ctx context.Context, q sqlx.QueryerContext, phrases []Phrase, groups [][]string, distance int,
+) ([][]string, error) {
+	fuzzed := make([][]string, len(phrases))
+	copy(fuzzed, groups)
+
+	for i, phrase := range phrases {
+		if len(groups[i]) > 0 || phrase.Exclude || phrase.Wildcard {
+			continue
+		}
+		word := strings.ToLower(strings.Trim(phrase.Text, `" `))
+		if word == "" || strings.ContainsAny(word, " \"") {
+			continue
+		}
+
+		var candidates []string
+		err := sqlx.SelectContext(
+			ctx, q, &candidates,
+			`select word from speling where word match ? and top = ?`, word, fuzzyCandidates,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up fuzzy matches: %w", err)
+		}
+
+		group := []string{word}
+		for _, candidate := range candidates {
+			if candidate != word && editDistance(word, candidate) <= distance {
+				group = append(group, candidate)
+			}
+		}
+		if len(group) > 1 {
+			fuzzed[i] = group
+		}
+	}
+	return fuzzed, nil
+}
+
+// editDistance returns the Levenshtein distance between two words,
+// counting single character insertions, deletions and substitutions.
+func editDistance(a, b string) int {
+	x := []rune(a)
+	y := []rune(b)
+
+	previous := make([]int, len(y)+1)
+	current := make([]int, len(y)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		current[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			current[j] = min(min(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(y)]
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/logger"
+)
+
+// Time allowed for the database check of a health request
+const healthCheckTimeout = 5 * time.Second
+
+// HealthStatus is the JSON body of health check responses
+type HealthStatus struct {
+	Status string   `json:"status"`
+	Spaces []string `json:"spaces,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+type healthServer struct {
+	db     *database
+	server http.Server
+}
+
+// StartHealthServer starts an HTTP server for health checks on the
+// Health.ListenAddr address of the config.
+//
+// The "/health" path responds with status 200 and the index spaces
+// when the database is reachable, and with status 503 when not.
+// The "/metrics" path lists the worker metrics in the Prometheus
+// text format.
+func StartHealthServer(dbo Database, cfg Config) (io.Closer, error) {
+	self := &healthServer{
+		db: dbo.(*database),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", self.serveHealth)
+	mux.HandleFunc("/metrics", serveMetrics)
+	self.server = http.Server{
+		Addr:    cfg.Health.ListenAddr,
+		Handler: mux,
+	}
+
+	listener, err := net.Listen("tcp", cfg.Health.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start health server: %w", err)
+	}
+	logger.Info.Printf("Health server listening on %v", listener.Addr())
+
+	go func() {
+		err := self.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error.Printf("Health server failed: %v", err)
+		}
+	}()
+
+	return self, nil
+}
+
+// Close stops the health server
+func (hs *healthServer) Close() error {
+	return hs.server.Close()
+}
+
+func (hs *healthServer) serveHealth(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+	defer cancel()
+
+	status := HealthStatus{Status: "ok"}
+	code := http.StatusOK
+	err := hs.db.rdb.SelectContext(
+		ctx, &status.Spaces, "select space from spaces where not retired order by space",
+	)
+	if err != nil {
+		status = HealthStatus{Status: "unavailable", Error: err.Error()}
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// serveMetrics writes the numeric metrics, see metricsByName,
+// in the Prometheus text format
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+	names := make([]string, 0, len(metricsByName))
+	for name := range metricsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		value, err := strconv.ParseFloat(metricsByName[name].String(), 64)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "# TYPE letarette_%s untyped\n", name)
+		fmt.Fprintf(&b, "letarette_%s %v\n", name, value)
+	}
+
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	_, _ = io.WriteString(w, b.String())
+}
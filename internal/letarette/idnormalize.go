@@ -0,0 +1,65 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// idNormalizer normalizes document IDs, so that IDs differing only
+// in formatting refer to the same document. See Config.Index.IDNormalization.
+type idNormalizer struct {
+	lowercase   bool
+	trim        string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// newIDNormalizer expects the pattern to be validated by the config
+func newIDNormalizer(cfg Config) idNormalizer {
+	normalizer := idNormalizer{
+		lowercase:   cfg.Index.IDNormalization.Lowercase,
+		trim:        cfg.Index.IDNormalization.Trim,
+		replacement: cfg.Index.IDNormalization.Replacement,
+	}
+	if cfg.Index.IDNormalization.Pattern != "" {
+		normalizer.pattern = regexp.MustCompile(cfg.Index.IDNormalization.Pattern)
+	}
+	return normalizer
+}
+
+// normalize applies the pattern replacement, trimming and lowercasing,
+// in that order. IDs normalized to the empty string are kept as is.
+// The indexer normalizes IDs before storing, so normalizing a normalized
+// ID is expected to keep it unchanged.
+func (n idNormalizer) normalize(id protocol.DocumentID) protocol.DocumentID {
+	normalized := string(id)
+	if n.pattern != nil {
+		normalized = n.pattern.ReplaceAllString(normalized, n.replacement)
+	}
+	if n.trim != "" {
+		normalized = strings.Trim(normalized, n.trim)
+	}
+	if n.lowercase {
+		normalized = strings.ToLower(normalized)
+	}
+	if normalized == "" {
+		return id
+	}
+	return protocol.DocumentID(normalized)
+}
@@ -0,0 +1,40 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"testing"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+
+	xt "github.com/erkkah/letarette/pkg/xt"
+)
+
+func TestIDNormalizer(t *testing.T) {
+	xt := xt.X(t)
+
+	var cfg Config
+	cfg.Index.IDNormalization.Lowercase = true
+	cfg.Index.IDNormalization.Trim = "/ "
+	cfg.Index.IDNormalization.Pattern = `(?i)^https?://`
+	normalizer := newIDNormalizer(cfg)
+
+	xt.Equal(protocol.DocumentID("docs/1"), normalizer.normalize(" Docs/1/"))
+	xt.Equal(protocol.DocumentID("example.com/a"), normalizer.normalize("HTTPS://example.com/A"))
+	xt.Equal(protocol.DocumentID("docs/1"), normalizer.normalize(normalizer.normalize("Docs/1/")))
+	xt.Equalf(protocol.DocumentID("//"), normalizer.normalize("//"), "Expected empty IDs to be kept")
+
+	xt.Equal(protocol.DocumentID("Docs/1/"), newIDNormalizer(Config{}).normalize("Docs/1/"))
+}
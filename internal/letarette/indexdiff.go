@@ -0,0 +1,200 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// QueryDiff holds the differences between the results of one
+// query, run against two indexes.
+type QueryDiff struct {
+	Query      string
+	TotalHits  int
+	OtherTotal int
+	// Hits only found in the first index
+	Missing []protocol.DocumentID
+	// Hits only found in the other index
+	Added []protocol.DocumentID
+	// Number of common hits ranked at different positions
+	Reordered int
+}
+
+// Equal is true when both indexes returned the same hits in the same order
+func (qd QueryDiff) Equal() bool {
+	return qd.TotalHits == qd.OtherTotal &&
+		len(qd.Missing) == 0 && len(qd.Added) == 0 && qd.Reordered == 0
+}
+
+// DiffIndexes runs each query against both the given database and
+// the database at otherPath, comparing the first pageLimit hits.
+// All spaces in the first database are searched.
+// The other database is opened read-only using the search settings
+// of cfg. It is never migrated or otherwise written to, and must be
+// at the current schema version.
+func DiffIndexes(cfg Config, dbo Database, otherPath string, queries []string, pageLimit uint16) ([]QueryDiff, error) {
+	db := dbo.(*database)
+
+	otherCfg := cfg
+	otherCfg.DB.Path = otherPath
+	other, err := openReadOnlyDatabase(otherCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open other index: %w", err)
+	}
+	defer other.Close()
+
+	var spaces []string
+	// Spaces being reloaded or replaced by reloads are left out
+	err = db.rdb.Select(&spaces, `
+		select space from spaces
+		where not retired and spaceID not in (select shadowID from reloads where shadowID is not null)
+		`)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	var diffs []QueryDiff
+
+	for _, query := range queries {
+		phrases := ReducePhraseList(ParseQuery(query))
+		if len(phrases) == 0 {
+			continue
+		}
+		request := protocol.SearchRequest{
+			Spaces:    spaces,
+			PageLimit: pageLimit,
+		}
+
+		result, err := db.search(ctx, phrases, request)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search index: %w", err)
+		}
+		otherResult, err := other.search(ctx, phrases, request)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search other index: %w", err)
+		}
+
+		diffs = append(diffs, diffResults(query, result, otherResult))
+	}
+
+	return diffs, nil
+}
+
+func diffResults(query string, result, other protocol.SearchResult) QueryDiff {
+	diff := QueryDiff{
+		Query:      query,
+		TotalHits:  result.TotalHits,
+		OtherTotal: other.TotalHits,
+	}
+
+	otherPositions := map[protocol.DocumentID]int{}
+	for i, hit := range other.Hits {
+		otherPositions[hit.ID] = i
+	}
+
+	found := map[protocol.DocumentID]bool{}
+	for i, hit := range result.Hits {
+		found[hit.ID] = true
+		otherPosition, inOther := otherPositions[hit.ID]
+		if !inOther {
+			diff.Missing = append(diff.Missing, hit.ID)
+		} else if otherPosition != i {
+			diff.Reordered++
+		}
+	}
+
+	for _, hit := range other.Hits {
+		if !found[hit.ID] {
+			diff.Added = append(diff.Added, hit.ID)
+		}
+	}
+
+	return diff
+}
+
+func loadContentlessSpaces(rdb *sqlx.DB) (map[string]bool, error) {
+	var spaces []string
+	err := rdb.Select(&spaces, "select space from spaces where contentless")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load space content modes: %w", err)
+	}
+	contentless := map[string]bool{}
+	for _, space := range spaces {
+		contentless[space] = true
+	}
+	return contentless, nil
+}
+
+// openReadOnlyDatabase opens a search-only connection to an existing
+// database, without a writer and without migrating the database.
+// Fails unless the database is at the current schema version.
+func openReadOnlyDatabase(cfg Config) (*database, error) {
+	if _, err := os.Stat(cfg.DB.Path); err != nil {
+		return nil, err
+	}
+
+	latestMigration, err := latestMigrationVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	registerCustomDriver(cfg)
+	// No journal mode, changing it would write to the database
+	url, err := getDatabaseURL(cfg.DB.Path, readOnly, "")
+	if err != nil {
+		return nil, err
+	}
+	rdb, err := sqlx.Connect(driver, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var state struct {
+		Version uint
+		Dirty   bool
+	}
+	err = rdb.Get(&state, `select version, dirty from schema_migrations`)
+	if err == nil && (state.Dirty || state.Version != latestMigration) {
+		err = fmt.Errorf(
+			"schema version %d (dirty: %v) differs from current version %d",
+			state.Version, state.Dirty, latestMigration,
+		)
+	}
+	if err != nil {
+		_ = rdb.Close()
+		return nil, err
+	}
+
+	contentless, err := loadContentlessSpaces(rdb)
+	if err != nil {
+		_ = rdb.Close()
+		return nil, err
+	}
+
+	db, err := newDatabase(cfg, rdb, nil, contentless)
+	if err != nil {
+		_ = rdb.Close()
+		return nil, err
+	}
+	db.latestMigration = latestMigration
+	return db, nil
+}
@@ -16,6 +16,7 @@ package letarette
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -49,16 +50,35 @@ func StartIndexer(nc *nats.Conn, db Database, cfg Config, cache *Cache) (Indexer
 		context:             mainContext,
 		close:               cancel,
 		lastDocumentRequest: map[string]time.Time{},
+		progress:            map[string]spaceProgress{},
+		restartFetch:        map[string]chan struct{}{},
 		cfg:                 cfg,
 		conn:                ec,
 		db:                  db.(*database),
 		indexUpdates:        map[string]chan protocol.IndexUpdate{},
 		updateReceived:      make(chan struct{}, 1),
+		cache:               cache,
+		reloads:             map[string]*spaceReload{},
+		shadows:             map[string]string{},
+		paused:              map[string]bool{},
+		steps:               make(chan indexStep),
+	}
+
+	rebuild, err := self.db.getRebuildState(mainContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rebuild state: %w", err)
+	}
+	if rebuild != nil {
+		logger.Warning.Printf(
+			"Index rebuild started %v is unfinished, %d documents are not searchable until resumed",
+			rebuild.Started.Format(time.RFC3339), rebuild.Remaining,
+		)
 	}
 
 	for _, space := range cfg.Index.Spaces {
 		self.indexUpdates[space] = make(chan protocol.IndexUpdate)
-		err := self.db.clearInterestList(context.Background(), space)
+		self.restartFetch[space] = make(chan struct{}, 1)
+		err := self.db.clearInterestList(mainContext, space)
 		if err != nil {
 			return nil, fmt.Errorf("failed to clear interest list: %w", err)
 		}
@@ -69,63 +89,124 @@ func StartIndexer(nc *nats.Conn, db Database, cfg Config, cache *Cache) (Indexer
 		return nil, err
 	}
 
-	updates := make(chan protocol.DocumentUpdate, 50)
+	updates := make(chan queuedUpdate, cfg.Index.UpdateQueueSize)
+
+	queueUpdate := func(update []protocol.DocumentUpdate, ack func()) {
+		queued := queuedUpdate{update, ack}
+		select {
+		case updates <- queued:
+		default:
+			start := time.Now()
+			updates <- queued
+			metrics.UpdateQueueBlocked.Add(time.Since(start).Seconds())
+		}
+		metrics.UpdateQueue.Set(int64(len(updates)))
+	}
+
+	var backpressure queueWatch
+	received := func() {
+		depth := len(updates)
+		metrics.UpdateQueue.Set(int64(depth))
+		backpressure.check(depth, cap(updates))
+		self.notifyUpdateReceived()
+	}
 
 	self.waiter.Add(1)
 	go func() {
-		for update := range updates {
-			self.notifyUpdateReceived()
-			err := self.db.addDocumentUpdates(mainContext, update.Space, update.Documents)
-			if err != nil {
-				logger.Error.Printf("failed to add document update: %v", err)
-			}
-			for _, doc := range update.Documents {
-				cache.Invalidate(doc.ID)
-			}
-		}
+		batchUpdates(
+			mainContext, updates,
+			cfg.Index.CommitBatch.MinDocs, cfg.Index.CommitBatch.MaxLatency,
+			received, self.storeUpdate,
+		)
 		self.waiter.Done()
 	}()
 
-	subscription, err := ec.Subscribe(cfg.Nats.Topic+".document.update", func(update *protocol.DocumentUpdate) {
-		filtered := make([]protocol.Document, 0, len(update.Documents))
-		for _, doc := range update.Documents {
-			index := ShardIndexFromDocumentID(doc.ID, int(cfg.ShardgroupSize))
-			if index == int(cfg.ShardIndex) {
-				filtered = append(filtered, doc)
-			}
+	subscription, err := self.subscribeUpdates(".document.update", "update", func(data []byte, ack func()) error {
+		var update protocol.DocumentUpdate
+		err := json.Unmarshal(data, &update)
+		if err != nil {
+			return err
+		}
+		queueUpdate([]protocol.DocumentUpdate{self.shardFilter(update)}, ack)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	multiSubscription, err := self.subscribeUpdates(".document.update.multi", "multi", func(data []byte, ack func()) error {
+		var update protocol.MultiSpaceDocumentUpdate
+		err := json.Unmarshal(data, &update)
+		if err != nil {
+			return err
+		}
+		filtered := make([]protocol.DocumentUpdate, len(update.Updates))
+		for i, spaceUpdate := range update.Updates {
+			filtered[i] = self.shardFilter(spaceUpdate)
 		}
 
-		metrics.UpdateQueue.Set(int64(len(updates)))
+		queueUpdate(filtered, ack)
+		return nil
+	})
+	if err != nil {
+		_ = subscription.Unsubscribe()
+		return nil, err
+	}
 
-		updates <- protocol.DocumentUpdate{
-			Space:     update.Space,
-			Documents: filtered,
+	touchSubscription, err := ec.Subscribe(cfg.Nats.Topic+".document.touch", func(touch *protocol.DocumentTouch) {
+		ids := self.shardIDs(touch.IDs)
+		if len(ids) == 0 {
+			return
+		}
+		self.shadowsLock.RLock()
+		for _, space := range self.withShadowSpace(touch.Space) {
+			_, err := self.db.touchDocuments(mainContext, space, ids, touch.Updated)
+			if err != nil {
+				logger.Error.Printf("failed to touch documents: %v", err)
+			}
+		}
+		self.shadowsLock.RUnlock()
+		for _, id := range ids {
+			self.cache.Invalidate(id)
 		}
 	})
 	if err != nil {
+		_ = subscription.Unsubscribe()
+		_ = multiSubscription.Unsubscribe()
+		return nil, err
+	}
+
+	stepSubscription, err := self.startStepResponder()
+	if err != nil {
+		_ = subscription.Unsubscribe()
+		_ = multiSubscription.Unsubscribe()
+		_ = touchSubscription.Unsubscribe()
 		return nil, err
 	}
 
 	atExit := func() {
 		logger.Info.Printf("Indexer exiting")
-		err = subscription.Drain()
-		if err != nil {
-			logger.Error.Printf("Failed to drain document subscription: %v", err)
-		} else {
-			var drainWaiter sync.WaitGroup
+		_ = stepSubscription.Unsubscribe()
+		var drainWaiter sync.WaitGroup
+		for _, sub := range []*nats.Subscription{subscription, multiSubscription, touchSubscription} {
+			err := sub.Drain()
+			if err != nil {
+				logger.Error.Printf("Failed to drain document subscription: %v", err)
+				continue
+			}
 			drainWaiter.Add(1)
-			go func() {
+			go func(sub *nats.Subscription) {
 				for {
-					messages, _, _ := subscription.Pending()
+					messages, _, _ := sub.Pending()
 					if messages == 0 {
 						break
 					}
 					time.Sleep(time.Millisecond * 20)
 				}
 				drainWaiter.Done()
-			}()
-			drainWaiter.Wait()
+			}(sub)
 		}
+		drainWaiter.Wait()
 		cancel()
 		close(updates)
 		self.waiter.Done()
@@ -137,6 +218,156 @@ func StartIndexer(nc *nats.Conn, db Database, cfg Config, cache *Cache) (Indexer
 	return self, nil
 }
 
+// queuedUpdate is a document update waiting to be stored,
+// acknowledged by calling ack once stored
+type queuedUpdate struct {
+	updates []protocol.DocumentUpdate
+	ack     func()
+}
+
+// batchUpdates stores queued updates together, once minDocs documents
+// are waiting or when the first waiting update has waited for maxLatency,
+// acknowledging the updates once stored. The received callback is called
+// for each dequeued update. Returns when the queue is closed, after
+// storing the last batch.
+func batchUpdates(
+	ctx context.Context, updates <-chan queuedUpdate, minDocs int, maxLatency time.Duration,
+	received func(), store func([]protocol.DocumentUpdate),
+) {
+	var batch []protocol.DocumentUpdate
+	var batchAcks []func()
+	batchDocs := 0
+	var batchDeadline <-chan time.Time
+
+	flush := func() {
+		if len(batch) > 0 {
+			store(batch)
+		}
+		if ctx.Err() == nil {
+			for _, ack := range batchAcks {
+				ack()
+			}
+		}
+		batch = nil
+		batchAcks = nil
+		batchDocs = 0
+		batchDeadline = nil
+	}
+
+	for {
+		select {
+		case update, open := <-updates:
+			if !open {
+				flush()
+				return
+			}
+			received()
+
+			batch = append(batch, update.updates...)
+			batchAcks = append(batchAcks, update.ack)
+			for _, spaceUpdate := range update.updates {
+				batchDocs += len(spaceUpdate.Documents)
+			}
+			if batchDocs >= minDocs {
+				flush()
+			} else if batchDeadline == nil {
+				batchDeadline = time.After(maxLatency)
+			}
+		case <-batchDeadline:
+			flush()
+		}
+	}
+}
+
+// subscribeUpdates subscribes to document updates on a topic subject.
+// With Config.Nats.UseJetStream, updates are received from a durable
+// JetStream consumer named after the index and the given kind, and are
+// acknowledged once stored. Otherwise, updates are core NATS messages,
+// and acknowledging them does nothing.
+//
+// The consumer is created before binding to it, since consumers created
+// by subscribing are deleted when the subscription is drained.
+func (idx *indexer) subscribeUpdates(
+	subject string, kind string, handler func(data []byte, ack func()) error,
+) (*nats.Subscription, error) {
+	subject = idx.cfg.Nats.Topic + subject
+	conn := idx.conn.Conn
+
+	if !idx.cfg.Nats.UseJetStream {
+		return conn.Subscribe(subject, func(msg *nats.Msg) {
+			err := handler(msg.Data, func() {})
+			if err != nil {
+				logger.Error.Printf("Failed to decode document update: %v", err)
+			}
+		})
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+	indexID, err := idx.db.getIndexID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index ID: %w", err)
+	}
+	durable := fmt.Sprintf("letarette-%s-%s", indexID, kind)
+	stream := idx.cfg.Nats.UpdateStream
+
+	_, err = js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:        durable,
+		DeliverSubject: "_letarette.deliver." + durable,
+		DeliverPolicy:  nats.DeliverAllPolicy,
+		AckPolicy:      nats.AckExplicitPolicy,
+		FilterSubject:  subject,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream consumer %q: %w", durable, err)
+	}
+
+	return js.Subscribe(subject, func(msg *nats.Msg) {
+		err := handler(msg.Data, func() {
+			if err := msg.Ack(); err != nil {
+				logger.Error.Printf("Failed to acknowledge document update: %v", err)
+			}
+		})
+		if err != nil {
+			logger.Error.Printf("Failed to decode document update: %v", err)
+			// Redelivery would fail the same way
+			_ = msg.Term()
+		}
+	}, nats.Bind(stream, durable), nats.ManualAck())
+}
+
+// Time the update queue stays near full before logging a warning,
+// and the minimum time between warnings
+const backpressureWarningDelay = time.Second * 10
+const backpressureWarningInterval = time.Minute
+
+// queueWatch tracks how long a queue has been near full
+type queueWatch struct {
+	fullSince   time.Time
+	lastWarning time.Time
+}
+
+func (w *queueWatch) check(depth, capacity int) {
+	if depth*10 < capacity*9 {
+		w.fullSince = time.Time{}
+		return
+	}
+	now := time.Now()
+	if w.fullSince.IsZero() {
+		w.fullSince = now
+		return
+	}
+	if now.Sub(w.fullSince) > backpressureWarningDelay && now.Sub(w.lastWarning) > backpressureWarningInterval {
+		w.lastWarning = now
+		logger.Warning.Printf(
+			"Update queue near full (%d/%d) for %v, document updates arrive faster than they are stored",
+			depth, capacity, now.Sub(w.fullSince).Round(time.Second),
+		)
+	}
+}
+
 type indexer struct {
 	close   context.CancelFunc
 	context context.Context
@@ -148,9 +379,28 @@ type indexer struct {
 
 	lastDocumentRequest map[string]time.Time
 
-	cfg  Config
-	conn *nats.EncodedConn
-	db   *database
+	// Watchdog state, see Config.Index.Watchdog
+	progress     map[string]spaceProgress
+	restartFetch map[string]chan struct{}
+
+	cfg   Config
+	conn  *nats.EncodedConn
+	db    *database
+	cache *Cache
+
+	// Running space reloads by reloaded space, see reload.go
+	reloads map[string]*spaceReload
+	// Shadow spaces by reloaded space, for storing document updates
+	// in both spaces. Held for reading while storing updates.
+	shadows     map[string]string
+	shadowsLock sync.RWMutex
+
+	// Spaces with indexing paused, see protocol.SpaceControl.
+	// Shadow spaces of paused spaces are paused too.
+	paused map[string]bool
+
+	// Requested single update cycles, run by the main loop, see step.go
+	steps chan indexStep
 }
 
 func (idx *indexer) Close() {
@@ -161,30 +411,111 @@ func (idx *indexer) Close() {
 func (idx *indexer) main(atExit func()) {
 	logger.Info.Printf("Indexer starting")
 
+	// Each space is cycled on its own schedule, with reload shadow
+	// spaces following the schedule of their space
+	nextCycle := map[string]time.Time{}
+	busy := map[string]bool{}
+	lastHousekeeping := time.Now()
+	var lastStatsSample time.Time
+	var lastReloadCheck time.Time
+
 	for {
-		cycleThrottle := time.After(idx.cfg.Index.Wait.Cycle)
-		totalInterests := 0
+		now := time.Now()
+		anyBusy := false
+
+		if now.Sub(lastReloadCheck) >= idx.cfg.Index.Wait.EmptyCycle {
+			idx.checkReloads()
+			idx.checkPausedSpaces()
+			lastReloadCheck = now
+		}
 
-		for _, space := range idx.cfg.Index.Spaces {
-			totalInterests += idx.runUpdateCycle(space)
+		spaces := idx.spaces()
+		for _, space := range spaces {
+			provider := idx.providerSpace(space)
+			if idx.paused[provider] {
+				busy[space] = false
+				nextCycle[space] = now.Add(idx.cfg.emptyCycleWait(provider))
+				continue
+			}
+			if !now.Before(nextCycle[space]) {
+				busy[space] = idx.runUpdateCycle(space).listed > 0
+				if busy[space] {
+					nextCycle[space] = now.Add(idx.cfg.cycleWait(provider))
+				} else {
+					nextCycle[space] = now.Add(idx.cfg.emptyCycleWait(provider))
+				}
+			}
+			anyBusy = anyBusy || busy[space]
 		}
 
-		if totalInterests == 0 {
-			logger.Debug.Printf("main loop empty cycle wait")
-			cycleThrottle = time.After(idx.cfg.Index.Wait.EmptyCycle)
+		if !anyBusy && time.Since(lastHousekeeping) >= idx.cfg.Index.Wait.EmptyCycle {
+			logger.Debug.Printf("main loop empty cycle housekeeping")
 			idx.doHousekeeping()
+			lastHousekeeping = time.Now()
+		}
+
+		statsInterval := idx.cfg.Index.StatsHistory.Interval
+		if statsInterval > 0 && time.Since(lastStatsSample) >= statsInterval {
+			idx.sampleStats()
+			lastStatsSample = time.Now()
 		}
+
+		var nextRun time.Time
+		for _, space := range spaces {
+			if nextRun.IsZero() || nextCycle[space].Before(nextRun) {
+				nextRun = nextCycle[space]
+			}
+		}
+		cycleThrottle := time.After(time.Until(nextRun))
+
 		select {
 		case <-idx.context.Done():
 			atExit()
 			return
 		case <-idx.updateReceived:
-			// Trigger cycle if we got an update
+			// Trigger cycle of non-idle spaces if we got an update
+			for space, isBusy := range busy {
+				if isBusy {
+					nextCycle[space] = time.Time{}
+				}
+			}
 		case <-cycleThrottle:
 			// Trigger cycle after timeout
+		case step := <-idx.steps:
+			step.done <- idx.runStep(step.space)
+		}
+	}
+
+}
+
+// checkPausedSpaces reads the spaces with indexing paused, logging changes.
+// Resumed spaces restart their watchdog timeout.
+func (idx *indexer) checkPausedSpaces() {
+	_, pausedSpaces, err := idx.db.getSpaceControls(idx.context)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			logger.Error.Printf("Failed to get paused spaces: %v", err)
 		}
+		return
 	}
 
+	paused := map[string]bool{}
+	for _, space := range pausedSpaces {
+		paused[space] = true
+		if !idx.paused[space] {
+			logger.Info.Printf("Indexing of space %q paused", space)
+		}
+	}
+	for space := range idx.paused {
+		if !paused[space] {
+			logger.Info.Printf("Indexing of space %q resumed", space)
+			if progress, found := idx.progress[space]; found {
+				progress.at = time.Now()
+				idx.progress[space] = progress
+			}
+		}
+	}
+	idx.paused = paused
 }
 
 func (idx *indexer) notifyUpdateReceived() {
@@ -194,20 +525,34 @@ func (idx *indexer) notifyUpdateReceived() {
 	}
 }
 
-func (idx *indexer) runUpdateCycle(space string) int {
+// cycleResult is the outcome of an update cycle of a space
+type cycleResult struct {
+	// Length of the interest list at the start of the cycle
+	listed int
+	// Documents requested from the document manager
+	requested int
+	// Documents committed from a fully served interest list
+	committed int
+	// Set when the cycle failed
+	err error
+}
+
+func (idx *indexer) runUpdateCycle(space string) (result cycleResult) {
 	interests, err := idx.db.getInterestList(idx.context, space)
 	if err != nil {
 		logger.Error.Printf("Failed to fetch current interest list: %v", err)
-		return 0
+		result.err = err
+		return
 	}
 
-	total := len(interests)
+	result.listed = len(interests)
 
 	numPending := 0
 	numRequested := 0
 	numServed := 0
 	pendingDocs := []Interest{}
-	maxRequestedDocuments := int(idx.cfg.Index.MaxOutstanding) * int(idx.cfg.Index.ReqSize)
+	reqSize := int(idx.cfg.reqSize(idx.providerSpace(space)))
+	maxRequestedDocuments := int(idx.cfg.Index.MaxOutstanding) * reqSize
 
 	for _, interest := range interests {
 		switch interest.State {
@@ -224,17 +569,24 @@ func (idx *indexer) runUpdateCycle(space string) int {
 	metrics.PendingDocs.Set(int64(numPending))
 	metrics.ServedDocs.Add(int64(numServed))
 
+	if idx.isStuck(space, numServed, numPending+numRequested) {
+		idx.recoverStuckSpace(space)
+		return
+	}
+
 	docsToRequest := min(numPending, maxRequestedDocuments-numRequested)
-	docsToRequest = min(docsToRequest, int(idx.cfg.Index.ReqSize))
+	docsToRequest = min(docsToRequest, reqSize)
 	if docsToRequest > 0 {
 		logger.Debug.Printf("Requesting %v docs\n", docsToRequest)
 		metrics.DocRequests.Add(int64(docsToRequest))
 		err = idx.requestDocuments(space, pendingDocs[:docsToRequest])
 		if err != nil {
 			logger.Error.Printf("Failed to request documents: %v", err)
+			result.err = err
 		} else {
 			idx.lastDocumentRequest[space] = time.Now()
 			numRequested += docsToRequest
+			result.requested = docsToRequest
 		}
 	}
 
@@ -247,18 +599,23 @@ func (idx *indexer) runUpdateCycle(space string) int {
 			if !errors.Is(err, context.Canceled) {
 				logger.Error.Printf("Failed to commit docs: %v", err)
 			}
-			return total
+			result.err = err
+			return
 		}
+		result.committed = numServed
 
 		err = idx.db.clearInterestList(idx.context, space)
 		if err != nil {
 			logger.Error.Printf("Failed to clean interest list: %v", err)
 		}
 
+		idx.evictDocuments(space)
+
 		err = idx.processIndexUpdateQueue(space)
 		if err != nil {
 			logger.Error.Printf("Failed to request next chunk: %v", err)
-			return total
+			result.err = err
+			return
 		}
 
 	} else {
@@ -272,7 +629,7 @@ func (idx *indexer) runUpdateCycle(space string) int {
 			state, err := idx.db.getInterestListState(idx.context, space)
 			if err != nil {
 				logger.Error.Printf("Failed to get interest list state: %v", err)
-				return total
+				return
 			}
 
 			if now.After(state.createdAtTime().Add(timeout)) {
@@ -291,77 +648,199 @@ func (idx *indexer) runUpdateCycle(space string) int {
 		}
 	}
 
-	return total
+	return
+}
+
+// spaceProgress tracks when a space last made indexing progress
+type spaceProgress struct {
+	served int
+	at     time.Time
+	stuck  bool
+}
+
+// isStuck checks if a space with outstanding documents has gone
+// without getting any documents served for longer than the watchdog timeout.
+func (idx *indexer) isStuck(space string, served, outstanding int) bool {
+	now := time.Now()
+	progress := idx.progress[space]
+
+	if outstanding == 0 || served != progress.served || progress.at.IsZero() {
+		idx.progress[space] = spaceProgress{served: served, at: now}
+		if progress.stuck {
+			logger.Info.Printf("Watchdog: Space %q is making progress again", space)
+			metrics.StuckSpaces.Add(-1)
+		}
+		return false
+	}
+
+	timeout := idx.cfg.Index.Watchdog.Timeout
+	return timeout > 0 && now.Sub(progress.at) >= timeout
+}
+
+// recoverStuckSpace resets requested documents of a stuck space, and
+// optionally restarts fetching of its interest list.
+func (idx *indexer) recoverStuckSpace(space string) {
+	progress := idx.progress[space]
+	logger.Error.Printf(
+		"Watchdog: Space %q made no progress in %v, resetting requested documents",
+		space, time.Since(progress.at).Round(time.Second),
+	)
+	if !progress.stuck {
+		metrics.StuckSpaces.Add(1)
+	}
+	// Give the space a new timeout period before acting again
+	idx.progress[space] = spaceProgress{served: progress.served, at: time.Now(), stuck: true}
+
+	err := idx.db.resetRequested(idx.context, space)
+	if err != nil {
+		logger.Error.Printf("Failed to reset interest list state: %v", err)
+	}
+
+	if !idx.cfg.Index.Watchdog.Refetch {
+		return
+	}
+
+	logger.Warning.Printf("Watchdog: Refetching interest list for space %q", space)
+	select {
+	case idx.restartFetch[space] <- struct{}{}:
+	default:
+	}
+	err = idx.db.clearInterestList(idx.context, space)
+	if err != nil {
+		logger.Error.Printf("Failed to clean interest list: %v", err)
+	}
 }
 
 func (idx *indexer) commitFetched(space string) error {
 	return idx.db.commitInterestList(idx.context, space)
 }
 
-func (idx *indexer) startIndexFetcher() error {
+// evictDocuments trims spaces exceeding their max document count.
+// Reload shadow spaces are trimmed like their reloaded spaces.
+func (idx *indexer) evictDocuments(space string) {
+	maxDocs, found := idx.cfg.Index.MaxDocs[idx.providerSpace(space)]
+	if !found {
+		return
+	}
+	evicted, err := idx.db.evictDocuments(idx.context, space, maxDocs, func(docs []protocol.DocumentID) {
+		for _, doc := range docs {
+			idx.cache.Invalidate(doc)
+		}
+	})
+	metrics.EvictedDocs.Add(int64(evicted))
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Error.Printf("Failed to evict documents: %v", err)
+	}
+	if evicted > 0 {
+		logger.Debug.Printf("Evicted %v documents from space %q", evicted, space)
+	}
+}
 
+func (idx *indexer) startIndexFetcher() error {
 	for _, space := range idx.cfg.Index.Spaces {
-		state, err := idx.db.getInterestListState(idx.context, space)
+		err := idx.startSpaceFetcher(idx.context, space, space)
 		if err != nil {
-			return fmt.Errorf("failed to get interest list state: %w", err)
+			return err
 		}
-		go func(space string, state InterestListState) {
-			fromTime := state.lastUpdatedTime()
-			afterDocument := state.LastUpdatedDocID
+	}
+	return nil
+}
 
-			idx.waiter.Add(1)
+// startSpaceFetcher starts fetching index updates for a space from the
+// document manager of the provider space, until the context is done.
+// The provider space differs from the space for reload shadow spaces.
+func (idx *indexer) startSpaceFetcher(ctx context.Context, space string, provider string) error {
+	state, err := idx.db.getInterestListState(ctx, space)
+	if err != nil {
+		return fmt.Errorf("failed to get interest list state: %w", err)
+	}
+	indexUpdates := idx.indexUpdates[space]
+	restartFetch := idx.restartFetch[space]
 
-		fetchLoop:
-			for {
-				cycleThrottle := idx.cfg.Index.Wait.Cycle
+	idx.waiter.Add(1)
+	go func() {
+		position := newFetchPosition(state.lastUpdatedTime(), state.LastUpdatedDocID)
 
-				logger.Debug.Printf("Requesting index update (%v, %v, %v)", space, fromTime, afterDocument)
-				update, err := idx.requestIndexUpdate(space, fromTime, afterDocument)
-				if err != nil {
-					if errors.Is(err, context.Canceled) {
-						break fetchLoop
-					}
+		// Restart fetching from the last committed position
+		restart := func() {
+			state, err := idx.db.getInterestListState(ctx, space)
+			if err != nil {
+				logger.Error.Printf("Failed to get interest list state: %v", err)
+				return
+			}
+			position = newFetchPosition(state.lastUpdatedTime(), state.LastUpdatedDocID)
+		}
 
-					if errors.Is(err, nats.ErrNoResponders) {
-						logger.Info.Printf("No Document Manager available for space %q", space)
-						cycleThrottle = idx.cfg.Index.Wait.EmptyCycle * 4
-					} else {
-						logger.Info.Printf("index update request failed: %v", err)
-						cycleThrottle = idx.cfg.Index.Wait.EmptyCycle
-					}
+	fetchLoop:
+		for {
+			cycleThrottle := idx.cfg.Index.Wait.Cycle
+
+			select {
+			case <-restartFetch:
+				restart()
+			default:
+			}
 
+			logger.Debug.Printf("Requesting index update (%v, %v, %v)", space, position.Updated, position.ID)
+			update, err := idx.requestIndexUpdate(ctx, provider, position.Updated, position.ID)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					break fetchLoop
+				}
+
+				if errors.Is(err, nats.ErrNoResponders) {
+					logger.Info.Printf("No Document Manager available for space %q", provider)
+					cycleThrottle = idx.cfg.Index.Wait.EmptyCycle * 4
 				} else {
-					numUpdates := len(update.Updates)
-					if numUpdates > 0 {
-						last := update.Updates[numUpdates-1]
-						fromTime = last.Updated
-						afterDocument = last.ID
+					logger.Info.Printf("index update request failed: %v", err)
+					cycleThrottle = idx.cfg.Index.Wait.EmptyCycle
+				}
+
+			} else {
+				update.Space = space
+				// The position follows all received references, also those
+				// left out of the interest list of this shard
+				previous := position.DocumentReference
+				position.advance(update.Updates, time.Now().Add(maxFutureUpdate))
+				caughtUp := position.ID == previous.ID && position.Updated.Equal(previous.Updated)
+				update.Updates = idx.keepIndexUpdates(update.Updates)
+				numUpdates := len(update.Updates)
+
+				// Batches without documents for this shard are skipped,
+				// until caught up
+				if numUpdates > 0 || caughtUp {
+					if caughtUp && idx.cfg.Index.ClockSkew > 0 {
+						position.rewind(idx.cfg.Index.ClockSkew)
 					}
 					select {
-					case idx.indexUpdates[space] <- update:
+					case indexUpdates <- update:
 						// Update written to channel
-					case <-idx.context.Done():
-						close(idx.indexUpdates[space])
+					case <-restartFetch:
+						// Drop the update, it is past the restart position
+						restart()
+						continue fetchLoop
+					case <-ctx.Done():
+						close(indexUpdates)
 						break fetchLoop
 					}
-
-					if numUpdates == 0 {
-						logger.Debug.Printf("Indexer loop empty cycle wait")
-						cycleThrottle = idx.cfg.Index.Wait.EmptyCycle
-					}
 				}
 
-				select {
-				case <-time.After(cycleThrottle):
-				case <-idx.context.Done():
-					close(idx.indexUpdates[space])
-					break fetchLoop
+				if caughtUp {
+					logger.Debug.Printf("Indexer loop empty cycle wait")
+					cycleThrottle = idx.cfg.Index.Wait.EmptyCycle
 				}
 			}
 
-			idx.waiter.Done()
-		}(space, state)
-	}
+			select {
+			case <-time.After(cycleThrottle):
+			case <-ctx.Done():
+				close(indexUpdates)
+				break fetchLoop
+			}
+		}
+
+		idx.waiter.Done()
+	}()
 
 	return nil
 }
@@ -372,7 +851,7 @@ func (idx *indexer) processIndexUpdateQueue(space string) error {
 	case <-idx.context.Done():
 		return nil
 
-	case update := <-channel:
+	case update, open := <-channel:
 		if len(update.Updates) > 0 {
 			logger.Debug.Printf("Received interest list of %v docs\n", len(update.Updates))
 			idx.notifyUpdateReceived()
@@ -381,6 +860,9 @@ func (idx *indexer) processIndexUpdateQueue(space string) error {
 			if err != nil {
 				return fmt.Errorf("failed to set interest list: %w", err)
 			}
+		} else if reloaded, isShadow := idx.reloadedSpace(space); isShadow && open {
+			// The shadow space has caught up, with all documents committed
+			return idx.finishReload(reloaded)
 		}
 
 	case <-time.After(idx.cfg.Index.Wait.Interest):
@@ -390,8 +872,10 @@ func (idx *indexer) processIndexUpdateQueue(space string) error {
 	return nil
 }
 
+// requestIndexUpdate requests index updates from the document manager of
+// a space. The request is cancelled when the context is done.
 func (idx *indexer) requestIndexUpdate(
-	space string, fromTime time.Time, afterDocument protocol.DocumentID,
+	ctx context.Context, space string, fromTime time.Time, afterDocument protocol.DocumentID,
 ) (protocol.IndexUpdate, error) {
 
 	topic := idx.cfg.Nats.Topic + ".index.request"
@@ -401,7 +885,7 @@ func (idx *indexer) requestIndexUpdate(
 		AfterDocument: afterDocument,
 		Limit:         idx.cfg.Index.ListSize,
 	}
-	timeout, cancel := context.WithTimeout(idx.context, idx.cfg.Index.Wait.Interest)
+	timeout, cancel := context.WithTimeout(ctx, idx.cfg.Index.Wait.Interest)
 
 	var update protocol.IndexUpdate
 	err := idx.conn.RequestWithContext(timeout, topic, updateRequest, &update)
@@ -411,25 +895,127 @@ func (idx *indexer) requestIndexUpdate(
 		return protocol.IndexUpdate{}, fmt.Errorf("NATS request failed: %w", err)
 	}
 
+	return update, nil
+}
+
+// inShard checks if a normalized document ID belongs to this shard.
+// Shards are selected by normalized ID, so that all IDs normalized to
+// the same ID are indexed by the same shard.
+func (idx *indexer) inShard(id protocol.DocumentID) bool {
+	index := ShardIndexFromDocumentID(id, int(idx.cfg.ShardgroupSize))
+	return index == int(idx.cfg.ShardIndex)
+}
+
+// shardFilter normalizes the document IDs of an update,
+// keeping the documents of this shard.
+func (idx *indexer) shardFilter(update protocol.DocumentUpdate) protocol.DocumentUpdate {
+	filtered := make([]protocol.Document, 0, len(update.Documents))
+	for _, doc := range update.Documents {
+		doc.ID = idx.db.idNormalizer.normalize(doc.ID)
+		if idx.inShard(doc.ID) {
+			filtered = append(filtered, doc)
+		}
+	}
+	return protocol.DocumentUpdate{
+		Space:     update.Space,
+		Documents: filtered,
+	}
+}
+
+// shardIDs normalizes document IDs, keeping the IDs of this shard.
+func (idx *indexer) shardIDs(ids []protocol.DocumentID) []protocol.DocumentID {
+	filtered := make([]protocol.DocumentID, 0, len(ids))
+	for _, id := range ids {
+		id = idx.db.idNormalizer.normalize(id)
+		if idx.inShard(id) {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered
+}
+
+// storeUpdate stores a batch of shard filtered document updates,
+// also in shadow spaces, and invalidates cached results listing
+// the updated documents.
+func (idx *indexer) storeUpdate(update []protocol.DocumentUpdate) {
+	idx.shadowsLock.RLock()
+	update = idx.withShadowUpdates(update)
+	err := idx.db.addMultiSpaceDocumentUpdates(idx.context, update)
+	if err != nil && idx.context.Err() == nil {
+		logger.Error.Printf("failed to add document update: %v", err)
+		failed := idx.db.addFailedUpdate(idx.context, update, err)
+		if failed > 0 {
+			logger.Warning.Printf("%d documents stored as dead letters", failed)
+		}
+	}
+	idx.shadowsLock.RUnlock()
+	for _, spaceUpdate := range update {
+		for _, doc := range spaceUpdate.Documents {
+			idx.cache.Invalidate(doc.ID)
+		}
+	}
+}
+
+// Documents updated further than this into the future are ignored
+const maxFutureUpdate = time.Minute * 5
+
+// keepIndexUpdates filters out references to documents of other shards,
+// and to documents from the future.
+func (idx *indexer) keepIndexUpdates(updates []protocol.DocumentReference) []protocol.DocumentReference {
 	// Ignore documents from the future. We will get there eventually.
-	nowish := time.Now().Add(time.Minute * 5)
-	filtered := make([]protocol.DocumentReference, 0, len(update.Updates))
-	for _, u := range update.Updates {
+	nowish := time.Now().Add(maxFutureUpdate)
+	filtered := make([]protocol.DocumentReference, 0, len(updates))
+	for _, u := range updates {
 		if u.Updated.After(nowish) {
 			logger.Info.Printf("Ignoring future document: %v (%v)", u.ID, u.Updated)
 			continue
 		}
-		index := ShardIndexFromDocumentID(u.ID, int(idx.cfg.ShardgroupSize))
-		if index == int(idx.cfg.ShardIndex) {
+		if idx.inShard(idx.db.idNormalizer.normalize(u.ID)) {
 			filtered = append(filtered, u)
 		}
 	}
 
-	logger.Debug.Printf("Keeping %v out of %v updates for shard %v", len(filtered), len(update.Updates), idx.cfg.Shard)
+	logger.Debug.Printf("Keeping %v out of %v updates for shard %v", len(filtered), len(updates), idx.cfg.Shard)
+	return filtered
+}
+
+// fetchPosition is where an index update fetcher continues fetching.
+// Document managers return references updated at or after the position
+// time, and after the position document among those updated at the
+// position time, in the order of the document manager. The document
+// always breaks ties, since any number of documents can share a time.
+type fetchPosition struct {
+	protocol.DocumentReference
+	// The furthest reference received, rewound from on clock skew
+	high protocol.DocumentReference
+}
 
-	update.Updates = filtered
+func newFetchPosition(updated time.Time, id protocol.DocumentID) fetchPosition {
+	reference := protocol.DocumentReference{ID: id, Updated: updated}
+	return fetchPosition{reference, reference}
+}
 
-	return update, nil
+// advance moves the position to the last of a list of references,
+// in document manager order. The position stops before references
+// updated after the horizon, to fetch them again when due.
+func (p *fetchPosition) advance(references []protocol.DocumentReference, horizon time.Time) {
+	for _, reference := range references {
+		if reference.Updated.After(horizon) {
+			break
+		}
+		p.DocumentReference = reference
+		if !reference.Updated.Before(p.high.Updated) {
+			p.high = reference
+		}
+	}
+}
+
+// rewind moves the position back by the clock skew from the furthest
+// reference received, to fetch documents updated by document manager
+// clocks going backwards. The rewound position has no tie-breaking
+// document, including all documents updated at the rewound time.
+func (p *fetchPosition) rewind(skew time.Duration) {
+	p.DocumentReference = protocol.DocumentReference{Updated: p.high.Updated.Add(-skew)}
 }
 
 func (idx *indexer) requestDocuments(space string, wanted []Interest) error {
@@ -465,7 +1051,7 @@ func (idx *indexer) requestDocuments(space string, wanted []Interest) error {
 	topic := idx.cfg.Nats.Topic + ".document.request"
 
 	request := protocol.DocumentRequest{
-		Space:  space,
+		Space:  idx.providerSpace(space),
 		Wanted: wantedIDs,
 	}
 
@@ -510,6 +1096,16 @@ func (idx *indexer) updateSpelling() {
 	logger.Info.Printf("Housekeeping: Done updating spelling index in %v seconds", duration.Seconds())
 }
 
+func (idx *indexer) sampleStats() {
+	sample, err := idx.db.sampleStats(idx.context)
+	if err == nil {
+		err = idx.db.addStatsSample(idx.context, sample, idx.cfg.Index.StatsHistory.Retention)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Error.Printf("Failed to sample index stats: %v", err)
+	}
+}
+
 func (idx *indexer) updateStopwords() {
 	logger.Debug.Printf("Updating stopwords...")
 	stopwordPercentageCutoff := idx.cfg.Stemmer.StopwordCutoff
@@ -20,9 +20,11 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"time"
 	"unsafe"
 
 	"github.com/erkkah/letarette/internal/snowball"
+	"github.com/erkkah/letarette/pkg/protocol"
 	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
@@ -152,6 +154,141 @@ func GetIndexStats(dbo Database) (Stats, error) {
 	return s, nil
 }
 
+// TermCount is the number of documents containing a term.
+type TermCount struct {
+	Term  string
+	Count int
+}
+
+// TopTerms returns the n terms present in the most documents in a space.
+//
+// Unlike the global CommonTerms of GetIndexStats, which are read directly
+// from the per-term totals of the fts5vocab "row" table, this requires a
+// full scan of the "instance" vocabulary table, visiting every term
+// occurrence in the index. The cost grows with the size of the whole index,
+// not only with the size of the space, so expect this to take a while on
+// large indexes.
+func TopTerms(ctx context.Context, dbo Database, space string, n int) ([]TermCount, error) {
+	db := dbo.(*database)
+	rawdb := db.getRawDB()
+
+	conn, err := rawdb.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var spaceID int
+	var contentless bool
+	row := conn.QueryRowContext(
+		ctx,
+		`select spaceID, contentless from spaces where space = ?`,
+		space,
+	)
+	err = row.Scan(&spaceID, &contentless)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("unknown space %q", space)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	vocabTable := "temp.instancestats"
+	ftsTable := "fts"
+	if contentless {
+		vocabTable = "temp.instancestatsc"
+		ftsTable = "ftsc"
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			`create virtual table if not exists %s using fts5vocab(main, '%s', 'instance');`,
+			vocabTable, ftsTable,
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stale entries in contentless indexes are filtered out
+	// by only counting documents present in the docs table.
+	rows, err := conn.QueryContext(
+		ctx,
+		fmt.Sprintf(`
+		select term, count(distinct doc) as cnt
+		from %s
+		where doc in (select id from docs where spaceID = ?)
+		group by term
+		order by cnt desc, term
+		limit ?
+		`, vocabTable),
+		spaceID, n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var terms []TermCount
+	for rows.Next() {
+		var tc TermCount
+		err = rows.Scan(&tc.Term, &tc.Count)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, tc)
+	}
+	return terms, rows.Err()
+}
+
+// TokenizeText returns the terms produced by the index tokenizer and
+// stemmer for a text, in order of appearance.
+// The text is tokenized using a temporary table, the index is not changed.
+func TokenizeText(ctx context.Context, dbo Database, text string) ([]string, error) {
+	db := dbo.(*database)
+	rawdb := db.getRawDB()
+
+	conn, err := rawdb.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	statements := []string{
+		`create virtual table if not exists temp.tokenized using fts5(txt, tokenize='snowball')`,
+		`create virtual table if not exists temp.tokenizedterms using fts5vocab(temp, 'tokenized', 'instance')`,
+		`delete from temp.tokenized`,
+	}
+	for _, statement := range statements {
+		_, err = conn.ExecContext(ctx, statement)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = conn.ExecContext(ctx, `insert into temp.tokenized(txt) values(?)`, text)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, `select term from temp.tokenizedterms order by offset`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var terms []string
+	for rows.Next() {
+		var term string
+		err = rows.Scan(&term)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	return terms, rows.Err()
+}
+
 // CheckIndex runs an integrity check on the index
 func CheckIndex(dbo Database) error {
 	db := dbo.(*database)
@@ -163,15 +300,37 @@ func CheckIndex(dbo Database) error {
 	return nil
 }
 
-// RebuildIndex rebuilds the fts index from the docs table
-func RebuildIndex(dbo Database) error {
+// RebuildIndex rebuilds the fts index from the docs table.
+// Changing the stemmer settings requires a full rebuild, since the index
+// entries of a document can only be removed using the settings it was
+// indexed with.
+//
+// The index is cleared and documents are indexed again in batches,
+// each committed with the rebuild progress. Until the rebuild is done,
+// searches only find documents up to the rebuild position.
+//
+// Cancelling the context, or calling CancelRebuild from another process,
+// stops the rebuild after the current batch. The rebuild then returns
+// the context error or ErrRebuildCancelled, and the index stays marked
+// as rebuilding. Calling RebuildIndex again resumes from the last batch.
+// Documents updated while rebuilding are indexed by the rebuild.
+func RebuildIndex(ctx context.Context, dbo Database) error {
 	db := dbo.(*database)
-	sql := db.getRawDB()
-	_, err := sql.Exec(`insert into fts(fts) values("rebuild");`)
-	if err != nil {
-		return err
-	}
-	return nil
+	return db.rebuild(ctx)
+}
+
+// CancelRebuild requests a rebuild in progress to stop after
+// its current batch. Returns false if no rebuild is in progress.
+func CancelRebuild(ctx context.Context, dbo Database) (bool, error) {
+	db := dbo.(*database)
+	return db.cancelRebuild(ctx)
+}
+
+// GetRebuildState returns the progress of an unfinished rebuild,
+// or nil if no rebuild is in progress.
+func GetRebuildState(ctx context.Context, dbo Database) (*RebuildState, error) {
+	db := dbo.(*database)
+	return db.getRebuildState(ctx)
 }
 
 // VacuumIndex runs vacuum on the database to reclaim space
@@ -270,6 +429,97 @@ func ForceIndexStemmerState(state snowball.Settings, dbo Database) error {
 	return db.setStemmerState(state)
 }
 
+// TouchDocuments sets the update time of existing documents in a space,
+// without re-indexing them. Returns the number of touched documents.
+// See protocol.DocumentTouch.
+func TouchDocuments(dbo Database, space string, ids []protocol.DocumentID, updated time.Time) (int, error) {
+	db := dbo.(*database)
+	return db.touchDocuments(context.Background(), space, ids, updated)
+}
+
+// DeleteDocuments removes live documents in a space from the index,
+// replacing them by dead documents, like documents delivered with
+// Alive false. Returns the number of deleted documents.
+func DeleteDocuments(dbo Database, space string, ids []protocol.DocumentID) (int, error) {
+	db := dbo.(*database)
+	return db.deleteDocuments(context.Background(), space, ids)
+}
+
+// GetDeadLetters lists documents that failed to be indexed, in a space
+// or in all spaces when space is empty.
+func GetDeadLetters(ctx context.Context, dbo Database, space string) ([]DeadLetter, error) {
+	db := dbo.(*database)
+	return db.getDeadLetters(ctx, space)
+}
+
+// RetryDeadLetters tries to index dead letters again, in a space or
+// in all spaces when space is empty. Returns the number of documents
+// indexed and the number failing again.
+func RetryDeadLetters(ctx context.Context, dbo Database, space string) (int, int, error) {
+	db := dbo.(*database)
+	return db.retryDeadLetters(ctx, space)
+}
+
+// GetStatsHistory lists the index statistics samples taken after
+// a point in time, oldest first.
+func GetStatsHistory(ctx context.Context, dbo Database, after time.Time) ([]StatsSample, error) {
+	db := dbo.(*database)
+	return db.getStatsHistory(ctx, after)
+}
+
+// RequestReload requests a reload of a space, which is started by a running
+// indexer. The space is reloaded from a fresh interest list pass into a
+// shadow space, which replaces the space when complete. The space stays
+// searchable during the reload.
+//
+// Until the shadow space has replaced the space and the replaced documents
+// are purged, the index holds a second copy of the documents of the space.
+// Returns false if a reload of the space is already requested.
+func RequestReload(ctx context.Context, dbo Database, space string) (bool, error) {
+	db := dbo.(*database)
+	return db.requestReload(ctx, space)
+}
+
+// GetReloads lists requested and running space reloads.
+func GetReloads(ctx context.Context, dbo Database) ([]Reload, error) {
+	db := dbo.(*database)
+	return db.getReloads(ctx)
+}
+
+// SetSpaceControl disables or enables search in a space, and pauses or
+// resumes indexing of the space, see protocol.SpaceControl.
+// Running workers pick up the change without restarting.
+func SetSpaceControl(ctx context.Context, dbo Database, control protocol.SpaceControl) error {
+	db := dbo.(*database)
+	return db.setSpaceControl(ctx, control)
+}
+
+// GetSpaceControls lists the spaces with search disabled, including
+// spaces disabled by config, and the spaces with indexing paused.
+func GetSpaceControls(ctx context.Context, dbo Database) (searchDisabled, indexPaused []string, err error) {
+	db := dbo.(*database)
+	return db.getSpaceControls(ctx)
+}
+
+// GetInterestList reads the interest list of a space, in list order,
+// together with the interest list state of the space.
+func GetInterestList(ctx context.Context, dbo Database, space string) (InterestListState, []Interest, error) {
+	db := dbo.(*database)
+	list, err := db.getInterestList(ctx, space)
+	if err != nil {
+		return InterestListState{}, nil, err
+	}
+	state, err := db.getInterestListState(ctx, space)
+	return state, list, err
+}
+
+// GetIndexSchema reads the full text index table definitions
+// and the recorded stemmer state.
+func GetIndexSchema(ctx context.Context, dbo Database) (IndexSchema, error) {
+	db := dbo.(*database)
+	return db.getIndexSchema(ctx)
+}
+
 // SetIndexPageSize sets the max page size for future index allocations.
 func SetIndexPageSize(dbo Database, pageSize int) error {
 	db := dbo.(*database)
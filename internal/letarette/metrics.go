@@ -25,6 +25,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/erkkah/letarette/internal/snowball"
 	"github.com/erkkah/letarette/pkg/protocol"
 	"github.com/nats-io/nats.go"
 )
@@ -33,9 +34,39 @@ import (
 var metrics = struct {
 	DocRequests expvar.Int
 	UpdateQueue expvar.Int
-	PendingDocs expvar.Int
-	ServedDocs  expvar.Int
-	QueryQueue  expvar.Int
+	// Total time spent blocked on a full update queue, in seconds
+	UpdateQueueBlocked expvar.Float
+	PendingDocs        expvar.Int
+	ServedDocs         expvar.Int
+	QueryQueue         expvar.Int
+	SlowQueries        expvar.Int
+	StuckSpaces        expvar.Int
+	// Stored field values failing to parse as numbers or dates
+	FieldParseErrors expvar.Int
+	// Document updates ignored for having a lower version
+	// than the stored document
+	StaleUpdates expvar.Int
+	// Documents evicted from spaces exceeding their max document count
+	EvictedDocs expvar.Int
+	// Documents failing to be indexed, stored as dead letters
+	DeadLetters expvar.Int
+	// Queries rejected because of a full search queue
+	BusyQueries expvar.Int
+	// Queries taken from the search queue, and their
+	// total time spent waiting in the queue, in seconds
+	QueuedQueries expvar.Int
+	QueueWaitTime expvar.Float
+	// Tokens longer than the max token length found while indexing,
+	// see snowball.OversizedTokens
+	OversizedTokens expvar.Func
+	// Search response compression threshold in bytes, and the number
+	// of compressed responses with their total plain and compressed
+	// sizes. The ratio is compressed size over plain size.
+	CompressThreshold      expvar.Int
+	CompressedResponses    expvar.Int
+	CompressionPlainBytes  expvar.Int
+	CompressionPackedBytes expvar.Int
+	CompressionRatio       expvar.Func
 }{}
 
 type jsonExpvar struct {
@@ -49,7 +80,18 @@ func (v jsonExpvar) MarshalJSON() ([]byte, error) {
 }
 
 func init() {
-	mType := reflect.TypeOf(metrics)
+	metrics.OversizedTokens = func() interface{} {
+		return snowball.OversizedTokens()
+	}
+	metrics.CompressionRatio = func() interface{} {
+		plain := metrics.CompressionPlainBytes.Value()
+		if plain == 0 {
+			return 0.0
+		}
+		return float64(metrics.CompressionPackedBytes.Value()) / float64(plain)
+	}
+
+	mType := reflect.TypeOf(&metrics).Elem()
 	mValue := reflect.ValueOf(&metrics).Elem()
 
 	for i := 0; i < mType.NumField(); i++ {
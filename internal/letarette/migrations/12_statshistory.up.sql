@@ -0,0 +1,25 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Index statistics sampled by the indexer, for trending.
+-- Samples are kept for the configured retention period.
+create table if not exists statshistory (
+    sampled integer primary key,
+    docs integer not null,
+    uniqueTerms integer not null,
+    totalTerms integer not null,
+    bytes integer not null,
+    -- JSON object of alive document counts by space
+    spaceDocs text not null
+);
@@ -0,0 +1,53 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Progress of a resumable full text index rebuild, see RebuildIndex.
+-- The index is cleared when a rebuild starts, and documents are added
+-- back in batches up to the rebuild position. Documents after the
+-- position are left to the rebuild by the triggers below.
+-- A rebuild is cancelled by setting the cancel flag.
+create table if not exists rebuild (
+    id integer primary key check (id = 1),
+    started integer not null,
+    position integer not null,
+    cancel boolean not null default false
+);
+
+drop trigger docs_ai;
+
+create trigger docs_ai after insert on docs
+when not (select contentless from spaces where spaceID = new.spaceID)
+and not exists (select 1 from rebuild where new.id > position)
+begin
+    insert into fts(rowid, title, txt) values (new.id, new.title, uncompress(new.txt));
+end;
+
+drop trigger docs_ad;
+
+create trigger docs_ad after delete on docs
+when not (select contentless from spaces where spaceID = old.spaceID)
+and not exists (select 1 from rebuild where old.id > position)
+begin
+    insert into fts(fts, rowid, title, txt) values ('delete', old.id, old.title, uncompress(old.txt));
+end;
+
+drop trigger docs_au;
+
+create trigger docs_au after update of title, txt on docs
+when not (select contentless from spaces where spaceID = old.spaceID)
+and not exists (select 1 from rebuild where old.id > position)
+begin
+    insert into fts(fts, rowid, title, txt) values ('delete', old.id, old.title, uncompress(old.txt));
+    insert into fts(rowid, title, txt) values (new.id, new.title, uncompress(new.txt));
+end;
@@ -0,0 +1,25 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- The provider that supplied each document, empty when not set.
+alter table docs add column source text not null default '';
+
+-- Stored field values including the document source, as used by
+-- demotions and facets. The source is listed as the "@source" field.
+create view if not exists docvalues (
+    spaceID, docID, field, value
+) as
+select spaceID, docID, field, value from docfields
+union all
+select spaceID, docID, '@source', source from docs where source != '';
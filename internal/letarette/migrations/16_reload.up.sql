@@ -0,0 +1,27 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Requested and running space reloads, see RequestReload.
+-- A reload fills a shadow space from a fresh interest list pass,
+-- and swaps it in when complete. The shadow is created when the
+-- indexer starts the reload.
+create table if not exists reloads (
+    space text primary key,
+    shadowID integer,
+    requested integer not null,
+    foreign key (shadowID) references spaces(spaceID)
+);
+
+-- Spaces replaced by a reload, purged in the background
+alter table spaces add column retired boolean not null default false;
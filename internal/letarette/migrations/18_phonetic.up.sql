@@ -0,0 +1,25 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Spaces indexing phonetic codes of document words
+alter table spaces add column phonetic boolean not null default false;
+
+-- Phonetic codes of the words of documents in phonetic spaces,
+-- one code per word, with the rowid of the document.
+create virtual table if not exists ftsp using fts5(codes);
+
+create trigger docs_ad_phonetic after delete on docs
+begin
+    delete from ftsp where rowid = old.id;
+end;
@@ -0,0 +1,19 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Spaces controlled at runtime, see protocol.SpaceControl.
+-- Search disabled spaces are skipped by searches, paused spaces
+-- are not fetched by the indexer.
+alter table spaces add column searchDisabled boolean not null default false;
+alter table spaces add column indexPaused boolean not null default false;
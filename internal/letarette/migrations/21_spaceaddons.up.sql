@@ -0,0 +1,29 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Schema add-ons applied to each space, at the version applied,
+-- see spaceaddons.go
+create table if not exists spaceaddons (
+    spaceID integer not null,
+    addon text not null,
+    version integer not null,
+    appliedNanos integer not null,
+    primary key (spaceID, addon),
+    foreign key (spaceID) references spaces(spaceID) on delete cascade
+);
+
+-- Phonetic spaces have the first version of the phonetic add-on
+insert into spaceaddons (spaceID, addon, version, appliedNanos)
+select spaceID, 'phonetic', 1, cast(strftime('%s', 'now') as integer) * 1000000000
+from spaces where phonetic;
@@ -0,0 +1,22 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+drop trigger if exists stemmerstate_au;
+create trigger if not exists stemmerstate_au after update
+of languages, removeDiacritics, tokenCharacters, separators, maxTokenLength, truncateLongTokens
+on stemmerstate begin
+    update stemmerstate set updated = current_timestamp;
+end;
+
+alter table stemmerstate drop column invisibleCharacters;
@@ -0,0 +1,28 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Spaces indexing the exact case of document words
+alter table spaces add column exactCase boolean not null default false;
+
+-- Case encoded words of documents in exact case spaces, with the rowid
+-- of the document. Upper case letters are lowered and marked with "^",
+-- which the tokenizer keeps as part of the word.
+create virtual table if not exists ftse using fts5(
+    words, tokenize = "unicode61 remove_diacritics 0 tokenchars '^'"
+);
+
+create trigger docs_ad_exactcase after delete on docs
+begin
+    delete from ftse where rowid = old.id;
+end;
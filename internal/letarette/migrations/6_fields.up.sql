@@ -0,0 +1,26 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Stored document fields, used for filtering and ranking
+create table if not exists docfields (
+    spaceID integer not null,
+    docID text not null,
+    field text not null,
+    value text not null,
+    primary key (spaceID, docID, field),
+    foreign key (spaceID) references spaces(spaceID)
+);
+
+create index if not exists docfields_fieldindex
+on docfields(field, value);
@@ -0,0 +1,36 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+drop trigger docs_ai;
+
+create trigger docs_ai after insert on docs begin
+    insert into fts(rowid, title, txt) values (new.id, new.title, uncompress(new.txt));
+end;
+
+drop trigger docs_ad;
+
+create trigger docs_ad after delete on docs begin
+    insert into fts(fts, rowid, title, txt) values ('delete', old.id, old.title, uncompress(old.txt));
+end;
+
+drop trigger docs_au;
+
+create trigger docs_au after update on docs begin
+    insert into fts(fts, rowid, title, txt) values ('delete', old.id, old.title, uncompress(old.txt));
+    insert into fts(rowid, title, txt) values (new.id, new.title, uncompress(new.txt));
+end;
+
+drop table ftsc;
+
+alter table spaces drop column contentless;
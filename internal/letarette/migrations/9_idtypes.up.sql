@@ -0,0 +1,90 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Spaces can use integer document IDs
+alter table spaces add column integerIDs boolean not null default false;
+
+-- Document IDs are stored without type affinity, keeping integer IDs
+-- as integers. Existing IDs are all text, and stay that way.
+-- Tables are rebuilt, since column types can not be altered.
+-- Rebuilding copies all documents, which takes a while on large
+-- indexes and temporarily needs space for a second copy of the docs table.
+-- The full text index is keyed on the preserved docs.id, and is not rebuilt.
+drop view cdocs;
+
+create table docs_typed(
+    id integer primary key,
+    spaceID integer not null,
+    docID not null,
+    updatedNanos integer not null,
+    title text not null,
+    txt text not null,
+    alive boolean not null default true,
+    unique(spaceID, docID)
+    foreign key (spaceID) references spaces(spaceID)
+);
+
+insert into docs_typed(id, spaceID, docID, updatedNanos, title, txt, alive)
+select id, spaceID, docID, updatedNanos, title, txt, alive from docs;
+
+drop table docs;
+
+alter table docs_typed rename to docs;
+
+create index docs_spaceindex
+on docs(spaceID);
+
+create view cdocs (
+    id, title, txt
+) as
+select
+    id,
+    title,
+    uncompress(txt)
+from docs;
+
+create trigger docs_ai after insert on docs
+when not (select contentless from spaces where spaceID = new.spaceID)
+begin
+    insert into fts(rowid, title, txt) values (new.id, new.title, uncompress(new.txt));
+end;
+
+create trigger docs_ad after delete on docs
+when not (select contentless from spaces where spaceID = old.spaceID)
+begin
+    insert into fts(fts, rowid, title, txt) values ('delete', old.id, old.title, uncompress(old.txt));
+end;
+
+create trigger docs_au after update of title, txt on docs
+when not (select contentless from spaces where spaceID = old.spaceID)
+begin
+    insert into fts(fts, rowid, title, txt) values ('delete', old.id, old.title, uncompress(old.txt));
+    insert into fts(rowid, title, txt) values (new.id, new.title, uncompress(new.txt));
+end;
+
+create table interest_typed(
+    spaceID integer not null,
+    docID not null,
+    state integer not null,
+    updatedNanos integer not null default 0,
+    unique(spaceID, docID)
+    foreign key (spaceID) references spaces(spaceID)
+);
+
+insert into interest_typed(spaceID, docID, state, updatedNanos)
+select spaceID, docID, state, updatedNanos from interest;
+
+drop table interest;
+
+alter table interest_typed rename to interest;
@@ -19,10 +19,15 @@ package letarette
 Search syntax:
 
 <phrase> ::= string | quotedstring
-<query> ::= [-] <phrase> [*]
+<column> ::= letter [letter | digit | _]*
+<query> ::= [-] [<column>:] <phrase> [*]
+<query> ::= [-] ( <query> [OR <query>]+ )
 <query> ::= <query> <query>
 
 Where the '-' prefix means "not" and the '*' denotes wildcard searches.
+A column prefix limits matching of the phrase to one of the indexed
+columns, "title" or "txt", also named "body". Prefixes naming no column,
+like "http:" or "re:", are part of the phrase.
 
 Examples:
 
@@ -30,6 +35,12 @@ animal -dog -cat
 
 horse* -"horse head"
 
+title:horse body:"horse head" -title:pony
+
+(horse OR pony) -(saddle OR "riding boots")
+
+(title:horse OR (pony rider) OR "horse head")
+
 The output of the search parser is a list of including phrases and a list of
 excluding phrases. Both lists can contain wildcard expressions, which will lead
 to prefix searches.
@@ -38,6 +49,18 @@ The parser is very defensive and will always produce a valid query.
 
 Searches will always be performed as "near" queries for all including phrases
 followed by a NOT list built from all excluding phrases.
+Including phrases with a column prefix are required in addition to the
+"near" query, and are not part of it. Adjacent including phrases with
+column prefixes match if any of them matches, so "title:alpha body:beta"
+matches alpha in the title or beta in the text. Column phrases separated
+by other phrases are all required.
+
+A parenthesized group with the OR operator, which must be upper case,
+matches if any of its alternatives matches. Each alternative is a query
+of its own, where all including phrases are required and excluding phrases
+are removed from the matches of the alternative. Groups can be nested.
+Including groups are required in addition to the "near" query, excluding
+groups are added to the NOT list. Parentheses without OR are ignored.
 
 */
 
@@ -51,11 +74,14 @@ import (
 	"unicode"
 )
 
-// Phrase represents one parsed query phrase, with flags
+// Phrase represents one parsed query phrase, with flags.
+// The text of a group phrase is a parenthesized OR group in query syntax.
 type Phrase struct {
 	Text     string
 	Wildcard bool
 	Exclude  bool
+	Column   string
+	Group    bool
 }
 
 func (p Phrase) String() string {
@@ -63,10 +89,16 @@ func (p Phrase) String() string {
 	if p.Exclude {
 		prefix = "-"
 	}
+	if p.Group {
+		return prefix + p.Text
+	}
 	suffix := ""
 	if p.Wildcard {
 		suffix = "*"
 	}
+	if p.Column != "" {
+		prefix += p.Column + ":"
+	}
 	phraseText := p.Text
 	if strings.Contains(phraseText, " ") && !strings.HasPrefix(phraseText, `"`) {
 		phraseText = fmt.Sprintf("%q", phraseText)
@@ -77,6 +109,16 @@ func (p Phrase) String() string {
 // ParseQuery tokenizes a query string and returns a list
 // of parsed phrases with exclusion and wildcard flags.
 func ParseQuery(query string) []Phrase {
+	return parseTokens(scanQuery(query))
+}
+
+// queryToken is one scanned query token
+type queryToken struct {
+	tok  rune
+	text string
+}
+
+func scanQuery(query string) []queryToken {
 	var s scanner.Scanner
 	s.Init(bytes.NewBufferString(query))
 	s.Mode = scanner.ScanIdents | scanner.ScanStrings
@@ -90,27 +132,59 @@ func ParseQuery(query string) []Phrase {
 		return unicode.IsGraphic(r) && !unicode.IsSpace(r)
 	}
 
+	var tokens []queryToken
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		tokens = append(tokens, queryToken{tok, s.TokenText()})
+	}
+	return tokens
+}
+
+func parseTokens(tokens []queryToken) []Phrase {
 	var result []Phrase
 	excludeNext := false
+	columnNext := ""
 
-	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
-		text := s.TokenText()
+	for i := 0; i < len(tokens); i++ {
+		tok, text := tokens[i].tok, tokens[i].text
 		switch tok {
+		case '(':
+			end := closingParen(tokens, i)
+			if !isGroup(tokens[i+1 : end]) {
+				// Parentheses without OR are skipped
+				continue
+			}
+			alternatives := groupAlternatives(tokens[i+1:end], false)
+			result = append(result, groupPhrases(alternatives, excludeNext)...)
+			excludeNext = false
+			columnNext = ""
+			i = end
 		case scanner.Ident:
-			//text = fmt.Sprintf("%q", text)
+			// Other prefixes, like in URLs, are part of the phrase
+			if match := columnPrefix.FindStringSubmatch(text); match != nil {
+				if column, found := searchColumn(match[1]); found {
+					columnNext = column
+					text = match[2]
+					if text == "" {
+						// Column prefix for a following quoted phrase
+						continue
+					}
+				}
+			}
 			fallthrough
 		case scanner.String:
 			text = unquote(text)
 			result = append(result, Phrase{
 				Text:    text,
 				Exclude: excludeNext,
+				Column:  columnNext,
 			})
 			excludeNext = false
+			columnNext = ""
 		case '-':
 			excludeNext = true
 		case '*':
 			l := len(result)
-			if l > 0 {
+			if l > 0 && !result[l-1].Group {
 				result[l-1].Wildcard = true
 			}
 		default:
@@ -121,6 +195,228 @@ func ParseQuery(query string) []Phrase {
 	return result
 }
 
+// closingParen returns the index of the parenthesis closing the one
+// at start, or the number of tokens if it is not closed.
+func closingParen(tokens []queryToken, start int) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		switch tokens[i].tok {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// splitGroup splits the tokens within a pair of parentheses
+// at each OR operator outside of nested parentheses.
+func splitGroup(tokens []queryToken) [][]queryToken {
+	var alternatives [][]queryToken
+	depth := 0
+	start := 0
+	for i, token := range tokens {
+		switch {
+		case token.tok == '(':
+			depth++
+		case token.tok == ')':
+			depth--
+		case depth == 0 && token.tok == scanner.Ident && token.text == "OR":
+			alternatives = append(alternatives, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(alternatives, tokens[start:])
+}
+
+func isGroup(tokens []queryToken) bool {
+	return len(splitGroup(tokens)) > 1
+}
+
+// groupAlternatives parses the alternatives of an OR group,
+// dropping alternatives without including phrases.
+func groupAlternatives(tokens []queryToken, reduce bool) [][]Phrase {
+	var alternatives [][]Phrase
+	for _, alternative := range splitGroup(tokens) {
+		phrases := parseTokens(alternative)
+		if reduce {
+			phrases = ReducePhraseList(phrases)
+		}
+		for _, phrase := range phrases {
+			if !phrase.Exclude {
+				alternatives = append(alternatives, phrases)
+				break
+			}
+		}
+	}
+	return alternatives
+}
+
+// formatGroup formats OR group alternatives in query syntax
+func formatGroup(alternatives [][]Phrase) string {
+	var formatted []string
+	for _, phrases := range alternatives {
+		var words []string
+		for _, phrase := range phrases {
+			words = append(words, phrase.String())
+		}
+		formatted = append(formatted, strings.Join(words, " "))
+	}
+	return "(" + strings.Join(formatted, " OR ") + ")"
+}
+
+// groupPhrases returns the phrases of a group, which is a single group
+// phrase, or the phrases of its alternative when there is only one.
+func groupPhrases(alternatives [][]Phrase, exclude bool) []Phrase {
+	switch {
+	case len(alternatives) == 0:
+		return nil
+	case len(alternatives) == 1 && !exclude:
+		return alternatives[0]
+	default:
+		return []Phrase{{
+			Text:    formatGroup(alternatives),
+			Exclude: exclude,
+			Group:   true,
+		}}
+	}
+}
+
+// parseGroup parses the alternatives of the text of a group phrase
+func parseGroup(group string, reduce bool) [][]Phrase {
+	tokens := scanQuery(group)
+	if len(tokens) == 0 || tokens[0].tok != '(' {
+		return nil
+	}
+	return groupAlternatives(tokens[1:closingParen(tokens, 0)], reduce)
+}
+
+var typographicQuotes = strings.NewReplacer("\u201c", `"`, "\u201d", `"`, "\u201e", `"`, "\u201f", `"`)
+
+// NormalizeQuery cleans up query strings pasted by users before parsing,
+// by trimming the characters in trim from the start and end of each
+// query word. An empty trim set disables normalization.
+//
+// The "-" and "*" operators of a word, and quoted phrases, are kept,
+// as are column prefixes of the search columns, "title:", "txt:" and "body:".
+// Typographic double quotes are turned into plain quotes, and the last
+// quote of a query with an odd number of quotes is dropped.
+// Words consisting only of trimmed characters are removed.
+// In queries using the OR operator, parentheses at the start and end
+// of words are kept.
+func NormalizeQuery(query string, trim string) string {
+	if trim == "" {
+		return query
+	}
+	query = typographicQuotes.Replace(query)
+	if strings.Count(query, `"`)%2 == 1 {
+		last := strings.LastIndex(query, `"`)
+		query = query[:last] + " " + query[last+1:]
+	}
+	keepParens := false
+	for _, token := range scanQuery(query) {
+		if token.tok == scanner.Ident && token.text == "OR" {
+			keepParens = true
+		}
+	}
+
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			if normalized := normalizeWord(word.String(), trim, keepParens); normalized != "" {
+				words = append(words, normalized)
+			}
+			word.Reset()
+		}
+	}
+	quoted := false
+	for _, r := range query {
+		if r == '"' {
+			quoted = !quoted
+		}
+		if unicode.IsSpace(r) && !quoted {
+			flush()
+			continue
+		}
+		word.WriteRune(r)
+	}
+	flush()
+	return strings.Join(words, " ")
+}
+
+// normalizeWord trims one query word, keeping operators and column prefixes
+func normalizeWord(word string, trim string, keepParens bool) string {
+	core := word
+	prefix := ""
+	if strings.HasPrefix(core, "-") {
+		prefix = "-"
+		core = core[1:]
+	}
+	closing := ""
+	if keepParens {
+		var opening string
+		opening, core, closing = splitParens(core, trim)
+		prefix += opening
+	}
+	suffix := ""
+	if strings.HasSuffix(core, "*") {
+		suffix = "*"
+		core = core[:len(core)-1]
+	}
+	if core == "" {
+		// Lone operators apply to the next word
+		return word
+	}
+
+	trimmed := func(r rune) bool {
+		return strings.ContainsRune(trim, r)
+	}
+	core = strings.TrimLeftFunc(core, trimmed)
+	if column := strings.TrimSuffix(core, ":"); column == core || !isColumnName(column) {
+		core = strings.TrimRightFunc(core, trimmed)
+	}
+	if core == "" {
+		return strings.TrimPrefix(prefix, "-") + closing
+	}
+	return prefix + core + suffix + closing
+}
+
+// splitParens splits the parentheses at the start and end of a word
+// from the word, dropping trimmed characters around them.
+func splitParens(word string, trim string) (opening string, core string, closing string) {
+	runes := []rune(word)
+	start := 0
+	for i, r := range runes {
+		if r == '(' {
+			opening += "("
+			start = i + 1
+		} else if !strings.ContainsRune(trim, r) {
+			break
+		}
+	}
+	end := len(runes)
+	for i := len(runes) - 1; i >= start; i-- {
+		if r := runes[i]; r == ')' {
+			closing += ")"
+			end = i
+		} else if !strings.ContainsRune(trim, r) {
+			break
+		}
+	}
+	return opening, string(runes[start:end]), closing
+}
+
+func isColumnName(name string) bool {
+	_, found := searchColumn(name)
+	return found
+}
+
+var columnPrefix = regexp.MustCompile(`^(\pL[\pL\pN_]*):(.*)$`)
 var singleChars = regexp.MustCompile(`\PL\pL\PL`)
 var singleCharStart = regexp.MustCompile(`^\pL\PL`)
 var singleCharEnd = regexp.MustCompile(`\PL\pL$`)
@@ -149,10 +445,14 @@ func reducePhrase(phrase string) string {
 }
 
 // ReducePhraseList removes one character phrases
-// from a list of phrases.
+// from a list of phrases, including the alternatives of OR groups.
 func ReducePhraseList(phrases []Phrase) []Phrase {
 	var result []Phrase
 	for _, phrase := range phrases {
+		if phrase.Group {
+			result = append(result, groupPhrases(parseGroup(phrase.Text, true), phrase.Exclude)...)
+			continue
+		}
 		phrase.Text = reducePhrase(phrase.Text)
 		if len(phrase.Text) > 0 {
 			result = append(result, phrase)
@@ -184,7 +484,7 @@ func CanonicalizePhraseList(phrases []Phrase) []Phrase {
 		if result[i].Wildcard != result[j].Exclude {
 			return result[j].Wildcard
 		}
-		return false
+		return result[i].Column < result[j].Column
 	})
 
 	last := result[0]
@@ -30,15 +30,15 @@ func TestParsePlainPhrases(t *testing.T) {
 	xt.Assert(len(r) == 3)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		`cat`, false, false,
+		`cat`, false, false, "", false,
 	})
 
 	xt.Assert(r[1] == letarette.Phrase{
-		`dog`, false, false,
+		`dog`, false, false, "", false,
 	})
 
 	xt.Assert(r[2] == letarette.Phrase{
-		`banana`, false, false,
+		`banana`, false, false, "", false,
 	})
 }
 
@@ -49,19 +49,19 @@ func TestIncludeExcludePhrases(t *testing.T) {
 	xt.Assert(len(r) == 4)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		`cat`, false, false,
+		`cat`, false, false, "", false,
 	})
 
 	xt.Assert(r[1] == letarette.Phrase{
-		`dog`, false, true,
+		`dog`, false, true, "", false,
 	})
 
 	xt.Assert(r[2] == letarette.Phrase{
-		`banana`, false, false,
+		`banana`, false, false, "", false,
 	})
 
 	xt.Assert(r[3] == letarette.Phrase{
-		`fishtank`, false, true,
+		`fishtank`, false, true, "", false,
 	})
 }
 
@@ -72,19 +72,19 @@ func TestWildcardPhrases(t *testing.T) {
 	xt.Assert(len(r) == 4)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		`cat`, true, false,
+		`cat`, true, false, "", false,
 	})
 
 	xt.Assert(r[1] == letarette.Phrase{
-		`dog`, true, true,
+		`dog`, true, true, "", false,
 	})
 
 	xt.Assert(r[2] == letarette.Phrase{
-		`banana`, false, false,
+		`banana`, false, false, "", false,
 	})
 
 	xt.Assert(r[3] == letarette.Phrase{
-		`fishtank`, false, true,
+		`fishtank`, false, true, "", false,
 	})
 }
 
@@ -95,15 +95,15 @@ func TestEmbeddedAndFreeExcludes(t *testing.T) {
 	xt.Assert(len(r) == 3)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		`cat-`, false, false,
+		`cat-`, false, false, "", false,
 	})
 
 	xt.Assert(r[1] == letarette.Phrase{
-		`cat-litter`, false, false,
+		`cat-litter`, false, false, "", false,
 	})
 
 	xt.Assert(r[2] == letarette.Phrase{
-		`dog`, false, true,
+		`dog`, false, true, "", false,
 	})
 }
 
@@ -114,19 +114,19 @@ func TestEmbeddedWildcard(t *testing.T) {
 	xt.Assert(len(r) == 4)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		`cat`, true, false,
+		`cat`, true, false, "", false,
 	})
 
 	xt.Assert(r[1] == letarette.Phrase{
-		`cat`, true, false,
+		`cat`, true, false, "", false,
 	})
 
 	xt.Assert(r[2] == letarette.Phrase{
-		`litter`, false, false,
+		`litter`, false, false, "", false,
 	})
 
 	xt.Assert(r[3] == letarette.Phrase{
-		`*dog*`, false, false,
+		`*dog*`, false, false, "", false,
 	})
 }
 
@@ -137,11 +137,11 @@ func TestString(t *testing.T) {
 	xt.Assert(len(r) == 2)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		`cat - * - dog`, false, false,
+		`cat - * - dog`, false, false, "", false,
 	})
 
 	xt.Assert(r[1] == letarette.Phrase{
-		`kawo\"nka`, true, false,
+		`kawo\"nka`, true, false, "", false,
 	})
 }
 
@@ -152,7 +152,7 @@ func TestBadString(t *testing.T) {
 	xt.Assert(len(r) == 1)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		`cat *`, false, false,
+		`cat *`, false, false, "", false,
 	})
 }
 
@@ -163,15 +163,15 @@ func TestDoubleDoubleQuotedString(t *testing.T) {
 	xt.Assert(len(r) == 3)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		``, false, false,
+		``, false, false, "", false,
 	})
 
 	xt.Assert(r[1] == letarette.Phrase{
-		`dog`, false, false,
+		`dog`, false, false, "", false,
 	})
 
 	xt.Assert(r[2] == letarette.Phrase{
-		``, false, false,
+		``, false, false, "", false,
 	})
 }
 
@@ -182,11 +182,11 @@ func TestSingleQuoteExclusion(t *testing.T) {
 	xt.Assert(len(r) == 2)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		`WinkelWolt`, false, false,
+		`WinkelWolt`, false, false, "", false,
 	})
 
 	xt.Assert(r[1] == letarette.Phrase{
-		`'Woff!`, false, false,
+		`'Woff!`, false, false, "", false,
 	})
 }
 
@@ -197,14 +197,93 @@ func TestParenthesisExclusion(t *testing.T) {
 	xt.Assert(len(r) == 2)
 
 	xt.Assert(r[0] == letarette.Phrase{
-		`WinkelWolt`, false, false,
+		`WinkelWolt`, false, false, "", false,
 	})
 
 	xt.Assert(r[1] == letarette.Phrase{
-		`()`, false, false,
+		`()`, false, false, "", false,
 	})
 }
 
+func TestColumnPhrases(t *testing.T) {
+	xt := xt.X(t)
+
+	r := letarette.ParseQuery(`title:cat -txt:"dog house" txt:bird* 12:30`)
+	xt.Assert(len(r) == 4)
+
+	xt.Assert(r[0] == letarette.Phrase{
+		`cat`, false, false, "title", false,
+	})
+
+	xt.Assert(r[1] == letarette.Phrase{
+		`dog house`, false, true, "txt", false,
+	})
+
+	xt.Assert(r[2] == letarette.Phrase{
+		`bird`, true, false, "txt", false,
+	})
+
+	xt.Assert(r[3] == letarette.Phrase{
+		`12:30`, false, false, "", false,
+	})
+
+	str := fmt.Sprintf("%s", r)
+	xt.Assert(str == `[title:cat -txt:"dog house" txt:bird* 12:30]`)
+}
+
+func TestColumnPhrases_NoColumn(t *testing.T) {
+	xt := xt.X(t)
+
+	r := letarette.ParseQuery(`http://example.com re:meeting note:important Body:cat TITLE:"dog house"`)
+	xt.DeepEqual([]letarette.Phrase{
+		{`http://example.com`, false, false, "", false},
+		{`re:meeting`, false, false, "", false},
+		{`note:important`, false, false, "", false},
+		{`cat`, false, false, "txt", false},
+		{`dog house`, false, false, "title", false},
+	}, r)
+
+	r = letarette.ParseQuery(`-https://example.com/a?b=c*`)
+	xt.DeepEqual([]letarette.Phrase{
+		{`https://example.com/a?b=c`, true, true, "", false},
+	}, r)
+}
+
+func TestGroupPhrases(t *testing.T) {
+	xt := xt.X(t)
+
+	r := letarette.ParseQuery(`horse (saddle OR "bridle rope" OR title:rein*) -(pony OR (dog -house OR cat))`)
+	xt.DeepEqual([]letarette.Phrase{
+		{`horse`, false, false, "", false},
+		{`(saddle OR "bridle rope" OR title:rein*)`, false, false, "", true},
+		{`(pony OR (dog -house OR cat))`, false, true, "", true},
+	}, r)
+
+	// Parentheses without OR, and lower case "or", are ignored
+	r = letarette.ParseQuery(`(horse or (pony)) "(saddle OR bridle)"`)
+	xt.DeepEqual([]letarette.Phrase{
+		{`horse`, false, false, "", false},
+		{`or`, false, false, "", false},
+		{`pony`, false, false, "", false},
+		{`(saddle OR bridle)`, false, false, "", false},
+	}, r)
+
+	// Alternatives without included phrases and unclosed groups
+	r = letarette.ParseQuery(`(horse -cart OR -pony OR OR) (cat OR dog`)
+	xt.DeepEqual([]letarette.Phrase{
+		{`horse`, false, false, "", false},
+		{`cart`, false, true, "", false},
+		{`(cat OR dog)`, false, false, "", true},
+	}, r)
+	xt.Equal(0, len(letarette.ParseQuery(`-(-cat OR -dog)`)))
+
+	r = letarette.ReducePhraseList(letarette.ParseQuery(`(a OR bb c) -(x OR yy OR z)`))
+	xt.DeepEqual([]letarette.Phrase{
+		{`bb`, false, false, "", false},
+		{`(yy)`, false, true, "", true},
+	}, r)
+}
+
 func TestToString(t *testing.T) {
 	xt := xt.X(t)
 
@@ -242,3 +321,31 @@ func TestUnicodeCharacters(t *testing.T) {
 	xt.Assert(len(phrases) == 1)
 	xt.Assert(phrases[0].Text == `rökare`)
 }
+
+func TestNormalizeQuery(t *testing.T) {
+	xt := xt.X(t)
+
+	const trim = ".,;:!?()[]{}<>"
+	for query, expected := range map[string]string{
+		"cat dog":                "cat dog",
+		"  cat,  dog.  ":         "cat dog",
+		"Error: file not found!": "Error file not found",
+		"(banana) [split]":       "banana split",
+		"cat -dog. fish*,":       "cat -dog fish*",
+		"cat - dog * fish":       "cat - dog * fish",
+		"title: horse txt:pony?": "title: horse txt:pony",
+		`"horse  head". pony`:    `"horse  head" pony`,
+		"\u201chorse head\u201d": `"horse head"`,
+		`"horse head`:            "horse head",
+		`cat "dog" "fish`:        `cat "dog" fish`,
+		"cat ... -... :":         "cat",
+		"-.cat":                  "-cat",
+		"(cat, OR dog.)":         "(cat OR dog)",
+		"-(cat OR (dog! fish)).": "-(cat OR (dog fish))",
+		"(cat or dog)":           "cat or dog",
+	} {
+		xt.Equalf(expected, letarette.NormalizeQuery(query, trim), "Unexpected normalization of %q", query)
+	}
+
+	xt.Equal("cat, dog.", letarette.NormalizeQuery("cat, dog.", ""))
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Soundex digits of the letters a to z, vowels and "h", "w" and "y" are zero.
+const soundexDigits = "01230120022455012623010202"
+
+// soundex returns the lower case American Soundex code of a word,
+// such as "s530" for both "Smith" and "Smyth".
+// Letters outside a to z are skipped, words without such letters
+// have no code.
+func soundex(word string) string {
+	code := make([]byte, 0, 4)
+	var last byte
+	for _, r := range strings.ToLower(word) {
+		if r < 'a' || r > 'z' {
+			continue
+		}
+		digit := soundexDigits[r-'a']
+		if len(code) == 0 {
+			code = append(code, byte(r))
+			last = digit
+			continue
+		}
+		if digit != '0' && digit != last {
+			code = append(code, digit)
+			if len(code) == 4 {
+				break
+			}
+		}
+		// "h" and "w" do not separate letters with equal digits
+		if r != 'h' && r != 'w' {
+			last = digit
+		}
+	}
+	if len(code) == 0 {
+		return ""
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+// phoneticCodes returns the space separated phonetic codes
+// of the words of a text, in text order.
+func phoneticCodes(text string) string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	codes := make([]string, 0, len(words))
+	for _, word := range words {
+		if code := soundex(word); code != "" {
+			codes = append(codes, code)
+		}
+	}
+	return strings.Join(codes, " ")
+}
+
+// phrasesToPhoneticMatchString builds a match expression for the
+// phonetic index, matching the codes of each phrase in order.
+// Wildcards and column filters do not apply to phonetic codes,
+// and are ignored. OR groups are not supported.
+func phrasesToPhoneticMatchString(phrases []Phrase) (string, error) {
+	var includes []string
+	var excludes []string
+	for _, phrase := range phrases {
+		if phrase.Group {
+			return "", fmt.Errorf("%w: OR group in phonetic query", errInvalidQuery)
+		}
+		codes := phoneticCodes(phrase.Text)
+		if codes == "" {
+			continue
+		}
+		expr := fmt.Sprintf("%q", codes)
+		if phrase.Exclude {
+			excludes = append(excludes, expr)
+		} else {
+			includes = append(includes, expr)
+		}
+	}
+	if len(includes) == 0 {
+		return "", fmt.Errorf("%w: no phonetic codes in query", errInvalidQuery)
+	}
+	matchString := strings.Join(includes, " AND ")
+	if len(excludes) > 0 {
+		matchString += fmt.Sprintf(" NOT (%s)", strings.Join(excludes, " OR "))
+	}
+	return matchString, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"testing"
+
+	xt "github.com/erkkah/letarette/pkg/xt"
+)
+
+func TestSoundex(t *testing.T) {
+	xt := xt.X(t)
+
+	codes := map[string]string{
+		"Smith":    "s530",
+		"Smyth":    "s530",
+		"Robert":   "r163",
+		"Rupert":   "r163",
+		"Ashcraft": "a261",
+		"Tymczak":  "t522",
+		"Pfister":  "p236",
+		"Lee":      "l000",
+		"Müller":   "m460",
+		"123":      "",
+	}
+	for word, code := range codes {
+		xt.Equalf(code, soundex(word), "Unexpected code for %q", word)
+	}
+
+	xt.Equal("j500 s530", phoneticCodes("John, Smith-123"))
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"math"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// registerRankingFunctions registers Go implemented SQL functions
+// used for adjusting search result ranking.
+func registerRankingFunctions(conn *sqlite3.SQLiteConn) error {
+	err := conn.RegisterFunc("decay", timeDecay, true)
+	if err != nil {
+		return err
+	}
+	return conn.RegisterFunc("positionboost", positionBoost, true)
+}
+
+// timeDecay calculates the factor 0.5^(age / halfLife), where age is
+// the time from the document update time to the given current time.
+// Documents updated "in the future" are not decayed.
+// A zero or negative half-life disables decay.
+func timeDecay(updatedNanos int64, halfLifeHours float64, nowNanos int64) float64 {
+	if halfLifeHours <= 0 {
+		return 1
+	}
+	age := time.Duration(nowNanos - updatedNanos)
+	if age < 0 {
+		return 1
+	}
+	return math.Pow(0.5, age.Hours()/halfLifeHours)
+}
+
+// positionBoost calculates the factor 1 + weight * (1 - offset / cutoff)
+// for documents with a first match at the given token offset,
+// boosting matches near the start of the matching column.
+// Matches at or beyond the cutoff are not boosted.
+// A zero or negative weight or cutoff disables boosting.
+func positionBoost(offset int64, weight float64, cutoff int64) float64 {
+	if weight <= 0 || cutoff <= 0 || offset >= cutoff {
+		return 1
+	}
+	return 1 + weight*(1-float64(offset)/float64(cutoff))
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+/*
+	Space reloads fill a shadow space from a fresh interest list pass,
+	while the reloaded space stays searchable. The shadow space is cycled
+	like any other space, fetching index updates and documents from the
+	document manager of the reloaded space. Document updates for the
+	reloaded space are stored in both spaces.
+
+	When the shadow space has caught up, it replaces the reloaded space
+	in one transaction. The documents of the replaced space are then
+	purged in the background.
+*/
+
+type spaceReload struct {
+	shadow string
+	// Stops the shadow space fetcher
+	stop context.CancelFunc
+}
+
+// spaces lists the spaces to cycle, the configured spaces
+// and the shadow spaces of running reloads.
+func (idx *indexer) spaces() []string {
+	if len(idx.reloads) == 0 {
+		return idx.cfg.Index.Spaces
+	}
+	spaces := append([]string{}, idx.cfg.Index.Spaces...)
+	var shadows []string
+	for _, reload := range idx.reloads {
+		shadows = append(shadows, reload.shadow)
+	}
+	sort.Strings(shadows)
+	return append(spaces, shadows...)
+}
+
+// reloadedSpace returns the space reloaded into a shadow space
+func (idx *indexer) reloadedSpace(shadow string) (string, bool) {
+	for space, reload := range idx.reloads {
+		if reload.shadow == shadow {
+			return space, true
+		}
+	}
+	return "", false
+}
+
+// providerSpace returns the space known by document managers,
+// the reloaded space for shadow spaces.
+func (idx *indexer) providerSpace(space string) string {
+	if reloaded, isShadow := idx.reloadedSpace(space); isShadow {
+		return reloaded
+	}
+	return space
+}
+
+// checkReloads starts requested reloads of configured spaces,
+// and purges spaces replaced by finished reloads.
+func (idx *indexer) checkReloads() {
+	idx.purgeRetiredSpaces()
+
+	requested, err := idx.db.getReloads(idx.context)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			logger.Error.Printf("Failed to get space reloads: %v", err)
+		}
+		return
+	}
+
+	configured := map[string]bool{}
+	for _, space := range idx.cfg.Index.Spaces {
+		configured[space] = true
+	}
+
+	for _, reload := range requested {
+		if !configured[reload.Space] || idx.reloads[reload.Space] != nil {
+			continue
+		}
+		err := idx.startReload(reload.Space)
+		if err != nil {
+			logger.Error.Printf("Failed to start reload of space %q: %v", reload.Space, err)
+		}
+	}
+}
+
+func (idx *indexer) startReload(space string) error {
+	shadow, err := idx.db.startReload(idx.context, space)
+	if err != nil {
+		return err
+	}
+	err = idx.db.clearInterestList(idx.context, shadow)
+	if err != nil {
+		return fmt.Errorf("failed to clear interest list: %w", err)
+	}
+
+	idx.indexUpdates[shadow] = make(chan protocol.IndexUpdate)
+	idx.restartFetch[shadow] = make(chan struct{}, 1)
+	ctx, stop := context.WithCancel(idx.context)
+	err = idx.startSpaceFetcher(ctx, shadow, space)
+	if err != nil {
+		stop()
+		return err
+	}
+
+	idx.reloads[space] = &spaceReload{shadow: shadow, stop: stop}
+	idx.shadowsLock.Lock()
+	idx.shadows[space] = shadow
+	idx.shadowsLock.Unlock()
+
+	logger.Info.Printf("Reloading space %q into %q", space, shadow)
+	return nil
+}
+
+// finishReload swaps in the shadow space of a caught up reload,
+// and restarts fetching for the reloaded space from the position
+// of the shadow space.
+func (idx *indexer) finishReload(space string) error {
+	reload := idx.reloads[space]
+
+	// Hold off document updates while swapping, so that no update
+	// is stored in only one of the spaces.
+	idx.shadowsLock.Lock()
+	err := idx.db.swapReload(idx.context, space)
+	if err == nil {
+		delete(idx.shadows, space)
+	}
+	idx.shadowsLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to finish reload: %w", err)
+	}
+
+	reload.stop()
+	delete(idx.reloads, space)
+	delete(idx.indexUpdates, reload.shadow)
+	delete(idx.restartFetch, reload.shadow)
+	delete(idx.progress, reload.shadow)
+	delete(idx.lastDocumentRequest, reload.shadow)
+
+	select {
+	case idx.restartFetch[space] <- struct{}{}:
+	default:
+	}
+	err = idx.db.clearInterestList(idx.context, space)
+	if err != nil {
+		logger.Error.Printf("Failed to clean interest list: %v", err)
+	}
+
+	logger.Info.Printf("Reload of space %q done", space)
+	idx.purgeRetiredSpaces()
+	return nil
+}
+
+// purgeRetiredSpaces deletes spaces replaced by reloads,
+// invalidating cached results listing their documents.
+func (idx *indexer) purgeRetiredSpaces() {
+	err := idx.db.purgeRetiredSpaces(idx.context, func(docs []protocol.DocumentID) {
+		for _, doc := range docs {
+			idx.cache.Invalidate(doc)
+		}
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Error.Printf("Failed to purge replaced spaces: %v", err)
+	}
+}
+
+// withShadowUpdates adds copies of document updates for reloaded spaces,
+// for their shadow spaces. Must be called holding the shadows lock.
+func (idx *indexer) withShadowUpdates(updates []protocol.DocumentUpdate) []protocol.DocumentUpdate {
+	if len(idx.shadows) == 0 {
+		return updates
+	}
+	for _, update := range updates {
+		if shadow, found := idx.shadows[update.Space]; found {
+			updates = append(updates, protocol.DocumentUpdate{
+				Space:     shadow,
+				Documents: update.Documents,
+			})
+		}
+	}
+	return updates
+}
+
+// withShadowSpace lists a space together with its shadow space, when
+// it is being reloaded. Must be called holding the shadows lock.
+func (idx *indexer) withShadowSpace(space string) []string {
+	if shadow, found := idx.shadows[space]; found {
+		return []string{space, shadow}
+	}
+	return []string{space}
+}
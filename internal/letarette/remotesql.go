@@ -0,0 +1,255 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/nats-io/nats.go"
+
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// SQLResponder runs read-only SQL statements requested over NATS
+type SQLResponder interface {
+	Close()
+}
+
+// Rows beyond this limit are dropped from remote SQL responses
+const maxRemoteSQLRows = 1000
+
+// ErrNotReadOnly is returned for statements rejected by the read-only
+// checks of remote SQL and Database.SafeRawQuery
+var ErrNotReadOnly = errors.New("statement is not read-only")
+
+// Pragmas allowed in remote SQL, reading the schema or database state.
+// Pragmas taking a table or index name are allowed with an argument,
+// all other pragmas only without, since an argument can change a setting.
+var readOnlyPragmas = map[string]bool{
+	"table_info":       true,
+	"table_xinfo":      true,
+	"table_list":       true,
+	"index_list":       true,
+	"index_info":       true,
+	"index_xinfo":      true,
+	"foreign_key_list": true,
+	"integrity_check":  true,
+	"quick_check":      true,
+	"compile_options":  false,
+	"database_list":    false,
+	"page_count":       false,
+	"page_size":        false,
+	"freelist_count":   false,
+	"journal_mode":     false,
+	"schema_version":   false,
+	"user_version":     false,
+	"data_version":     false,
+	"function_list":    false,
+	"pragma_list":      false,
+}
+
+var leadingKeyword = regexp.MustCompile(`^[a-zA-Z]+`)
+var pragmaStatement = regexp.MustCompile(`(?is)^pragma\s+(\w+)\s*(\(\s*[\w"']+\s*\))?$`)
+
+// checkReadOnlySQL rejects all statements but single SELECT, WITH, VALUES
+// and EXPLAIN statements, and pragmas reading the schema or database state.
+// Multiple statements are rejected by rejecting semicolons, except at the end,
+// and statements must start with the keyword, not with a comment.
+func checkReadOnlySQL(statement string) error {
+	statement = strings.TrimRight(strings.TrimSpace(statement), "; \t\r\n")
+	if statement == "" {
+		return fmt.Errorf("%w: empty statement", ErrNotReadOnly)
+	}
+	if strings.Contains(statement, ";") {
+		return fmt.Errorf("%w: multiple statements", ErrNotReadOnly)
+	}
+	keyword := strings.ToLower(leadingKeyword.FindString(statement))
+	switch keyword {
+	case "select", "with", "values", "explain":
+		return nil
+	case "pragma":
+		match := pragmaStatement.FindStringSubmatch(statement)
+		if match == nil {
+			return fmt.Errorf("%w: pragma assignment", ErrNotReadOnly)
+		}
+		withArgument, allowed := readOnlyPragmas[strings.ToLower(match[1])]
+		if !allowed || (match[2] != "" && !withArgument) {
+			return fmt.Errorf("%w: pragma %q is not allowed", ErrNotReadOnly, match[1])
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %q statements are not allowed", ErrNotReadOnly, keyword)
+}
+
+// runReadOnlySQL runs a statement on the read connection of the database,
+// returning at most maxRemoteSQLRows rows.
+//
+// In addition to the checks of checkReadOnlySQL, the statement is rejected
+// unless SQLite reports it as read-only, and it is run on a connection
+// opened in read-only, query-only mode.
+func (db *database) runReadOnlySQL(
+	ctx context.Context, statement string, stringArgs []string,
+) (columns []string, rows [][]interface{}, truncated bool, err error) {
+	err = checkReadOnlySQL(statement)
+	if err != nil {
+		return
+	}
+
+	conn, err := db.rdb.Connx(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	err = checkPreparedReadOnly(conn, statement)
+	if err != nil {
+		return
+	}
+
+	args := make([]interface{}, len(stringArgs))
+	for i, arg := range stringArgs {
+		args[i] = arg
+	}
+	result, err := conn.QueryxContext(ctx, statement, args...)
+	if err != nil {
+		return
+	}
+	defer result.Close()
+
+	columns, err = result.Columns()
+	if err != nil {
+		return
+	}
+	rows = [][]interface{}{}
+	for result.Next() {
+		if len(rows) == maxRemoteSQLRows {
+			truncated = true
+			break
+		}
+		var row []interface{}
+		row, err = result.SliceScan()
+		if err != nil {
+			return
+		}
+		for i, value := range row {
+			if bytes, isBytes := value.([]byte); isBytes {
+				row[i] = string(bytes)
+			}
+		}
+		rows = append(rows, row)
+	}
+	err = result.Err()
+	return
+}
+
+// checkPreparedReadOnly rejects statements that SQLite does not
+// report as read-only when prepared on the connection
+func checkPreparedReadOnly(conn *sqlx.Conn, statement string) error {
+	return conn.Raw(func(driverConn interface{}) error {
+		sqliteConn, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection type %T", driverConn)
+		}
+		stmt, err := sqliteConn.Prepare(statement)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		if !stmt.(*sqlite3.SQLiteStmt).Readonly() {
+			return ErrNotReadOnly
+		}
+		return nil
+	})
+}
+
+type sqlResponder struct {
+	subscription *nats.Subscription
+}
+
+func (r *sqlResponder) Close() {
+	_ = r.subscription.Unsubscribe()
+}
+
+// StartSQLResponder runs read-only SQL statements requested on the
+// "<topic>.sql" subject, one worker per shard, for remote diagnostics.
+// Requests are authorized by the given authorizer.
+//
+// Statements are checked to be single read-only statements, see
+// checkReadOnlySQL and runReadOnlySQL, run with the search timeout,
+// and return at most 1000 rows.
+func StartSQLResponder(nc *nats.Conn, dbo Database, cfg Config, authorize SQLAuthorizer) (SQLResponder, error) {
+	ec, err := nats.NewEncodedConn(nc, nats.JSON_ENCODER)
+	if err != nil {
+		return nil, err
+	}
+	db := dbo.(*database)
+
+	indexID, err := db.getIndexID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index ID: %w", err)
+	}
+
+	subscription, err := nc.QueueSubscribe(
+		cfg.Nats.Topic+".sql", cfg.Shard,
+		func(msg *nats.Msg) {
+			var req protocol.SQLRequest
+			err := json.Unmarshal(msg.Data, &req)
+			if err != nil {
+				logger.Error.Printf("Failed to decode SQL request: %v", err)
+				return
+			}
+			var credentials string
+			if msg.Header != nil {
+				credentials = msg.Header.Get(protocol.CredentialsHeader)
+			}
+
+			response := protocol.SQLResponse{
+				RequestID: req.RequestID,
+				IndexID:   indexID,
+				Shard:     cfg.Shard,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Search.Timeout)
+			defer cancel()
+			err = authorize(ctx, credentials, req.Statement)
+			if err == nil {
+				response.Columns, response.Rows, response.Truncated, err = db.runReadOnlySQL(
+					ctx, req.Statement, req.Args,
+				)
+			}
+			if err != nil {
+				logger.Warning.Printf("Remote SQL request failed: %v", err)
+				response.Error = err.Error()
+				response.Columns = nil
+				response.Rows = nil
+			}
+			err = ec.Publish(msg.Reply, &response)
+			if err != nil {
+				logger.Error.Printf("Failed to publish SQL response: %v", err)
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlResponder{subscription}, nil
+}
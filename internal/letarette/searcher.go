@@ -16,12 +16,16 @@ package letarette
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/mattn/go-sqlite3"
 	"github.com/nats-io/nats.go"
 
@@ -35,11 +39,14 @@ type Searcher interface {
 }
 
 type searcher struct {
-	closer chan bool
-	cfg    Config
-	conn   *nats.EncodedConn
-	db     *database
-	cache  *Cache
+	closer    chan bool
+	cfg       Config
+	conn      *nats.EncodedConn
+	db        *database
+	cache     *Cache
+	snapshots *searchSnapshots
+	indexID   string
+	authorize SearchAuthorizer
 }
 
 func (s *searcher) Close() {
@@ -48,13 +55,17 @@ func (s *searcher) Close() {
 	<-s.closer
 }
 
+// errInvalidQuery is wrapped by search request validation errors
+var errInvalidQuery = errors.New("invalid query")
+
 const minPagesize = 1
 const maxPagesize = 500
+const maxFacetLimit = 100
 
 func (s *searcher) spellSearch(
-	ctx context.Context, phrases []Phrase, query protocol.SearchRequest,
+	ctx context.Context, q sqlx.QueryerContext, phrases []Phrase, query protocol.SearchRequest,
 ) (protocol.SearchResult, error) {
-	result, err := s.db.search(ctx, phrases, query.Spaces, query.PageLimit, query.PageOffset)
+	result, err := s.db.searchIn(ctx, q, phrases, query)
 	if err != nil || result.TotalHits != 0 {
 		return result, err
 	}
@@ -71,37 +82,168 @@ func (s *searcher) spellSearch(
 	if !query.Autocorrect {
 		return result, nil
 	}
-	result, err = s.db.search(ctx, phrases, query.Spaces, query.PageLimit, query.PageOffset)
+	result, err = s.db.searchIn(ctx, q, phrases, query)
+	return result, err
+}
+
+// snapshotFor returns the snapshot to search for a request, if any.
+// Requests for unknown snapshots are searched in the live index.
+func (s *searcher) snapshotFor(ctx context.Context, query protocol.SearchRequest) (string, *sqlx.Tx, error) {
+	if query.Snapshot != "" {
+		token, tx, found := s.snapshots.get(query.Snapshot)
+		if found {
+			return token, tx, nil
+		}
+		logger.Debug.Printf("Search snapshot not found, searching live index")
+	}
+	if query.PinSnapshot {
+		return s.snapshots.pin(ctx)
+	}
+	return "", nil, nil
+}
+
+// uncachedSearch searches a snapshot, or the live index when there
+// is no snapshot, handling since-tokens.
+func (s *searcher) uncachedSearch(
+	ctx context.Context, snapshot *sqlx.Tx, phrases []Phrase, query protocol.SearchRequest,
+) (protocol.SearchResult, error) {
+	var q sqlx.QueryerContext = s.db.rdb
+	if snapshot != nil {
+		q = snapshot
+	}
+	watermarks, err := s.db.getSpaceWatermarks(ctx, q, query.Spaces)
+	if err != nil {
+		return protocol.SearchResult{}, err
+	}
+	if query.Since == "" && !query.NewSinceToken {
+		result, err := s.spellSearch(ctx, q, phrases, query)
+		result.Watermarks = watermarks
+		return result, err
+	}
+
+	// Taken before searching, so that documents indexed while searching
+	// are returned again by the next poll, instead of being missed.
+	last, err := s.db.lastDocumentPosition(ctx, q)
+	if err != nil {
+		return protocol.SearchResult{}, err
+	}
+
+	var result protocol.SearchResult
+	if query.Since != "" {
+		// No spelling fixes, no new documents is the common case
+		result, err = s.db.searchSince(ctx, q, phrases, query, sincePosition(s.indexID, query.Since))
+	} else {
+		result, err = s.spellSearch(ctx, q, phrases, query)
+	}
+	if err == nil {
+		result.SinceToken = fmt.Sprintf("%s:%d", s.indexID, last)
+		result.Watermarks = watermarks
+	}
 	return result, err
 }
 
+// sincePosition finds this index's position in a list of since-tokens.
+// Returns zero, the start of the index, when there is no valid token
+// for this index, for example after adding shards.
+func sincePosition(indexID string, tokens string) int64 {
+	for _, token := range strings.Split(tokens, ",") {
+		if !strings.HasPrefix(token, indexID+":") {
+			continue
+		}
+		position, err := strconv.ParseInt(strings.TrimPrefix(token, indexID+":"), 10, 64)
+		if err == nil && position >= 0 {
+			return position
+		}
+	}
+	return 0
+}
+
 func (s *searcher) parseAndExecute(ctx context.Context, query protocol.SearchRequest) (protocol.SearchResponse, error) {
 	var err error
 	var status protocol.SearchStatusCode
 
 	start := time.Now()
+	requestedLimit := query.PageLimit
+	requestedFacetLimit := query.FacetLimit
 	query.PageLimit = uint16(max(minPagesize, int(query.PageLimit)))
 	query.PageLimit = uint16(min(maxPagesize, int(query.PageLimit)))
-	phrases := ParseQuery(query.Query)
+	query.FacetLimit = uint16(min(maxFacetLimit, int(query.FacetLimit)))
+	queryString := s.db.invisible.Replace(query.Query)
+	phrases := ParseQuery(NormalizeQuery(queryString, s.cfg.Search.QueryTrim))
 	phrases = ReducePhraseList(phrases)
 
 	var result protocol.SearchResult
 
-	if len(query.Spaces) > 0 && len(phrases) > 0 {
-		cacheKey := fmt.Sprintf("%s", CanonicalizePhraseList(phrases))
-		var cached bool
-		result, cached = s.cache.Get(cacheKey, query.Spaces, query.PageLimit, query.PageOffset)
+	err = s.validateRequest(query, phrases)
 
-		if cached {
-			status = protocol.SearchStatusCacheHit
-		} else {
-			result, err = s.spellSearch(ctx, phrases, query)
+	var missingSpaces []string
+	var unavailableSpaces []string
+	if err == nil {
+		query.Spaces, missingSpaces, unavailableSpaces, err = s.db.splitSpaces(ctx, query.Spaces)
+		if len(missingSpaces) > 0 {
+			logger.Warning.Printf("Skipping search in missing spaces %v", missingSpaces)
+		}
+	}
+
+	var snapshotToken string
+	var snapshot *sqlx.Tx
+	if err == nil && len(query.Spaces) > 0 && len(phrases) > 0 {
+		snapshotToken, snapshot, err = s.snapshotFor(ctx, query)
+	}
+
+	if err == nil && len(query.Spaces) > 0 && len(phrases) > 0 {
+		if snapshot != nil || query.Since != "" || query.NewSinceToken {
+			// Snapshot and since-token searches bypass the cache,
+			// which follows the live index
+			result, err = s.uncachedSearch(ctx, snapshot, phrases, query)
 			if err == nil {
 				status = protocol.SearchStatusIndexHit
-				s.cache.Put(cacheKey, query.Spaces, query.PageLimit, query.PageOffset, result)
+				result.Snapshot = snapshotToken
+			}
+		} else {
+			cacheKey := searchCacheKey(phrases, query)
+			var cached bool
+			result, cached = s.cache.Get(cacheKey, query.Spaces, query.PageLimit, query.PageOffset)
+
+			if cached {
+				status = protocol.SearchStatusCacheHit
+			} else {
+				// Read before searching, and cached with the result,
+				// so that hits are never older than the watermarks
+				var watermarks map[string]time.Time
+				watermarks, err = s.db.getSpaceWatermarks(ctx, s.db.rdb, query.Spaces)
+				if err == nil {
+					result, err = s.spellSearch(ctx, s.db.rdb, phrases, query)
+				}
+				if err == nil {
+					result.Watermarks = watermarks
+					status = protocol.SearchStatusIndexHit
+					s.cache.Put(cacheKey, query.Spaces, query.PageLimit, query.PageOffset, result)
+				}
 			}
 		}
 	}
+	if snapshot != nil && query.ReleaseSnapshot {
+		s.snapshots.release(snapshotToken)
+		result.Snapshot = ""
+	}
+	result.MissingSpaces = missingSpaces
+	result.UnavailableSpaces = unavailableSpaces
+	if err == nil {
+		if int(requestedLimit) > maxPagesize {
+			result.Truncate(fmt.Sprintf("page limit %d exceeds max %d", requestedLimit, maxPagesize))
+		}
+		if len(query.Facets) > 0 && int(requestedFacetLimit) > maxFacetLimit {
+			result.Truncate(fmt.Sprintf("facet limit %d exceeds max %d", requestedFacetLimit, maxFacetLimit))
+		}
+		if result.Capped {
+			result.Truncate(fmt.Sprintf("hits capped at %d", s.db.resultCap))
+		}
+		if query.TierGap > 0 {
+			// Cached hits are shared, tiers are set on a copy
+			result.Hits = protocol.TierHits(result.Hits, query.TierGap)
+		}
+	}
 	duration := float32(time.Since(start)) / float32(time.Second)
 
 	if err != nil {
@@ -113,9 +255,15 @@ func (s *searcher) parseAndExecute(ctx context.Context, query protocol.SearchReq
 			status = protocol.SearchStatusTimeout
 		case errors.Is(err, context.DeadlineExceeded):
 			status = protocol.SearchStatusTimeout
+		case errors.Is(err, errInvalidQuery):
+			status = protocol.SearchStatusQueryError
 		default:
 			status = protocol.SearchStatusServerError
 		}
+	} else if len(query.Spaces) == 0 && len(unavailableSpaces) > 0 {
+		status = protocol.SearchStatusSpaceUnavailable
+	} else if len(result.Hits) == 0 && result.StopwordsOnly {
+		status = protocol.SearchStatusStopwordsOnly
 	} else if len(result.Hits) == 0 {
 		status = protocol.SearchStatusNoHit
 	}
@@ -125,11 +273,162 @@ func (s *searcher) parseAndExecute(ctx context.Context, query protocol.SearchReq
 		Status:   status,
 		Duration: duration,
 	}
+	s.logQuery(query, response, err)
 	return response, err
 }
 
+// searchCacheKey builds a cache key from the parsed query phrases
+// and all request options affecting the result.
+func searchCacheKey(phrases []Phrase, query protocol.SearchRequest) string {
+	cacheKeyPhrases := CanonicalizePhraseList(phrases)
+	if query.ExactCase {
+		// Canonical phrases are lower case
+		cacheKeyPhrases = phrases
+	}
+	return fmt.Sprintf(
+		"%s%v%v%v%v%v%v%v%v%q%v%v%v%v%v%v%v%q%q",
+		cacheKeyPhrases, query.Demotions, query.DecayHalfLifeHours, query.CountSpaces,
+		query.Facets, query.FacetLimit, query.NumericStats, query.Languages, query.IncludeContent,
+		query.CollapseField, query.Phonetic, query.EstimateTotal, query.ExactCase, query.TermCounts,
+		query.IgnoreBoost, query.Fuzzy, query.SnippetWindow, query.SnippetOpen, query.SnippetClose,
+	)
+}
+
+func (s *searcher) validateRequest(query protocol.SearchRequest, phrases []Phrase) error {
+	if err := validatePhraseColumns(phrases); err != nil {
+		return err
+	}
+	if limit := s.cfg.Search.MaxSpaces; limit > 0 && len(query.Spaces) > limit {
+		return fmt.Errorf("%w: %d spaces requested, at most %d allowed", errInvalidQuery, len(query.Spaces), limit)
+	}
+	if query.DecayHalfLifeHours < 0 {
+		return fmt.Errorf("%w: negative decay half-life", errInvalidQuery)
+	}
+	for _, demotion := range query.Demotions {
+		if !s.db.isStoredField(demotion.Field) {
+			return fmt.Errorf("%w: demotion field %q is not a stored field", errInvalidQuery, demotion.Field)
+		}
+		if demotion.Factor <= 0 || demotion.Factor > 1 {
+			return fmt.Errorf("%w: demotion factor %v is out of range", errInvalidQuery, demotion.Factor)
+		}
+	}
+	for _, facet := range query.Facets {
+		if !s.db.isStoredField(facet) {
+			return fmt.Errorf("%w: facet field %q is not a stored field", errInvalidQuery, facet)
+		}
+	}
+	for _, field := range query.NumericStats {
+		if !s.db.fieldParser.numeric[field] {
+			return fmt.Errorf("%w: stats field %q is not a numeric field", errInvalidQuery, field)
+		}
+	}
+	if query.CollapseField != "" {
+		if !s.db.isStoredField(query.CollapseField) {
+			return fmt.Errorf("%w: collapse field %q is not a stored field", errInvalidQuery, query.CollapseField)
+		}
+		if query.Since != "" {
+			return fmt.Errorf("%w: collapsing cannot be combined with since", errInvalidQuery)
+		}
+	}
+	if query.Phonetic && (query.Since != "" || query.CollapseField != "") {
+		return fmt.Errorf("%w: phonetic search cannot be combined with since or collapsing", errInvalidQuery)
+	}
+	if query.Fuzzy < 0 || query.Fuzzy > protocol.MaxFuzzy {
+		return fmt.Errorf("%w: fuzzy edit distance %d is out of range", errInvalidQuery, query.Fuzzy)
+	}
+	if query.Fuzzy > 0 && (query.Phonetic || query.ExactCase) {
+		return fmt.Errorf("%w: fuzzy search cannot be combined with phonetic or exact case search", errInvalidQuery)
+	}
+	if query.SnippetWindow < 0 || query.SnippetWindow > protocol.MaxSnippetWindow {
+		return fmt.Errorf("%w: snippet window %d is out of range", errInvalidQuery, query.SnippetWindow)
+	}
+	if query.TierGap < 0 || query.TierGap >= 1 {
+		return fmt.Errorf("%w: tier gap %v is out of range", errInvalidQuery, query.TierGap)
+	}
+	if query.TierGap > 0 && query.Since != "" {
+		return fmt.Errorf("%w: tiers cannot be combined with since", errInvalidQuery)
+	}
+	if query.ExactCase && (query.Since != "" || query.CollapseField != "" || query.Phonetic) {
+		return fmt.Errorf("%w: exact case search cannot be combined with since, collapsing or phonetic search", errInvalidQuery)
+	}
+	return nil
+}
+
+// authorizeSpaces returns the requested spaces a request is allowed to
+// search. Spaces not requested are never added by the authorizer.
+func (s *searcher) authorizeSpaces(ctx context.Context, credentials string, spaces []string) ([]string, error) {
+	allowed, err := s.authorize(ctx, credentials, spaces)
+	if err != nil {
+		logger.Debug.Printf("Search request rejected: %v", err)
+		return nil, err
+	}
+	requested := map[string]bool{}
+	for _, space := range spaces {
+		requested[space] = true
+	}
+	var authorized []string
+	for _, space := range allowed {
+		if requested[space] {
+			authorized = append(authorized, space)
+		}
+	}
+	if len(authorized) == 0 {
+		logger.Debug.Printf("Search request rejected: no authorized spaces")
+		return nil, ErrUnauthorized
+	}
+	return authorized, nil
+}
+
+// logQuery logs failed and slow queries, and a random sample of all
+// other queries, see Config.Search.QueryLogSampling.
+func (s *searcher) logQuery(query protocol.SearchRequest, response protocol.SearchResponse, err error) {
+	threshold := s.cfg.Search.SlowQueryThreshold
+	slow := threshold > 0 && time.Duration(response.Duration*float32(time.Second)) >= threshold
+	if slow {
+		metrics.SlowQueries.Add(1)
+	}
+
+	sampled := false
+	if err == nil && !slow {
+		rate := s.cfg.Search.QueryLogSampling
+		if rate <= 0 || rand.Float64() >= rate {
+			return
+		}
+		sampled = true
+	}
+
+	log, kind := logger.Info, "Query"
+	var failure string
+	switch {
+	case err != nil:
+		log, kind = logger.Error, "Failed query"
+		failure = fmt.Sprintf(" error=%q", err.Error())
+	case slow:
+		log, kind = logger.Warning, "Slow query"
+	}
+	log.Printf(
+		"%s: query=%q spaces=%q status=%q hits=%d duration=%.3fs sampled=%v%s",
+		kind, s.loggedPhrase(query.Query), strings.Join(query.Spaces, ","),
+		response.Status.String(), response.Result.TotalHits, response.Duration,
+		sampled, failure,
+	)
+}
+
+func (s *searcher) loggedPhrase(phrase string) string {
+	if s.cfg.Search.RedactQueries {
+		return "<redacted>"
+	}
+	return phrase
+}
+
 // StartSearcher creates and starts a searcher instance.
-func StartSearcher(nc *nats.Conn, db Database, cfg Config, cache *Cache) (Searcher, error) {
+// Requests are authorized by the given authorizer, or by
+// AllowAllSearches when nil.
+func StartSearcher(nc *nats.Conn, db Database, cfg Config, cache *Cache, authorize SearchAuthorizer) (Searcher, error) {
+	if authorize == nil {
+		authorize = AllowAllSearches
+	}
+
 	closer := make(chan bool)
 
 	ec, err := nats.NewEncodedConn(nc, nats.JSON_ENCODER)
@@ -137,50 +436,145 @@ func StartSearcher(nc *nats.Conn, db Database, cfg Config, cache *Cache) (Search
 		return &searcher{}, err
 	}
 
+	privateDB := db.(*database)
+	indexID, err := privateDB.getIndexID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index ID: %w", err)
+	}
+	snapshots := newSearchSnapshots(
+		privateDB, indexID, cfg.Search.SnapshotTimeout, cfg.Search.MaxSnapshots,
+	)
+
 	self := &searcher{
 		closer,
 		cfg,
 		ec,
-		db.(*database),
+		privateDB,
 		cache,
+		snapshots,
+		indexID,
+		authorize,
 	}
 
 	type searchWork struct {
-		req   protocol.SearchRequest
-		reply string
+		req         protocol.SearchRequest
+		credentials string
+		compress    bool
+		reply       string
+		queued      time.Time
 	}
 
-	// Worker pool = 4 * GOMAXPROCS
+	metrics.CompressThreshold.Set(int64(cfg.Search.CompressThreshold))
+
+	// Responses are compressed when accepted by the client and larger
+	// than the threshold, see protocol.AcceptEncodingHeader
+	publish := func(work searchWork, response protocol.SearchResponse) {
+		response = response.ForVersion(work.req.ClientVersion())
+		data, err := json.Marshal(response)
+		if err != nil {
+			logger.Error.Printf("Failed to encode response: %v", err)
+			return
+		}
+		msg := nats.NewMsg(work.reply)
+		threshold := cfg.Search.CompressThreshold
+		if work.compress && threshold > 0 && len(data) > threshold {
+			packed, err := protocol.CompressResponse(data)
+			if err != nil {
+				logger.Error.Printf("Failed to compress response: %v", err)
+			} else {
+				metrics.CompressedResponses.Add(1)
+				metrics.CompressionPlainBytes.Add(int64(len(data)))
+				metrics.CompressionPackedBytes.Add(int64(len(packed)))
+				msg.Header.Set(protocol.ContentEncodingHeader, protocol.EncodingGzip)
+				data = packed
+			}
+		}
+		msg.Data = data
+		err = nc.PublishMsg(msg)
+		if err != nil {
+			logger.Error.Printf("Failed to publish response: %v", err)
+		}
+	}
+
+	// Worker pool defaults to 4 * GOMAXPROCS
 	// I/O vs CPU, this needs measurements and tweaks.
-	numWorkers := 4 * runtime.GOMAXPROCS(-1)
-	// Queue size == 2 * workers
-	workChannel := make(chan searchWork, numWorkers*2)
+	numWorkers := cfg.Search.MaxConcurrent
+	if numWorkers <= 0 {
+		numWorkers = 4 * runtime.GOMAXPROCS(-1)
+	}
+	// Queue size defaults to 2 * workers
+	queueSize := cfg.Search.QueueSize
+	if queueSize <= 0 {
+		queueSize = numWorkers * 2
+	}
+	workChannel := make(chan searchWork, queueSize)
 
 	for i := 0; i < numWorkers; i++ {
 		go func() {
 			for work := range workChannel {
+				wait := time.Since(work.queued)
+				metrics.QueuedQueries.Add(1)
+				metrics.QueueWaitTime.Add(wait.Seconds())
+				if cfg.Search.QueueTimeout > 0 && wait > cfg.Search.QueueTimeout {
+					publish(work, protocol.SearchResponse{
+						Status:   protocol.SearchStatusTimeout,
+						Duration: float32(wait) / float32(time.Second),
+					})
+					continue
+				}
+
 				// Handle query
 				ctx, cancel := context.WithTimeout(context.Background(), cfg.Search.Timeout)
-				response, err := self.parseAndExecute(ctx, work.req)
-				cancel()
-				if err != nil {
-					logger.Error.Printf("Failed to execute query: %v", err)
+				if !privateDB.checkSchemaReady(ctx) {
+					cancel()
+					publish(work, protocol.SearchResponse{
+						Status: protocol.SearchStatusInitializing,
+					})
+					continue
 				}
-				// Reply
-				err = ec.Publish(work.reply, response)
+				spaces, err := self.authorizeSpaces(ctx, work.credentials, work.req.Spaces)
 				if err != nil {
-					logger.Error.Printf("Failed to publish response: %v", err)
+					cancel()
+					publish(work, protocol.SearchResponse{
+						Status: protocol.SearchStatusUnauthorized,
+					})
+					continue
 				}
+				work.req.Spaces = spaces
+				// Failed queries are logged by parseAndExecute
+				response, _ := self.parseAndExecute(ctx, work.req)
+				cancel()
+				// Reply
+				publish(work, response)
 			}
 		}()
 	}
 
-	subscription, err := ec.QueueSubscribe(
+	subscription, err := nc.QueueSubscribe(
 		cfg.Nats.Topic+".q", cfg.Shard,
-		func(sub, reply string, query *protocol.SearchRequest) {
-			workChannel <- searchWork{
-				req:   *query,
-				reply: reply,
+		func(msg *nats.Msg) {
+			var query protocol.SearchRequest
+			err := json.Unmarshal(msg.Data, &query)
+			if err != nil {
+				logger.Error.Printf("Failed to decode search request: %v", err)
+				return
+			}
+			work := searchWork{
+				req:    query,
+				reply:  msg.Reply,
+				queued: time.Now(),
+			}
+			if msg.Header != nil {
+				work.credentials = msg.Header.Get(protocol.CredentialsHeader)
+				work.compress = msg.Header.Get(protocol.AcceptEncodingHeader) == protocol.EncodingGzip
+			}
+			select {
+			case workChannel <- work:
+			default:
+				metrics.BusyQueries.Add(1)
+				publish(work, protocol.SearchResponse{
+					Status: protocol.SearchStatusBusy,
+				})
 			}
 		})
 
@@ -188,6 +582,24 @@ func StartSearcher(nc *nats.Conn, db Database, cfg Config, cache *Cache) (Search
 		return nil, err
 	}
 
+	// All workers answer pings, not only one per shard
+	pingSubscription, err := ec.Subscribe(
+		cfg.Nats.Topic+".ping",
+		func(sub, reply string, req *protocol.PingRequest) {
+			err := ec.Publish(reply, &protocol.PingResponse{
+				RequestID: req.RequestID,
+				IndexID:   indexID,
+				Shard:     cfg.Shard,
+			})
+			if err != nil {
+				logger.Error.Printf("Failed to publish ping response: %v", err)
+			}
+		})
+	if err != nil {
+		_ = subscription.Unsubscribe()
+		return nil, err
+	}
+
 	go func() {
 		for {
 			time.Sleep(time.Second)
@@ -195,11 +607,28 @@ func StartSearcher(nc *nats.Conn, db Database, cfg Config, cache *Cache) (Search
 		}
 	}()
 
+	stopExpiry := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cfg.Search.SnapshotTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				snapshots.expire()
+			case <-stopExpiry:
+				return
+			}
+		}
+	}()
+
 	go func() {
 		logger.Info.Printf("Searcher starting")
 		<-closer
 		close(workChannel)
 		_ = subscription.Unsubscribe()
+		_ = pingSubscription.Unsubscribe()
+		close(stopExpiry)
+		snapshots.close()
 		logger.Info.Printf("Searcher exiting")
 		closer <- true
 	}()
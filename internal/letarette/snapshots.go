@@ -0,0 +1,172 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/erkkah/letarette/pkg/logger"
+)
+
+/*
+	Search snapshots.
+
+	A snapshot is a point-in-time view of the index, used to page through
+	search results without inserts and updates between pages shifting them.
+
+	In WAL mode, a read transaction sees the database as it was when the
+	transaction made its first read, until the transaction ends.
+	Each snapshot is such a read transaction, pinned to its own connection
+	and kept open between searches.
+
+	Snapshots are identified by tokens prefixed by the index ID. Requests
+	from sharded clients carry a comma separated list of tokens, one for
+	each shard, and each worker picks its own token from the list.
+
+	Lifetime and cleanup:
+	A snapshot is released by a search requesting its release, when it
+	has not been used for the configured snapshot timeout, or when the
+	searcher is closed.
+	While a snapshot is open, WAL checkpoints can not proceed past it,
+	so the WAL file grows with all index updates made during its lifetime.
+	The number of open snapshots is capped, requests for new snapshots
+	beyond the cap are served from the live index without a snapshot.
+*/
+
+type searchSnapshot struct {
+	tx       *sqlx.Tx
+	lastUsed time.Time
+}
+
+type searchSnapshots struct {
+	sync.Mutex
+	db      *database
+	indexID string
+	timeout time.Duration
+	max     int
+	serial  uint64
+	pinned  map[string]*searchSnapshot
+}
+
+func newSearchSnapshots(db *database, indexID string, timeout time.Duration, max int) *searchSnapshots {
+	return &searchSnapshots{
+		db:      db,
+		indexID: indexID,
+		timeout: timeout,
+		max:     max,
+		pinned:  map[string]*searchSnapshot{},
+	}
+}
+
+// pin opens a new snapshot, returning its token and the transaction
+// to read it through. Returns an empty token when the cap is reached.
+func (s *searchSnapshots) pin(ctx context.Context) (string, *sqlx.Tx, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.pinned) >= s.max {
+		return "", nil, nil
+	}
+
+	// Not bound to the request context, the transaction
+	// outlives the request.
+	tx, err := s.db.rdb.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The snapshot is taken at the first read
+	var spaces int
+	err = tx.GetContext(ctx, &spaces, "select count(*) from spaces")
+	if err != nil {
+		_ = tx.Rollback()
+		return "", nil, fmt.Errorf("failed to start snapshot: %w", err)
+	}
+
+	s.serial++
+	token := fmt.Sprintf("%s:%d", s.indexID, s.serial)
+	s.pinned[token] = &searchSnapshot{
+		tx:       tx,
+		lastUsed: time.Now(),
+	}
+	return token, tx, nil
+}
+
+// get finds this worker's snapshot in a list of tokens, returning
+// the token and the transaction to read the snapshot through.
+func (s *searchSnapshots) get(tokens string) (string, *sqlx.Tx, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, token := range strings.Split(tokens, ",") {
+		if !strings.HasPrefix(token, s.indexID+":") {
+			continue
+		}
+		snapshot, found := s.pinned[token]
+		if !found {
+			return "", nil, false
+		}
+		snapshot.lastUsed = time.Now()
+		return token, snapshot.tx, true
+	}
+	return "", nil, false
+}
+
+// release releases this worker's snapshot in a list of tokens
+func (s *searchSnapshots) release(tokens string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, token := range strings.Split(tokens, ",") {
+		if snapshot, found := s.pinned[token]; found {
+			logger.Debug.Printf("Releasing search snapshot %v", token)
+			_ = snapshot.tx.Rollback()
+			delete(s.pinned, token)
+			return
+		}
+	}
+}
+
+// expire releases all snapshots that have not been used for the timeout
+func (s *searchSnapshots) expire() {
+	s.Lock()
+	defer s.Unlock()
+
+	for token, snapshot := range s.pinned {
+		if time.Since(snapshot.lastUsed) < s.timeout {
+			continue
+		}
+		logger.Debug.Printf("Releasing expired search snapshot %v", token)
+		_ = snapshot.tx.Rollback()
+		delete(s.pinned, token)
+	}
+}
+
+// close releases all snapshots
+func (s *searchSnapshots) close() {
+	s.Lock()
+	defer s.Unlock()
+
+	for token, snapshot := range s.pinned {
+		_ = snapshot.tx.Rollback()
+		delete(s.pinned, token)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+/*
+
+Space add-ons
+
+Migrations change the schema of the whole index. Features enabled per
+space by config, like phonetic codes, instead use space add-ons: schema
+changes applied to each space with the feature enabled, like extra
+columns, shadow tables or index rows.
+
+Each add-on has a list of steps, each upgrading a space by one version.
+The version of each add-on applied to a space is recorded in the
+"spaceaddons" table. When opening the index, workers apply the missing
+steps of the add-ons enabled for their spaces, and remove add-ons no
+longer enabled. Each add-on of a space is upgraded or removed in its own
+transaction.
+
+Upgrade path: add a step to the end of the steps of an add-on, never
+change released steps. Workers with the new version upgrade the add-on in
+their spaces when started. Workers of an older version refuse to open an
+index with add-on versions they do not know, like for migrations.
+"lrcli index verify" reports spaces differing from the config, which
+are brought in line by starting a worker with the config.
+
+Reload shadow spaces get the add-ons of the reloaded space.
+
+*/
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/erkkah/letarette/pkg/logger"
+)
+
+// spaceAddonStep changes the schema of the space with the given ID
+type spaceAddonStep func(ctx context.Context, tx *sqlx.Tx, spaceID int) error
+
+// spaceAddon is a schema add-on applied to spaces, see above
+type spaceAddon struct {
+	name string
+	// Reports if the add-on is enabled for a space
+	enabled func(cfg Config, space string) bool
+	// Version n is applied by running the first n steps
+	steps []spaceAddonStep
+	// Removes the add-on from a space, at any version
+	remove spaceAddonStep
+}
+
+func (a spaceAddon) version() int {
+	return len(a.steps)
+}
+
+// spaceAddons are all known add-ons
+var spaceAddons = []spaceAddon{
+	{
+		name: "phonetic",
+		enabled: func(cfg Config, space string) bool {
+			for _, phonetic := range cfg.Index.Phonetic {
+				if phonetic == space {
+					return true
+				}
+			}
+			return false
+		},
+		steps: []spaceAddonStep{
+			// Codes are stored in the shared "ftsp" index, see migration 18
+			func(ctx context.Context, tx *sqlx.Tx, spaceID int) error {
+				_, err := tx.ExecContext(ctx, "update spaces set phonetic = true where spaceID = ?", spaceID)
+				return err
+			},
+		},
+		remove: func(ctx context.Context, tx *sqlx.Tx, spaceID int) error {
+			_, err := tx.ExecContext(ctx, `
+			delete from ftsp where rowid in (
+				select id from docs where spaceID = ?
+			)`, spaceID)
+			if err != nil {
+				return fmt.Errorf("failed to remove phonetic codes: %w", err)
+			}
+			_, err = tx.ExecContext(ctx, "update spaces set phonetic = false where spaceID = ?", spaceID)
+			return err
+		},
+	},
+	{
+		name: "exactcase",
+		enabled: func(cfg Config, space string) bool {
+			for _, exactCase := range cfg.Index.ExactCase {
+				if exactCase == space {
+					return true
+				}
+			}
+			return false
+		},
+		steps: []spaceAddonStep{
+			// Words are stored in the shared "ftse" index, see migration 23
+			func(ctx context.Context, tx *sqlx.Tx, spaceID int) error {
+				_, err := tx.ExecContext(ctx, "update spaces set exactCase = true where spaceID = ?", spaceID)
+				return err
+			},
+		},
+		remove: func(ctx context.Context, tx *sqlx.Tx, spaceID int) error {
+			_, err := tx.ExecContext(ctx, `
+			delete from ftse where rowid in (
+				select id from docs where spaceID = ?
+			)`, spaceID)
+			if err != nil {
+				return fmt.Errorf("failed to remove exact case words: %w", err)
+			}
+			_, err = tx.ExecContext(ctx, "update spaces set exactCase = false where spaceID = ?", spaceID)
+			return err
+		},
+	},
+}
+
+func findSpaceAddon(name string) (spaceAddon, bool) {
+	for _, addon := range spaceAddons {
+		if addon.name == name {
+			return addon, true
+		}
+	}
+	return spaceAddon{}, false
+}
+
+// getSpaceAddonVersions reads the add-on versions applied to a space, by add-on
+func getSpaceAddonVersions(ctx context.Context, q sqlx.QueryerContext, spaceID int) (map[string]int, error) {
+	var applied []struct {
+		Addon   string
+		Version int
+	}
+	err := sqlx.SelectContext(ctx, q, &applied, `select addon, version from spaceaddons where spaceID = ?`, spaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get space add-ons: %w", err)
+	}
+	versions := map[string]int{}
+	for _, addon := range applied {
+		versions[addon.Addon] = addon.Version
+	}
+	return versions, nil
+}
+
+// applySpaceAddons upgrades the add-ons enabled for each configured space
+// to their latest version, and removes add-ons no longer enabled.
+// Add-ons unknown to this version, or applied at a later version, fail
+// the upgrade.
+func applySpaceAddons(ctx context.Context, db *sqlx.DB, cfg Config) error {
+	for _, space := range cfg.Index.Spaces {
+		var spaceID int
+		err := db.GetContext(ctx, &spaceID, `select spaceID from spaces where space = ?`, space)
+		if err != nil {
+			return fmt.Errorf("failed to get space ID: %w", err)
+		}
+		versions, err := getSpaceAddonVersions(ctx, db, spaceID)
+		if err != nil {
+			return err
+		}
+		for name, version := range versions {
+			addon, known := findSpaceAddon(name)
+			if !known || version > addon.version() {
+				return fmt.Errorf("space %q has unsupported add-on %q at version %d", space, name, version)
+			}
+		}
+
+		for _, addon := range spaceAddons {
+			version := versions[addon.name]
+			enabled := addon.enabled(cfg, space)
+			switch {
+			case enabled && version < addon.version():
+				err = upgradeSpaceAddon(ctx, db, spaceID, addon, version)
+				if err != nil {
+					return fmt.Errorf("failed to apply add-on %q to space %q: %w", addon.name, space, err)
+				}
+				logger.Info.Printf("Applied add-on %q version %d to space %q", addon.name, addon.version(), space)
+			case !enabled && version > 0:
+				err = removeSpaceAddon(ctx, db, spaceID, addon)
+				if err != nil {
+					return fmt.Errorf("failed to remove add-on %q from space %q: %w", addon.name, space, err)
+				}
+				logger.Info.Printf("Removed add-on %q from space %q", addon.name, space)
+			}
+		}
+	}
+	return nil
+}
+
+// upgradeSpaceAddon runs the steps of an add-on after the given version
+func upgradeSpaceAddon(ctx context.Context, db *sqlx.DB, spaceID int, addon spaceAddon, version int) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = runSpaceAddonSteps(ctx, tx, spaceID, addon, version)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		tx = nil
+	}
+	return err
+}
+
+// runSpaceAddonSteps runs the steps of an add-on after the given version
+// in a transaction, and records the latest version as applied
+func runSpaceAddonSteps(ctx context.Context, tx *sqlx.Tx, spaceID int, addon spaceAddon, version int) error {
+	for _, step := range addon.steps[version:] {
+		err := step(ctx, tx, spaceID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, `
+		insert into spaceaddons (spaceID, addon, version, appliedNanos) values (?, ?, ?, ?)
+		on conflict (spaceID, addon) do update set version = excluded.version, appliedNanos = excluded.appliedNanos
+		`, spaceID, addon.name, addon.version(), time.Now().UnixNano())
+	return err
+}
+
+func removeSpaceAddon(ctx context.Context, db *sqlx.DB, spaceID int, addon spaceAddon) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = addon.remove(ctx, tx, spaceID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `delete from spaceaddons where spaceID = ? and addon = ?`, spaceID, addon.name)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		tx = nil
+	}
+	return err
+}
+
+// copySpaceAddons applies the add-ons of a space to another space,
+// at the same versions, in a transaction
+func copySpaceAddons(ctx context.Context, tx *sqlx.Tx, fromSpaceID int, toSpaceID int) error {
+	versions, err := getSpaceAddonVersions(ctx, tx, fromSpaceID)
+	if err != nil {
+		return err
+	}
+	for _, addon := range spaceAddons {
+		version := versions[addon.name]
+		if version == 0 {
+			continue
+		}
+		limited := addon
+		limited.steps = addon.steps[:version]
+		err = runSpaceAddonSteps(ctx, tx, toSpaceID, limited, 0)
+		if err != nil {
+			return fmt.Errorf("failed to apply add-on %q: %w", addon.name, err)
+		}
+	}
+	return nil
+}
+
+// removeSpaceAddons removes all add-ons of a space, in a transaction
+func removeSpaceAddons(ctx context.Context, tx *sqlx.Tx, spaceID int) error {
+	versions, err := getSpaceAddonVersions(ctx, tx, spaceID)
+	if err != nil {
+		return err
+	}
+	for _, addon := range spaceAddons {
+		if versions[addon.name] == 0 {
+			continue
+		}
+		err = addon.remove(ctx, tx, spaceID)
+		if err != nil {
+			return fmt.Errorf("failed to remove add-on %q: %w", addon.name, err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, `delete from spaceaddons where spaceID = ?`, spaceID)
+	return err
+}
+
+// SpaceAddonDrift is a difference between the add-ons applied to a
+// space and the add-ons enabled for it by the config
+type SpaceAddonDrift struct {
+	Space string
+	Addon string
+	// Applied version, zero when not applied
+	Applied int
+	// Version required by the config, zero when not enabled
+	Required int
+	// Set for add-ons unknown to this version
+	Unknown bool
+}
+
+func (d SpaceAddonDrift) String() string {
+	switch {
+	case d.Unknown:
+		return fmt.Sprintf("space %q has unknown add-on %q at version %d", d.Space, d.Addon, d.Applied)
+	case d.Applied == 0:
+		return fmt.Sprintf("space %q is missing add-on %q", d.Space, d.Addon)
+	case d.Required == 0:
+		return fmt.Sprintf("space %q has add-on %q, which is not enabled", d.Space, d.Addon)
+	case d.Applied < d.Required:
+		return fmt.Sprintf(
+			"space %q has add-on %q at version %d, expected %d", d.Space, d.Addon, d.Applied, d.Required,
+		)
+	default:
+		return fmt.Sprintf(
+			"space %q has add-on %q at version %d, newer than supported %d",
+			d.Space, d.Addon, d.Applied, d.Required,
+		)
+	}
+}
+
+// CheckSpaceAddons compares the add-ons applied to the configured spaces
+// with the add-ons enabled by the config, returning the differences.
+// Spaces not yet in the index are missing all their enabled add-ons.
+func CheckSpaceAddons(ctx context.Context, dbo Database, cfg Config) ([]SpaceAddonDrift, error) {
+	db := dbo.(*database)
+
+	var drift []SpaceAddonDrift
+	for _, space := range cfg.Index.Spaces {
+		var spaceIDs []int
+		err := db.rdb.SelectContext(ctx, &spaceIDs, `select spaceID from spaces where space = ?`, space)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get space ID: %w", err)
+		}
+		versions := map[string]int{}
+		if len(spaceIDs) > 0 {
+			versions, err = getSpaceAddonVersions(ctx, db.rdb, spaceIDs[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, addon := range spaceAddons {
+			required := 0
+			if addon.enabled(cfg, space) {
+				required = addon.version()
+			}
+			applied := versions[addon.name]
+			delete(versions, addon.name)
+			if applied != required {
+				drift = append(drift, SpaceAddonDrift{
+					Space: space, Addon: addon.name, Applied: applied, Required: required,
+				})
+			}
+		}
+		var unknown []string
+		for name := range versions {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		for _, name := range unknown {
+			drift = append(drift, SpaceAddonDrift{Space: space, Addon: name, Applied: versions[name], Unknown: true})
+		}
+	}
+	return drift, nil
+}
@@ -20,6 +20,7 @@ matches as (
         rowid,
         firstmatch(fts, 0) as matchColumn,
         firstmatch(fts, 1) as matchOffset,
+        firstmatch(fts, 2) as matchLength,
         tokens(fts, firstmatch(fts, 0)) as numTokens,
         rank as r
     from
@@ -33,34 +34,59 @@ stats as (
 )
 select
     space, r as rank, cnt as total, joined.docID as id,
-    substr("…", 1, (matchOffset > 1)) ||
-    replace(
-        gettokens(fts,
-            case matchColumn
-                when 0 then docs.title
-                when 1 then uncompress(docs.txt)
-            end,
-            max(matchOffset-1, 0), 10),
-        X'0A', " "
-    )
-    || substr("…", 1, (numTokens > 10))
-    as snippet
+    -- Snippets are only generated for the first :snippets hits of the page
+    case when pos <= :snippets then
+        substr("…", 1, (matchOffset > :snippetBefore)) ||
+        replace(
+            gettokens(fts,
+                case matchColumn
+                    when 0 then docs.title
+                    when 1 then uncompress(docs.txt)
+                end,
+                max(matchOffset-:snippetBefore, 0), :snippetLength,
+                :snippetOpen, :snippetClose, matchOffset, matchLength),
+            X'0A', " "
+        )
+        || substr("…", 1, (numTokens > max(matchOffset-:snippetBefore, 0)+:snippetLength))
+    else '' end
+    as snippet,
+    docs.source,
+    docs.language
 from (
-    select
-        space, matchColumn, matchOffset, numTokens, r, stats.cnt, docs.docID, docs.id
-    from
-        matches
-        left join docs on docs.id = matches.rowid
-        cross join stats
-        join spaces using(spaceID)
-    where
-        space in (?)
-        and docs.alive
-    order by r asc
-    limit :limit
-    offset :offset
+    -- Number the hits of the page
+    select *, row_number() over (order by r asc, case when :tiebreak then space end, case when :tiebreak then docID end, id asc) as pos from (
+        select
+            space, matchColumn, matchOffset, matchLength, numTokens, stats.cnt, docs.docID, docs.id,
+            matches.r * ifnull((
+                -- Apply the strongest matching demotion
+                select min(json_extract(demotion.value, '$.Factor'))
+                from json_each(:demotions) as demotion
+                join docvalues on
+                    docvalues.spaceID = docs.spaceID
+                    and docvalues.docID = docs.docID
+                    and docvalues.field = json_extract(demotion.value, '$.Field')
+                    and docvalues.value = json_extract(demotion.value, '$.Value')
+            ), 1)
+            * decay(docs.updatedNanos, :decayHalfLife, :now)
+            * case when :boost then docs.boost else 1 end
+            * positionboost(matchOffset, :positionWeight, :positionCutoff) as r
+        from
+            matches
+            left join docs on docs.id = matches.rowid
+            cross join stats
+            join spaces using(spaceID)
+        where
+            space in (:spaces)
+            and docs.alive
+            and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+        -- Hits with equal rank are ordered by document ID, see Config.Search.Tiebreaker
+        order by r asc, case when :tiebreak then space end, case when :tiebreak then docs.docID end
+        limit :limit
+        offset :offset
+    )
 ) joined
 -- re-joining on docs here is faster than pulling text and title into "joined" above
 left join docs using(id)
 -- Join in fts to get an fts handle to run "gettokens" on
 left join fts on fts.rowid = (select id from docs limit 1)
+order by pos
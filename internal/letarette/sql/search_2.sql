@@ -20,6 +20,7 @@ matches as (
         rowid,
         firstmatch(fts, 0) as matchColumn,
         firstmatch(fts, 1) as matchOffset,
+        firstmatch(fts, 2) as matchLength,
         tokens(fts, firstmatch(fts, 0)) as numTokens,
         rank as r
     from
@@ -30,29 +31,64 @@ matches as (
 ),
 stats as (
     select count(*) as cnt from matches
+),
+page as (
+    select
+        spaces.space, docs.id as docRow, docs.docID, stats.cnt as total,
+        matchColumn, matchOffset, matchLength, numTokens,
+        matches.r * ifnull((
+            -- Apply the strongest matching demotion
+            select min(json_extract(demotion.value, '$.Factor'))
+            from json_each(:demotions) as demotion
+            join docvalues on
+                docvalues.spaceID = docs.spaceID
+                and docvalues.docID = docs.docID
+                and docvalues.field = json_extract(demotion.value, '$.Field')
+                and docvalues.value = json_extract(demotion.value, '$.Value')
+        ), 1)
+            * decay(docs.updatedNanos, :decayHalfLife, :now)
+            * case when :boost then docs.boost else 1 end
+            * positionboost(matchOffset, :positionWeight, :positionCutoff) as r,
+        docs.source, docs.language
+    from
+        matches
+        join docs on docs.id = matches.rowid
+        left join spaces using (spaceID)
+        cross join stats
+    where
+        docs.alive
+        and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+        and space in (:spaces)
+    -- Hits with equal rank are ordered by document ID, see Config.Search.Tiebreaker
+    order by r asc, case when :tiebreak then spaces.space end, case when :tiebreak then docs.docID end
+    limit :limit offset :offset
+),
+numbered as (
+    -- Number the hits of the page
+    select *, row_number() over (order by r asc, case when :tiebreak then space end, case when :tiebreak then docID end, docRow asc) as pos from page
 )
 select
-    spaces.space, docs.docID as id, matches.r as rank, stats.cnt as total,
-    substr("…", 1, (matchOffset > 1)) ||
-    replace(
-        gettokens(fts,
-            case matchColumn
-                when 0 then docs.title
-                when 1 then uncompress(docs.txt)
-            end,
-            max(matchOffset-1, 0), 10),
-        X'0A', " "
-    )
-    || substr("…", 1, (numTokens > 10))
-    as snippet
+    space, numbered.docID as id, total, r as rank,
+    -- Snippets are only generated for the first :snippets hits of the page
+    case when pos <= :snippets then
+        substr("…", 1, (matchOffset > :snippetBefore)) ||
+        replace(
+            gettokens(fts,
+                case matchColumn
+                    when 0 then docs.title
+                    when 1 then uncompress(docs.txt)
+                end,
+                max(matchOffset-:snippetBefore, 0), :snippetLength,
+                :snippetOpen, :snippetClose, matchOffset, matchLength),
+            X'0A', " "
+        )
+        || substr("…", 1, (numTokens > max(matchOffset-:snippetBefore, 0)+:snippetLength))
+    else '' end
+    as snippet,
+    numbered.source,
+    numbered.language
 from
-    matches
-    join docs on docs.id = matches.rowid
+    numbered
+    join docs on docs.id = numbered.docRow
     left join fts on fts.rowid = (select id from docs limit 1)
-    left join spaces using (spaceID)
-    cross join stats
-where
-    docs.alive
-    and space in (?)
-order by matches.r asc
-limit :limit offset :offset
+order by pos
@@ -19,6 +19,8 @@ with
 matches as (
     select
         rowid,
+        -- Match positions are only needed for position boosts
+        case when :positionWeight > 0 then firstmatch(fts, 1) else 0 end as matchOffset,
         rank as r
     from
         fts
@@ -31,19 +33,35 @@ stats as (
 )
 select
     space,
-    r as rank,
+    r * ifnull((
+        -- Apply the strongest matching demotion
+        select min(json_extract(demotion.value, '$.Factor'))
+        from json_each(:demotions) as demotion
+        join docvalues on
+            docvalues.spaceID = docs.spaceID
+            and docvalues.docID = docs.docID
+            and docvalues.field = json_extract(demotion.value, '$.Field')
+            and docvalues.value = json_extract(demotion.value, '$.Value')
+    ), 1)
+        * decay(docs.updatedNanos, :decayHalfLife, :now)
+        * case when :boost then docs.boost else 1 end
+        * positionboost(matchOffset, :positionWeight, :positionCutoff) as rank,
     stats.cnt as total,
     docs.docID as id,
-    docs.title as snippet
+    docs.title as snippet,
+    docs.source,
+    docs.language
 from
     matches
     left join docs on docs.id = matches.rowid
     cross join stats
     join spaces using(spaceID)
 where
-    space in (?)
+    space in (:spaces)
     and docs.alive
-order by r asc
+    and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+-- Hits with equal rank are ordered by document ID, see Config.Search.Tiebreaker
+order by rank asc, case when :tiebreak then space end, case when :tiebreak then docs.docID end
 limit :limit
 offset :offset
 
@@ -0,0 +1,122 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Search keeping only the best ranked hit of each group of documents
+-- sharing a value of the collapse field. Documents without a value are
+-- groups of their own. Groups are ranked and paged by their best hit.
+
+with
+matches as (
+    select
+        rowid,
+        firstmatch(fts, 0) as matchColumn,
+        firstmatch(fts, 1) as matchOffset,
+        firstmatch(fts, 2) as matchLength,
+        tokens(fts, firstmatch(fts, 0)) as numTokens,
+        rank as r
+    from
+        fts
+    where
+        fts match :match
+    limit :cap
+),
+ranked as (
+    select
+        space, matchColumn, matchOffset, matchLength, numTokens, docs.docID, docs.id,
+        matches.r * ifnull((
+            -- Apply the strongest matching demotion
+            select min(json_extract(demotion.value, '$.Factor'))
+            from json_each(:demotions) as demotion
+            join docvalues on
+                docvalues.spaceID = docs.spaceID
+                and docvalues.docID = docs.docID
+                and docvalues.field = json_extract(demotion.value, '$.Field')
+                and docvalues.value = json_extract(demotion.value, '$.Value')
+        ), 1)
+        * decay(docs.updatedNanos, :decayHalfLife, :now)
+        * case when :boost then docs.boost else 1 end
+        * positionboost(matchOffset, :positionWeight, :positionCutoff) as r,
+        (
+            select min(value) from docvalues
+            where
+                docvalues.spaceID = docs.spaceID
+                and docvalues.docID = docs.docID
+                and docvalues.field = :collapseField
+                and docvalues.value != ''
+        ) as groupValue
+    from
+        matches
+        join docs on docs.id = matches.rowid
+        join spaces using(spaceID)
+    where
+        space in (:spaces)
+        and docs.alive
+        and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+),
+grouped as (
+    select
+        *,
+        row_number() over win as groupRank,
+        count(*) over (partition by ifnull(groupValue, id)) as groupCount
+    from ranked
+    window win as (partition by ifnull(groupValue, id) order by r asc, case when :tiebreak then space end, case when :tiebreak then docID end, id asc)
+),
+representatives as (
+    select * from grouped where groupRank = 1
+),
+stats as (
+    select
+        (select count(*) from representatives) as cnt,
+        (select count(*) from matches) as matchCount
+)
+select
+    space, r as rank, cnt as total, matchCount as matches, joined.docID as id,
+    -- Snippets are only generated for the first :snippets hits of the page
+    case when pos <= :snippets then
+        substr("…", 1, (matchOffset > :snippetBefore)) ||
+        replace(
+            gettokens(fts,
+                case matchColumn
+                    when 0 then docs.title
+                    when 1 then uncompress(docs.txt)
+                end,
+                max(matchOffset-:snippetBefore, 0), :snippetLength,
+                :snippetOpen, :snippetClose, matchOffset, matchLength),
+            X'0A', " "
+        )
+        || substr("…", 1, (numTokens > max(matchOffset-:snippetBefore, 0)+:snippetLength))
+    else '' end
+    as snippet,
+    docs.source,
+    docs.language,
+    ifnull(groupValue, '') as collapsevalue,
+    groupCount as collapsecount
+from (
+    -- Number the hits of the page
+    select *, row_number() over (order by r asc, case when :tiebreak then space end, case when :tiebreak then docID end, id asc) as pos from (
+        select *
+        from
+            representatives
+            cross join stats
+        -- Hits with equal rank are ordered by document ID, see Config.Search.Tiebreaker
+        order by r asc, case when :tiebreak then space end, case when :tiebreak then docID end, id asc
+        limit :limit
+        offset :offset
+    )
+) joined
+-- re-joining on docs here is faster than pulling text and title into "joined" above
+left join docs using(id)
+-- Join in fts to get an fts handle to run "gettokens" on
+left join fts on fts.rowid = (select id from docs limit 1)
+order by pos
@@ -0,0 +1,99 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Collapsing search in contentless spaces, see search_collapse.sql.
+-- There is no stored content, so no snippets are produced.
+
+with
+matches as (
+    select
+        rowid,
+        -- Match positions are only needed for position boosts
+        case when :positionWeight > 0 then firstmatch(ftsc, 1) else 0 end as matchOffset,
+        rank as r
+    from
+        ftsc
+    where
+        ftsc match :match
+        -- Replaced and evicted documents leave their rows in the index
+        and exists (select 1 from docs where docs.id = ftsc.rowid and docs.alive)
+    limit :cap
+),
+ranked as (
+    select
+        space, docs.docID, docs.id, docs.source, docs.language,
+        matches.r * ifnull((
+            -- Apply the strongest matching demotion
+            select min(json_extract(demotion.value, '$.Factor'))
+            from json_each(:demotions) as demotion
+            join docvalues on
+                docvalues.spaceID = docs.spaceID
+                and docvalues.docID = docs.docID
+                and docvalues.field = json_extract(demotion.value, '$.Field')
+                and docvalues.value = json_extract(demotion.value, '$.Value')
+        ), 1)
+        * decay(docs.updatedNanos, :decayHalfLife, :now)
+        * case when :boost then docs.boost else 1 end
+        * positionboost(matchOffset, :positionWeight, :positionCutoff) as r,
+        (
+            select min(value) from docvalues
+            where
+                docvalues.spaceID = docs.spaceID
+                and docvalues.docID = docs.docID
+                and docvalues.field = :collapseField
+                and docvalues.value != ''
+        ) as groupValue
+    from
+        matches
+        join docs on docs.id = matches.rowid
+        join spaces using(spaceID)
+    where
+        space in (:spaces)
+        and docs.alive
+        and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+),
+grouped as (
+    select
+        *,
+        row_number() over win as groupRank,
+        count(*) over (partition by ifnull(groupValue, id)) as groupCount
+    from ranked
+    window win as (partition by ifnull(groupValue, id) order by r asc, case when :tiebreak then space end, case when :tiebreak then docID end, id asc)
+),
+representatives as (
+    select * from grouped where groupRank = 1
+),
+stats as (
+    select
+        (select count(*) from representatives) as cnt,
+        (select count(*) from matches) as matchCount
+)
+select
+    space,
+    r as rank,
+    stats.cnt as total,
+    stats.matchCount as matches,
+    docID as id,
+    '' as snippet,
+    source,
+    language,
+    ifnull(groupValue, '') as collapsevalue,
+    groupCount as collapsecount
+from
+    representatives
+    cross join stats
+-- Hits with equal rank are ordered by document ID, see Config.Search.Tiebreaker
+order by r asc, case when :tiebreak then space end, case when :tiebreak then docID end, id asc
+limit :limit
+offset :offset
@@ -0,0 +1,67 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Search the case encoded words of documents in exact case spaces.
+-- Positions in the words do not map to the text, the title is used
+-- as snippet.
+
+with
+matches as (
+    select
+        rowid,
+        -- Match positions are only needed for position boosts
+        case when :positionWeight > 0 then firstmatch(ftse, 1) else 0 end as matchOffset,
+        rank as r
+    from
+        ftse
+    where
+        ftse match :match
+    limit :cap
+),
+stats as (
+    select count(*) as cnt from matches
+)
+select
+    space,
+    r * ifnull((
+        -- Apply the strongest matching demotion
+        select min(json_extract(demotion.value, '$.Factor'))
+        from json_each(:demotions) as demotion
+        join docvalues on
+            docvalues.spaceID = docs.spaceID
+            and docvalues.docID = docs.docID
+            and docvalues.field = json_extract(demotion.value, '$.Field')
+            and docvalues.value = json_extract(demotion.value, '$.Value')
+    ), 1)
+        * decay(docs.updatedNanos, :decayHalfLife, :now)
+        * case when :boost then docs.boost else 1 end
+        * positionboost(matchOffset, :positionWeight, :positionCutoff) as rank,
+    stats.cnt as total,
+    docs.docID as id,
+    docs.title as snippet,
+    docs.source,
+    docs.language
+from
+    matches
+    join docs on docs.id = matches.rowid
+    cross join stats
+    join spaces using(spaceID)
+where
+    space in (:spaces)
+    and docs.alive
+    and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+-- Hits with equal rank are ordered by document ID, see Config.Search.Tiebreaker
+order by rank asc, case when :tiebreak then space end, case when :tiebreak then docs.docID end
+limit :limit
+offset :offset
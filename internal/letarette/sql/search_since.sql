@@ -0,0 +1,82 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Search for documents indexed after a since-token position,
+-- most recently updated first. The rank of each hit is its age in seconds.
+-- Replaced documents get new positions, so "rowid > :since" finds
+-- both new and updated documents.
+
+with
+matches as (
+    select
+        rowid,
+        firstmatch(fts, 0) as matchColumn,
+        firstmatch(fts, 1) as matchOffset,
+        firstmatch(fts, 2) as matchLength,
+        tokens(fts, firstmatch(fts, 0)) as numTokens
+    from
+        fts
+    where
+        fts match :match
+        and rowid > :since
+    limit :cap
+),
+hits as (
+    select
+        space, matchColumn, matchOffset, matchLength, numTokens, docs.docID, docs.id, docs.updatedNanos
+    from
+        matches
+        join docs on docs.id = matches.rowid
+        join spaces using(spaceID)
+    where
+        space in (:spaces)
+        and docs.alive
+        and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+),
+stats as (
+    select count(*) as cnt from hits
+)
+select
+    space, (:now - joined.updatedNanos) / 1e9 as rank, cnt as total, joined.docID as id,
+    -- Snippets are only generated for the first :snippets hits of the page
+    case when pos <= :snippets then
+        substr("…", 1, (matchOffset > :snippetBefore)) ||
+        replace(
+            gettokens(fts,
+                case matchColumn
+                    when 0 then docs.title
+                    when 1 then uncompress(docs.txt)
+                end,
+                max(matchOffset-:snippetBefore, 0), :snippetLength,
+                :snippetOpen, :snippetClose, matchOffset, matchLength),
+            X'0A', " "
+        )
+        || substr("…", 1, (numTokens > max(matchOffset-:snippetBefore, 0)+:snippetLength))
+    else '' end
+    as snippet,
+    docs.source,
+    docs.language
+from (
+    -- Number the hits of the page
+    select *, row_number() over (order by updatedNanos desc, id desc) as pos from (
+        select * from hits cross join stats
+        order by updatedNanos desc, id desc
+        limit :limit
+        offset :offset
+    )
+) joined
+left join docs using(id)
+-- Join in fts to get an fts handle to run "gettokens" on
+left join fts on fts.rowid = (select id from docs limit 1)
+order by pos
@@ -0,0 +1,59 @@
+-- Copyright 2020 Erik Agsjö
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Search for documents indexed after a since-token position in
+-- contentless spaces. See search_since.sql.
+
+with
+matches as (
+    select
+        rowid
+    from
+        ftsc
+    where
+        ftsc match :match
+        and rowid > :since
+        -- Replaced and evicted documents leave their rows in the index
+        and exists (select 1 from docs where docs.id = ftsc.rowid and docs.alive)
+    limit :cap
+),
+hits as (
+    select
+        space, docs.docID, docs.id, docs.updatedNanos, docs.source, docs.language
+    from
+        matches
+        join docs on docs.id = matches.rowid
+        join spaces using(spaceID)
+    where
+        space in (:spaces)
+        and docs.alive
+        and (json_array_length(:languages) = 0 or docs.language in (select value from json_each(:languages)))
+),
+stats as (
+    select count(*) as cnt from hits
+)
+select
+    space,
+    (:now - updatedNanos) / 1e9 as rank,
+    stats.cnt as total,
+    docID as id,
+    '' as snippet,
+    source,
+    language
+from
+    hits
+    cross join stats
+order by hits.updatedNanos desc, hits.id desc
+limit :limit
+offset :offset
@@ -97,6 +97,55 @@ func StartStatusMonitor(nc *nats.Conn, db Database, cfg Config) (StatusMonitor,
 		return nil, err
 	}
 
+	stemmerSub, err := ec.QueueSubscribe(
+		cfg.Nats.Topic+".stemmer.request", cfg.Shard,
+		func(sub, reply string, req *protocol.StemmerStateRequest) {
+			state, updated, err := privateDB.getStemmerState()
+			if err != nil {
+				logger.Error.Printf("Failed to get stemmer state: %v", err)
+				return
+			}
+			response := protocol.StemmerState{
+				RequestID:           req.RequestID,
+				IndexID:             indexID,
+				Shard:               cfg.Shard,
+				Stemmers:            state.Stemmers,
+				RemoveDiacritics:    state.RemoveDiacritics,
+				TokenCharacters:     state.TokenCharacters,
+				Separators:          state.Separators,
+				MaxTokenLength:      state.MaxTokenLength,
+				TruncateLongTokens:  state.TruncateLongTokens,
+				InvisibleCharacters: state.InvisibleCharacters,
+				StopWords:           state.StopWords,
+				Updated:             updated,
+			}
+			err = ec.Publish(reply, &response)
+			if err != nil {
+				logger.Error.Printf("Failed to publish stemmer state: %v", err)
+			}
+		})
+	if err != nil {
+		_ = sub.Unsubscribe()
+		return nil, err
+	}
+
+	spaceControlSub, err := ec.Subscribe(cfg.Nats.Topic+".space.control", func(control *protocol.SpaceControl) {
+		err := privateDB.setSpaceControl(ctx, *control)
+		if err != nil {
+			logger.Error.Printf("Failed to set space control: %v", err)
+			return
+		}
+		logger.Info.Printf(
+			"Space %q search disabled: %v, index paused: %v",
+			control.Space, control.SearchDisabled, control.IndexPaused,
+		)
+	})
+	if err != nil {
+		_ = sub.Unsubscribe()
+		_ = stemmerSub.Unsubscribe()
+		return nil, err
+	}
+
 	self.starting.Add(1)
 	started := false
 
@@ -109,6 +158,8 @@ func StartStatusMonitor(nc *nats.Conn, db Database, cfg Config) (StatusMonitor,
 				self.workerPingtime[status.IndexID] = time.Now()
 			case <-self.ctx.Done():
 				_ = sub.Unsubscribe()
+				_ = stemmerSub.Unsubscribe()
+				_ = spaceControlSub.Unsubscribe()
 				return
 			case <-checkpoint:
 				self.checkpoint()
@@ -190,6 +241,10 @@ func (m *monitor) checkpoint() {
 		}
 	}
 
+	if !m.db.checkSchemaReady(m.ctx) {
+		setStatus(protocol.IndexStatusInitializing)
+	}
+
 	for _, v := range m.workerStatus {
 		if m.workerPingtime[v.IndexID].After(staleTime) {
 			if v.ShardgroupSize != m.cfg.ShardgroupSize {
@@ -270,6 +325,16 @@ func (m *monitor) checkpoint() {
 
 	status.LastUpdate = lastUpdate
 	status.Status = m.statusCode
+	status.UpdateQueue = int(metrics.UpdateQueue.Value())
+	status.UpdateQueueBlocked = metrics.UpdateQueueBlocked.Value()
+	status.WALFrames, status.CheckpointedFrames = m.db.getCheckpointStats()
+
+	searchDisabled, indexPaused, err := m.db.getSpaceControls(m.ctx)
+	if err != nil {
+		logger.Error.Printf("Failed to get space controls: %v", err)
+	}
+	status.SearchDisabledSpaces = searchDisabled
+	status.IndexPausedSpaces = indexPaused
 
 	m.workerStatus[m.indexID] = status
 	err = m.conn.Publish(m.cfg.Nats.Topic+".status", &status)
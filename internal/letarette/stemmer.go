@@ -34,10 +34,14 @@ func CheckStemmerSettings(db Database, cfg Config) error {
 	state, _, err := internal.getStemmerState()
 	if errors.Is(err, sql.ErrNoRows) {
 		state = snowball.Settings{
-			Stemmers:         cfg.Stemmer.Languages,
-			RemoveDiacritics: cfg.Stemmer.RemoveDiacritics,
-			TokenCharacters:  cfg.Stemmer.TokenCharacters,
-			Separators:       cfg.Stemmer.Separators,
+			Stemmers:            cfg.Stemmer.Languages,
+			RemoveDiacritics:    cfg.Stemmer.RemoveDiacritics,
+			TokenCharacters:     cfg.Stemmer.TokenCharacters,
+			Separators:          cfg.Stemmer.Separators,
+			MaxTokenLength:      cfg.Stemmer.MaxTokenLength,
+			TruncateLongTokens:  cfg.Stemmer.TruncateLongTokens,
+			InvisibleCharacters: cfg.Stemmer.InvisibleCharacters,
+			StopWords:           cfg.Stemmer.StopWords,
 		}
 		return internal.setStemmerState(state)
 	}
@@ -47,13 +51,28 @@ func CheckStemmerSettings(db Database, cfg Config) error {
 
 	stateLanguages := strings.Join(state.Stemmers, ",")
 	configLanguages := strings.Join(cfg.Stemmer.Languages, ",")
+	stateStopWords := strings.Join(state.StopWords, ",")
+	configStopWords := strings.Join(cfg.Stemmer.StopWords, ",")
 
 	if stateLanguages != configLanguages ||
 		state.RemoveDiacritics != cfg.Stemmer.RemoveDiacritics ||
 		state.Separators != cfg.Stemmer.Separators ||
-		state.TokenCharacters != cfg.Stemmer.TokenCharacters {
+		state.TokenCharacters != cfg.Stemmer.TokenCharacters ||
+		state.MaxTokenLength != cfg.Stemmer.MaxTokenLength ||
+		state.TruncateLongTokens != cfg.Stemmer.TruncateLongTokens ||
+		state.InvisibleCharacters != cfg.Stemmer.InvisibleCharacters ||
+		stateStopWords != configStopWords {
 		return ErrStemmerSettingsMismatch
 	}
 
 	return nil
 }
+
+// newInvisibleStripper returns a replacer removing the given characters
+func newInvisibleStripper(characters string) *strings.Replacer {
+	var pairs []string
+	for _, r := range characters {
+		pairs = append(pairs, string(r), "")
+	}
+	return strings.NewReplacer(pairs...)
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package letarette
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/erkkah/letarette/pkg/logger"
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// indexStep is a single update cycle of a space, requested over NATS.
+// Steps are run by the indexer main loop, since the indexer state
+// is not safe for concurrent use.
+type indexStep struct {
+	space string
+	done  chan cycleResult
+}
+
+// startStepResponder runs single update cycles requested on the
+// "<topic>.index.step" subject, one worker per shard, see
+// protocol.IndexStepRequest. Steps run between regular cycles,
+// and do not change the cycle schedule.
+func (idx *indexer) startStepResponder() (*nats.Subscription, error) {
+	indexID, err := idx.db.getIndexID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index ID: %w", err)
+	}
+
+	return idx.conn.QueueSubscribe(
+		idx.cfg.Nats.Topic+".index.step", idx.cfg.Shard,
+		func(subject, reply string, req *protocol.IndexStepRequest) {
+			step := indexStep{
+				space: req.Space,
+				done:  make(chan cycleResult, 1),
+			}
+
+			var result cycleResult
+			select {
+			case idx.steps <- step:
+				result = <-step.done
+			case <-idx.context.Done():
+				result.err = idx.context.Err()
+			}
+
+			response := protocol.IndexStepResult{
+				RequestID: req.RequestID,
+				IndexID:   indexID,
+				Shard:     idx.cfg.Shard,
+				Space:     req.Space,
+				Listed:    result.listed,
+				Requested: result.requested,
+				Committed: result.committed,
+			}
+			if result.err != nil {
+				response.Error = result.err.Error()
+			}
+			err := idx.conn.Publish(reply, &response)
+			if err != nil {
+				logger.Error.Printf("Failed to publish index step result: %v", err)
+			}
+		})
+}
+
+// runStep runs a single update cycle of an indexed space,
+// unless indexing of the space is paused.
+func (idx *indexer) runStep(space string) cycleResult {
+	indexed := false
+	for _, s := range idx.spaces() {
+		indexed = indexed || s == space
+	}
+	if !indexed {
+		return cycleResult{err: fmt.Errorf("space %q is not indexed", space)}
+	}
+	if idx.paused[idx.providerSpace(space)] {
+		return cycleResult{err: fmt.Errorf("indexing of space %q is paused", space)}
+	}
+
+	logger.Info.Printf("Running requested update cycle of space %q", space)
+	return idx.runUpdateCycle(space)
+}
@@ -31,6 +31,10 @@ struct StemmerModuleData {
     sqlite3 *db;
     struct sb_stemmer** stemmers;
     int minTokenLength;
+    int maxTokenLength;
+    int truncateLongTokens;
+    char** stopWords;
+    int nStopWords;
     const char** parentArgs;
     int nParentArgs;
     fts5_api *fts;
@@ -42,6 +46,9 @@ struct StemmerInstance {
 	Fts5Tokenizer *parentInstance;
     sqlite3_stmt *stopwordStatement;
     sqlite3_stmt *synonymStatement;
+    // Configured stop words, tokenized and stemmed like texts, sorted
+    char** stopWords;
+    int nStopWords;
 };
 
 struct StemmerContext {
@@ -49,9 +56,132 @@ struct StemmerContext {
     void* callerContext;
     int removeStopwords;
     int addSynonyms;
+    int countOversized;
     int (*xToken)(void*, int, const char*, int, int, int);
 };
 
+// Returns the stem of a token, from the first stemmer changing its length.
+// Tokens outside the stemmed length interval are returned as is.
+static const char* stemToken(struct sb_stemmer** stemmer, const char* pToken, int nToken, int* pnStemmed) {
+    if (nToken > MAX_TOKEN_LEN || nToken < MIN_TOKEN_LEN) {
+        *pnStemmed = nToken;
+        return pToken;
+    }
+    char buffer[MAX_TOKEN_LEN];
+    memcpy(buffer, pToken, nToken);
+    const sb_symbol* stemmed = (const sb_symbol*) pToken;
+    int stemmedLength = nToken;
+    while (*stemmer) {
+        stemmed = sb_stemmer_stem(*stemmer, (unsigned char*) buffer, nToken);
+        stemmedLength = sb_stemmer_length(*stemmer);
+        if (stemmedLength != nToken) {
+            break;
+        }
+        stemmer++;
+    }
+    *pnStemmed = stemmedLength;
+    return (const char*) stemmed;
+}
+
+struct StopWordContext {
+    struct StemmerModuleData* module;
+    int nTokens;
+    char* word;
+};
+
+static int stopWordCallback(
+	void *pCtx,
+	int tflags,
+	const char *pToken,
+	int nToken,
+	int iStart,
+	int iEnd
+){
+    struct StopWordContext* ctx = (struct StopWordContext*) pCtx;
+    ctx->nTokens++;
+    if (ctx->nTokens > 1) {
+        return SQLITE_OK;
+    }
+    int nStemmed;
+    const char* stemmed = stemToken(ctx->module->stemmers, pToken, nToken, &nStemmed);
+    ctx->word = sqlite3_mprintf("%.*s", nStemmed, stemmed);
+    if (!ctx->word) {
+        return SQLITE_NOMEM;
+    }
+    return SQLITE_OK;
+}
+
+static int compareStopWords(const void* a, const void* b) {
+    return strcmp(*(const char* const*) a, *(const char* const*) b);
+}
+
+struct TokenKey {
+    const char* token;
+    int nToken;
+};
+
+static int compareTokenToStopWord(const void* pKey, const void* pWord) {
+    const struct TokenKey* key = (const struct TokenKey*) pKey;
+    const char* word = *(const char* const*) pWord;
+    int nWord = strlen(word);
+    int rc = memcmp(key->token, word, key->nToken < nWord ? key->nToken : nWord);
+    if (rc == 0) {
+        rc = key->nToken - nWord;
+    }
+    return rc;
+}
+
+static void freeStopWords(char** stopWords, int nStopWords) {
+    for (int i = 0; i < nStopWords; i++) {
+        sqlite3_free(stopWords[i]);
+    }
+    sqlite3_free(stopWords);
+}
+
+// Runs the configured stop words through the parent tokenizer and the
+// stemmers, for matching stemmed tokens regardless of case and diacritics.
+// Stop words not making up exactly one token are ignored.
+static int prepareStopWords(struct StemmerInstance* instance) {
+    struct StemmerModuleData* modData = instance->module;
+    instance->stopWords = 0;
+    instance->nStopWords = 0;
+    if (modData->nStopWords == 0) {
+        return SQLITE_OK;
+    }
+
+    instance->stopWords = sqlite3_malloc(modData->nStopWords * sizeof(char*));
+    if (!instance->stopWords) {
+        return SQLITE_NOMEM;
+    }
+
+    for (int i = 0; i < modData->nStopWords; i++) {
+        struct StopWordContext ctx = {modData, 0, 0};
+        const char* word = modData->stopWords[i];
+        int rc = instance->parentModule.xTokenize(
+            instance->parentInstance, &ctx, FTS5_TOKENIZE_DOCUMENT, word, strlen(word), stopWordCallback
+        );
+        if (rc != SQLITE_OK || ctx.nTokens != 1) {
+            sqlite3_free(ctx.word);
+            if (rc != SQLITE_OK) {
+                return rc;
+            }
+            continue;
+        }
+        instance->stopWords[instance->nStopWords++] = ctx.word;
+    }
+
+    qsort(instance->stopWords, instance->nStopWords, sizeof(char*), compareStopWords);
+    return SQLITE_OK;
+}
+
+static int isConfiguredStopWord(struct StemmerInstance* instance, const char* token, int nToken) {
+    if (instance->nStopWords == 0) {
+        return 0;
+    }
+    struct TokenKey key = {token, nToken};
+    return bsearch(&key, instance->stopWords, instance->nStopWords, sizeof(char*), compareTokenToStopWord) != 0;
+}
+
 static int ftsSnowballCreate(
 	void *pCtx,
 	const char **azArg, int nArg,
@@ -75,6 +205,16 @@ static int ftsSnowballCreate(
 
     instance->stopwordStatement = 0;
     instance->synonymStatement = 0;
+    instance->stopWords = 0;
+    instance->nStopWords = 0;
+
+    if (rc == SQLITE_OK) {
+        rc = prepareStopWords(instance);
+        if (rc != SQLITE_OK) {
+            freeStopWords(instance->stopWords, instance->nStopWords);
+            instance->parentModule.xDelete(instance->parentInstance);
+        }
+    }
 
     if (rc == SQLITE_OK) {
         *ppOut = (Fts5Tokenizer*) instance;
@@ -88,6 +228,7 @@ static int ftsSnowballCreate(
 static void ftsSnowballDelete(Fts5Tokenizer *pTok) {
     struct StemmerInstance* instance = (struct StemmerInstance*) pTok;
     instance->parentModule.xDelete(instance->parentInstance);
+    freeStopWords(instance->stopWords, instance->nStopWords);
     sqlite3_free(instance);
 }
 
@@ -171,6 +312,19 @@ static int isNumerical(const char* word, int len) {
     return 1;
 }
 
+// Number of oversized tokens found while indexing, see getOversizedTokenCount
+static long long oversizedTokens = 0;
+
+// Returns the length of an oversized token cut to at most maxLength bytes,
+// without splitting UTF-8 sequences.
+static int truncatedLength(const char* word, int maxLength) {
+    int len = maxLength;
+    while (len > 0 && (word[len] & 0xC0) == 0x80) {
+        len--;
+    }
+    return len;
+}
+
 static int ftsSnowballCallback(
 	void *pCtx,
 	int tflags,
@@ -186,6 +340,21 @@ static int ftsSnowballCallback(
         return SQLITE_OK;
     }
 
+    // Truncate or drop tokens above maxTokenLength, if set
+    int maxTokenLength = ctx->instance->module->maxTokenLength;
+    if (maxTokenLength > 0 && nToken > maxTokenLength) {
+        if (ctx->countOversized) {
+            __atomic_add_fetch(&oversizedTokens, 1, __ATOMIC_RELAXED);
+        }
+        if (!ctx->instance->module->truncateLongTokens) {
+            return SQLITE_OK;
+        }
+        nToken = truncatedLength(pToken, maxTokenLength);
+        if (nToken == 0) {
+            return SQLITE_OK;
+        }
+    }
+
     if (ctx->removeStopwords) {
 
         int stopwordStatus = isStopWord(ctx->instance, pToken, nToken);
@@ -198,34 +367,21 @@ static int ftsSnowballCallback(
         }
     }
 
-    // Only call snowball for tokens within the set interval
-    if (nToken > MAX_TOKEN_LEN || nToken < MIN_TOKEN_LEN) {
-        int rc = ctx->xToken(ctx->callerContext, tflags, pToken, nToken, iStart, iEnd);
-        if (rc != SQLITE_OK) {
-            return rc;
-        }
-    } else {
-        char buffer[MAX_TOKEN_LEN];
-        memcpy(buffer, pToken, nToken);
-        struct sb_stemmer** stemmer = ctx->instance->module->stemmers;
-        const sb_symbol* stemmed = (const sb_symbol*) pToken;
-        int stemmedLength = nToken;
-        while (*stemmer) {
-            stemmed = sb_stemmer_stem(*stemmer, (unsigned char*) buffer, nToken);
-            stemmedLength = sb_stemmer_length(*stemmer);
-            if (stemmedLength != nToken) {
-                break;
-            }
-            stemmer++;
-        }
-        int rc = ctx->xToken(ctx->callerContext, tflags, (const char*) stemmed, stemmedLength, iStart, iEnd);
-        if (rc != SQLITE_OK) {
-            return rc;
-        }
+    int stemmedLength;
+    const char* stemmed = stemToken(ctx->instance->module->stemmers, pToken, nToken, &stemmedLength);
+
+    // Configured stop words are skipped both when indexing and searching
+    if (isConfiguredStopWord(ctx->instance, stemmed, stemmedLength)) {
+        return SQLITE_OK;
+    }
+
+    int rc = ctx->xToken(ctx->callerContext, tflags, stemmed, stemmedLength, iStart, iEnd);
+    if (rc != SQLITE_OK) {
+        return rc;
     }
 
     if (ctx->addSynonyms) {
-        int rc = addSynonyms(ctx, pToken, nToken, iStart, iEnd);
+        rc = addSynonyms(ctx, pToken, nToken, iStart, iEnd);
         return rc;
     }
 
@@ -248,6 +404,7 @@ static int ftsSnowballTokenize(
     if ( (flags & (FTS5_TOKENIZE_QUERY | FTS5_TOKENIZE_PREFIX)) == FTS5_TOKENIZE_QUERY ) {
         ctx.removeStopwords = 1;
         ctx.addSynonyms = 1;
+        ctx.countOversized = 0;
 
         for (int i = 0; i < nText; i++) {
             // No stop word handling for quoted phrases
@@ -259,6 +416,7 @@ static int ftsSnowballTokenize(
     } else {
         ctx.removeStopwords = 0;
         ctx.addSynonyms = 0;
+        ctx.countOversized = (flags & FTS5_TOKENIZE_DOCUMENT) != 0;
     }
 
     return instance->parentModule.xTokenize(
@@ -307,6 +465,7 @@ static struct sb_stemmer** allocateStemmerList(const char** languages, int nLang
 static void destroyStemmerModule(void *p) {
     struct StemmerModuleData* modData = (struct StemmerModuleData*) p;
     freeStemmerList(modData->stemmers);
+    freeStopWords(modData->stopWords, modData->nStopWords);
     for (int i = 0; i < modData->nParentArgs; i++) {
         sqlite3_free((void*) modData->parentArgs[i]);
     }
@@ -321,7 +480,11 @@ int initSnowballStemmer(
     int removeDiacritics,
     const char* tokenCharacters,
     const char* separators,
-    int minTokenLength
+    int minTokenLength,
+    int maxTokenLength,
+    int truncateLongTokens,
+    const char** stopWords,
+    int nStopWords
 ){
     fts5_tokenizer tokenizer = {ftsSnowballCreate, ftsSnowballDelete, ftsSnowballTokenize};
 
@@ -339,6 +502,19 @@ int initSnowballStemmer(
 
     modData->stemmers = stemmers;
     modData->minTokenLength = minTokenLength;
+    modData->maxTokenLength = maxTokenLength;
+    modData->truncateLongTokens = truncateLongTokens;
+
+    modData->stopWords = sqlite3_malloc((nStopWords + 1) * sizeof(char*));
+    if (!modData->stopWords) {
+        freeStemmerList(stemmers);
+        sqlite3_free(modData);
+        return SQLITE_ERROR;
+    }
+    modData->nStopWords = 0;
+    for (int i = 0; i < nStopWords; i++) {
+        modData->stopWords[modData->nStopWords++] = sqlite3_mprintf("%s", stopWords[i]);
+    }
 
     const int maxArgs = 6;
     const char** args = sqlite3_malloc(sizeof(char*) * maxArgs);
@@ -373,3 +549,7 @@ int initSnowballStemmer(
 const char** getStemmerList() {
     return sb_stemmer_list();
 }
+
+long long getOversizedTokenCount() {
+    return __atomic_load_n(&oversizedTokens, __ATOMIC_RELAXED);
+}
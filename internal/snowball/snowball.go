@@ -40,6 +40,16 @@ type Settings struct {
 	TokenCharacters  string
 	Separators       string
 	MinTokenLength   int
+	// Tokens longer than MaxTokenLength bytes are dropped, or truncated
+	// if TruncateLongTokens is set. Zero disables the limit.
+	MaxTokenLength     int
+	TruncateLongTokens bool
+	// Characters removed from texts before tokenization. Not applied
+	// by the tokenizer, but by the indexer and searcher.
+	InvisibleCharacters string
+	// Tokens matching a stop word after case folding and stemming are
+	// skipped, both in texts and queries.
+	StopWords []string
 }
 
 // ListStemmers returns a list of all built-in Snowball
@@ -54,6 +64,12 @@ func ListStemmers() []string {
 	return stemmers
 }
 
+// OversizedTokens returns the number of tokens longer than
+// the max token length found while indexing documents.
+func OversizedTokens() int64 {
+	return int64(C.getOversizedTokenCount())
+}
+
 // Init registers the snowball stemmer with the connection and configures
 // it for the list of languages.
 // If a language cannot be found, initialization fails.
@@ -61,9 +77,13 @@ func Init(conn *sqlite3.SQLiteConn, settings Settings) error {
 	if len(settings.Stemmers) == 0 {
 		return fmt.Errorf("config.Stemmers list cannot be empty")
 	}
+	if len(settings.StopWords) > maxArgs {
+		return fmt.Errorf("config.StopWords list cannot have more than %d words", maxArgs)
+	}
 
 	db := dbFromConnection(conn)
 	cStemmers := allocateCArgs(settings.Stemmers)
+	cStopWords := allocateCArgs(settings.StopWords)
 
 	var cTokenCharacters *C.char
 	if len(settings.TokenCharacters) > 0 {
@@ -89,14 +109,21 @@ func Init(conn *sqlite3.SQLiteConn, settings Settings) error {
 		minTokenLength = settings.MinTokenLength
 	}
 
+	var truncateLongTokens = 0
+	if settings.TruncateLongTokens {
+		truncateLongTokens = 1
+	}
+
 	result := C.initSnowballStemmer(
 		db,
 		cStemmers, C.int(len(settings.Stemmers)),
 		C.int(removeDiacritics), cTokenCharacters, cSeparators,
-		C.int(minTokenLength),
+		C.int(minTokenLength), C.int(settings.MaxTokenLength), C.int(truncateLongTokens),
+		cStopWords, C.int(len(settings.StopWords)),
 	)
 
 	freeCArgs(cStemmers, len(settings.Stemmers))
+	freeCArgs(cStopWords, len(settings.StopWords))
 
 	if cSeparators != nil {
 		C.free(unsafe.Pointer(cSeparators))
@@ -23,7 +23,13 @@ int initSnowballStemmer(
     int removeDiacritics,
     const char* tokenCharacters,
     const char* separators,
-    int minTokenLength
+    int minTokenLength,
+    int maxTokenLength,
+    int truncateLongTokens,
+    const char** stopWords,
+    int nStopWords
 );
 
 const char** getStemmerList();
+
+long long getOversizedTokenCount();
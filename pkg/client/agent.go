@@ -15,18 +15,268 @@
 package client
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/nats-io/nats.go"
+
 	"github.com/erkkah/letarette/pkg/protocol"
 )
 
 // SearchAgent is a letarette cluster searcher
 type SearchAgent interface {
 	Close()
-	Search(q string, spaces []string, pageLimit int, pageOffset int) (protocol.SearchResponse, error)
+	// Search runs a query in the given spaces, or in the default space
+	// when no spaces are given, see WithDefaultSpace.
+	Search(q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption) (protocol.SearchResponse, error)
+	// SearchWithContext runs a query like Search, giving up with the
+	// context error when the context is done before the agent timeout.
+	SearchWithContext(
+		ctx context.Context, q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+	) (protocol.SearchResponse, error)
+	// SearchStream runs a query, pushing the result in chunks of hits
+	// to out, which is closed when done, see WithStreamChunkSize.
+	SearchStream(
+		ctx context.Context, q string, spaces []string, limit int, offset int,
+		out chan<- protocol.SearchResult, options ...SearchOption,
+	) error
+	// StemmerState fetches the index stemmer state from one worker per shard
+	StemmerState() ([]protocol.StemmerState, error)
+	// Ping checks that search workers respond, see PingResult
+	Ping() (PingResult, error)
+	// SQL runs a read-only SQL statement on one worker per shard,
+	// see protocol.SQLRequest. Workers only serve SQL requests when
+	// configured to, and require credentials, see WithCredentials.
+	SQL(statement string, args ...string) ([]protocol.SQLResponse, error)
+	// IndexStep runs a single indexing update cycle of a space on one
+	// worker per shard, see protocol.IndexStepRequest
+	IndexStep(space string) ([]protocol.IndexStepResult, error)
+}
+
+// PingResult is the outcome of pinging the search workers on the
+// "<topic>.ping" subject. Replies are collected for PingCollectTime
+// after the first reply, bounded by the agent timeout.
+type PingResult struct {
+	// Round-trip time of the first reply
+	Latency time.Duration
+	// Number of workers replying
+	Workers int
+	// Number of replying workers in each shard, like "1/2"
+	Shards map[string]int
+}
+
+// PingCollectTime is how long Ping waits for more replies
+// after the first reply
+const PingCollectTime = 250 * time.Millisecond
+
+// ErrNoSpace is returned when searching without spaces,
+// and no default space is set, see WithDefaultSpace.
+var ErrNoSpace = errors.New("no space to search")
+
+// ErrTooManySpaces is returned when searching more spaces
+// than allowed, see WithMaxSpaces. The response status is
+// protocol.SearchStatusQueryError.
+var ErrTooManySpaces = errors.New("too many spaces to search")
+
+// ErrNoWorkers is returned when no search workers are available,
+// without waiting for the search timeout, or when no shard group size
+// is discovered within the timeout. The response status is
+// protocol.SearchStatusNoWorkers.
+var ErrNoWorkers = errors.New("no search workers available")
+
+// NATS status header value of replies to requests without subscribers
+const noRespondersStatus = "503"
+
+// SearchOption modifies a single search request
+type SearchOption func(*protocol.SearchRequest)
+
+// WithDemotions lowers the rank of documents with matching stored field values
+func WithDemotions(demotions ...protocol.Demotion) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.Demotions = append(req.Demotions, demotions...)
+	}
+}
+
+// WithTimeDecay blends document age into the ranking, see
+// protocol.SearchRequest.DecayHalfLifeHours
+func WithTimeDecay(halfLifeHours float32) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.DecayHalfLifeHours = halfLifeHours
+	}
+}
+
+// WithoutBoost ranks documents by relevance alone, ignoring
+// document boosts, see protocol.Document.Boost
+func WithoutBoost() SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.IgnoreBoost = true
+	}
+}
+
+// WithFuzzy lets single word query phrases match words within
+// the given number of edits, see protocol.SearchRequest.Fuzzy
+func WithFuzzy(edits int) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.Fuzzy = edits
+	}
+}
+
+// WithTiers groups hits into relevance tiers, starting a new tier at
+// each score drop of at least the given gap, see protocol.SearchRequest.TierGap
+func WithTiers(gap float32) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.TierGap = gap
+	}
+}
+
+// WithSpaceCounts requests the number of hits in each space,
+// returned in the result SpaceCounts field.
+func WithSpaceCounts() SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.CountSpaces = true
+	}
+}
+
+// WithFacets requests hit counts by value of the given stored fields,
+// returned in the result Facets field together with the result page.
+// At most limit buckets are returned per field, zero means
+// protocol.DefaultFacetLimit.
+func WithFacets(limit uint16, fields ...string) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.Facets = append(req.Facets, fields...)
+		req.FacetLimit = limit
+	}
+}
+
+// WithNumericStats requests the min, max, sum and average value of the
+// given numeric fields over all hits, returned in the result NumericStats
+// field, see protocol.SearchRequest.NumericStats.
+func WithNumericStats(fields ...string) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.NumericStats = append(req.NumericStats, fields...)
+	}
+}
+
+// WithEstimatedTotal requests an estimate of the total number of hits
+// beyond the result cap, returned in the result EstimatedTotal field,
+// see protocol.SearchRequest.EstimateTotal.
+func WithEstimatedTotal() SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.EstimateTotal = true
+	}
+}
+
+// WithLanguages only returns documents in one of the given languages,
+// see protocol.SearchRequest.Languages.
+func WithLanguages(languages ...string) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.Languages = append(req.Languages, languages...)
+	}
+}
+
+// WithContent returns the stored text of each hit in its Content field,
+// see protocol.SearchRequest.IncludeContent.
+func WithContent() SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.IncludeContent = true
+	}
+}
+
+// WithCollapse returns only the best ranked hit for each value of
+// the given stored field, see protocol.SearchRequest.CollapseField.
+func WithCollapse(field string) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.CollapseField = field
+	}
+}
+
+// WithPhonetic matches words by how they sound,
+// see protocol.SearchRequest.Phonetic.
+func WithPhonetic() SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.Phonetic = true
+	}
+}
+
+// WithTermCounts returns the number of matches of each query term
+// with each hit, see protocol.SearchRequest.TermCounts.
+func WithTermCounts() SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.TermCounts = true
+	}
+}
+
+// WithExactCase matches words case sensitively,
+// see protocol.SearchRequest.ExactCase.
+func WithExactCase() SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.ExactCase = true
+	}
+}
+
+// WithSnippetOptions sets the number of tokens before and after the
+// first match of snippets, and the markers wrapping the first match,
+// see protocol.SearchRequest.SnippetWindow. A zero window keeps the
+// window configured by the workers.
+func WithSnippetOptions(window int, open, close string) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.SnippetWindow = window
+		req.SnippetOpen = open
+		req.SnippetClose = close
+	}
+}
+
+// WithNewSnapshot pins a point-in-time view of the index, for paging
+// through results consistently. Pass the Snapshot token of the result
+// to WithSnapshot when fetching the following pages.
+func WithNewSnapshot() SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.PinSnapshot = true
+	}
+}
+
+// WithSnapshot searches the point-in-time view identified by a token
+// returned from a search using WithNewSnapshot.
+// When the snapshot has been released, the live index is searched,
+// and the Snapshot token of the result is empty.
+func WithSnapshot(token string) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.Snapshot = token
+	}
+}
+
+// WithReleasedSnapshot searches the point-in-time view identified by
+// a token like WithSnapshot, releasing it after the search.
+func WithReleasedSnapshot(token string) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.Snapshot = token
+		req.ReleaseSnapshot = true
+	}
+}
+
+// WithNewSinceToken requests a token marking the end of the index,
+// returned in the result SinceToken field. Pass it to WithSince to
+// poll for documents indexed after the search.
+func WithNewSinceToken() SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.NewSinceToken = true
+	}
+}
+
+// WithSince only returns documents indexed after the search returning
+// the token, most recently updated first, see protocol.SearchRequest.Since.
+// The result carries a new token for the next poll.
+func WithSince(token string) SearchOption {
+	return func(req *protocol.SearchRequest) {
+		req.Since = token
+	}
 }
 
 // WithShardgroupSize forces shard group size instead of using discovery
@@ -37,7 +287,60 @@ func WithShardgroupSize(groupSize int32) Option {
 	}
 }
 
-// WithTimeout sets search request timeout
+// WithDefaultSpace sets the space searched when Search is called
+// without spaces. Without a default, such searches fail with ErrNoSpace.
+func WithDefaultSpace(space string) Option {
+	return func(st *state) {
+		sa := st.local.(*searchAgent)
+		sa.defaultSpace = space
+	}
+}
+
+// WithCredentials sets credentials sent with each search request,
+// in the protocol.CredentialsHeader message header.
+// Requires a NATS server supporting headers.
+func WithCredentials(credentials string) Option {
+	return func(st *state) {
+		sa := st.local.(*searchAgent)
+		sa.credentials = credentials
+	}
+}
+
+// WithCompression makes search requests accept gzip compressed responses,
+// sent by workers for responses larger than their configured threshold.
+// Responses are decompressed transparently.
+// Requires a NATS server supporting headers.
+func WithCompression() Option {
+	return func(st *state) {
+		sa := st.local.(*searchAgent)
+		sa.compress = true
+	}
+}
+
+// WithMaxSpaces sets the most spaces a single search may request,
+// larger searches fail with ErrTooManySpaces without being sent.
+// The default is zero, which disables the check, leaving it to the
+// workers. Use protocol.DefaultMaxSpaces to match the worker default.
+func WithMaxSpaces(maxSpaces int) Option {
+	return func(st *state) {
+		sa := st.local.(*searchAgent)
+		sa.maxSpaces = maxSpaces
+	}
+}
+
+// WithMergeStrategy sets how the hits of searches in several spaces
+// are ordered, see MergeStrategy. Hits are ordered within each page,
+// pages are still cut from the hits in rank order.
+func WithMergeStrategy(strategy MergeStrategy) Option {
+	return func(st *state) {
+		sa := st.local.(*searchAgent)
+		sa.mergeStrategy = strategy
+	}
+}
+
+// WithTimeout sets search request timeout. Searches also wait at most
+// this long for the shard group size to be discovered, before failing
+// with ErrNoWorkers.
 func WithTimeout(timeout time.Duration) Option {
 	return func(st *state) {
 		sa := st.local.(*searchAgent)
@@ -54,6 +357,7 @@ func NewSearchAgent(URLs []string, options ...Option) (SearchAgent, error) {
 		},
 		volatileNumShards: 0,
 		timeout:           time.Second * 2,
+		streamChunkSize:   DefaultStreamChunkSize,
 	}
 
 	agent.local = agent
@@ -77,6 +381,15 @@ func NewSearchAgent(URLs []string, options ...Option) (SearchAgent, error) {
 			WithTopic(agent.topic),
 			WithSeedFile(agent.seedFile),
 			WithRootCAs(agent.rootCAs...),
+			func(o *state) {
+				o.reconnect = agent.reconnect
+				o.certFile = agent.certFile
+				o.keyFile = agent.keyFile
+				o.skipVerify = agent.skipVerify
+				o.nkeySeed = agent.nkeySeed
+				o.user = agent.user
+				o.password = agent.password
+			},
 		)
 		if err != nil {
 			return nil, err
@@ -91,6 +404,12 @@ type searchAgent struct {
 	volatileNumShards int32
 	monitor           Monitor
 	timeout           time.Duration
+	defaultSpace      string
+	credentials       string
+	compress          bool
+	maxSpaces         int
+	streamChunkSize   int
+	mergeStrategy     MergeStrategy
 }
 
 func (agent *searchAgent) Close() {
@@ -101,15 +420,19 @@ func (agent *searchAgent) Close() {
 	agent.conn.Close()
 }
 
-func (agent *searchAgent) getNumShards() (int32, error) {
+func (agent *searchAgent) getNumShards(ctx context.Context) (int32, error) {
 	start := time.Now()
 	for {
 		numShards := atomic.LoadInt32(&agent.volatileNumShards)
 		if numShards == 0 {
-			if time.Now().After(start.Add(time.Second * 5)) {
-				return 0, fmt.Errorf("timeout waiting for cluster")
+			if time.Now().After(start.Add(agent.timeout)) {
+				return 0, fmt.Errorf("%w: timeout waiting for cluster", ErrNoWorkers)
+			}
+			select {
+			case <-time.After(time.Millisecond * 100):
+			case <-ctx.Done():
+				return 0, ctx.Err()
 			}
-			time.Sleep(time.Millisecond * 100)
 		} else {
 			return numShards, nil
 		}
@@ -117,16 +440,44 @@ func (agent *searchAgent) getNumShards() (int32, error) {
 }
 
 func (agent *searchAgent) Search(
-	q string, spaces []string, pageLimit int, pageOffset int,
+	q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+) (
+	protocol.SearchResponse,
+	error,
+) {
+	return agent.SearchWithContext(context.Background(), q, spaces, pageLimit, pageOffset, options...)
+}
+
+func (agent *searchAgent) SearchWithContext(
+	ctx context.Context, q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
 ) (
 	res protocol.SearchResponse,
 	err error,
 ) {
 
-	numShards, err := agent.getNumShards()
+	if len(spaces) == 0 {
+		if agent.defaultSpace == "" {
+			err = ErrNoSpace
+			return
+		}
+		spaces = []string{agent.defaultSpace}
+	}
+	if agent.maxSpaces > 0 && len(spaces) > agent.maxSpaces {
+		err = fmt.Errorf("%w: %d spaces, at most %d allowed", ErrTooManySpaces, len(spaces), agent.maxSpaces)
+		res.Status = protocol.SearchStatusQueryError
+		return
+	}
+
+	numShards, err := agent.getNumShards(ctx)
 	if err != nil {
+		if errors.Is(err, ErrNoWorkers) {
+			res.Status = protocol.SearchStatusNoWorkers
+		}
 		return
 	}
+	if pageLimit < 1 {
+		pageLimit = 1
+	}
 	shardedLimit := pageLimit / int(numShards)
 	if shardedLimit < 1 {
 		shardedLimit = 1
@@ -136,19 +487,40 @@ func (agent *searchAgent) Search(
 		Query:      q,
 		PageLimit:  uint16(shardedLimit),
 		PageOffset: uint16(pageOffset),
+		Version:    protocol.Version.String(),
+	}
+	for _, option := range options {
+		option(&req)
 	}
 
 	inbox := agent.conn.Conn.NewRespInbox()
 	responseCh := make(chan protocol.SearchResponse, numShards)
+	noWorkers := make(chan struct{}, 1)
 	defer func() {
 		close(responseCh)
 		responseCh = nil
 	}()
-	sub, err := agent.conn.Subscribe(inbox, func(response *protocol.SearchResponse) {
+	sub, err := agent.conn.Conn.Subscribe(inbox, func(msg *nats.Msg) {
+		if len(msg.Data) == 0 && msg.Header.Get("Status") == noRespondersStatus {
+			select {
+			case noWorkers <- struct{}{}:
+			default:
+			}
+			return
+		}
+		data, err := protocol.DecodeResponse(msg.Data, msg.Header.Get(protocol.ContentEncodingHeader))
+		if err != nil {
+			agent.onError(fmt.Errorf("failed to decode search response: %w", err))
+			return
+		}
+		var response protocol.SearchResponse
+		err = json.Unmarshal(data, &response)
+		if err != nil {
+			agent.onError(fmt.Errorf("failed to decode search response: %w", err))
+			return
+		}
 		if responseCh != nil {
-			clone := *response
-			clone.Result.Hits = append(clone.Result.Hits[:0:0], clone.Result.Hits...)
-			responseCh <- *response
+			responseCh <- response
 		}
 	})
 	if err != nil {
@@ -158,7 +530,7 @@ func (agent *searchAgent) Search(
 	if err != nil {
 		return
 	}
-	err = agent.conn.PublishRequest(agent.topic+".q", inbox, req)
+	err = agent.publishSearch(inbox, req)
 	if err != nil {
 		return
 	}
@@ -172,6 +544,15 @@ waitLoop:
 			_ = sub.Unsubscribe()
 			err = fmt.Errorf("timeout waiting for search response")
 			return
+		case <-ctx.Done():
+			_ = sub.Unsubscribe()
+			err = ctx.Err()
+			return
+		case <-noWorkers:
+			_ = sub.Unsubscribe()
+			res.Status = protocol.SearchStatusNoWorkers
+			err = ErrNoWorkers
+			return
 		case response := <-responseCh:
 			responses = append(responses, response)
 			if len(responses) == int(numShards) {
@@ -180,12 +561,257 @@ waitLoop:
 		}
 	}
 
-	res = mergeResponses(responses)
+	facetLimit := int(req.FacetLimit)
+	if facetLimit == 0 {
+		facetLimit = protocol.DefaultFacetLimit
+	}
+	res = mergeResponses(responses, pageLimit, facetLimit, req.CollapseField != "", req.TierGap)
+	if len(spaces) > 1 {
+		res.Result.Hits = orderHits(res.Result.Hits, spaces, agent.mergeStrategy)
+	}
 	return
 }
 
-func mergeResponses(responses []protocol.SearchResponse) protocol.SearchResponse {
+func (agent *searchAgent) publishSearch(inbox string, req protocol.SearchRequest) error {
+	if agent.credentials == "" && !agent.compress {
+		return agent.conn.PublishRequest(agent.topic+".q", inbox, req)
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(agent.topic + ".q")
+	msg.Reply = inbox
+	msg.Data = data
+	if agent.credentials != "" {
+		msg.Header.Set(protocol.CredentialsHeader, agent.credentials)
+	}
+	if agent.compress {
+		msg.Header.Set(protocol.AcceptEncodingHeader, protocol.EncodingGzip)
+	}
+	return agent.conn.Conn.PublishMsg(msg)
+}
+
+func (agent *searchAgent) StemmerState() (states []protocol.StemmerState, err error) {
+	numShards, err := agent.getNumShards(context.Background())
+	if err != nil {
+		return
+	}
+
+	inbox := agent.conn.Conn.NewRespInbox()
+	stateCh := make(chan protocol.StemmerState, numShards)
+	sub, err := agent.conn.Subscribe(inbox, func(state *protocol.StemmerState) {
+		stateCh <- *state
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+	err = sub.AutoUnsubscribe(int(numShards))
+	if err != nil {
+		return
+	}
+	req := protocol.StemmerStateRequest{
+		RequestID: time.Now().String(),
+	}
+	err = agent.conn.PublishRequest(agent.topic+".stemmer.request", inbox, req)
+	if err != nil {
+		return
+	}
+	timeout := time.After(agent.timeout)
+
+	for len(states) < int(numShards) {
+		select {
+		case <-timeout:
+			err = fmt.Errorf("timeout waiting for stemmer state")
+			return
+		case state := <-stateCh:
+			states = append(states, state)
+		}
+	}
+	return
+}
+
+func (agent *searchAgent) SQL(statement string, args ...string) (responses []protocol.SQLResponse, err error) {
+	numShards, err := agent.getNumShards(context.Background())
+	if err != nil {
+		return
+	}
+
+	inbox := agent.conn.Conn.NewRespInbox()
+	responseCh := make(chan protocol.SQLResponse, numShards)
+	sub, err := agent.conn.Subscribe(inbox, func(response *protocol.SQLResponse) {
+		responseCh <- *response
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+	err = sub.AutoUnsubscribe(int(numShards))
+	if err != nil {
+		return
+	}
+
+	req := protocol.SQLRequest{
+		RequestID: time.Now().String(),
+		Statement: statement,
+		Args:      args,
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	msg := nats.NewMsg(agent.topic + ".sql")
+	msg.Reply = inbox
+	msg.Data = data
+	if agent.credentials != "" {
+		msg.Header.Set(protocol.CredentialsHeader, agent.credentials)
+	}
+	err = agent.conn.Conn.PublishMsg(msg)
+	if err != nil {
+		return
+	}
+	timeout := time.After(agent.timeout)
+
+	for len(responses) < int(numShards) {
+		select {
+		case <-timeout:
+			err = fmt.Errorf("timeout waiting for SQL responses")
+			return
+		case response := <-responseCh:
+			responses = append(responses, response)
+		}
+	}
+	return
+}
+
+func (agent *searchAgent) IndexStep(space string) (results []protocol.IndexStepResult, err error) {
+	numShards, err := agent.getNumShards(context.Background())
+	if err != nil {
+		return
+	}
+
+	inbox := agent.conn.Conn.NewRespInbox()
+	resultCh := make(chan protocol.IndexStepResult, numShards)
+	sub, err := agent.conn.Subscribe(inbox, func(result *protocol.IndexStepResult) {
+		resultCh <- *result
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+	err = sub.AutoUnsubscribe(int(numShards))
+	if err != nil {
+		return
+	}
+	req := protocol.IndexStepRequest{
+		RequestID: time.Now().String(),
+		Space:     space,
+	}
+	err = agent.conn.PublishRequest(agent.topic+".index.step", inbox, req)
+	if err != nil {
+		return
+	}
+	timeout := time.After(agent.timeout)
+
+	for len(results) < int(numShards) {
+		select {
+		case <-timeout:
+			err = fmt.Errorf("timeout waiting for index step results")
+			return
+		case result := <-resultCh:
+			results = append(results, result)
+		}
+	}
+	return
+}
+
+func (agent *searchAgent) Ping() (result PingResult, err error) {
+	inbox := agent.conn.Conn.NewRespInbox()
+	replies := make(chan protocol.PingResponse, 256)
+	noWorkers := make(chan struct{}, 1)
+	sub, err := agent.conn.Conn.Subscribe(inbox, func(msg *nats.Msg) {
+		if len(msg.Data) == 0 && msg.Header.Get("Status") == noRespondersStatus {
+			select {
+			case noWorkers <- struct{}{}:
+			default:
+			}
+			return
+		}
+		var response protocol.PingResponse
+		err := json.Unmarshal(msg.Data, &response)
+		if err != nil {
+			agent.onError(fmt.Errorf("failed to decode ping response: %w", err))
+			return
+		}
+		// Late replies are dropped when Ping has returned
+		select {
+		case replies <- response:
+		default:
+		}
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	req := protocol.PingRequest{
+		RequestID: time.Now().String(),
+	}
+	start := time.Now()
+	err = agent.conn.PublishRequest(agent.topic+".ping", inbox, req)
+	if err != nil {
+		return
+	}
+
+	result.Shards = map[string]int{}
+	timeout := time.After(agent.timeout)
+	var collected <-chan time.Time
+	for {
+		select {
+		case <-timeout:
+			if result.Workers == 0 {
+				err = fmt.Errorf("timeout waiting for ping response")
+			}
+			return
+		case <-collected:
+			return
+		case <-noWorkers:
+			err = ErrNoWorkers
+			return
+		case response := <-replies:
+			if response.RequestID != req.RequestID {
+				continue
+			}
+			if result.Workers == 0 {
+				result.Latency = time.Since(start)
+				collected = time.After(PingCollectTime)
+			}
+			result.Workers++
+			result.Shards[response.Shard]++
+		}
+	}
+}
+
+func mergeResponses(
+	responses []protocol.SearchResponse, pageLimit int, facetLimit int, collapse bool, tierGap float32,
+) protocol.SearchResponse {
 	var merged protocol.SearchResponse
+	hitLists := make([][]protocol.SearchHit, 0, len(responses))
+	var facetLists []map[string][]protocol.FacetBucket
+	var statsLists []map[string]protocol.NumericStats
+	missing := map[string]bool{}
+	unavailable := map[string]bool{}
+	var snapshots []string
+	var sinceTokens []string
 	for _, response := range responses {
 		if merged.Duration < response.Duration {
 			merged.Duration = response.Duration
@@ -194,8 +820,61 @@ func mergeResponses(responses []protocol.SearchResponse) protocol.SearchResponse
 			merged.Status = response.Status
 		}
 		merged.Result.Capped = merged.Result.Capped || response.Result.Capped
+		merged.Result.SnippetsOmitted = merged.Result.SnippetsOmitted || response.Result.SnippetsOmitted
+		merged.Result.StopwordsOnly = merged.Result.StopwordsOnly || response.Result.StopwordsOnly
+		if response.Result.Truncated {
+			for _, reason := range strings.Split(response.Result.TruncatedReason, "; ") {
+				merged.Result.Truncate(reason)
+			}
+		}
 		merged.Result.TotalHits += response.Result.TotalHits
-		merged.Result.Hits = append(merged.Result.Hits, response.Result.Hits...)
+		merged.Result.EstimatedTotal += response.Result.EstimatedTotal
+		merged.Result.EstimateIsLowerBound = merged.Result.EstimateIsLowerBound || response.Result.EstimateIsLowerBound
+		hitLists = append(hitLists, response.Result.Hits)
+		if response.Result.Facets != nil {
+			facetLists = append(facetLists, response.Result.Facets)
+		}
+		if response.Result.NumericStats != nil {
+			statsLists = append(statsLists, response.Result.NumericStats)
+		}
+
+		for space, count := range response.Result.SpaceCounts {
+			if merged.Result.SpaceCounts == nil {
+				merged.Result.SpaceCounts = map[string]int{}
+			}
+			merged.Result.SpaceCounts[space] += count
+		}
+
+		for space, watermark := range response.Result.Watermarks {
+			if merged.Result.Watermarks == nil {
+				merged.Result.Watermarks = map[string]time.Time{}
+			}
+			// Shards are only as current as the least current shard
+			current, found := merged.Result.Watermarks[space]
+			if !found || watermark.Before(current) {
+				merged.Result.Watermarks[space] = watermark
+			}
+		}
+
+		if response.Result.Snapshot != "" {
+			snapshots = append(snapshots, response.Result.Snapshot)
+		}
+		if response.Result.SinceToken != "" {
+			sinceTokens = append(sinceTokens, response.Result.SinceToken)
+		}
+
+		for _, space := range response.Result.MissingSpaces {
+			if !missing[space] {
+				missing[space] = true
+				merged.Result.MissingSpaces = append(merged.Result.MissingSpaces, space)
+			}
+		}
+		for _, space := range response.Result.UnavailableSpaces {
+			if !unavailable[space] {
+				unavailable[space] = true
+				merged.Result.UnavailableSpaces = append(merged.Result.UnavailableSpaces, space)
+			}
+		}
 
 		// Keep the respelt version with the lowest distance
 		if merged.Result.Respelt == "" ||
@@ -204,8 +883,32 @@ func mergeResponses(responses []protocol.SearchResponse) protocol.SearchResponse
 			merged.Result.RespeltDistance = response.Result.RespeltDistance
 		}
 	}
-	sort.SliceStable(merged.Result.Hits, func(a, b int) bool {
-		return merged.Result.Hits[a].Rank < merged.Result.Hits[b].Rank
-	})
+	if collapse {
+		// Groups can span shards, collapse all hits before cutting the page
+		hits := protocol.CollapseHits(protocol.MergeHits(math.MaxInt32, hitLists...))
+		if len(hits) > pageLimit {
+			hits = hits[:pageLimit]
+		}
+		merged.Result.Hits = hits
+	} else {
+		merged.Result.Hits = protocol.MergeHits(pageLimit, hitLists...)
+	}
+	if tierGap > 0 {
+		// Shard tiers are relative to shard pages
+		merged.Result.Hits = protocol.TierHits(merged.Result.Hits, tierGap)
+	}
+	merged.Result.Facets = protocol.MergeFacets(facetLimit, facetLists...)
+	merged.Result.NumericStats = protocol.MergeNumericStats(statsLists...)
+
+	// Each shard pins its own snapshot
+	sort.Strings(snapshots)
+	merged.Result.Snapshot = strings.Join(snapshots, ",")
+	// Each shard has its own index positions
+	sort.Strings(sinceTokens)
+	merged.Result.SinceToken = strings.Join(sinceTokens, ",")
+	// Shards have their own stop words, other shards may have found hits
+	if merged.Status == protocol.SearchStatusStopwordsOnly && len(merged.Result.Hits) > 0 {
+		merged.Status = protocol.SearchStatusIndexHit
+	}
 	return merged
 }
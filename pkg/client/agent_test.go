@@ -0,0 +1,192 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+	"github.com/erkkah/letarette/pkg/xt"
+)
+
+// fakeNATS is a NATS server accepting connections, subscriptions and
+// published messages, without ever delivering any messages
+type fakeNATS struct {
+	listener  net.Listener
+	published chan string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	fake := &fakeNATS{
+		listener:  listener,
+		published: make(chan string, 100),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return fake
+}
+
+func (fake *fakeNATS) URL() string {
+	return "nats://" + fake.listener.Addr().String()
+}
+
+func (fake *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	info := `{"server_id":"fake","version":"2.7.4","proto":1,"headers":true,"max_payload":1048576}`
+	fmt.Fprintf(conn, "INFO %s\r\n", info)
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "PUB", "HPUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			if _, err := io.CopyN(ioutil.Discard, reader, int64(size)+2); err != nil {
+				return
+			}
+			select {
+			case fake.published <- fields[1]:
+			default:
+			}
+		}
+	}
+}
+
+// waitForPublish waits for a message to be published to subject
+func (fake *fakeNATS) waitForPublish(subject string) {
+	for published := range fake.published {
+		if published == subject {
+			return
+		}
+	}
+}
+
+func TestSearchWithContext_CancelWaitingForResponses(t *testing.T) {
+	xt := xt.X(t)
+
+	server := newFakeNATS(t)
+	agent, err := NewSearchAgent([]string{server.URL()}, WithTimeout(time.Minute))
+	xt.Nilf(err, "Failed to create agent: %v", err)
+	defer agent.Close()
+	atomic.StoreInt32(&agent.(*searchAgent).volatileNumShards, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		server.waitForPublish("leta.q")
+		cancel()
+	}()
+
+	_, err = agent.SearchWithContext(ctx, "banana", []string{"test"}, 10, 0)
+	xt.Truef(errors.Is(err, context.Canceled), "Expected canceled search, got: %v", err)
+}
+
+func TestSearchWithContext_CancelWaitingForShards(t *testing.T) {
+	xt := xt.X(t)
+
+	server := newFakeNATS(t)
+	agent, err := NewSearchAgent([]string{server.URL()}, WithTimeout(time.Minute))
+	xt.Nilf(err, "Failed to create agent: %v", err)
+	defer agent.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = agent.SearchWithContext(ctx, "banana", []string{"test"}, 10, 0)
+	xt.Truef(errors.Is(err, context.Canceled), "Expected canceled search, got: %v", err)
+	xt.Assertf(time.Since(start) < time.Second, "Expected search to stop when canceled")
+}
+
+func TestSearchWithContext_MaxSpaces(t *testing.T) {
+	xt := xt.X(t)
+
+	spaces := make([]string, protocol.DefaultMaxSpaces+1)
+	for i := range spaces {
+		spaces[i] = fmt.Sprintf("space%d", i)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	server := newFakeNATS(t)
+	agent, err := NewSearchAgent([]string{server.URL()})
+	xt.Nilf(err, "Failed to create agent: %v", err)
+	defer agent.Close()
+
+	// No limit by default, the search is left to the workers
+	_, err = agent.SearchWithContext(ctx, "banana", spaces, 10, 0)
+	xt.Truef(errors.Is(err, context.Canceled), "Expected search to be sent, got: %v", err)
+
+	limited, err := NewSearchAgent([]string{server.URL()}, WithMaxSpaces(protocol.DefaultMaxSpaces))
+	xt.Nilf(err, "Failed to create agent: %v", err)
+	defer limited.Close()
+
+	res, err := limited.SearchWithContext(ctx, "banana", spaces, 10, 0)
+	xt.Truef(errors.Is(err, ErrTooManySpaces), "Unexpected error: %v", err)
+	xt.Equal(protocol.SearchStatusQueryError, res.Status)
+	_, err = limited.SearchWithContext(ctx, "banana", spaces[1:], 10, 0)
+	xt.Truef(errors.Is(err, context.Canceled), "Expected search within limit to be sent, got: %v", err)
+}
+
+func TestSearchWithContext_NoShards(t *testing.T) {
+	xt := xt.X(t)
+
+	server := newFakeNATS(t)
+	agent, err := NewSearchAgent([]string{server.URL()}, WithTimeout(100*time.Millisecond))
+	xt.Nilf(err, "Failed to create agent: %v", err)
+	defer agent.Close()
+
+	start := time.Now()
+	res, err := agent.SearchWithContext(context.Background(), "banana", []string{"test"}, 10, 0)
+	xt.Truef(errors.Is(err, ErrNoWorkers), "Expected no workers, got: %v", err)
+	xt.Equal(protocol.SearchStatusNoWorkers, res.Status)
+	xt.Assertf(time.Since(start) < time.Second, "Expected shard wait to be bounded by the timeout")
+}
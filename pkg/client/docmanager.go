@@ -36,6 +36,9 @@ type DocumentManager interface {
 	Close()
 	StartIndexRequestHandler(handler IndexRequestHandler) error
 	StartDocumentRequestHandler(handler DocumentRequestHandler) error
+	PublishMultiSpaceUpdate(update protocol.MultiSpaceDocumentUpdate) error
+	PublishTouch(touch protocol.DocumentTouch) error
+	PublishSpaceControl(control protocol.SpaceControl) error
 }
 
 type manager struct {
@@ -141,6 +144,24 @@ func (m *manager) StartDocumentRequestHandler(handler DocumentRequestHandler) er
 	return err
 }
 
+// PublishMultiSpaceUpdate pushes document updates for several spaces to the
+// cluster. Each worker applies the complete update atomically.
+func (m *manager) PublishMultiSpaceUpdate(update protocol.MultiSpaceDocumentUpdate) error {
+	return m.conn.Publish(m.topic+".document.update.multi", update)
+}
+
+// PublishTouch updates the timestamp of documents in the cluster,
+// without changing their content.
+func (m *manager) PublishTouch(touch protocol.DocumentTouch) error {
+	return m.conn.Publish(m.topic+".document.touch", touch)
+}
+
+// PublishSpaceControl disables or enables search in a space, and pauses
+// or resumes indexing of the space, on all workers in the cluster.
+func (m *manager) PublishSpaceControl(control protocol.SpaceControl) error {
+	return m.conn.Publish(m.topic+".space.control", control)
+}
+
 func truncateString(long string, max int) string {
 	result := long
 	// i indexes in bytes, but steps in runes
@@ -0,0 +1,109 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sort"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// MergeStrategy orders the hits of searches in several spaces,
+// see WithMergeStrategy.
+//
+// Ordering is page-local. Each page is first cut from the hits of all
+// spaces in rank order, and the hits of that page are then ordered.
+// With SpacePriority, the hits of the first space therefore come first
+// on each page, not first in the whole result, and a later page can
+// start with hits of the first space again. Search each space on its
+// own to page through the hits of one space after the other.
+type MergeStrategy int
+
+const (
+	// RankSort orders hits by rank, regardless of space. Hits with equal
+	// rank are ordered by the order of the spaces of the search, and then
+	// by document ID. This is the default.
+	RankSort MergeStrategy = iota
+	// Interleave takes one hit from each space in turn, in the order of
+	// the spaces of the search, each space in rank order.
+	Interleave
+	// SpacePriority returns the hits of each space in the order of the
+	// spaces of the search, each space in rank order.
+	SpacePriority
+)
+
+func (s MergeStrategy) String() string {
+	switch s {
+	case RankSort:
+		return "RankSort"
+	case Interleave:
+		return "Interleave"
+	case SpacePriority:
+		return "SpacePriority"
+	}
+	return "Unknown"
+}
+
+// orderHits returns the hits of a page ordered by a merge strategy.
+// Hits are expected in rank order. Hits of spaces not in the list
+// go last.
+func orderHits(hits []protocol.SearchHit, spaces []string, strategy MergeStrategy) []protocol.SearchHit {
+	spaceIndex := make(map[string]int, len(spaces))
+	for i, space := range spaces {
+		if _, found := spaceIndex[space]; !found {
+			spaceIndex[space] = i
+		}
+	}
+	indexOf := func(space string) int {
+		if index, found := spaceIndex[space]; found {
+			return index
+		}
+		return len(spaces)
+	}
+
+	ordered := append([]protocol.SearchHit{}, hits...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Rank != ordered[j].Rank {
+			return ordered[i].Rank < ordered[j].Rank
+		}
+		if a, b := indexOf(ordered[i].Space), indexOf(ordered[j].Space); a != b {
+			return a < b
+		}
+		return ordered[i].ID < ordered[j].ID
+	})
+
+	switch strategy {
+	case SpacePriority:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return indexOf(ordered[i].Space) < indexOf(ordered[j].Space)
+		})
+	case Interleave:
+		bySpace := make([][]protocol.SearchHit, len(spaces)+1)
+		for _, hit := range ordered {
+			index := indexOf(hit.Space)
+			bySpace[index] = append(bySpace[index], hit)
+		}
+		interleaved := ordered[:0]
+		for round := 0; len(interleaved) < len(hits); round++ {
+			for _, spaceHits := range bySpace {
+				if round < len(spaceHits) {
+					interleaved = append(interleaved, spaceHits[round])
+				}
+			}
+		}
+		ordered = interleaved
+	}
+	return ordered
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"testing"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+	"github.com/erkkah/letarette/pkg/xt"
+)
+
+func hitIDs(hits []protocol.SearchHit) []protocol.DocumentID {
+	ids := make([]protocol.DocumentID, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.ID
+	}
+	return ids
+}
+
+func TestOrderHits(t *testing.T) {
+	xt := xt.X(t)
+
+	hits := []protocol.SearchHit{
+		{Space: "b", ID: "b1", Rank: -9},
+		{Space: "a", ID: "a1", Rank: -8},
+		{Space: "b", ID: "b2", Rank: -7},
+		{Space: "b", ID: "b3", Rank: -6},
+		{Space: "a", ID: "a3", Rank: -5},
+		{Space: "a", ID: "a2", Rank: -5},
+	}
+	spaces := []string{"a", "b"}
+
+	xt.DeepEqual(
+		[]protocol.DocumentID{"b1", "a1", "b2", "b3", "a2", "a3"},
+		hitIDs(orderHits(hits, spaces, RankSort)),
+	)
+	xt.DeepEqual(
+		[]protocol.DocumentID{"a1", "b1", "a2", "b2", "a3", "b3"},
+		hitIDs(orderHits(hits, spaces, Interleave)),
+	)
+	xt.DeepEqual(
+		[]protocol.DocumentID{"a1", "a2", "a3", "b1", "b2", "b3"},
+		hitIDs(orderHits(hits, spaces, SpacePriority)),
+	)
+
+	// Hits are not modified in place
+	xt.Equal(protocol.DocumentID("b1"), hits[0].ID)
+}
+
+func TestOrderHits_Pages(t *testing.T) {
+	xt := xt.X(t)
+
+	// Hits of two pages, cut in rank order
+	pages := [][]protocol.SearchHit{
+		{
+			{Space: "b", ID: "b1", Rank: -9},
+			{Space: "a", ID: "a1", Rank: -8},
+			{Space: "b", ID: "b2", Rank: -7},
+		},
+		{
+			{Space: "b", ID: "b3", Rank: -6},
+			{Space: "a", ID: "a2", Rank: -5},
+			{Space: "a", ID: "a3", Rank: -4},
+		},
+	}
+	spaces := []string{"a", "b"}
+
+	ordered := func(strategy MergeStrategy) []protocol.DocumentID {
+		var ids []protocol.DocumentID
+		for _, page := range pages {
+			ids = append(ids, hitIDs(orderHits(page, spaces, strategy))...)
+		}
+		return ids
+	}
+
+	// Each page is ordered on its own
+	xt.DeepEqual(
+		[]protocol.DocumentID{"a1", "b1", "b2", "a2", "a3", "b3"},
+		ordered(SpacePriority),
+	)
+	xt.DeepEqual(
+		[]protocol.DocumentID{"a1", "b1", "b2", "a2", "b3", "a3"},
+		ordered(Interleave),
+	)
+}
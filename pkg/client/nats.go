@@ -17,23 +17,67 @@ package client
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
+// Default reconnect settings, used unless overridden by WithReconnect
+const (
+	DefaultMaxReconnects   = -1
+	DefaultReconnectWait   = time.Millisecond * 500
+	DefaultReconnectJitter = time.Millisecond * 100
+)
+
+// ReconnectOptions returns NATS options for re-establishing lost connections.
+// Up to maxReconnects attempts are made, a negative value means trying forever.
+// Attempts to the same server are separated by wait plus a random jitter
+// of up to the given duration, which spreads out reconnects from
+// many clients to a restarted server.
+func ReconnectOptions(maxReconnects int, wait time.Duration, jitter time.Duration) []nats.Option {
+	return []nats.Option{
+		nats.MaxReconnects(maxReconnects),
+		nats.ReconnectWait(wait),
+		nats.ReconnectJitter(jitter, jitter),
+	}
+}
+
+// TLSOptions returns NATS options for TLS connections, verifying the
+// server using the given root CA files, or the system root CAs when none
+// are given. The client certificate and key files are used for mutual TLS
+// when set. Skipping server verification is only meant for development.
+func TLSOptions(certFile, keyFile string, rootCAs []string, skipVerify bool) []nats.Option {
+	var options []nats.Option
+	if skipVerify {
+		// Set first, the other options modify the TLS config
+		options = append(options, nats.Secure(&tls.Config{InsecureSkipVerify: true}))
+	}
+	if len(rootCAs) > 0 {
+		options = append(options, nats.RootCAs(rootCAs...))
+	}
+	if certFile != "" || keyFile != "" {
+		options = append(options, nats.ClientCert(certFile, keyFile))
+	}
+	return options
+}
+
 func connect(URLs []string, opts state) (*nats.EncodedConn, error) {
-	natsOptions := []nats.Option{
-		nats.MaxReconnects(-1),
-		nats.ReconnectWait(time.Millisecond * 500),
+	if opts.seedFile != "" && opts.nkeySeed != "" {
+		return nil, fmt.Errorf("nkey seed file and nkey seed cannot both be set")
 	}
 
-	if len(opts.rootCAs) > 0 {
-		natsOptions = append(natsOptions, nats.RootCAs(opts.rootCAs...))
+	settings := reconnect{DefaultMaxReconnects, DefaultReconnectWait, DefaultReconnectJitter}
+	if opts.reconnect != nil {
+		settings = *opts.reconnect
 	}
+	natsOptions := ReconnectOptions(settings.max, settings.wait, settings.jitter)
+	natsOptions = append(natsOptions, TLSOptions(opts.certFile, opts.keyFile, opts.rootCAs, opts.skipVerify)...)
 
 	if opts.seedFile != "" {
 		option, err := nats.NkeyOptionFromSeed(opts.seedFile)
@@ -43,6 +87,18 @@ func connect(URLs []string, opts state) (*nats.EncodedConn, error) {
 		natsOptions = append(natsOptions, option)
 	}
 
+	if opts.nkeySeed != "" {
+		option, err := nkeyOptionFromSeed(opts.nkeySeed)
+		if err != nil {
+			return nil, err
+		}
+		natsOptions = append(natsOptions, option)
+	}
+
+	if opts.user != "" {
+		natsOptions = append(natsOptions, nats.UserInfo(opts.user, opts.password))
+	}
+
 	nc, err := nats.Connect(strings.Join(URLs, ","), natsOptions...)
 	if err != nil {
 		return nil, err
@@ -55,6 +111,34 @@ func connect(URLs []string, opts state) (*nats.EncodedConn, error) {
 	return ec, nil
 }
 
+// nkeyOptionFromSeed returns the Nkey authentication option for a user seed,
+// signing server nonces with the key pair of the seed
+func nkeyOptionFromSeed(seed string) (nats.Option, error) {
+	keyPair, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return nil, fmt.Errorf("invalid nkey seed: %w", err)
+	}
+	defer keyPair.Wipe()
+
+	publicKey, err := keyPair.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if !nkeys.IsValidPublicUserKey(publicKey) {
+		return nil, fmt.Errorf("nkey seed is not a user seed")
+	}
+
+	sign := func(nonce []byte) ([]byte, error) {
+		keyPair, err := nkeys.FromSeed([]byte(seed))
+		if err != nil {
+			return nil, err
+		}
+		defer keyPair.Wipe()
+		return keyPair.Sign(nonce)
+	}
+	return nats.Nkey(publicKey, sign), nil
+}
+
 const COMPRESSED_ENCODER = "COMPRESSED_ENCODER"
 const COMPRESSION_MARKER = uint8(0xf8)
 const COMPRESSION_LIMIT = 1024
@@ -14,15 +14,32 @@
 
 package client
 
-import "github.com/nats-io/nats.go"
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
 
 type state struct {
-	conn     *nats.EncodedConn
-	seedFile string
-	rootCAs  []string
-	topic    string
-	onError  func(error)
-	local    interface{}
+	conn       *nats.EncodedConn
+	seedFile   string
+	nkeySeed   string
+	user       string
+	password   string
+	rootCAs    []string
+	certFile   string
+	keyFile    string
+	skipVerify bool
+	topic      string
+	onError    func(error)
+	reconnect  *reconnect
+	local      interface{}
+}
+
+type reconnect struct {
+	max    int
+	wait   time.Duration
+	jitter time.Duration
 }
 
 func (s *state) apply(options []Option) {
@@ -55,6 +72,25 @@ func WithSeedFile(seedFile string) Option {
 	}
 }
 
+// WithNKey specifies an Nkey user seed for Nkey authentication,
+// like WithSeedFile, but without reading the seed from a file.
+// Connecting fails when both are set.
+func WithNKey(seed string) Option {
+	return func(o *state) {
+		o.nkeySeed = seed
+	}
+}
+
+// WithUserInfo specifies a username and password for NATS authentication.
+// Not to be confused with WithCredentials, setting the credentials sent
+// with search requests.
+func WithUserInfo(user, password string) Option {
+	return func(o *state) {
+		o.user = user
+		o.password = password
+	}
+}
+
 // WithRootCAs specifies a set of root CA files for server verification
 func WithRootCAs(rootCAFiles ...string) Option {
 	return func(o *state) {
@@ -69,3 +105,32 @@ func WithRootCAs(rootCAFiles ...string) Option {
 		}
 	}
 }
+
+// WithTLS specifies a client certificate and key file for mutual TLS,
+// and a root CA file for server verification, see WithRootCAs.
+// An empty caFile keeps the system root CAs, or those set by WithRootCAs.
+func WithTLS(certFile, keyFile, caFile string) Option {
+	return func(o *state) {
+		o.certFile = certFile
+		o.keyFile = keyFile
+		if caFile != "" {
+			o.rootCAs = append(o.rootCAs, caFile)
+		}
+	}
+}
+
+// WithTLSSkipVerify connects using TLS without verifying the server
+// certificate. Only meant for development, with self-signed certificates.
+func WithTLSSkipVerify() Option {
+	return func(o *state) {
+		o.skipVerify = true
+	}
+}
+
+// WithReconnect sets how the NATS connection is re-established when lost,
+// instead of the defaults, see ReconnectOptions.
+func WithReconnect(maxReconnects int, wait time.Duration, jitter time.Duration) Option {
+	return func(o *state) {
+		o.reconnect = &reconnect{maxReconnects, wait, jitter}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+
+	"github.com/erkkah/letarette/pkg/xt"
+)
+
+// writeTestCerts writes a self-signed CA certificate, and a client
+// certificate and key signed by the CA, to dir
+func writeTestCerts(t *testing.T, dir string) (certFile, keyFile, caFile string) {
+	t.Helper()
+
+	writePEM := func(name, blockType string, der []byte) string {
+		file := path.Join(dir, name)
+		data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return file
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "letarette test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %v", err)
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "letarette test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caTemplate, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal client key: %v", err)
+	}
+
+	caFile = writePEM("ca.pem", "CERTIFICATE", caDER)
+	certFile = writePEM("client.pem", "CERTIFICATE", clientDER)
+	keyFile = writePEM("client-key.pem", "EC PRIVATE KEY", clientKeyDER)
+	return
+}
+
+// natsOptionsFor applies the TLS options of client options
+// to default NATS options
+func natsOptionsFor(options ...Option) (nats.Options, error) {
+	var st state
+	st.apply(options)
+	natsOptions := nats.GetDefaultOptions()
+	for _, option := range TLSOptions(st.certFile, st.keyFile, st.rootCAs, st.skipVerify) {
+		if err := option(&natsOptions); err != nil {
+			return natsOptions, err
+		}
+	}
+	return natsOptions, nil
+}
+
+func TestWithTLS(t *testing.T) {
+	xt := xt.X(t)
+
+	certFile, keyFile, caFile := writeTestCerts(t, t.TempDir())
+
+	natsOptions, err := natsOptionsFor(WithTLS(certFile, keyFile, caFile))
+	xt.Nilf(err, "Failed to apply TLS options: %v", err)
+	xt.Truef(natsOptions.Secure, "Expected secure connection")
+	xt.NotNil(natsOptions.TLSConfig)
+	xt.Falsef(natsOptions.TLSConfig.InsecureSkipVerify, "Expected server verification")
+	xt.Equal(1, len(natsOptions.TLSConfig.Certificates))
+	xt.Equal("letarette test client", natsOptions.TLSConfig.Certificates[0].Leaf.Subject.CommonName)
+	xt.NotNilf(natsOptions.TLSConfig.RootCAs, "Expected CA to be loaded")
+
+	// Empty CA file keeps the root CAs
+	var st state
+	st.apply([]Option{WithRootCAs(caFile), WithTLS(certFile, keyFile, "")})
+	xt.DeepEqual([]string{caFile}, st.rootCAs)
+
+	natsOptions, err = natsOptionsFor()
+	xt.Nil(err)
+	xt.Falsef(natsOptions.Secure, "Expected no TLS without TLS options")
+}
+
+func TestWithTLS_InvalidFiles(t *testing.T) {
+	xt := xt.X(t)
+
+	dir := t.TempDir()
+	certFile, keyFile, caFile := writeTestCerts(t, dir)
+	missing := path.Join(dir, "missing.pem")
+	invalid := path.Join(dir, "invalid.pem")
+	err := ioutil.WriteFile(invalid, []byte("not a certificate"), 0600)
+	xt.Nil(err)
+
+	cases := []struct {
+		name string
+		tls  Option
+	}{
+		{"missing certificate", WithTLS(missing, keyFile, caFile)},
+		{"missing key", WithTLS(certFile, missing, caFile)},
+		{"missing CA", WithTLS(certFile, keyFile, missing)},
+		{"invalid certificate", WithTLS(invalid, keyFile, caFile)},
+		{"invalid key", WithTLS(certFile, invalid, caFile)},
+		{"invalid CA", WithTLS(certFile, keyFile, invalid)},
+		{"mismatched key", WithTLS(caFile, keyFile, caFile)},
+	}
+	for _, c := range cases {
+		_, err := natsOptionsFor(c.tls)
+		xt.NotNilf(err, "Expected error for %s", c.name)
+	}
+}
+
+func TestWithTLSSkipVerify(t *testing.T) {
+	xt := xt.X(t)
+
+	natsOptions, err := natsOptionsFor(WithTLSSkipVerify())
+	xt.Nil(err)
+	xt.Truef(natsOptions.Secure, "Expected secure connection")
+	xt.Truef(natsOptions.TLSConfig.InsecureSkipVerify, "Expected server verification to be skipped")
+
+	// Kept when combined with other TLS options
+	_, _, caFile := writeTestCerts(t, t.TempDir())
+	natsOptions, err = natsOptionsFor(WithTLSSkipVerify(), WithRootCAs(caFile))
+	xt.Nil(err)
+	xt.Truef(natsOptions.TLSConfig.InsecureSkipVerify, "Expected server verification to be skipped")
+	xt.NotNil(natsOptions.TLSConfig.RootCAs)
+}
+
+func TestNkeyOptionFromSeed(t *testing.T) {
+	xt := xt.X(t)
+
+	user, err := nkeys.CreateUser()
+	xt.Nil(err)
+	seed, err := user.Seed()
+	xt.Nil(err)
+	publicKey, err := user.PublicKey()
+	xt.Nil(err)
+
+	option, err := nkeyOptionFromSeed(string(seed))
+	xt.Nilf(err, "Expected valid user seed: %v", err)
+	natsOptions := nats.GetDefaultOptions()
+	err = option(&natsOptions)
+	xt.Nil(err)
+	xt.Equal(publicKey, natsOptions.Nkey)
+
+	nonce := []byte("nonce")
+	signature, err := natsOptions.SignatureCB(nonce)
+	xt.Nil(err)
+	xt.Nilf(user.Verify(nonce, signature), "Expected nonce to be signed by the seed")
+
+	_, err = nkeyOptionFromSeed("not a seed")
+	xt.NotNilf(err, "Expected invalid seed to be rejected")
+
+	account, err := nkeys.CreateAccount()
+	xt.Nil(err)
+	accountSeed, err := account.Seed()
+	xt.Nil(err)
+	_, err = nkeyOptionFromSeed(string(accountSeed))
+	xt.NotNilf(err, "Expected account seed to be rejected")
+}
+
+func TestConnect_SeedFileAndNKey(t *testing.T) {
+	xt := xt.X(t)
+
+	user, err := nkeys.CreateUser()
+	xt.Nil(err)
+	seed, err := user.Seed()
+	xt.Nil(err)
+	seedFile := path.Join(t.TempDir(), "user.nk")
+	err = ioutil.WriteFile(seedFile, seed, 0600)
+	xt.Nil(err)
+
+	var st state
+	st.apply([]Option{WithSeedFile(seedFile), WithNKey(string(seed))})
+	_, err = connect([]string{"nats://127.0.0.1:1"}, st)
+	xt.NotNil(err)
+	xt.Truef(strings.Contains(err.Error(), "cannot both be set"), "Unexpected error: %v", err)
+}
@@ -0,0 +1,285 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// Weight of the latest response time in the moving average
+// response time of a pooled cluster
+const poolLatencyWeight = 0.3
+
+// Clusters failing a request are not preferred for this long
+const poolFailureBackoff = 30 * time.Second
+
+// ErrNoClusters is returned by NewAgentPool when no cluster could
+// be connected to
+var ErrNoClusters = errors.New("no cluster available")
+
+type pooledAgent struct {
+	// Held while connecting
+	connecting sync.Mutex
+	connect    func() (SearchAgent, error)
+	// Nil until connected
+	agent SearchAgent
+	// Exponentially weighted moving average response time, in seconds
+	latency float64
+	// Time of the last failed request or connection attempt
+	failed time.Time
+}
+
+type agentPool struct {
+	mutex  sync.Mutex
+	agents []*pooledAgent
+	closed bool
+}
+
+// NewAgentPool returns a SearchAgent routing requests to several
+// independent letarette clusters, given by the NATS URLs of each.
+// The options apply to the agent of each cluster.
+//
+// Each request is sent to the cluster with the shortest moving average
+// response time. Clusters failing a request are tried last for a while,
+// and the request is retried on the next cluster, so an unreachable
+// cluster is failed over transparently. Requests rejected by the agent
+// itself, like searches without spaces, are not retried.
+//
+// Clusters failing to connect are kept in the pool, and are connected
+// to by the first request routed to them, once they are no longer
+// tried last. ErrNoClusters is returned when no cluster connects.
+func NewAgentPool(clusters [][]string, options ...Option) (SearchAgent, error) {
+	connectors := make([]func() (SearchAgent, error), len(clusters))
+	for i, URLs := range clusters {
+		URLs := URLs
+		connectors[i] = func() (SearchAgent, error) {
+			return NewSearchAgent(URLs, options...)
+		}
+	}
+	return newAgentPool(connectors)
+}
+
+// newAgentPool connects to each cluster using its connector
+func newAgentPool(connectors []func() (SearchAgent, error)) (*agentPool, error) {
+	pool := &agentPool{}
+	var connectErrors []error
+	for _, connect := range connectors {
+		pooled := &pooledAgent{connect: connect}
+		_, err := pool.agentOf(pooled)
+		if err != nil {
+			connectErrors = append(connectErrors, err)
+		}
+		pool.agents = append(pool.agents, pooled)
+	}
+	if len(connectErrors) == len(pool.agents) {
+		return nil, fmt.Errorf("%w: %v", ErrNoClusters, connectErrors)
+	}
+	return pool, nil
+}
+
+func (pool *agentPool) Close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.closed = true
+	for _, pooled := range pool.agents {
+		if pooled.agent != nil {
+			pooled.agent.Close()
+		}
+	}
+}
+
+// agentOf returns the agent of a pooled cluster, connecting first
+// when not connected. Failed connection attempts count as failed
+// requests, see report.
+func (pool *agentPool) agentOf(pooled *pooledAgent) (SearchAgent, error) {
+	pooled.connecting.Lock()
+	defer pooled.connecting.Unlock()
+
+	pool.mutex.Lock()
+	agent, closed := pooled.agent, pool.closed
+	pool.mutex.Unlock()
+	if agent != nil {
+		return agent, nil
+	}
+	if closed {
+		return nil, nats.ErrConnectionClosed
+	}
+
+	agent, err := pooled.connect()
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if err != nil {
+		pooled.failed = time.Now()
+		return nil, err
+	}
+	if pool.closed {
+		agent.Close()
+		return nil, nats.ErrConnectionClosed
+	}
+	pooled.agent = agent
+	return agent, nil
+}
+
+// ordered returns the pooled agents, healthy ones first,
+// ordered by response time
+func (pool *agentPool) ordered() []*pooledAgent {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	now := time.Now()
+	failing := func(pooled *pooledAgent) bool {
+		return now.Sub(pooled.failed) < poolFailureBackoff
+	}
+	ordered := append([]*pooledAgent{}, pool.agents...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if failing(ordered[i]) != failing(ordered[j]) {
+			return !failing(ordered[i])
+		}
+		return ordered[i].latency < ordered[j].latency
+	})
+	return ordered
+}
+
+func (pool *agentPool) report(pooled *pooledAgent, elapsed time.Duration, err error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if err != nil {
+		pooled.failed = time.Now()
+		return
+	}
+	pooled.failed = time.Time{}
+	seconds := elapsed.Seconds()
+	if pooled.latency == 0 {
+		pooled.latency = seconds
+	} else {
+		pooled.latency = poolLatencyWeight*seconds + (1-poolLatencyWeight)*pooled.latency
+	}
+}
+
+// retryable reports if a failed request can be retried on another cluster
+func retryable(err error) bool {
+	return !errors.Is(err, ErrNoSpace) && !errors.Is(err, ErrTooManySpaces) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// do runs a request on the pooled agents in order, until it succeeds
+// or fails with an error that cannot be retried
+func (pool *agentPool) do(request func(agent SearchAgent) error) (err error) {
+	for _, pooled := range pool.ordered() {
+		var agent SearchAgent
+		agent, err = pool.agentOf(pooled)
+		if err != nil {
+			continue
+		}
+		start := time.Now()
+		err = request(agent)
+		if err != nil && !retryable(err) {
+			return err
+		}
+		pool.report(pooled, time.Since(start), err)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (pool *agentPool) Search(
+	q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+) (
+	protocol.SearchResponse,
+	error,
+) {
+	return pool.SearchWithContext(context.Background(), q, spaces, pageLimit, pageOffset, options...)
+}
+
+func (pool *agentPool) SearchWithContext(
+	ctx context.Context, q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+) (
+	res protocol.SearchResponse,
+	err error,
+) {
+	err = pool.do(func(agent SearchAgent) (err error) {
+		res, err = agent.SearchWithContext(ctx, q, spaces, pageLimit, pageOffset, options...)
+		return
+	})
+	return
+}
+
+// SearchStream streams from a single cluster, since the chunks are
+// searched in a snapshot pinned in that cluster. Streams are not
+// retried, and do not count towards the response time.
+func (pool *agentPool) SearchStream(
+	ctx context.Context, q string, spaces []string, limit int, offset int,
+	out chan<- protocol.SearchResult, options ...SearchOption,
+) (err error) {
+	for _, pooled := range pool.ordered() {
+		var agent SearchAgent
+		agent, err = pool.agentOf(pooled)
+		if err != nil {
+			continue
+		}
+		err = agent.SearchStream(ctx, q, spaces, limit, offset, out, options...)
+		if err != nil && retryable(err) {
+			pool.report(pooled, 0, err)
+		}
+		return err
+	}
+	close(out)
+	return err
+}
+
+func (pool *agentPool) StemmerState() (states []protocol.StemmerState, err error) {
+	err = pool.do(func(agent SearchAgent) (err error) {
+		states, err = agent.StemmerState()
+		return
+	})
+	return
+}
+
+func (pool *agentPool) Ping() (result PingResult, err error) {
+	err = pool.do(func(agent SearchAgent) (err error) {
+		result, err = agent.Ping()
+		return
+	})
+	return
+}
+
+func (pool *agentPool) SQL(statement string, args ...string) (responses []protocol.SQLResponse, err error) {
+	err = pool.do(func(agent SearchAgent) (err error) {
+		responses, err = agent.SQL(statement, args...)
+		return
+	})
+	return
+}
+
+func (pool *agentPool) IndexStep(space string) (results []protocol.IndexStepResult, err error) {
+	err = pool.do(func(agent SearchAgent) (err error) {
+		results, err = agent.IndexStep(space)
+		return
+	})
+	return
+}
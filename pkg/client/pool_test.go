@@ -0,0 +1,223 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+	"github.com/erkkah/letarette/pkg/xt"
+)
+
+// fakeAgent answers searches with its name as the query,
+// or fails with err
+type fakeAgent struct {
+	name     string
+	err      error
+	searches int
+	closed   bool
+}
+
+func (fake *fakeAgent) Close() {
+	fake.closed = true
+}
+
+func (fake *fakeAgent) Search(
+	q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+) (protocol.SearchResponse, error) {
+	return fake.SearchWithContext(context.Background(), q, spaces, pageLimit, pageOffset, options...)
+}
+
+func (fake *fakeAgent) SearchWithContext(
+	ctx context.Context, q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+) (protocol.SearchResponse, error) {
+	fake.searches++
+	if fake.err != nil {
+		return protocol.SearchResponse{}, fake.err
+	}
+	return protocol.SearchResponse{
+		Status: protocol.SearchStatusNoHit,
+		Result: protocol.SearchResult{Respelt: fake.name},
+	}, nil
+}
+
+func (fake *fakeAgent) SearchStream(
+	ctx context.Context, q string, spaces []string, limit int, offset int,
+	out chan<- protocol.SearchResult, options ...SearchOption,
+) error {
+	defer close(out)
+	fake.searches++
+	if fake.err != nil {
+		return fake.err
+	}
+	out <- protocol.SearchResult{Respelt: fake.name}
+	return nil
+}
+
+func (fake *fakeAgent) StemmerState() ([]protocol.StemmerState, error) {
+	return nil, fake.err
+}
+
+func (fake *fakeAgent) Ping() (PingResult, error) {
+	return PingResult{}, fake.err
+}
+
+func (fake *fakeAgent) SQL(statement string, args ...string) ([]protocol.SQLResponse, error) {
+	return nil, fake.err
+}
+
+func (fake *fakeAgent) IndexStep(space string) ([]protocol.IndexStepResult, error) {
+	return nil, fake.err
+}
+
+func connected(agent SearchAgent) func() (SearchAgent, error) {
+	return func() (SearchAgent, error) {
+		return agent, nil
+	}
+}
+
+// searchedBy returns the name of the fake agent serving a search
+func searchedBy(pool *agentPool) (string, error) {
+	res, err := pool.Search("banana", []string{"test"}, 10, 0)
+	return res.Result.Respelt, err
+}
+
+func TestAgentPool_LatencyOrder(t *testing.T) {
+	xt := xt.X(t)
+
+	a, b := &fakeAgent{name: "a"}, &fakeAgent{name: "b"}
+	pool, err := newAgentPool([]func() (SearchAgent, error){connected(a), connected(b)})
+	xt.Nilf(err, "Failed to create pool: %v", err)
+
+	pool.report(pool.agents[0], time.Second, nil)
+	pool.report(pool.agents[1], time.Millisecond, nil)
+
+	served, err := searchedBy(pool)
+	xt.Nil(err)
+	xt.Equalf("b", served, "Expected fastest cluster to serve search")
+
+	// Moving average, a single fast response does not reorder
+	pool.report(pool.agents[0], 0, nil)
+	served, _ = searchedBy(pool)
+	xt.Equal("b", served)
+
+	pool.Close()
+	xt.Truef(a.closed && b.closed, "Expected agents to be closed")
+}
+
+func TestAgentPool_Failover(t *testing.T) {
+	xt := xt.X(t)
+
+	a, b := &fakeAgent{name: "a"}, &fakeAgent{name: "b"}
+	pool, err := newAgentPool([]func() (SearchAgent, error){connected(a), connected(b)})
+	xt.Nilf(err, "Failed to create pool: %v", err)
+	pool.report(pool.agents[0], time.Millisecond, nil)
+	pool.report(pool.agents[1], time.Second, nil)
+
+	a.err = ErrNoWorkers
+	served, err := searchedBy(pool)
+	xt.Nilf(err, "Expected search to fail over: %v", err)
+	xt.Equal("b", served)
+	xt.Equal(1, a.searches)
+
+	// Failed clusters are tried last within the back-off window
+	a.err = nil
+	served, _ = searchedBy(pool)
+	xt.Equalf("b", served, "Expected failed cluster to be tried last")
+	xt.Equal(1, a.searches)
+
+	pool.agents[0].failed = time.Now().Add(-poolFailureBackoff)
+	served, _ = searchedBy(pool)
+	xt.Equalf("a", served, "Expected cluster to be preferred after back-off")
+
+	// All clusters failing returns the last error
+	a.err, b.err = ErrNoWorkers, ErrNoWorkers
+	_, err = searchedBy(pool)
+	xt.Truef(errors.Is(err, ErrNoWorkers), "Unexpected error: %v", err)
+}
+
+func TestAgentPool_NoRetry(t *testing.T) {
+	xt := xt.X(t)
+
+	for _, cause := range []error{ErrNoSpace, context.Canceled, context.DeadlineExceeded} {
+		a, b := &fakeAgent{name: "a", err: cause}, &fakeAgent{name: "b"}
+		pool, err := newAgentPool([]func() (SearchAgent, error){connected(a), connected(b)})
+		xt.Nilf(err, "Failed to create pool: %v", err)
+		pool.report(pool.agents[0], time.Millisecond, nil)
+		pool.report(pool.agents[1], time.Second, nil)
+
+		_, err = searchedBy(pool)
+		xt.Truef(errors.Is(err, cause), "Expected %v, got: %v", cause, err)
+		xt.Equalf(0, b.searches, "Expected no retry on %v", cause)
+		xt.Truef(pool.agents[0].failed.IsZero(), "Expected no back-off on %v", cause)
+	}
+}
+
+func TestAgentPool_Reconnect(t *testing.T) {
+	xt := xt.X(t)
+
+	a, b := &fakeAgent{name: "a"}, &fakeAgent{name: "b"}
+	unreachable := errors.New("unreachable")
+	connects := 0
+	reconnecting := func() (SearchAgent, error) {
+		connects++
+		if connects == 1 {
+			return nil, unreachable
+		}
+		return a, nil
+	}
+	pool, err := newAgentPool([]func() (SearchAgent, error){reconnecting, connected(b)})
+	xt.Nilf(err, "Failed to create pool: %v", err)
+	xt.Equalf(2, len(pool.agents), "Expected unconnected cluster to be kept")
+
+	served, _ := searchedBy(pool)
+	xt.Equal("b", served)
+	xt.Equalf(1, connects, "Expected no reconnect within back-off")
+
+	pool.agents[0].failed = time.Now().Add(-poolFailureBackoff)
+	served, err = searchedBy(pool)
+	xt.Nil(err)
+	xt.Equalf("a", served, "Expected cluster to be connected lazily")
+	xt.Equal(2, connects)
+
+	_, err = newAgentPool([]func() (SearchAgent, error){func() (SearchAgent, error) {
+		return nil, unreachable
+	}})
+	xt.Truef(errors.Is(err, ErrNoClusters), "Unexpected error: %v", err)
+}
+
+func TestAgentPool_SearchStream(t *testing.T) {
+	xt := xt.X(t)
+
+	unreachable := errors.New("unreachable")
+	b := &fakeAgent{name: "b"}
+	pool, err := newAgentPool([]func() (SearchAgent, error){
+		func() (SearchAgent, error) { return nil, unreachable },
+		connected(b),
+	})
+	xt.Nilf(err, "Failed to create pool: %v", err)
+	pool.agents[0].failed = time.Time{}
+
+	out := make(chan protocol.SearchResult, 1)
+	err = pool.SearchStream(context.Background(), "banana", []string{"test"}, 0, 0, out)
+	xt.Nil(err)
+	chunk := <-out
+	xt.Equalf("b", chunk.Respelt, "Expected stream from connected cluster")
+	_, open := <-out
+	xt.Falsef(open, "Expected stream to be closed")
+}
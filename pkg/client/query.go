@@ -0,0 +1,158 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// QueryBuilder builds query strings in the search syntax of the workers,
+// quoting terms as needed:
+//
+//     query := client.NewQuery().And("horse", "saddle").Not("pony").Phrase("horse", "head")
+//     client.SearchQuery(ctx, agent, query, spaces, limit, offset)
+//
+// All included terms must match, near each other, and documents matching
+// an excluded term are removed from the result.
+//
+// Alternatives are added as OR groups, which are required in addition to
+// the included terms. Alternatives can be nested queries, where all
+// included terms of the query must match, but not necessarily near
+// each other:
+//
+//     saddle := client.NewQuery().And("saddle").Not("pony")
+//     query := client.NewQuery().And("horse").OrQueries(saddle, client.NewQuery().Or("bridle", "reins"))
+//
+// builds "horse (saddle -pony OR (bridle OR reins))".
+type QueryBuilder struct {
+	parts []string
+}
+
+// NewQuery returns an empty QueryBuilder
+func NewQuery() *QueryBuilder {
+	return &QueryBuilder{}
+}
+
+// And adds terms that must all match
+func (q *QueryBuilder) And(terms ...string) *QueryBuilder {
+	for _, term := range terms {
+		if term = cleanTerm(term); term != "" {
+			q.parts = append(q.parts, quoteTerm(term))
+		}
+	}
+	return q
+}
+
+// Not adds a term excluding matching documents
+func (q *QueryBuilder) Not(term string) *QueryBuilder {
+	if term = cleanTerm(term); term != "" {
+		q.parts = append(q.parts, "-"+quoteTerm(term))
+	}
+	return q
+}
+
+// Phrase adds words that must match in sequence
+func (q *QueryBuilder) Phrase(words ...string) *QueryBuilder {
+	if phrase := cleanTerm(strings.Join(words, " ")); phrase != "" {
+		q.parts = append(q.parts, `"`+phrase+`"`)
+	}
+	return q
+}
+
+// Prefix adds a term matching all words starting with it
+func (q *QueryBuilder) Prefix(term string) *QueryBuilder {
+	if term = cleanTerm(term); term != "" {
+		q.parts = append(q.parts, quoteTerm(term)+"*")
+	}
+	return q
+}
+
+// Or adds terms of which any must match
+func (q *QueryBuilder) Or(terms ...string) *QueryBuilder {
+	var alternatives []string
+	for _, term := range terms {
+		if term = cleanTerm(term); term != "" {
+			alternatives = append(alternatives, quoteTerm(term))
+		}
+	}
+	return q.group(alternatives)
+}
+
+// OrQueries adds queries of which any must match. Queries without
+// included terms match nothing, and are left out.
+func (q *QueryBuilder) OrQueries(queries ...*QueryBuilder) *QueryBuilder {
+	var alternatives []string
+	for _, query := range queries {
+		if query.included() {
+			alternatives = append(alternatives, query.String())
+		}
+	}
+	return q.group(alternatives)
+}
+
+func (q *QueryBuilder) group(alternatives []string) *QueryBuilder {
+	switch len(alternatives) {
+	case 0:
+	case 1:
+		q.parts = append(q.parts, alternatives[0])
+	default:
+		q.parts = append(q.parts, "("+strings.Join(alternatives, " OR ")+")")
+	}
+	return q
+}
+
+// included reports if the query has any included terms
+func (q *QueryBuilder) included() bool {
+	for _, part := range q.parts {
+		if !strings.HasPrefix(part, "-") {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the query string
+func (q *QueryBuilder) String() string {
+	return strings.Join(q.parts, " ")
+}
+
+// cleanTerm removes quotes, which cannot be escaped in the search syntax
+func cleanTerm(term string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(term, `"`, " ")), " ")
+}
+
+// quoteTerm quotes terms that would otherwise be parsed as operators,
+// column prefixes or several terms
+func quoteTerm(term string) string {
+	plain := !strings.HasPrefix(term, "-") && !strings.ContainsAny(term, `*'():`) &&
+		strings.IndexFunc(term, unicode.IsSpace) < 0 && term != "OR"
+	if plain {
+		return term
+	}
+	return `"` + term + `"`
+}
+
+// SearchQuery runs a built query using a search agent,
+// see SearchAgent.SearchWithContext
+func SearchQuery(
+	ctx context.Context, agent SearchAgent, query *QueryBuilder,
+	spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+) (protocol.SearchResponse, error) {
+	return agent.SearchWithContext(ctx, query.String(), spaces, pageLimit, pageOffset, options...)
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"testing"
+
+	"github.com/erkkah/letarette/pkg/xt"
+)
+
+func TestQueryBuilder(t *testing.T) {
+	xt := xt.X(t)
+
+	query := NewQuery().
+		And("cat", "-dog", "title:horse").
+		Not(`"pony"`).
+		Phrase("horse", " head").
+		Prefix("ban")
+	xt.Equal(`cat "-dog" "title:horse" -pony "horse head" ban*`, query.String())
+
+	xt.Equal("", NewQuery().And(" ", `""`).Not("").Phrase().String())
+}
+
+func TestQueryBuilder_Or(t *testing.T) {
+	xt := xt.X(t)
+
+	query := NewQuery().And("horse").Or("saddle", "bridle rope", "OR", "(reins)")
+	xt.Equal(`horse (saddle OR "bridle rope" OR "OR" OR "(reins)")`, query.String())
+
+	// Single alternatives are plain terms
+	xt.Equal("horse", NewQuery().Or("", "horse", `""`).String())
+	xt.Equal("", NewQuery().Or().String())
+}
+
+func TestQueryBuilder_Nested(t *testing.T) {
+	xt := xt.X(t)
+
+	saddle := NewQuery().And("saddle").Not("pony")
+	tack := NewQuery().Or("bridle", "reins")
+	query := NewQuery().And("horse").OrQueries(saddle, tack)
+	xt.Equal("horse (saddle -pony OR (bridle OR reins))", query.String())
+
+	inner := NewQuery().OrQueries(NewQuery().Phrase("horse", "head"), NewQuery().And("dog", "house"))
+	outer := NewQuery().OrQueries(inner, NewQuery().Prefix("ban"))
+	xt.Equal(`(("horse head" OR dog house) OR ban*)`, outer.String())
+
+	// Queries without included terms are left out
+	query = NewQuery().OrQueries(NewQuery().Not("pony"), NewQuery(), saddle)
+	xt.Equal("saddle -pony", query.String())
+	xt.Equal("", NewQuery().OrQueries(NewQuery().Not("pony")).String())
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+)
+
+// DefaultStreamChunkSize is the default number of hits fetched by
+// each search of a stream, see WithStreamChunkSize.
+const DefaultStreamChunkSize = 100
+
+// WithStreamChunkSize sets the number of hits fetched by each search
+// of a SearchStream, instead of DefaultStreamChunkSize.
+func WithStreamChunkSize(hits int) Option {
+	return func(st *state) {
+		sa := st.local.(*searchAgent)
+		sa.streamChunkSize = hits
+	}
+}
+
+// SearchStream runs a query like Search, pushing the result to out in
+// chunks of hits as they are fetched, and closes out when done.
+// Up to limit hits are streamed, all hits when limit is zero, starting
+// at chunk number offset. The first chunk is always pushed, also when
+// empty, carrying the totals and spelling fixes of the result.
+//
+// Each chunk is a separate search of a pinned snapshot of the index,
+// so chunks stay consistent while the index changes, and no single
+// response needs to hold the whole result. The snapshot is released
+// when the stream ends. Searches are capped like other searches,
+// see protocol.SearchResult.Capped.
+//
+// Streaming stops with the context error when the context is done,
+// also while searching or waiting for the receiver of out.
+func (agent *searchAgent) SearchStream(
+	ctx context.Context, q string, spaces []string, limit int, offset int,
+	out chan<- protocol.SearchResult, options ...SearchOption,
+) error {
+	chunkSize := agent.streamChunkSize
+	if chunkSize < 1 {
+		chunkSize = DefaultStreamChunkSize
+	}
+	stream := searchStream{
+		search:    agent.SearchWithContext,
+		chunkSize: chunkSize,
+	}
+	return stream.run(ctx, q, spaces, limit, offset, out, options...)
+}
+
+// searchFunc runs one search of a stream, see searchAgent.SearchWithContext
+type searchFunc func(
+	ctx context.Context, q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+) (protocol.SearchResponse, error)
+
+// Time allowed for releasing the snapshot of an ended stream
+const snapshotReleaseTimeout = time.Second * 5
+
+type searchStream struct {
+	search    searchFunc
+	chunkSize int
+}
+
+// run pages through a search in chunks, see SearchStream
+func (stream searchStream) run(
+	ctx context.Context, q string, spaces []string, limit int, offset int,
+	out chan<- protocol.SearchResult, options ...SearchOption,
+) error {
+	defer close(out)
+
+	chunkSize := stream.chunkSize
+	snapshot := ""
+	defer func() {
+		if snapshot != "" {
+			stream.release(q, spaces, offset, snapshot, options)
+		}
+	}()
+
+	streamed := 0
+	for page := offset; limit <= 0 || streamed < limit; page++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		pin := WithNewSnapshot()
+		if snapshot != "" {
+			pin = WithSnapshot(snapshot)
+		}
+		pageOptions := append(options[:len(options):len(options)], pin)
+		res, err := stream.search(ctx, q, spaces, chunkSize, page, pageOptions...)
+		if err != nil {
+			return err
+		}
+		if !streamableStatus(res.Status) {
+			return fmt.Errorf("search stream failed: %s", res.Status)
+		}
+		if res.Result.Snapshot != "" {
+			snapshot = res.Result.Snapshot
+		}
+
+		last := len(res.Result.Hits) < chunkSize
+		if page > offset && len(res.Result.Hits) == 0 {
+			return nil
+		}
+		if limit > 0 && len(res.Result.Hits) > limit-streamed {
+			res.Result.Hits = res.Result.Hits[:limit-streamed]
+		}
+		streamed += len(res.Result.Hits)
+
+		select {
+		case out <- res.Result:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if last {
+			return nil
+		}
+	}
+	return nil
+}
+
+// release releases the snapshot of a stream by searching it a final
+// time. Not bound to the stream context, which might be done already.
+// Failures are ignored, unreleased snapshots expire eventually.
+func (stream searchStream) release(q string, spaces []string, page int, snapshot string, options []SearchOption) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotReleaseTimeout)
+	defer cancel()
+	releaseOptions := append(options[:len(options):len(options)], WithReleasedSnapshot(snapshot))
+	_, _ = stream.search(ctx, q, spaces, 1, page, releaseOptions...)
+}
+
+// streamableStatus reports if a search response status carries a result
+func streamableStatus(status protocol.SearchStatusCode) bool {
+	switch status {
+	case protocol.SearchStatusNoHit, protocol.SearchStatusCacheHit,
+		protocol.SearchStatusIndexHit, protocol.SearchStatusStopwordsOnly:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/erkkah/letarette/pkg/protocol"
+	"github.com/erkkah/letarette/pkg/xt"
+)
+
+// fakeSearch serves a fixed number of hits from a pinned snapshot,
+// recording the requests made
+type fakeSearch struct {
+	sync.Mutex
+	hits     int
+	requests []protocol.SearchRequest
+}
+
+func (fake *fakeSearch) search(
+	ctx context.Context, q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+) (protocol.SearchResponse, error) {
+	req := protocol.SearchRequest{
+		Query:      q,
+		Spaces:     spaces,
+		PageLimit:  uint16(pageLimit),
+		PageOffset: uint16(pageOffset),
+	}
+	for _, option := range options {
+		option(&req)
+	}
+	fake.Lock()
+	fake.requests = append(fake.requests, req)
+	fake.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return protocol.SearchResponse{}, err
+	}
+
+	res := protocol.SearchResponse{Status: protocol.SearchStatusNoHit}
+	res.Result.TotalHits = fake.hits
+	if req.PinSnapshot || (req.Snapshot != "" && !req.ReleaseSnapshot) {
+		res.Result.Snapshot = "index:1"
+	}
+	for i := pageOffset * pageLimit; i < fake.hits && i < (pageOffset+1)*pageLimit; i++ {
+		res.Status = protocol.SearchStatusIndexHit
+		res.Result.Hits = append(res.Result.Hits, protocol.SearchHit{
+			Space: "test",
+			ID:    protocol.DocumentID(fmt.Sprintf("%d", i)),
+		})
+	}
+	return res, nil
+}
+
+func (fake *fakeSearch) released() bool {
+	fake.Lock()
+	defer fake.Unlock()
+	last := fake.requests[len(fake.requests)-1]
+	return last.ReleaseSnapshot && last.Snapshot == "index:1"
+}
+
+func collectStream(out <-chan protocol.SearchResult) []protocol.SearchResult {
+	var chunks []protocol.SearchResult
+	for chunk := range out {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// runStream runs a stream to its end, returning the chunks streamed
+func runStream(stream searchStream, limit int) ([]protocol.SearchResult, error) {
+	out := make(chan protocol.SearchResult)
+	done := make(chan error)
+	go func() {
+		done <- stream.run(context.Background(), "banana", []string{"test"}, limit, 0, out)
+	}()
+	chunks := collectStream(out)
+	return chunks, <-done
+}
+
+func TestSearchStream(t *testing.T) {
+	xt := xt.X(t)
+
+	fake := &fakeSearch{hits: 25}
+	stream := searchStream{search: fake.search, chunkSize: 10}
+	chunks, err := runStream(stream, 0)
+
+	xt.Nilf(err, "Stream failed: %v", err)
+	xt.Equal(3, len(chunks))
+	xt.Equal(5, len(chunks[2].Hits))
+	xt.Truef(fake.requests[0].PinSnapshot, "Expected first search to pin a snapshot")
+	xt.Equal("index:1", fake.requests[1].Snapshot)
+	xt.Truef(fake.released(), "Expected snapshot to be released")
+}
+
+func TestSearchStream_Limit(t *testing.T) {
+	xt := xt.X(t)
+
+	fake := &fakeSearch{hits: 25}
+	stream := searchStream{search: fake.search, chunkSize: 10}
+	chunks, err := runStream(stream, 15)
+
+	xt.Nilf(err, "Stream failed: %v", err)
+	xt.Equal(2, len(chunks))
+	xt.Equal(5, len(chunks[1].Hits))
+	xt.Truef(fake.released(), "Expected snapshot to be released")
+}
+
+func TestSearchStream_Empty(t *testing.T) {
+	xt := xt.X(t)
+
+	fake := &fakeSearch{}
+	stream := searchStream{search: fake.search, chunkSize: 10}
+	chunks, err := runStream(stream, 0)
+
+	xt.Nilf(err, "Stream failed: %v", err)
+	xt.Equalf(1, len(chunks), "Expected a single empty chunk before closing")
+	xt.Equal(0, len(chunks[0].Hits))
+	xt.Truef(fake.released(), "Expected snapshot to be released")
+}
+
+func TestSearchStream_Cancel(t *testing.T) {
+	xt := xt.X(t)
+
+	fake := &fakeSearch{hits: 1000}
+	stream := searchStream{search: fake.search, chunkSize: 10}
+	out := make(chan protocol.SearchResult)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- stream.run(ctx, "banana", []string{"test"}, 0, 0, out)
+	}()
+
+	first := <-out
+	xt.Equal(10, len(first.Hits))
+	cancel()
+	chunks := collectStream(out)
+	err := <-done
+
+	xt.Truef(errors.Is(err, context.Canceled), "Expected canceled stream, got: %v", err)
+	xt.Assertf(len(chunks) <= 1, "Expected stream to stop after cancel")
+	xt.Truef(fake.released(), "Expected snapshot of canceled stream to be released")
+}
+
+func TestSearchStream_Error(t *testing.T) {
+	xt := xt.X(t)
+
+	failing := func(
+		ctx context.Context, q string, spaces []string, pageLimit int, pageOffset int, options ...SearchOption,
+	) (protocol.SearchResponse, error) {
+		return protocol.SearchResponse{Status: protocol.SearchStatusServerError}, nil
+	}
+	stream := searchStream{search: failing, chunkSize: 10}
+	chunks, err := runStream(stream, 0)
+
+	xt.NotNil(err)
+	xt.Equal(0, len(chunks))
+}
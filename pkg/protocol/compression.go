@@ -0,0 +1,80 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+/*
+	Search response compression.
+
+	Clients accepting compressed search responses set the
+	AcceptEncodingHeader request header to EncodingGzip. Workers then
+	gzip responses larger than their configured threshold, and mark them
+	with the ContentEncodingHeader response header. Smaller responses,
+	and all responses to clients not accepting compression, are plain JSON.
+
+	Both ends must support message headers. Workers not supporting
+	compression ignore the request header, so clients must always check
+	the response header before decoding.
+*/
+
+// AcceptEncodingHeader is the search request header listing
+// the response encodings accepted by the client
+const AcceptEncodingHeader = "Letarette-Accept-Encoding"
+
+// ContentEncodingHeader is the search response header stating
+// the encoding of the response. Plain JSON responses have no header.
+const ContentEncodingHeader = "Letarette-Content-Encoding"
+
+// EncodingGzip is the gzip response encoding
+const EncodingGzip = "gzip"
+
+// CompressResponse gzips an encoded response
+func CompressResponse(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// DecodeResponse returns the plain JSON of a response with
+// the given content encoding
+func DecodeResponse(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case EncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unsupported response encoding %q", encoding)
+	}
+}
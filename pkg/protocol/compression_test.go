@@ -0,0 +1,42 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/erkkah/letarette/pkg/xt"
+)
+
+func TestCompressResponse(t *testing.T) {
+	xt := xt.X(t)
+
+	plain := []byte(`{"Result":{"Hits":[` + strings.Repeat(`{"Snippet":"lorem ipsum"},`, 100) + `{}]}}`)
+	packed, err := CompressResponse(plain)
+	xt.Nil(err)
+	xt.True(len(packed) < len(plain))
+
+	decoded, err := DecodeResponse(packed, EncodingGzip)
+	xt.Nil(err)
+	xt.Equal(string(plain), string(decoded))
+
+	decoded, err = DecodeResponse(plain, "")
+	xt.Nil(err)
+	xt.Equal(string(plain), string(decoded))
+
+	_, err = DecodeResponse(packed, "br")
+	xt.NotNil(err)
+}
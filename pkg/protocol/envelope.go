@@ -0,0 +1,99 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+/*
+	Search response envelope versioning.
+
+	Clients state the protocol version they speak in SearchRequest.Version.
+	Workers tailor the response to that version, clearing all fields
+	introduced in later versions. Such fields are always tagged "omitempty",
+	which keeps them out of the encoded response completely.
+	Clients not stating a version are assumed to speak BaseVersion.
+
+	New fields are only added in minor version bumps.
+	Fields are deprecated by documenting them as such, and are kept
+	until the next major version bump.
+*/
+
+// BaseVersion is the protocol version assumed for clients not stating a version
+var BaseVersion = Semver{0, 5, 0}
+
+var v060 = Semver{0, 6, 0}
+
+// ClientVersion returns the protocol version stated in the request,
+// or BaseVersion when not stated.
+func (req SearchRequest) ClientVersion() Semver {
+	version, err := ParseSemver(req.Version)
+	if err != nil {
+		return BaseVersion
+	}
+	return version
+}
+
+// ForVersion tailors a search response to a client speaking the given
+// protocol version, by clearing all fields introduced in later versions.
+func (res SearchResponse) ForVersion(clientVersion Semver) SearchResponse {
+	tailored := res
+	if v060.NewerThan(clientVersion) {
+		tailored.Version = ""
+		tailored.Result.MissingSpaces = nil
+		tailored.Result.UnavailableSpaces = nil
+		tailored.Result.Snapshot = ""
+		tailored.Result.SpaceCounts = nil
+		tailored.Result.Facets = nil
+		tailored.Result.NumericStats = nil
+		tailored.Result.EstimatedTotal = 0
+		tailored.Result.EstimateIsLowerBound = false
+		tailored.Result.SinceToken = ""
+		tailored.Result.Watermarks = nil
+		tailored.Result.Truncated = false
+		tailored.Result.TruncatedReason = ""
+		tailored.Result.SnippetsOmitted = false
+		tailored.Result.StopwordsOnly = false
+		if len(res.Result.Hits) > 0 {
+			hits := make([]SearchHit, len(res.Result.Hits))
+			for i, hit := range res.Result.Hits {
+				hit.Source = ""
+				hit.Language = ""
+				hit.Content = ""
+				hit.CollapseValue = ""
+				hit.CollapseCount = 0
+				hit.TermCounts = nil
+				hit.Tier = 0
+				hits[i] = hit
+			}
+			tailored.Result.Hits = hits
+		}
+		if tailored.Status == SearchStatusBusy {
+			tailored.Status = SearchStatusServerError
+		}
+		if tailored.Status == SearchStatusSpaceUnavailable {
+			tailored.Status = SearchStatusServerError
+		}
+		if tailored.Status == SearchStatusInitializing {
+			tailored.Status = SearchStatusServerError
+		}
+		if tailored.Status == SearchStatusStopwordsOnly {
+			tailored.Status = SearchStatusNoHit
+		}
+		if tailored.Status == SearchStatusUnauthorized {
+			tailored.Status = SearchStatusQueryError
+		}
+	} else {
+		tailored.Version = Version.String()
+	}
+	return tailored
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// MergeHits merges lists of search hits, each sorted by rank, into one
+// list of at most limit hits sorted by rank. Returns nil when limit
+// is not positive.
+// Hits with equal rank are ordered by space and document ID, and
+// equal hits are kept in list order. This keeps the merged order
+// independent of the order of the lists, like the order of shard
+// responses.
+//
+// The merge is a k-way merge using a heap of list cursors, so memory
+// use is bounded by the number of lists and the limit, not by the
+// total number of hits.
+func MergeHits(limit int, lists ...[]SearchHit) []SearchHit {
+	return mergeHits(limit, true, lists)
+}
+
+// MergeHitsUntied merges lists of search hits like MergeHits, but keeps
+// hits with equal rank in list order, for indexes configured without
+// a tiebreaker.
+func MergeHitsUntied(limit int, lists ...[]SearchHit) []SearchHit {
+	return mergeHits(limit, false, lists)
+}
+
+func mergeHits(limit int, tiebreak bool, lists [][]SearchHit) []SearchHit {
+	if limit <= 0 {
+		return nil
+	}
+	cursors := hitCursors{
+		cursors:  make([]hitCursor, 0, len(lists)),
+		tiebreak: tiebreak,
+	}
+	total := 0
+	for i, list := range lists {
+		if len(list) > 0 {
+			cursors.cursors = append(cursors.cursors, hitCursor{list, i})
+			total += len(list)
+		}
+	}
+	if total < limit {
+		limit = total
+	}
+	heap.Init(&cursors)
+
+	merged := make([]SearchHit, 0, limit)
+	for len(merged) < limit {
+		top := &cursors.cursors[0]
+		merged = append(merged, top.hits[0])
+		top.hits = top.hits[1:]
+		if len(top.hits) == 0 {
+			heap.Pop(&cursors)
+		} else {
+			heap.Fix(&cursors, 0)
+		}
+	}
+	return merged
+}
+
+type hitCursor struct {
+	hits  []SearchHit
+	index int
+}
+
+type hitCursors struct {
+	cursors []hitCursor
+	// Order equal rank hits by space and document ID
+	tiebreak bool
+}
+
+func (hc hitCursors) Len() int {
+	return len(hc.cursors)
+}
+
+func (hc hitCursors) Less(i, j int) bool {
+	a := hc.cursors[i]
+	b := hc.cursors[j]
+	x := a.hits[0]
+	y := b.hits[0]
+	switch {
+	case x.Rank != y.Rank:
+		return x.Rank < y.Rank
+	case !hc.tiebreak:
+	case x.Space != y.Space:
+		return x.Space < y.Space
+	case x.ID != y.ID:
+		return x.ID < y.ID
+	}
+	return a.index < b.index
+}
+
+func (hc hitCursors) Swap(i, j int) {
+	hc.cursors[i], hc.cursors[j] = hc.cursors[j], hc.cursors[i]
+}
+
+func (hc *hitCursors) Push(x interface{}) {
+	hc.cursors = append(hc.cursors, x.(hitCursor))
+}
+
+func (hc *hitCursors) Pop() interface{} {
+	old := hc.cursors
+	last := old[len(old)-1]
+	hc.cursors = old[:len(old)-1]
+	return last
+}
+
+// MergeFacets merges facet bucket lists by summing the counts of equal
+// values, returning at most limit buckets per facet, most common first.
+// Buckets with equal counts are sorted by value.
+func MergeFacets(limit int, lists ...map[string][]FacetBucket) map[string][]FacetBucket {
+	counts := map[string]map[string]int{}
+	for _, list := range lists {
+		for field, buckets := range list {
+			if counts[field] == nil {
+				counts[field] = map[string]int{}
+			}
+			for _, bucket := range buckets {
+				counts[field][bucket.Value] += bucket.Count
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+
+	merged := make(map[string][]FacetBucket, len(counts))
+	for field, values := range counts {
+		buckets := make([]FacetBucket, 0, len(values))
+		for value, count := range values {
+			buckets = append(buckets, FacetBucket{value, count})
+		}
+		sort.Slice(buckets, func(i, j int) bool {
+			if buckets[i].Count == buckets[j].Count {
+				return buckets[i].Value < buckets[j].Value
+			}
+			return buckets[i].Count > buckets[j].Count
+		})
+		if len(buckets) > limit {
+			buckets = buckets[:limit]
+		}
+		merged[field] = buckets
+	}
+	return merged
+}
+
+// MergeNumericStats merges numeric field stats, recomputing the
+// average from the merged sum and count.
+func MergeNumericStats(lists ...map[string]NumericStats) map[string]NumericStats {
+	var merged map[string]NumericStats
+	for _, list := range lists {
+		for field, stats := range list {
+			if merged == nil {
+				merged = map[string]NumericStats{}
+			}
+			current, found := merged[field]
+			if !found {
+				merged[field] = stats
+				continue
+			}
+			current.Min = math.Min(current.Min, stats.Min)
+			current.Max = math.Max(current.Max, stats.Max)
+			current.Sum += stats.Sum
+			current.Count += stats.Count
+			current.Avg = current.Sum / float64(current.Count)
+			merged[field] = current
+		}
+	}
+	return merged
+}
+
+// CollapseHits keeps the first hit of each collapse value in a list of
+// hits sorted by rank, adding up the collapse counts of the hits
+// removed. Hits without a collapse value are kept.
+// See SearchRequest.CollapseField.
+func CollapseHits(hits []SearchHit) []SearchHit {
+	collapsed := make([]SearchHit, 0, len(hits))
+	groups := map[string]int{}
+	for _, hit := range hits {
+		if hit.CollapseValue == "" {
+			collapsed = append(collapsed, hit)
+			continue
+		}
+		if index, found := groups[hit.CollapseValue]; found {
+			collapsed[index].CollapseCount += hit.CollapseCount
+			continue
+		}
+		groups[hit.CollapseValue] = len(collapsed)
+		collapsed = append(collapsed, hit)
+	}
+	return collapsed
+}
+
+// TierHits returns a copy of a list of hits sorted by rank, with each hit
+// assigned to a relevance tier. The first hit is in tier zero, and each
+// hit scoring less than (1 - gap) times the score of the hit before it
+// starts the next tier. See SearchRequest.TierGap.
+func TierHits(hits []SearchHit, gap float32) []SearchHit {
+	if hits == nil {
+		return nil
+	}
+	tiered := make([]SearchHit, len(hits))
+	tier := 0
+	for i, hit := range hits {
+		if i > 0 {
+			previous := math.Abs(float64(hits[i-1].Rank))
+			score := math.Abs(float64(hit.Rank))
+			if previous > 0 && score < previous*float64(1-gap) {
+				tier++
+			}
+		}
+		hit.Tier = tier
+		tiered[i] = hit
+	}
+	return tiered
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 Erik Agsjö
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/erkkah/letarette/pkg/xt"
+)
+
+func sortedHitLists(lists int, hitsPerList int) [][]SearchHit {
+	result := make([][]SearchHit, lists)
+	for i := range result {
+		hits := make([]SearchHit, hitsPerList)
+		for j := range hits {
+			hits[j] = SearchHit{
+				Space: fmt.Sprintf("space%d", i),
+				ID:    DocumentID(fmt.Sprintf("%d-%d", i, j)),
+				Rank:  -rand.Float32() * 20,
+			}
+		}
+		sort.Slice(hits, func(a, b int) bool {
+			return hits[a].Rank < hits[b].Rank
+		})
+		result[i] = hits
+	}
+	return result
+}
+
+func TestMergeHits(t *testing.T) {
+	xt := xt.X(t)
+
+	lists := sortedHitLists(10, 20)
+	merged := MergeHits(50, lists...)
+	xt.Equal(50, len(merged))
+
+	var all []SearchHit
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	sort.SliceStable(all, func(a, b int) bool {
+		return all[a].Rank < all[b].Rank
+	})
+	xt.DeepEqual(all[:50], merged)
+
+	xt.Equal(0, len(MergeHits(10)))
+	xt.Equal(5, len(MergeHits(10, lists[0][:5], nil)))
+	xt.Assert(MergeHits(0, lists...) == nil)
+	xt.Assert(MergeHits(-1, lists...) == nil)
+}
+
+func TestMergeHits_Ties(t *testing.T) {
+	xt := xt.X(t)
+
+	ids := func(hits []SearchHit) []DocumentID {
+		var result []DocumentID
+		for _, hit := range hits {
+			result = append(result, hit.ID)
+		}
+		return result
+	}
+
+	lists := [][]SearchHit{
+		{{Space: "b", ID: "1", Rank: -2}, {Space: "a", ID: "3", Rank: -1}},
+		{{Space: "a", ID: "2", Rank: -2}, {Space: "a", ID: "1", Rank: -1}},
+	}
+	xt.DeepEqual([]DocumentID{"2", "1", "1", "3"}, ids(MergeHits(10, lists...)))
+	// Without tiebreaker, equal rank hits are kept in list order
+	xt.DeepEqual([]DocumentID{"1", "2", "3", "1"}, ids(MergeHitsUntied(10, lists...)))
+	xt.Assert(MergeHitsUntied(0, lists...) == nil)
+}
+
+func TestMergeFacets(t *testing.T) {
+	xt := xt.X(t)
+
+	a := map[string][]FacetBucket{
+		"color": {{"red", 3}, {"blue", 2}},
+	}
+	b := map[string][]FacetBucket{
+		"color": {{"blue", 2}, {"green", 2}},
+		"size":  {{"large", 1}},
+	}
+	merged := MergeFacets(2, a, b)
+	xt.DeepEqual(map[string][]FacetBucket{
+		"color": {{"blue", 4}, {"red", 3}},
+		"size":  {{"large", 1}},
+	}, merged)
+
+	xt.Assert(MergeFacets(10) == nil)
+}
+
+func TestMergeNumericStats(t *testing.T) {
+	xt := xt.X(t)
+
+	a := map[string]NumericStats{
+		"price": {Count: 2, Min: 10, Max: 20, Sum: 30, Avg: 15},
+	}
+	b := map[string]NumericStats{
+		"price":  {Count: 1, Min: 5, Max: 5, Sum: 5, Avg: 5},
+		"weight": {Count: 1, Min: 2, Max: 2, Sum: 2, Avg: 2},
+	}
+	xt.DeepEqual(map[string]NumericStats{
+		"price":  {Count: 3, Min: 5, Max: 20, Sum: 35, Avg: 35.0 / 3},
+		"weight": {Count: 1, Min: 2, Max: 2, Sum: 2, Avg: 2},
+	}, MergeNumericStats(a, b))
+
+	xt.Assert(MergeNumericStats() == nil)
+}
+
+func TestCollapseHits(t *testing.T) {
+	xt := xt.X(t)
+
+	hits := []SearchHit{
+		{ID: "a", CollapseValue: "x", CollapseCount: 2},
+		{ID: "b"},
+		{ID: "c", CollapseValue: "y", CollapseCount: 1},
+		{ID: "d", CollapseValue: "x", CollapseCount: 3},
+		{ID: "e"},
+	}
+	xt.DeepEqual([]SearchHit{
+		{ID: "a", CollapseValue: "x", CollapseCount: 5},
+		{ID: "b"},
+		{ID: "c", CollapseValue: "y", CollapseCount: 1},
+		{ID: "e"},
+	}, CollapseHits(hits))
+}
+
+func TestTierHits(t *testing.T) {
+	xt := xt.X(t)
+
+	hits := []SearchHit{
+		{ID: "a", Rank: -10},
+		{ID: "b", Rank: -9},
+		{ID: "c", Rank: -5},
+		{ID: "d", Rank: -4},
+		{ID: "e", Rank: -1},
+	}
+	xt.DeepEqual([]SearchHit{
+		{ID: "a", Rank: -10},
+		{ID: "b", Rank: -9},
+		{ID: "c", Rank: -5, Tier: 1},
+		{ID: "d", Rank: -4, Tier: 1},
+		{ID: "e", Rank: -1, Tier: 2},
+	}, TierHits(hits, 0.3))
+	xt.Equal(0, hits[4].Tier)
+
+	xt.Assert(TierHits(nil, 0.3) == nil)
+}
+
+// Merging the top 500 hits from 100 spaces
+func BenchmarkMergeHits(b *testing.B) {
+	lists := sortedHitLists(100, 500)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MergeHits(500, lists...)
+	}
+}
+
+// Collecting all hits from 100 spaces and sorting, for reference
+func BenchmarkCollectAndSortHits(b *testing.B) {
+	lists := sortedHitLists(100, 500)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var all []SearchHit
+		for _, list := range lists {
+			all = append(all, list...)
+		}
+		sort.SliceStable(all, func(a, b int) bool {
+			return all[a].Rank < all[b].Rank
+		})
+		_ = all[:500]
+	}
+}
@@ -20,15 +20,49 @@ package protocol
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Version of the wire protocol
-var Version = Semver{0, 5, 0}
+var Version = Semver{0, 6, 0}
 
 // DocumentID is just a string, could be uuid, hash, numeric, et.c.
+//
+// Spaces configured for integer IDs only accept IDs that are
+// decimal 64-bit integers, as created by IntegerDocumentID.
 type DocumentID string
 
+// IntegerDocumentID creates the ID of a document in an integer ID space.
+func IntegerDocumentID(id int64) DocumentID {
+	return DocumentID(strconv.FormatInt(id, 10))
+}
+
+// Integer returns the value of an ID in an integer ID space.
+func (id DocumentID) Integer() (int64, error) {
+	value, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("document ID %q is not an integer", id)
+	}
+	return value, nil
+}
+
+// Scan implements sql.Scanner, reading IDs stored as text or integers.
+func (id *DocumentID) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case string:
+		*id = DocumentID(value)
+	case []byte:
+		*id = DocumentID(value)
+	case int64:
+		*id = IntegerDocumentID(value)
+	default:
+		return fmt.Errorf("cannot scan %T into DocumentID", src)
+	}
+	return nil
+}
+
 // IndexStatusCode is what is says
 type IndexStatusCode uint8
 
@@ -41,6 +75,8 @@ const (
 	IndexStatusStartingUp
 	IndexStatusIncompleteShardgroup
 	IndexStatusIncompatible
+	// The index schema is being created or migrated by another worker
+	IndexStatusInitializing
 )
 
 func (isc IndexStatusCode) String() string {
@@ -50,6 +86,7 @@ func (isc IndexStatusCode) String() string {
 		IndexStatusStartingUp:           "starting up",
 		IndexStatusIncompleteShardgroup: "incomplete shard group",
 		IndexStatusIncompatible:         "incompatible protocol versions",
+		IndexStatusInitializing:         "initializing",
 	}
 	str, found := strings[isc]
 	if !found {
@@ -67,12 +104,43 @@ type IndexStatus struct {
 	ShardgroupSize uint16
 	ShardIndex     uint16
 	Status         IndexStatusCode
+	// Document updates waiting to be stored, and the total time
+	// spent blocked on a full update queue, in seconds
+	UpdateQueue        int     `json:",omitempty"`
+	UpdateQueueBlocked float64 `json:",omitempty"`
+	// Spaces with search disabled, and spaces with indexing paused,
+	// see SpaceControl
+	SearchDisabledSpaces []string `json:",omitempty"`
+	IndexPausedSpaces    []string `json:",omitempty"`
+	// Frames in the WAL, and frames checkpointed to the database,
+	// as of the latest periodic checkpoint
+	WALFrames          int64 `json:",omitempty"`
+	CheckpointedFrames int64 `json:",omitempty"`
 }
 
 func (status IndexStatus) String() string {
-	return fmt.Sprintf("Index@%s(%d/%d): %d docs, last update: %v, status: %v",
+	return fmt.Sprintf("Index@%s(%d/%d): %d docs, last update: %v, status: %v, update queue: %d (%.1fs blocked)",
 		status.IndexID, status.ShardIndex+1, status.ShardgroupSize,
-		status.DocCount, status.LastUpdate, status.Status)
+		status.DocCount, status.LastUpdate, status.Status,
+		status.UpdateQueue, status.UpdateQueueBlocked) + walString(status) + spaceControlString(status)
+}
+
+func walString(status IndexStatus) string {
+	if status.WALFrames == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", WAL: %d frames (%d checkpointed)", status.WALFrames, status.CheckpointedFrames)
+}
+
+func spaceControlString(status IndexStatus) string {
+	var str string
+	if len(status.SearchDisabledSpaces) > 0 {
+		str += fmt.Sprintf(", search disabled: %v", strings.Join(status.SearchDisabledSpaces, ","))
+	}
+	if len(status.IndexPausedSpaces) > 0 {
+		str += fmt.Sprintf(", index paused: %v", strings.Join(status.IndexPausedSpaces, ","))
+	}
+	return str
 }
 
 // IndexUpdateRequest is a request for available updates.
@@ -105,14 +173,103 @@ type Document struct {
 	Title   string
 	Text    string
 	Alive   bool
+	// Stored field values, used for filtering and ranking.
+	// Only fields listed in the worker "stored fields" config are kept.
+	Fields map[string]string `json:",omitempty"`
+	// The provider that supplied the document, returned with each
+	// search hit. Demotions and facets can use it as the SourceField
+	// stored field, without listing it in the "stored fields" config.
+	//
+	// The source is stored in the document row, costing the length
+	// of the value per document. Empty sources take a single byte.
+	Source string `json:",omitempty"`
+	// The language of the document, like "en" or "english", used to
+	// filter searches by SearchRequest.Languages. Demotions and facets
+	// can use it as the LanguageField stored field.
+	//
+	// The language is metadata only. Documents are stemmed using all
+	// stemmer languages configured for the worker, regardless of
+	// their language.
+	Language string `json:",omitempty"`
+	// Optional version of the document, increasing with each update.
+	// Updates with a lower version than the stored document are stale,
+	// and are ignored. Updates with the same or a higher version replace
+	// the stored document, so repeated deliveries are harmless.
+	// Documents without version have version zero, and are stale
+	// once a versioned update has been stored.
+	Version uint64 `json:",omitempty"`
+	// Optional ranking boost, multiplying the relevance score of the
+	// document in all searches not setting SearchRequest.IgnoreBoost.
+	// Boosts above one raise the document, boosts below one lower it.
+	//
+	// The relevance score is the bm25 score of the match, so a boost
+	// of 2 lets a document outrank documents matching up to twice as
+	// well. Valid boosts range from MinBoost to MaxBoost, values outside
+	// the range are clamped when indexing. The default, zero, and
+	// negative values mean no boost.
+	Boost float32 `json:",omitempty"`
 }
 
+// MaxFuzzy is the largest edit distance of fuzzy searches,
+// see SearchRequest.Fuzzy
+const MaxFuzzy = 2
+
+// MaxSnippetWindow is the largest number of tokens before and after
+// the first match of snippets, see SearchRequest.SnippetWindow
+const MaxSnippetWindow = 64
+
+// DefaultMaxSpaces is the default limit of spaces searched by a
+// single search request. Workers reject searches in more spaces,
+// with status SearchStatusQueryError.
+const DefaultMaxSpaces = 64
+
+// MinBoost and MaxBoost limit the Document.Boost range
+const (
+	MinBoost = 0.01
+	MaxBoost = 100
+)
+
+// SourceField is the stored field name of Document.Source,
+// used in demotions and facets.
+const SourceField = "@source"
+
+// LanguageField is the stored field name of Document.Language,
+// used in demotions and facets.
+const LanguageField = "@language"
+
 // A DocumentUpdate is sent in response to DocumentRequest
 type DocumentUpdate struct {
 	Space     string
 	Documents []Document
 }
 
+// A MultiSpaceDocumentUpdate bundles document updates for several spaces.
+// Workers apply all included updates in one transaction, so that searches
+// never see a partially applied update.
+//
+// Multi-space updates are pushed by document managers, and are not tied to
+// the interest lists of the included spaces. The documents are stored directly,
+// and interests for them are marked as served. Documents not yet on an interest
+// list will be recognized as up to date when later listed in an index update,
+// as long as the update timestamps match.
+type MultiSpaceDocumentUpdate struct {
+	Updates []DocumentUpdate
+}
+
+// A DocumentTouch updates the timestamp of documents without changing
+// their content, and without re-indexing them.
+//
+// Touching does not move the index position of the space directly.
+// Touched documents on the current interest list take part in calculating
+// the new position when the list is committed, as any other document.
+// Documents later listed by the document manager with a timestamp
+// different from the touched one will be re-fetched.
+type DocumentTouch struct {
+	Space   string
+	IDs     []DocumentID
+	Updated time.Time
+}
+
 // A DocumentRequest is a request for a list of documents.
 // Returned documents are broadcasted to all workers.
 type DocumentRequest struct {
@@ -133,6 +290,13 @@ type CloneStream struct {
 	URL string
 }
 
+// CredentialsHeader is the NATS message header carrying the credentials
+// of a search request, such as a token. Credentials are kept out of the
+// request body, and are passed as is to the search authorizer of each
+// worker, which may reject the request or narrow its spaces.
+// Requests without the header have empty credentials.
+const CredentialsHeader = "Letarette-Credentials"
+
 // A SearchRequest is sent from a search handler to search the index.
 type SearchRequest struct {
 	// Spaces to search
@@ -148,6 +312,174 @@ type SearchRequest struct {
 	// In either case, spell-fixed queries are returned
 	// in the SearchResult Respelt field.
 	Autocorrect bool
+	// Demotions lower the rank of matching documents having
+	// specific stored field values, without excluding them.
+	//
+	// Demotions are applied to the rank before sorting and paging,
+	// so a demoted document can be pushed to later result pages.
+	Demotions []Demotion `json:",omitempty"`
+	// DecayHalfLifeHours blends document age into the rank.
+	// The relevance score of each document is multiplied by
+	//
+	//     0.5 ^ (age / DecayHalfLifeHours)
+	//
+	// where age is the time in hours since the document was updated.
+	// The default, zero, disables time decay.
+	DecayHalfLifeHours float32 `json:",omitempty"`
+	// When true, document boosts are not applied to the rank,
+	// see Document.Boost.
+	IgnoreBoost bool `json:",omitempty"`
+	// PinSnapshot requests a point-in-time view of the index, keeping
+	// results consistent when paging through them while the index changes.
+	// The view is identified by the Snapshot token in the SearchResult.
+	PinSnapshot bool `json:",omitempty"`
+	// Snapshot token from a previous search result. The search reads the
+	// same point-in-time view of the index as the search returning the token.
+	// Snapshots are released after a period of inactivity, searches using
+	// released or unknown snapshots are performed on the live index.
+	Snapshot string `json:",omitempty"`
+	// When true, the Snapshot is released after the search, instead of
+	// being kept until the snapshot timeout.
+	ReleaseSnapshot bool `json:",omitempty"`
+	// When true, the number of hits in each space is returned
+	// in the SearchResult SpaceCounts field.
+	CountSpaces bool `json:",omitempty"`
+	// Stored fields to count hits by value for, returned in the
+	// SearchResult Facets field, together with the result page.
+	//
+	// Facets and space counts share one extra pass over all hits,
+	// up to the search cap. The cost grows with the number of hits
+	// and the number of stored values of the faceted fields, but
+	// not with the number of requested facets.
+	Facets []string `json:",omitempty"`
+	// Maximum number of buckets returned for each facet.
+	// Zero means DefaultFacetLimit.
+	FacetLimit uint16 `json:",omitempty"`
+	// Numeric stored fields to compute the min, max, sum and average
+	// value of over all hits, ignoring paging, returned in the
+	// SearchResult NumericStats field. Fields must be configured as
+	// numeric fields, hits without a parsed value are not counted.
+	//
+	// Stats are computed in the same extra pass over all hits as facets
+	// and space counts, reading the stored values of the requested
+	// fields. The cost grows with the number of hits and requested fields.
+	NumericStats []string `json:",omitempty"`
+	// Estimate the total number of hits beyond the result cap, returned
+	// in the SearchResult EstimatedTotal field. TotalHits stays capped.
+	//
+	// The estimate counts matching documents in one pass without ranking
+	// or snippets, up to a second, larger cap set by the worker. This
+	// costs much less than searching without a cap, but grows with the
+	// number of matches counted. Estimates reaching the worker cap are
+	// lower bounds.
+	EstimateTotal bool `json:",omitempty"`
+	// Only documents in one of these languages are returned, and
+	// counted in totals, space counts and facets. Documents without a
+	// language are only matched by the empty language "".
+	// An empty list matches all documents.
+	Languages []string `json:",omitempty"`
+	// Since is a token from the SinceToken field of a previous result.
+	// When set, only documents indexed after that search are returned,
+	// most recently updated first, instead of by relevance. The Rank of
+	// each hit is then its age in seconds.
+	// Updated documents are returned again, deleted documents are not
+	// returned. Documents updated and then deleted since the previous
+	// search are not reported at all, since they no longer match.
+	// Documents indexed while a search runs can be returned twice,
+	// but are never missed.
+	Since string `json:",omitempty"`
+	// When true, the result carries a SinceToken marking the end of
+	// the index, to be passed as Since when polling for new documents.
+	// Searches with Since set always return a new token.
+	NewSinceToken bool `json:",omitempty"`
+	// When true, hits carry the stored text of their documents in the
+	// Content field, for spaces storing content. Text longer than the
+	// max content size of the worker is cut, and the result is marked
+	// as truncated.
+	//
+	// The text is sent with each hit, and is part of cached results,
+	// so response sizes and cache usage grow with document sizes.
+	IncludeContent bool `json:",omitempty"`
+	// When set to a stored field, only the best ranked hit among
+	// documents sharing a value of the field is returned, with the
+	// size of its group in CollapseCount. Documents without a value
+	// for the field, or with an empty value, are not collapsed.
+	//
+	// Collapsing is done before paging, so pages and TotalHits count
+	// groups, not documents. Space counts and facets still count
+	// documents. Groups spanning several shards are collapsed when the
+	// client merges the shard responses, but can then be counted more
+	// than once in TotalHits.
+	// Collapsing cannot be combined with Since.
+	CollapseField string `json:",omitempty"`
+	// When true, the phonetic (Soundex) codes of the query words are
+	// matched against the codes of document words, so that "Smyth"
+	// finds "Smith". Only documents in spaces indexing phonetic codes
+	// are found. Phrases match codes in order, wildcards and column
+	// filters are ignored, and the document title is used as snippet.
+	// Phonetic search cannot be combined with Since or CollapseField.
+	Phonetic bool `json:",omitempty"`
+	// When true, query words are matched case sensitively against
+	// document words, so that "IT" does not find "it". Words are matched
+	// exactly, without stemming. Only documents in spaces indexing exact
+	// case words are found. Column filters are ignored, and the document
+	// title is used as snippet.
+	// Exact case search cannot be combined with Since, CollapseField
+	// or Phonetic.
+	ExactCase bool `json:",omitempty"`
+	// When true, hits carry the number of times each query term matches
+	// the document in TermCounts, for relevance diagnostics. Terms are
+	// the included query phrases, as written, with column filters and
+	// wildcards. Synonyms count as matches of their term.
+	//
+	// Each term is matched again against the hits of the page, adding
+	// one index query per term to the search.
+	TermCounts bool `json:",omitempty"`
+	// When set, hits are grouped into relevance tiers, like "best matches"
+	// and "other matches", returned in the SearchHit Tier field. A hit
+	// scoring less than (1 - TierGap) times the hit ranked before it
+	// starts a new tier, so a TierGap of 0.3 starts a new tier at each
+	// score drop of 30% or more. Valid gaps are between zero and one,
+	// the default, zero, disables tiers.
+	//
+	// Tiers are assigned within each page, the first hit of every page
+	// is in tier zero. Tiers spanning pages are only seen in full by
+	// requesting a page large enough to hold them.
+	// Tiers cannot be combined with Since, which ranks by age.
+	TierGap float32 `json:",omitempty"`
+	// When set, single word query phrases also match words within Fuzzy
+	// edits of the phrase, counting single character insertions,
+	// deletions and substitutions. Fuzzy 1 lets "receve" match "receive",
+	// fuzzy 2 also lets "recieve" match. At most MaxFuzzy edits are
+	// allowed, the default, zero, matches exactly.
+	//
+	// Near-matches are looked up in the spelling index, which holds
+	// the most frequent words of the index and is updated in the
+	// background, so recently indexed words may not be matched yet.
+	// Fuzzy search cannot be combined with Phonetic or ExactCase.
+	Fuzzy int `json:",omitempty"`
+	// Number of tokens before and after the first match included in
+	// snippets, at most MaxSnippetWindow. The default, zero, uses the
+	// window configured by the worker, which by default holds one token
+	// before and eight after the first match.
+	SnippetWindow int `json:",omitempty"`
+	// Markers inserted before and after the first match in snippets,
+	// like "<b>" and "</b>". When both are empty, the markers configured
+	// by the worker are used. Snippet text is not escaped.
+	SnippetOpen  string `json:",omitempty"`
+	SnippetClose string `json:",omitempty"`
+	// Protocol version spoken by the client.
+	// The response is tailored to this version, see SearchResponse.ForVersion.
+	Version string `json:",omitempty"`
+}
+
+// Demotion multiplies the relevance score of documents where the stored
+// field Field has the value Value with Factor, in the range (0, 1].
+// When several demotions apply to a document, the strongest one is used.
+type Demotion struct {
+	Field  string
+	Value  string
+	Factor float32
 }
 
 // SearchResult is a collection of search hits
@@ -163,6 +495,115 @@ type SearchResult struct {
 	RespeltDistance float32
 	// The total number of hits to the given query
 	TotalHits int
+	// Requested spaces not present in the index.
+	// These are skipped, and do not fail the search.
+	// When no requested space is present, the response status is
+	// SearchStatusNoHit.
+	MissingSpaces []string `json:",omitempty"`
+	// Requested spaces with search disabled, see SpaceControl.
+	// These are skipped. When no requested space is searchable,
+	// the response status is SearchStatusSpaceUnavailable.
+	UnavailableSpaces []string `json:",omitempty"`
+	// Token of the point-in-time view searched, when pinned.
+	// See SearchRequest.PinSnapshot.
+	Snapshot string `json:",omitempty"`
+	// Number of hits in each searched space, across all result pages,
+	// when requested by SearchRequest.CountSpaces.
+	// Counts are exact, unless the result is Capped. Capped counts only
+	// include the hits found before reaching the cap, and are lower bounds.
+	SpaceCounts map[string]int `json:",omitempty"`
+	// Hit counts by stored field value for each field requested by
+	// SearchRequest.Facets, with the most common values first.
+	// Counts follow the same rules as SpaceCounts. When searching
+	// sharded indexes, values outside the top buckets of a shard are
+	// not counted for that shard.
+	Facets map[string][]FacetBucket `json:",omitempty"`
+	// Stats of each field requested by SearchRequest.NumericStats,
+	// following the same rules as SpaceCounts. Fields without any
+	// value in the hits are left out.
+	NumericStats map[string]NumericStats `json:",omitempty"`
+	// Estimated total number of hits when requested by
+	// SearchRequest.EstimateTotal. The estimate equals TotalHits when
+	// the result is not Capped. EstimateIsLowerBound is set when the
+	// estimate also reached a cap, and there may be more hits.
+	EstimatedTotal       int  `json:",omitempty"`
+	EstimateIsLowerBound bool `json:",omitempty"`
+	// Token marking the end of the index at the time of the search,
+	// see SearchRequest.Since.
+	SinceToken string `json:",omitempty"`
+	// Update time of the last document indexed in each searched space,
+	// before searching. The index is current as of this time, see
+	// InterestListState.LastUpdated. Spaces without indexed documents
+	// are left out. When searching sharded indexes, each space has the
+	// oldest watermark of all shards. See OldestWatermark for the
+	// watermark of a multi-space search as a whole.
+	Watermarks map[string]time.Time `json:",omitempty"`
+	// Set when hits, counts or facets were limited by a server-side
+	// limit, such as the result cap or the max page limit.
+	// TruncatedReason lists the limits hit, separated by "; ".
+	Truncated       bool   `json:",omitempty"`
+	TruncatedReason string `json:",omitempty"`
+	// Set when hits beyond the max number of snippets of the worker
+	// were returned with empty snippets, to bound the cost of large
+	// pages. Document text requested by IncludeContent is still
+	// returned for all hits.
+	SnippetsOmitted bool `json:",omitempty"`
+	// Set when all words of the query are stop words, too common in the
+	// index to be searched. Depending on worker config, the query either
+	// has no hits, with status SearchStatusStopwordsOnly, or is searched
+	// with the stop words kept.
+	StopwordsOnly bool `json:",omitempty"`
+}
+
+// OldestWatermark returns the oldest of the space watermarks, which is
+// the freshness of the result as a whole, or the zero time when there
+// are no watermarks.
+func (result SearchResult) OldestWatermark() time.Time {
+	var oldest time.Time
+	for _, watermark := range result.Watermarks {
+		if oldest.IsZero() || watermark.Before(oldest) {
+			oldest = watermark
+		}
+	}
+	return oldest
+}
+
+// Truncate marks the result as truncated, adding a reason
+// unless already listed.
+func (result *SearchResult) Truncate(reason string) {
+	result.Truncated = true
+	if reason == "" {
+		return
+	}
+	for _, listed := range strings.Split(result.TruncatedReason, "; ") {
+		if listed == reason {
+			return
+		}
+	}
+	if result.TruncatedReason != "" {
+		result.TruncatedReason += "; "
+	}
+	result.TruncatedReason += reason
+}
+
+// DefaultFacetLimit is the number of buckets returned per facet
+// when not set by SearchRequest.FacetLimit.
+const DefaultFacetLimit = 10
+
+// FacetBucket is the number of hits having one value of a stored field
+type FacetBucket struct {
+	Value string
+	Count int
+}
+
+// NumericStats summarizes the values of a numeric field over all hits
+type NumericStats struct {
+	// Number of hits with a value
+	Count int
+	Min   float64
+	Max   float64
+	Sum   float64
+	Avg   float64
 }
 
 // SearchHit represents one search hit
@@ -171,6 +612,21 @@ type SearchHit struct {
 	ID      DocumentID
 	Snippet string
 	Rank    float32
+	// Source of the document, see Document.Source
+	Source string `json:",omitempty"`
+	// Language of the document, see Document.Language
+	Language string `json:",omitempty"`
+	// Document text, see SearchRequest.IncludeContent
+	Content string `json:",omitempty"`
+	// Value of the collapse field, see SearchRequest.CollapseField
+	CollapseValue string `json:",omitempty"`
+	// Number of matches of each query term, see SearchRequest.TermCounts
+	TermCounts map[string]int `json:",omitempty"`
+	// Number of matching documents in the group of the hit,
+	// see SearchRequest.CollapseField
+	CollapseCount int `json:",omitempty"`
+	// Relevance tier of the hit, see SearchRequest.TierGap
+	Tier int `json:",omitempty"`
 }
 
 // SearchStatusCode is what is says
@@ -184,16 +640,38 @@ const (
 	SearchStatusTimeout
 	SearchStatusQueryError
 	SearchStatusServerError
+	// The worker search queue is full
+	SearchStatusBusy
+	// The request was rejected by the worker search authorizer
+	SearchStatusUnauthorized
+	// No search workers were available. Only set by clients,
+	// never sent by workers.
+	SearchStatusNoWorkers
+	// All requested spaces present in the index have search disabled,
+	// see SearchResult.UnavailableSpaces
+	SearchStatusSpaceUnavailable
+	// The index schema is being created or migrated,
+	// the search can be retried shortly
+	SearchStatusInitializing
+	// All words of the query are stop words, and no hits were
+	// returned, see SearchResult.StopwordsOnly
+	SearchStatusStopwordsOnly
 )
 
 func (ssc SearchStatusCode) String() string {
 	strings := map[SearchStatusCode]string{
-		SearchStatusIndexHit:    "found in index",
-		SearchStatusCacheHit:    "found in cache",
-		SearchStatusNoHit:       "not found",
-		SearchStatusTimeout:     "timeout",
-		SearchStatusQueryError:  "query format error",
-		SearchStatusServerError: "server error",
+		SearchStatusIndexHit:         "found in index",
+		SearchStatusCacheHit:         "found in cache",
+		SearchStatusNoHit:            "not found",
+		SearchStatusTimeout:          "timeout",
+		SearchStatusQueryError:       "query format error",
+		SearchStatusServerError:      "server error",
+		SearchStatusBusy:             "busy",
+		SearchStatusUnauthorized:     "unauthorized",
+		SearchStatusNoWorkers:        "no workers",
+		SearchStatusSpaceUnavailable: "space unavailable",
+		SearchStatusInitializing:     "initializing",
+		SearchStatusStopwordsOnly:    "only stop words",
 	}
 	str, found := strings[ssc]
 	if !found {
@@ -207,4 +685,109 @@ type SearchResponse struct {
 	Result   SearchResult
 	Duration float32
 	Status   SearchStatusCode
+	// Protocol version of the response envelope
+	Version string `json:",omitempty"`
+}
+
+// PingRequest is published on the "<topic>.ping" subject, asking all
+// search workers to reply with a PingResponse. Workers reply without
+// touching the index or queueing behind searches.
+type PingRequest struct {
+	RequestID string
+}
+
+// PingResponse is sent by each search worker in reply to a PingRequest
+type PingResponse struct {
+	RequestID string
+	IndexID   string
+	Shard     string
+}
+
+// SpaceControl is published on the "<topic>.space.control" subject,
+// to disable or enable search in a space, and to pause or resume
+// indexing of the space, on all workers.
+//
+// Search disabled spaces are skipped by searches, and reported in
+// SearchResult.UnavailableSpaces. Indexing paused spaces are not
+// fetched from document managers, but pushed document updates are
+// still stored. The settings are kept in the index, and survive restarts.
+type SpaceControl struct {
+	Space          string
+	SearchDisabled bool
+	IndexPaused    bool
+}
+
+// StemmerStateRequest asks one worker per shard for its index stemmer state
+type StemmerStateRequest struct {
+	RequestID string
+}
+
+// StemmerState holds the stemmer settings stored in the index of one worker,
+// sent in response to StemmerStateRequest.
+// Updated is the time of the last stemmer settings change.
+type StemmerState struct {
+	RequestID        string
+	IndexID          string
+	Shard            string
+	Stemmers         []string
+	RemoveDiacritics bool
+	TokenCharacters  string
+	Separators       string
+	// Tokens longer than MaxTokenLength are dropped, or truncated
+	// if TruncateLongTokens is set. Zero means no limit.
+	MaxTokenLength     int  `json:",omitempty"`
+	TruncateLongTokens bool `json:",omitempty"`
+	// Characters removed from texts and queries before tokenization
+	InvisibleCharacters string `json:",omitempty"`
+	// Words skipped when indexing and searching
+	StopWords []string `json:",omitempty"`
+	Updated   time.Time
+}
+
+// SQLRequest asks one worker per shard to run a read-only SQL statement
+// on its index, for remote diagnostics. Requests carry credentials in
+// the CredentialsHeader message header, like search requests.
+// Statements may use "?" placeholders for the arguments.
+type SQLRequest struct {
+	RequestID string
+	Statement string
+	Args      []string `json:",omitempty"`
+}
+
+// SQLResponse holds the result of a SQLRequest on one worker.
+// Row values are JSON numbers, strings or nulls, in column order.
+// Truncated is set when rows beyond the worker row limit were dropped.
+// Error is set when the statement was rejected or failed.
+type SQLResponse struct {
+	RequestID string
+	IndexID   string
+	Shard     string
+	Columns   []string
+	Rows      [][]interface{}
+	Truncated bool   `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+// IndexStepRequest asks one worker per shard to run a single indexing
+// update cycle for a space, without waiting for the cycle timer.
+// Used for testing and debugging of the indexing loop.
+type IndexStepRequest struct {
+	RequestID string
+	Space     string
+}
+
+// IndexStepResult holds the outcome of an IndexStepRequest on one worker.
+// Listed is the length of the interest list at the start of the cycle,
+// Requested the number of documents requested and Committed the number
+// of documents committed by the cycle.
+// Error is set when the cycle could not be run.
+type IndexStepResult struct {
+	RequestID string
+	IndexID   string
+	Shard     string
+	Space     string
+	Listed    int
+	Requested int
+	Committed int
+	Error     string `json:",omitempty"`
 }